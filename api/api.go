@@ -23,6 +23,13 @@ type Volume struct {
 	Description string
 	Size        uint64
 	NQN         string
+
+	// AuthenticationRequired is set when hosts must authenticate with their DH-HMAC-CHAP secret
+	AuthenticationRequired bool `json:",omitempty"`
+	// AuthenticatedHosts lists the hosts that have a DH-HMAC-CHAP secret
+	AuthenticatedHosts []string `json:",omitempty"`
+	// AllowedHosts lists the hosts that may connect, any host can when empty
+	AllowedHosts []string `json:",omitempty"`
 }
 
 type CreateVolumeRequest struct {
@@ -60,3 +67,60 @@ type ListVolumeResponse struct {
 	Status  Status
 	Volumes []Volume
 }
+
+// SetHostSecretRequest requires HostNQN to authenticate to the volume with DH-HMAC-CHAP
+//
+//	Secrets use the DHHC-1:xx:<base64>: representation, ControllerSecret is optional
+//	and enables bidirectional authentication
+type SetHostSecretRequest struct {
+	UUID             string
+	HostNQN          string
+	Secret           string
+	ControllerSecret string
+}
+
+type SetHostSecretResponse struct {
+	Status
+}
+
+type RemoveHostSecretRequest struct {
+	UUID    string
+	HostNQN string
+}
+
+type RemoveHostSecretResponse struct {
+	Status
+}
+
+// SetAuthenticationRequest sets whether hosts must authenticate to the volume, hosts without a secret
+// cannot connect while it is required
+type SetAuthenticationRequest struct {
+	UUID     string
+	Required bool
+}
+
+type SetAuthenticationResponse struct {
+	Status
+}
+
+// AllowHostRequest adds HostNQN to the hosts allowed to connect to the volume
+//
+//	HostID is an optional host identifier (UUID) the host must also present
+type AllowHostRequest struct {
+	UUID    string
+	HostNQN string
+	HostID  string
+}
+
+type AllowHostResponse struct {
+	Status
+}
+
+type DisallowHostRequest struct {
+	UUID    string
+	HostNQN string
+}
+
+type DisallowHostResponse struct {
+	Status
+}
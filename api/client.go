@@ -15,6 +15,11 @@ type Client interface {
 	CreateVolume(name, description string, size uint64) (*Volume, error)
 	ListVolumes() ([]Volume, error)
 	DeleteVolume(UUID string) error
+	SetHostSecret(UUID, hostNQN, secret, controllerSecret string) error
+	RemoveHostSecret(UUID, hostNQN string) error
+	SetAuthentication(UUID string, required bool) error
+	AllowHost(UUID, hostNQN, hostID string) error
+	DisallowHost(UUID, hostNQN string) error
 }
 
 type HTTPClient struct {
@@ -106,6 +111,59 @@ func (c *HTTPClient) DeleteVolume(UUID string) error {
 	return nil
 }
 
+func (c *HTTPClient) SetHostSecret(UUID, hostNQN, secret, controllerSecret string) error {
+	req := &SetHostSecretRequest{
+		UUID:             UUID,
+		HostNQN:          hostNQN,
+		Secret:           secret,
+		ControllerSecret: controllerSecret,
+	}
+	resp := &SetHostSecretResponse{}
+
+	return c.request(req, resp)
+}
+
+func (c *HTTPClient) RemoveHostSecret(UUID, hostNQN string) error {
+	req := &RemoveHostSecretRequest{
+		UUID:    UUID,
+		HostNQN: hostNQN,
+	}
+	resp := &RemoveHostSecretResponse{}
+
+	return c.request(req, resp)
+}
+
+func (c *HTTPClient) SetAuthentication(UUID string, required bool) error {
+	req := &SetAuthenticationRequest{
+		UUID:     UUID,
+		Required: required,
+	}
+	resp := &SetAuthenticationResponse{}
+
+	return c.request(req, resp)
+}
+
+func (c *HTTPClient) AllowHost(UUID, hostNQN, hostID string) error {
+	req := &AllowHostRequest{
+		UUID:    UUID,
+		HostNQN: hostNQN,
+		HostID:  hostID,
+	}
+	resp := &AllowHostResponse{}
+
+	return c.request(req, resp)
+}
+
+func (c *HTTPClient) DisallowHost(UUID, hostNQN string) error {
+	req := &DisallowHostRequest{
+		UUID:    UUID,
+		HostNQN: hostNQN,
+	}
+	resp := &DisallowHostResponse{}
+
+	return c.request(req, resp)
+}
+
 func NewHTTPClient(address string) *HTTPClient {
 	return &HTTPClient{
 		address: address,
@@ -1,14 +1,26 @@
 package client
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/thirdmartini/go-nvme"
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
 	"github.com/thirdmartini/go-nvme/protocol"
 )
 
+const (
+	// DefaultInCapsuleDataSize is the largest write we send as in capsule data, larger writes use R2T
+	DefaultInCapsuleDataSize = 8192
+
+	// DefaultQueueSize is the number of entries of every queue we open
+	DefaultQueueSize = 32
+)
+
 type Client struct {
 	adminQueue AdminQueue
 
@@ -16,10 +28,25 @@ type Client struct {
 	conn    net.Conn
 
 	hostNQN   string
+	hostID    [16]byte
 	targetNQN string
 
+	// controllerID is assigned by the target when the admin queue connects, I/O queues connect to it
+	controllerID uint16
+
 	queues map[uint16]*IOQueue
 
+	inCapsuleDataSize uint32
+	digests           uint8
+	queueSize         uint16
+	sqFlowControl     bool
+	kato              uint32
+	tlsConfig         *tls.Config
+
+	// DH-HMAC-CHAP secrets, ctrlSecret is only set for bidirectional authentication
+	secret     *dhchap.Secret
+	ctrlSecret *dhchap.Secret
+
 	log tracer.Tracer
 }
 
@@ -36,7 +63,7 @@ func (c *Client) Close() error {
 func (c *Client) CloseQueue(id uint16) error {
 	if c.queues[id] != nil {
 		err := c.queues[id].Close()
-		c.queues[id] = nil
+		delete(c.queues, id)
 		return err
 	}
 	return nil
@@ -86,12 +113,15 @@ func (c *Client) OpenIOQueue(id uint16) (*IOQueue, protocol.NVMEStatusCode) {
 			return nil, errors.New("connect failure")
 		}
 	*/
+	// never have more commands outstanding than the queue holds, the controller treats that as an overrun
 	ioq := &IOQueue{
-		Queue: q,
-		ready: make(chan *CapsuleRequest, 128),
+		Queue:     q,
+		ready:     make(chan *CapsuleRequest, c.queueSize),
+		nsid:      1,
+		blockSize: 512,
 	}
 
-	for i := 0; i < 128; i++ {
+	for i := 0; i < int(c.queueSize); i++ {
 		ioq.ready <- &CapsuleRequest{
 			ready: make(chan bool),
 		}
@@ -107,8 +137,14 @@ func (c *Client) AdminQueue() *AdminQueue {
 }
 
 func (c *Client) openQueue(id uint16) (*Queue, protocol.NVMEStatusCode) {
-	conn, err := net.Dial("tcp", c.address)
-	if err != err {
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", c.address, c.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", c.address)
+	}
+	if err != nil {
 		return nil, protocol.SCConnectionFailure
 	}
 
@@ -119,6 +155,9 @@ func (c *Client) openQueue(id uint16) (*Queue, protocol.NVMEStatusCode) {
 		requests:     make(map[uint16]*CapsuleRequest),
 		requestQueue: make(chan *CapsuleRequest, 32),
 		log:          c.log,
+
+		inCapsuleDataSize: c.inCapsuleDataSize,
+		digests:           c.digests,
 	}
 
 	err = q.init()
@@ -132,12 +171,23 @@ func (c *Client) openQueue(id uint16) (*Queue, protocol.NVMEStatusCode) {
 		FCType:    protocol.FabricCmdConnect,
 		CATTR:     nvme.SQFlowControlDisabled,
 		QueueID:   id,
-		QueueSize: 32,
+		QueueSize: c.queueSize - 1, // 0 based
+	}
+	if c.sqFlowControl {
+		fc.CATTR &^= nvme.SQFlowControlDisabled
+	}
+
+	// I/O queues join the controller of the admin queue, KATO is reserved for them
+	cntlid := uint16(0xFFFF)
+	if id == 0 {
+		fc.KATO = c.kato
+	} else {
+		cntlid = c.controllerID
 	}
 
 	fcd := protocol.ConnectData{
-		HostIdentifier: [16]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-		CNTLID:         0xFFFF,
+		HostIdentifier: c.hostID,
+		CNTLID:         cntlid,
 		SubNQN:         c.targetNQN,
 		HostNQN:        c.hostNQN,
 	}
@@ -157,6 +207,23 @@ func (c *Client) openQueue(id uint16) (*Queue, protocol.NVMEStatusCode) {
 		return nil, req.GetStatus()
 	}
 
+	if id == 0 {
+		c.controllerID = binary.LittleEndian.Uint16(req.Response.FabricResponse[0:])
+	}
+
+	// AUTHREQ follows CNTLID in the response
+	authreq := binary.LittleEndian.Uint16(req.Response.FabricResponse[2:])
+	if authreq&protocol.ConnectAuthReqATR != 0 {
+		status := protocol.SCConnectAuthenticationNeeded
+		if c.secret != nil {
+			status = q.authenticate(dhchap.NewHost(c.hostNQN, c.targetNQN, c.secret, c.ctrlSecret))
+		}
+		if status.IsError() {
+			q.Close()
+			return nil, status
+		}
+	}
+
 	return q, protocol.SCSuccess
 }
 
@@ -175,6 +242,84 @@ func (c *Client) WithTracer(t tracer.Tracer) *Client {
 	return c
 }
 
+// WithInCapsuleDataSize sets the largest write that will be sent as in capsule data
+func (c *Client) WithInCapsuleDataSize(size uint32) *Client {
+	c.inCapsuleDataSize = size
+	return c
+}
+
+// WithQueueSize sets the number of entries of the queues opened after this call, this also bounds
+// the number of commands outstanding on an I/O queue
+func (c *Client) WithQueueSize(size uint16) *Client {
+	c.queueSize = size
+	return c
+}
+
+// WithSQFlowControl leaves SQ flow control enabled on the queues opened after this call, responses
+// then carry the SQ head pointer
+func (c *Client) WithSQFlowControl(enable bool) *Client {
+	c.sqFlowControl = enable
+	return c
+}
+
+// WithDigests requests CRC32C header and/or data digests on all queues opened after this call
+func (c *Client) WithDigests(header, data bool) *Client {
+	c.digests = 0
+	if header {
+		c.digests |= protocol.DigestHeader
+	}
+	if data {
+		c.digests |= protocol.DigestData
+	}
+	return c
+}
+
+// WithTLS runs all queues opened after this call over TLS 1.3 using config
+//
+//	Use psk.ClientConfig to connect with a pre-shared key
+func (c *Client) WithTLS(config *tls.Config) *Client {
+	c.tlsConfig = config.Clone()
+	c.tlsConfig.MinVersion = tls.VersionTLS13
+	return c
+}
+
+// WithHostNQN sets the NQN we identify ourselves with on connect
+func (c *Client) WithHostNQN(nqn string) *Client {
+	c.hostNQN = nqn
+	return c
+}
+
+// WithAuthentication sets the DH-HMAC-CHAP secret used when the controller requires authentication
+//
+//	When ctrlSecret is not nil the controller has to authenticate itself as well
+func (c *Client) WithAuthentication(secret, ctrlSecret *dhchap.Secret) *Client {
+	c.secret = secret
+	c.ctrlSecret = ctrlSecret
+	return c
+}
+
+// WithHostID sets the host identifier we send on connect
+func (c *Client) WithHostID(id [16]byte) *Client {
+	c.hostID = id
+	return c
+}
+
+// WithKeepAliveTimeout sets the keep alive timeout we ask for in Login, the caller is responsible
+// for sending KeepAlive on the admin queue within it
+func (c *Client) WithKeepAliveTimeout(kato time.Duration) *Client {
+	c.kato = uint32(kato / time.Millisecond)
+	return c
+}
+
+// ControllerID returns the controller ID the target assigned to us in Login
+func (c *Client) ControllerID() uint16 {
+	return c.controllerID
+}
+
+func (c *Client) HostNQN() string {
+	return c.hostNQN
+}
+
 func New(address string, nqn string) (*Client, error) {
 	c := &Client{
 		address:   address,
@@ -182,6 +327,9 @@ func New(address string, nqn string) (*Client, error) {
 		targetNQN: nqn,
 		queues:    make(map[uint16]*IOQueue),
 		log:       &tracer.NullTracer{},
+
+		inCapsuleDataSize: DefaultInCapsuleDataSize,
+		queueSize:         DefaultQueueSize,
 	}
 
 	return c, nil
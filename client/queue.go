@@ -3,6 +3,7 @@ package client
 import (
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
@@ -21,12 +22,19 @@ type CapsuleRequest struct {
 	SendData []byte
 	RecvData []byte
 
+	// KeepSGL is set when the caller filled in the data descriptor of the command itself,
+	// otherwise it is built from SendData/RecvData
+	KeepSGL bool
+
 	// capsule for use
 	capsule protocol.CapsuleCommand
 	ready   chan bool
+
+	// set when C2HData for this request failed its data digest
+	dataDigestError bool
 }
 
-func (c CapsuleRequest) SetStatus(code protocol.NVMEStatusCode) {
+func (c *CapsuleRequest) SetStatus(code protocol.NVMEStatusCode) {
 	c.Response.SetStatus(code)
 }
 
@@ -55,6 +63,19 @@ type Queue struct {
 	id   uint16
 	conn net.Conn
 
+	// all outbound PDUs go through out, the receiver answers R2Ts while the transmitter sends capsules
+	out     *stream.Writer
+	outLock sync.Mutex
+
+	// in is buffered, the receiver has to keep using the reader that handled ICResp
+	in *stream.Reader
+
+	// writes with more data than this are sent without in capsule data and transferred on R2T
+	inCapsuleDataSize uint32
+
+	// digests we request in ICReq (protocol.DigestHeader|protocol.DigestData)
+	digests uint8
+
 	cid          uint16
 	lock         sync.Mutex
 	requests     map[uint16]*CapsuleRequest
@@ -66,6 +87,20 @@ type Queue struct {
 	log tracer.Tracer
 }
 
+// Outstanding returns the CIDs of the commands still waiting for a response, oldest first
+func (c *Queue) Outstanding() []uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cids := make([]uint16, 0, len(c.requests))
+	for cid := range c.requests {
+		cids = append(cids, cid)
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		return cids[i] < cids[j]
+	})
+	return cids
+}
+
 func (c *Queue) Close() error {
 	close(c.requestQueue)
 	return c.conn.Close()
@@ -91,9 +126,10 @@ func (c *Queue) receiver(wg *sync.WaitGroup) error {
 	}()
 
 	defer wg.Done()
-	stream := stream.NewReader(c.conn)
+	in := c.in
+	in.EnableDigests(c.ic.PDUDataDigest&protocol.DigestHeader != 0, c.ic.PDUDataDigest&protocol.DigestData != 0)
 	for {
-		hdr, err := stream.Dequeue()
+		hdr, err := in.Dequeue()
 		if err != nil {
 			return err
 		}
@@ -101,9 +137,9 @@ func (c *Queue) receiver(wg *sync.WaitGroup) error {
 		c.log.TraceProtocol(tracer.TraceCommands, hdr)
 		switch hdr.Type {
 		case protocol.CapsuleResp:
-			err = stream.Receive(&capResponse)
+			err = in.Receive(&capResponse)
 			if err != nil {
-				return err
+				return c.terminate(err)
 			}
 
 			//c.log.Trace(nvme.TraceCapsule,"%s", &capResponse)
@@ -116,12 +152,16 @@ func (c *Queue) receiver(wg *sync.WaitGroup) error {
 			c.lock.Unlock()
 
 			r.Response = capResponse
+			if r.dataDigestError {
+				r.dataDigestError = false
+				r.Response.SetStatus(protocol.SCTransientTransportError)
+			}
 			r.Done()
 
 		case protocol.C2HData:
-			err = stream.Receive(&c2Data)
+			err = in.Receive(&c2Data)
 			if err != nil {
-				return err
+				return c.terminate(err)
 			}
 
 			c.log.TraceProtocol(tracer.TraceData, &c2Data)
@@ -133,11 +173,58 @@ func (c *Queue) receiver(wg *sync.WaitGroup) error {
 
 			}
 			c.lock.Unlock()
-			stream.ReceiveData(r.RecvData[c2Data.DATAO:])
+			if c2Data.DATAO+c2Data.DATAL > uint32(len(r.RecvData)) {
+				return fmt.Errorf("c2h data for cid: %d out of range", c2Data.CCCID)
+			}
+
+			err = in.ReceiveData(r.RecvData[c2Data.DATAO : c2Data.DATAO+c2Data.DATAL])
+			if err == stream.ErrDataDigest {
+				r.dataDigestError = true
+			} else if err != nil {
+				return err
+			}
+
+			// the controller skips the response capsule for a successful command
+			if hdr.Flags&protocol.PDUFlagSuccess != 0 {
+				c.lock.Lock()
+				delete(c.requests, c2Data.CCCID)
+				c.lock.Unlock()
+
+				r.Response = protocol.CapsuleResponse{
+					SQHD: 0xFFFF,
+					CID:  c2Data.CCCID,
+				}
+				if r.dataDigestError {
+					r.dataDigestError = false
+					r.Response.SetStatus(protocol.SCTransientTransportError)
+				}
+				r.Done()
+			}
+
+		case protocol.R2T:
+			r2t := protocol.R2TRequest{}
+			err = in.Receive(&r2t)
+			if err != nil {
+				return c.terminate(err)
+			}
+
+			c.log.TraceProtocol(tracer.TraceData, &r2t)
+
+			c.lock.Lock()
+			r, ok := c.requests[r2t.CCCID]
+			c.lock.Unlock()
+			if !ok || r2t.DATAO+r2t.DATAL > uint32(len(r.SendData)) {
+				return fmt.Errorf("bad r2t for cid: %d", r2t.CCCID)
+			}
+
+			err = c.sendH2CData(&r2t, r.SendData)
+			if err != nil {
+				return err
+			}
 
 		case protocol.C2HTermReq:
 			term := protocol.C2HTermRequest{}
-			err = stream.Receive(&term)
+			err = in.Receive(&term)
 			if err != nil {
 				return err
 			}
@@ -153,7 +240,6 @@ func (c *Queue) receiver(wg *sync.WaitGroup) error {
 func (c *Queue) transmitter(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	out := stream.NewWriter(c.conn)
 	for cmd := range c.requestQueue {
 		c.lock.Lock()
 		cmd.Request.SetCID(c.cid)
@@ -161,13 +247,32 @@ func (c *Queue) transmitter(wg *sync.WaitGroup) {
 		c.cid++
 		c.lock.Unlock()
 
-		err := out.MarshalWithData2(protocol.CapsuleCmd, 0, cmd.Request, 64, cmd.SendData)
+		// data that does not fit in the capsule is sent when the controller asks for it (R2T)
+		data := cmd.SendData
+		if uint32(len(data)) > c.inCapsuleDataSize {
+			data = nil
+		}
+
+		if cc, ok := cmd.Request.(*protocol.CapsuleCommand); ok && !cmd.KeepSGL {
+			switch {
+			case data != nil:
+				cc.SetSGL(protocol.InCapsuleSGL(0, uint32(len(data))))
+			case cmd.SendData != nil:
+				cc.SetSGL(protocol.TransportSGL(uint32(len(cmd.SendData))))
+			default:
+				cc.SetSGL(protocol.TransportSGL(uint32(len(cmd.RecvData))))
+			}
+		}
+
+		c.outLock.Lock()
+		err := c.out.MarshalWithData2(protocol.CapsuleCmd, 0, cmd.Request, 64, data)
 		if err != nil {
 			tracer.Fatal("failed to marshal data")
 		}
 
 		c.log.TraceProtocol(tracer.TraceCapsule, cmd.Request)
-		err = out.Flush()
+		err = c.out.Flush()
+		c.outLock.Unlock()
 		if err != nil {
 			fmt.Printf("client error: %s\n", err.Error())
 			c.lock.Lock()
@@ -179,6 +284,42 @@ func (c *Queue) transmitter(wg *sync.WaitGroup) {
 	}
 }
 
+// sendH2CData sends the data requested by an R2T, split into PDUs no larger than the controller accepts
+func (c *Queue) sendH2CData(r2t *protocol.R2TRequest, data []byte) error {
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	offset := r2t.DATAO
+	end := r2t.DATAO + r2t.DATAL
+	for offset < end {
+		length := end - offset
+		if length > c.ic.MaxH2CDataLength {
+			length = c.ic.MaxH2CDataLength
+		}
+
+		flags := uint8(0)
+		if offset+length == end {
+			flags = protocol.PDUFlagLastPDU
+		}
+
+		h2c := protocol.H2CDataTransfer{
+			CCCID: r2t.CCCID,
+			TTAG:  r2t.TTAG,
+			DATAO: offset,
+			DATAL: length,
+		}
+		c.log.TraceProtocol(tracer.TraceData, &h2c)
+
+		c.out.MarshalWithData2(protocol.H2CData, flags, &h2c, 16, data[offset:offset+length])
+		err := c.out.Flush()
+		if err != nil {
+			return err
+		}
+		offset += length
+	}
+	return nil
+}
+
 func (c *Queue) QueueCapsule(cap *CapsuleRequest) error {
 	//	cap.wg.Add(1)
 	c.requestQueue <- cap
@@ -186,20 +327,46 @@ func (c *Queue) QueueCapsule(cap *CapsuleRequest) error {
 }
 
 func (c *Queue) SendH2C(h2c *protocol.H2CTermRequest) error {
-	out := stream.NewWriter(c.conn)
-	out.Send(protocol.ICReq, h2c, 16)
-	return out.Flush()
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	c.out.Send(protocol.H2CTermReq, h2c, 16)
+	return c.out.Flush()
+}
+
+// terminate sends an H2CTermReq to the controller for fatal transport errors and returns err
+func (c *Queue) terminate(err error) error {
+	term := protocol.H2CTermRequest{}
+
+	switch err {
+	case stream.ErrHeaderDigest:
+		term.FatalErrorStatus = protocol.FESHeaderDigestError
+
+	case stream.ErrDigestFlags:
+		term.FatalErrorStatus = protocol.FESInvalidHeaderField
+		term.FatalErrorInformation = 1 // offset of CH.Flags
+
+	default:
+		return err
+	}
+
+	c.log.TraceProtocol(tracer.TraceCommands, &term)
+	c.SendH2C(&term)
+	return err
 }
 
 func (c *Queue) init() error {
-	out := stream.NewWriter(c.conn)
-	in := stream.NewReader(c.conn)
+	c.out = stream.NewWriter(c.conn)
+	c.in = stream.NewReader(c.conn)
+	in := c.in
 
-	req := protocol.ICRequest{}
+	req := protocol.ICRequest{
+		PDUDataDigest: c.digests,
+	}
 
-	out.Send(protocol.ICReq, &req, 120)
+	c.out.Send(protocol.ICReq, &req, 120)
 
-	err := out.Flush()
+	err := c.out.Flush()
 	if err != nil {
 		return err
 	}
@@ -223,6 +390,9 @@ func (c *Queue) init() error {
 		tracer.Fatal("Not our target")
 	}
 
+	// all PDUs after ICResp carry the digests the controller agreed to
+	c.out.EnableDigests(c.ic.PDUDataDigest&protocol.DigestHeader != 0, c.ic.PDUDataDigest&protocol.DigestData != 0)
+
 	// start monitor func that cleans up any pending io
 	go func() {
 		wg := sync.WaitGroup{}
@@ -1,6 +1,9 @@
 package client
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/thirdmartini/go-nvme/internal/serialize"
 	"github.com/thirdmartini/go-nvme/protocol"
 )
@@ -23,6 +26,30 @@ func (q *AdminQueue) KeepAlive() error {
 	return req.GetStatus().AsError()
 }
 
+// SetNumberOfQueues requests ncqr/nsqr (0 based) I/O queues, returns what the target allocated
+func (q *AdminQueue) SetNumberOfQueues(ncqr, nsqr uint16) (uint16, uint16, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdSetFeatures,
+			D10:    protocol.FeatureNumberOfQueues,
+			D11:    uint32(ncqr)<<16 | uint32(nsqr),
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	val := uint32(0)
+	sm := serialize.NewDeserializer(req.Response.FabricResponse[:])
+	err = sm.Deserialize(&val)
+	return uint16(val >> 16), uint16(val), err
+}
+
 func (q *AdminQueue) GetProperty(property uint32, sz uint8) (uint64, error) {
 	req := CapsuleRequest{
 		Request: &protocol.CapsuleCommand{
@@ -95,3 +122,337 @@ func (q *AdminQueue) IdentifyController() (protocol.IdentifyController, error) {
 
 	return id, serialize.NewDeserializer(req.RecvData).Deserialize(&id)
 }
+
+// identify returns the 4K Identify data structure selected by cns for nsid
+func (q *AdminQueue) identify(cns uint8, nsid uint32) ([]byte, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdIdentify,
+			NSID:   nsid,
+			D10:    uint32(cns),
+		},
+		ready:    make(chan bool),
+		RecvData: make([]byte, 4096, 4096),
+	}
+
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.RecvData, req.GetStatus().AsError()
+}
+
+// IdentifyNamespace returns the Identify Namespace data of nsid, an inactive namespace is all zero
+func (q *AdminQueue) IdentifyNamespace(nsid uint32) (protocol.IdentifyNamespaceData, error) {
+	id := protocol.IdentifyNamespaceData{}
+	data, err := q.identify(protocol.CNSIdentifyNamespace, nsid)
+	if err != nil {
+		return id, err
+	}
+	return id, serialize.NewDeserializer(data).Deserialize(&id)
+}
+
+// LBASize returns the LBA data size in bytes of the format namespace nsid uses
+func (q *AdminQueue) LBASize(nsid uint32) (uint32, error) {
+	id, err := q.IdentifyNamespace(nsid)
+	if err != nil {
+		return 0, err
+	}
+
+	size := protocol.LBAFormatDataSize(id.LBAF[id.FLBAS&protocol.FLBASFormatMask])
+	if size == 0 {
+		return 0, fmt.Errorf("namespace %d has no lba format", nsid)
+	}
+	return size, nil
+}
+
+// ActiveNamespaces returns up to 1024 active namespace IDs greater than nsid in increasing order
+func (q *AdminQueue) ActiveNamespaces(nsid uint32) ([]uint32, error) {
+	return q.namespaceList(protocol.CNSIdentifyActiveNamespaces, nsid)
+}
+
+// AllocatedNamespaces returns up to 1024 namespace IDs greater than nsid that exist in the subsystem,
+// whether they are attached to this controller or not
+func (q *AdminQueue) AllocatedNamespaces(nsid uint32) ([]uint32, error) {
+	return q.namespaceList(protocol.CNSIdentifyAllocatedNamespaces, nsid)
+}
+
+func (q *AdminQueue) namespaceList(cns uint8, nsid uint32) ([]uint32, error) {
+	data, err := q.identify(cns, nsid)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []uint32
+	for offset := 0; offset < len(data); offset += 4 {
+		id := binary.LittleEndian.Uint32(data[offset:])
+		if id == 0 {
+			break
+		}
+		list = append(list, id)
+	}
+	return list, nil
+}
+
+// NamespaceDescriptors returns the Namespace Identification Descriptors (EUI64/NGUID/UUID) of nsid
+func (q *AdminQueue) NamespaceDescriptors(nsid uint32) ([]protocol.NamespaceDescriptor, error) {
+	data, err := q.identify(protocol.CNSIdentifyNamespaceDescriptorList, nsid)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.UnmarshalNamespaceDescriptors(data), nil
+}
+
+// AttachedControllers returns the controllers namespace nsid is attached to
+func (q *AdminQueue) AttachedControllers(nsid uint32) ([]uint16, error) {
+	data, err := q.identify(protocol.CNSIdentifyNamespaceAttachedControllers, nsid)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.UnmarshalControllerList(data), nil
+}
+
+// CreateNamespace asks the subsystem for a new namespace of blocks logical blocks in LBA format
+// format and returns its ID, the namespace has to be attached before it can be used
+func (q *AdminQueue) CreateNamespace(blocks uint64, format uint8) (uint32, error) {
+	id := protocol.IdentifyNamespaceData{
+		NSZE:  blocks,
+		NCAP:  blocks,
+		FLBAS: format & protocol.FLBASFormatMask,
+	}
+	data := make([]byte, 4096)
+	serialize.New(data).Serialize(&id)
+
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdNamespaceManagement,
+			D10:    protocol.NamespaceManagementCreate,
+		},
+		ready:    make(chan bool),
+		SendData: data,
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(req.Response.FabricResponse[0:]), nil
+}
+
+// DeleteNamespace deletes namespace nsid, protocol.NSIDBroadcast deletes all of them
+func (q *AdminQueue) DeleteNamespace(nsid uint32) error {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdNamespaceManagement,
+			NSID:   nsid,
+			D10:    protocol.NamespaceManagementDelete,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// AttachNamespace attaches namespace nsid to the controllers
+func (q *AdminQueue) AttachNamespace(nsid uint32, controllers []uint16) error {
+	return q.namespaceAttachment(protocol.NamespaceAttachmentAttach, nsid, controllers)
+}
+
+// DetachNamespace detaches namespace nsid from the controllers
+func (q *AdminQueue) DetachNamespace(nsid uint32, controllers []uint16) error {
+	return q.namespaceAttachment(protocol.NamespaceAttachmentDetach, nsid, controllers)
+}
+
+func (q *AdminQueue) namespaceAttachment(sel uint32, nsid uint32, controllers []uint16) error {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdNamespaceAttachment,
+			NSID:   nsid,
+			D10:    sel,
+		},
+		ready:    make(chan bool),
+		SendData: protocol.MarshalControllerList(controllers),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// FormatNVM formats namespace nsid (protocol.NSIDBroadcast for all of them) to LBA format lbaf, ses selects
+// the secure erase (protocol.SecureErase*). It returns once the format is done
+func (q *AdminQueue) FormatNVM(nsid uint32, lbaf uint8, ses uint8) error {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdFormatNVM,
+			NSID:   nsid,
+			D10:    uint32(lbaf&protocol.FormatLBAFMask) | uint32(ses&protocol.FormatSESMask)<<protocol.FormatSESShift,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// Sanitize starts a sanitize of the subsystem, cdw10 holds the action and its options (protocol.Sanitize*)
+// and pattern is the overwrite pattern. The command returns once the sanitize started, see SanitizeStatus
+func (q *AdminQueue) Sanitize(cdw10 uint32, pattern uint32) error {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdSanitize,
+			D10:    cdw10,
+			D11:    pattern,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// SanitizeStatus reads the Sanitize Status log page
+func (q *AdminQueue) SanitizeStatus() (protocol.SanitizeStatusLog, error) {
+	var lp protocol.SanitizeStatusLog
+	data := make([]byte, protocol.SanitizeStatusLogSize)
+	if err := q.GetLogPage(protocol.LPSanitizeStatus, false, data); err != nil {
+		return lp, err
+	}
+	return lp, serialize.NewDeserializer(data).Deserialize(&lp)
+}
+
+// SetAsyncEventConfig selects which asynchronous events the target reports
+func (q *AdminQueue) SetAsyncEventConfig(aec uint32) error {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdSetFeatures,
+			D10:    protocol.FeatureAsyncEventConfig,
+			D11:    aec,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// AsyncEventConfig returns the asynchronous events the target reports
+func (q *AdminQueue) AsyncEventConfig() (uint32, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdGetFeatures,
+			D10:    protocol.FeatureAsyncEventConfig,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(req.Response.FabricResponse[0:]), nil
+}
+
+// SetVolatileWriteCache enables or disables the volatile write cache of the target
+func (q *AdminQueue) SetVolatileWriteCache(enable bool) error {
+	wce := uint32(0)
+	if enable {
+		wce = 0x1
+	}
+
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdSetFeatures,
+			D10:    protocol.FeatureVolatileWriteCache,
+			D11:    wce,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// VolatileWriteCache returns true if the volatile write cache of the target is enabled
+func (q *AdminQueue) VolatileWriteCache() (bool, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdGetFeatures,
+			D10:    protocol.FeatureVolatileWriteCache,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(req.Response.FabricResponse[0:])&0x1 != 0, nil
+}
+
+// AsyncEventRequest blocks until the target reports an event
+func (q *AdminQueue) AsyncEventRequest() (protocol.AsyncEvent, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdAsyncEventRequest,
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return protocol.AsyncEvent{}, err
+	}
+
+	dw0 := binary.LittleEndian.Uint32(req.Response.FabricResponse[0:])
+	return protocol.AsyncEvent{
+		Type:    uint8(dw0 & 0x7),
+		Info:    uint8(dw0 >> 8),
+		LogPage: uint8(dw0 >> 16),
+	}, nil
+}
+
+// GetLogPage reads len(data) bytes of the log page, rae retains the asynchronous event so it stays masked
+func (q *AdminQueue) GetLogPage(lid uint8, rae bool, data []byte) error {
+	d10 := uint32(lid) | (uint32(len(data)/4-1)&0xFFFF)<<16
+	if rae {
+		d10 |= protocol.LogPageRAE << 8
+	}
+
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdGetLogPage,
+			D10:    d10,
+		},
+		ready:    make(chan bool),
+		RecvData: data,
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus().AsError()
+}
+
+// Abort asks the target to abort command cid on queue sqid, returns true if the target aborted it
+func (q *AdminQueue) Abort(sqid, cid uint16) (bool, error) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdAbort,
+			D10:    uint32(cid)<<16 | uint32(sqid),
+		},
+		ready: make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+
+	err := req.GetStatus().AsError()
+	if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(req.Response.FabricResponse[0:])&0x1 == 0, nil
+}
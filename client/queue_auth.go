@@ -0,0 +1,85 @@
+package client
+
+import (
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+const authReceiveSize = 4096
+
+// authSend sends an authentication message to the controller
+func (q *Queue) authSend(data []byte) protocol.NVMEStatusCode {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdFabric,
+			FCType: protocol.FabricCmdAuthenticationSend,
+			D10:    protocol.AuthCDW10,
+			D11:    uint32(len(data)),
+		},
+		SendData: data,
+		ready:    make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.GetStatus()
+}
+
+// authReceive retrieves the next authentication message from the controller
+func (q *Queue) authReceive() ([]byte, protocol.NVMEStatusCode) {
+	req := CapsuleRequest{
+		Request: &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdFabric,
+			FCType: protocol.FabricCmdAuthenticationReceive,
+			D10:    protocol.AuthCDW10,
+			D11:    authReceiveSize,
+		},
+		RecvData: make([]byte, authReceiveSize),
+		ready:    make(chan bool),
+	}
+	q.QueueCapsule(&req)
+	req.Wait()
+	return req.RecvData, req.GetStatus()
+}
+
+// authenticate runs a DH-HMAC-CHAP transaction on the queue
+func (q *Queue) authenticate(host *dhchap.Host) protocol.NVMEStatusCode {
+	status := q.authSend(host.Negotiate(q.id))
+	if status.IsError() {
+		return status
+	}
+
+	challenge, status := q.authReceive()
+	if status.IsError() {
+		return status
+	}
+
+	reply, err := host.Reply(challenge)
+	if err != nil {
+		q.log.Trace(tracer.TraceFabric, "authentication: %s", err.Error())
+		if reply != nil {
+			q.authSend(reply)
+		}
+		return protocol.SCConnectAuthenticationNeeded
+	}
+
+	status = q.authSend(reply)
+	if status.IsError() {
+		return status
+	}
+
+	success1, status := q.authReceive()
+	if status.IsError() {
+		return status
+	}
+
+	msg, err := host.Success(success1)
+	if msg != nil {
+		status = q.authSend(msg)
+	}
+	if err != nil {
+		q.log.Trace(tracer.TraceFabric, "authentication: %s", err.Error())
+		return protocol.SCConnectAuthenticationNeeded
+	}
+	return status
+}
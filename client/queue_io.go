@@ -10,15 +10,44 @@ import (
 type IOQueue struct {
 	*Queue
 	ready chan *CapsuleRequest
+
+	// nsid is the namespace commands are sent to, blockSize its LBA data size
+	nsid      uint32
+	blockSize uint32
+}
+
+// WithNamespace sends the commands of the queue to namespace nsid, the default is namespace 1
+//
+//	It has to be set before the queue is used
+func (q *IOQueue) WithNamespace(nsid uint32) *IOQueue {
+	q.nsid = nsid
+	return q
+}
+
+// WithBlockSize sets the LBA data size of the namespace, the default is 512 bytes, see AdminQueue.LBASize
+func (q *IOQueue) WithBlockSize(size uint32) *IOQueue {
+	q.blockSize = size
+	return q
+}
+
+// BlockSize returns the LBA data size the queue reads and writes in
+func (q *IOQueue) BlockSize() uint32 {
+	return q.blockSize
+}
+
+// Namespace returns the namespace the commands of the queue go to
+func (q *IOQueue) Namespace() uint32 {
+	return q.nsid
 }
 
 func (q *IOQueue) Write(lba uint64, data []byte) error {
 	req := <-q.ready
 	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
 	req.capsule.OpCode = protocol.CapsuleCmdWrite
 	req.capsule.D10 = uint32(lba)
 	req.capsule.D11 = uint32(lba >> 32)
-	req.capsule.D12 = (uint32(len(data)) / 512) - 1
+	req.capsule.D12 = (uint32(len(data)) / q.blockSize) - 1
 	req.SendData = data
 	q.QueueCapsule(req)
 	req.Wait()
@@ -35,6 +64,7 @@ func (q *IOQueue) WriteZero(lba uint64, count uint16) error {
 
 	req := <-q.ready
 	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
 	req.capsule.OpCode = protocol.CapsuleCmdWriteZeros
 	req.capsule.D10 = uint32(lba)
 	req.capsule.D11 = uint32(lba >> 32)
@@ -52,6 +82,7 @@ func (q *IOQueue) Trim(lba uint64, count uint16) error {
 	}
 	req := <-q.ready
 	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
 	req.capsule.OpCode = protocol.CapsuleCmdWriteZeros
 	req.capsule.D10 = uint32(lba)
 	req.capsule.D11 = uint32(lba >> 32)
@@ -63,14 +94,35 @@ func (q *IOQueue) Trim(lba uint64, count uint16) error {
 	return req.GetStatus().AsError()
 }
 
+// Deallocate trims the ranges with a Dataset Management command
+func (q *IOQueue) Deallocate(ranges []protocol.DSMRange) error {
+	if len(ranges) == 0 || len(ranges) > protocol.DSMMaxRanges {
+		return fmt.Errorf("invalid parameter")
+	}
+
+	req := <-q.ready
+	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
+	req.capsule.OpCode = protocol.CapsuleCmdDatasetMgmt
+	req.capsule.D10 = uint32(len(ranges) - 1)
+	req.capsule.D11 = protocol.DSMAttributeDeallocate
+	req.SendData = protocol.MarshalDSMRanges(ranges)
+	q.QueueCapsule(req)
+	req.Wait()
+	req.SendData = nil
+	q.ready <- req
+	return req.GetStatus().AsError()
+}
+
 func (q *IOQueue) Read(lba uint64, data []byte) error {
 	req := <-q.ready
 
 	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
 	req.capsule.OpCode = protocol.CapsuleCmdRead
 	req.capsule.D10 = uint32(lba)
 	req.capsule.D11 = uint32(lba >> 32)
-	req.capsule.D12 = (uint32(len(data)) / 512) - 1
+	req.capsule.D12 = (uint32(len(data)) / q.blockSize) - 1
 	req.RecvData = data
 	q.QueueCapsule(req)
 	req.Wait()
@@ -82,6 +134,7 @@ func (q *IOQueue) Read(lba uint64, data []byte) error {
 func (q *IOQueue) Flush(lba uint64, data []byte) error {
 	req := <-q.ready
 	req.Request = &req.capsule
+	req.capsule.NSID = q.nsid
 	req.capsule.OpCode = protocol.CapsuleCmdFlush
 	q.QueueCapsule(req)
 	req.Wait()
@@ -68,6 +68,44 @@ func (c *Client) DeleteVolume(UUID string) error {
 	return nil
 }
 
+func (c *Client) run(args ...string) error {
+	out, err := exec.Command(c.binPath, append([]string{"-api", c.address}, args...)...).Output()
+	if err != nil {
+		return err
+	}
+
+	var status api.Status
+	err = json.Unmarshal(out, &status)
+	if err != nil {
+		return err
+	}
+
+	if status.Message != "" {
+		return fmt.Errorf(status.Message)
+	}
+	return nil
+}
+
+func (c *Client) SetHostSecret(UUID, hostNQN, secret, controllerSecret string) error {
+	return c.run("target", "auth-set", "-uuid", UUID, "-host", hostNQN, "-secret", secret, "-ctrl-secret", controllerSecret)
+}
+
+func (c *Client) RemoveHostSecret(UUID, hostNQN string) error {
+	return c.run("target", "auth-remove", "-uuid", UUID, "-host", hostNQN)
+}
+
+func (c *Client) SetAuthentication(UUID string, required bool) error {
+	return c.run("target", "auth-require", "-uuid", UUID, fmt.Sprintf("-required=%t", required))
+}
+
+func (c *Client) AllowHost(UUID, hostNQN, hostID string) error {
+	return c.run("target", "host-allow", "-uuid", UUID, "-host", hostNQN, "-hostid", hostID)
+}
+
+func (c *Client) DisallowHost(UUID, hostNQN string) error {
+	return c.run("target", "host-disallow", "-uuid", UUID, "-host", hostNQN)
+}
+
 func NewClient(address, binPath string) *Client {
 	if binPath == "" {
 		binPath = "./nvmectl"
@@ -41,6 +41,37 @@ var (
 		Usage: "name of target",
 	}
 
+	hostFlag = cli.StringFlag{
+		Name:     "host",
+		Required: true,
+		Value:    "",
+		Usage:    "nqn of host",
+	}
+
+	hostIDFlag = cli.StringFlag{
+		Name:  "hostid",
+		Value: "",
+		Usage: "host identifier (uuid) the host must present, any if empty",
+	}
+
+	secretFlag = cli.StringFlag{
+		Name:  "secret",
+		Value: "",
+		Usage: "DH-HMAC-CHAP secret of the host (DHHC-1:xx:<base64>:), generated if empty",
+	}
+
+	ctrlSecretFlag = cli.StringFlag{
+		Name:  "ctrl-secret",
+		Value: "",
+		Usage: "DH-HMAC-CHAP secret of the controller for bidirectional authentication",
+	}
+
+	requiredFlag = cli.BoolFlag{
+		Name:  "required",
+		Value: true,
+		Usage: "hosts must authenticate, -required=false lets hosts connect without authenticating",
+	}
+
 	sizeFlag = cli.Int64Flag{
 		Name:     "size",
 		Required: true,
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
 	"github.com/urfave/cli/v2"
 )
 
@@ -45,6 +46,59 @@ var targetCommands = []*cli.Command{
 		},
 		Action: targetCreate,
 	},
+	{
+		Name:        "auth-set",
+		Usage:       "require a host to authenticate",
+		Description: "set the DH-HMAC-CHAP secret a host uses to authenticate to the target",
+		Flags: []cli.Flag{
+			&uuidFlag,
+			&hostFlag,
+			&secretFlag,
+			&ctrlSecretFlag,
+		},
+		Action: targetAuthSet,
+	},
+	{
+		Name:        "auth-remove",
+		Usage:       "remove a host secret",
+		Description: "remove the DH-HMAC-CHAP secret of a host",
+		Flags: []cli.Flag{
+			&uuidFlag,
+			&hostFlag,
+		},
+		Action: targetAuthRemove,
+	},
+	{
+		Name:        "auth-require",
+		Usage:       "require hosts to authenticate",
+		Description: "require hosts to authenticate with their DH-HMAC-CHAP secret, hosts without one can no longer connect",
+		Flags: []cli.Flag{
+			&uuidFlag,
+			&requiredFlag,
+		},
+		Action: targetAuthRequire,
+	},
+	{
+		Name:        "host-allow",
+		Usage:       "allow a host to connect",
+		Description: "add a host to the targets allowed hosts, once set only listed hosts can connect",
+		Flags: []cli.Flag{
+			&uuidFlag,
+			&hostFlag,
+			&hostIDFlag,
+		},
+		Action: targetHostAllow,
+	},
+	{
+		Name:        "host-disallow",
+		Usage:       "remove a host from the allowed hosts",
+		Description: "remove a host from the targets allowed hosts",
+		Flags: []cli.Flag{
+			&uuidFlag,
+			&hostFlag,
+		},
+		Action: targetHostDisallow,
+	},
 }
 
 func targetList(ctx *cli.Context) error {
@@ -119,3 +173,72 @@ func targetDestroy(ctx *cli.Context) error {
 	fmt.Printf("{}")
 	return nil
 }
+
+func targetAuthSet(ctx *cli.Context) error {
+	client := mustCreateClient(ctx)
+
+	secret := ctx.String(secretFlag.Name)
+	if secret == "" {
+		s, err := dhchap.NewSecret()
+		if err != nil {
+			return handleError(err)
+		}
+		secret = s.String()
+	}
+
+	err := client.SetHostSecret(ctx.String(uuidFlag.Name), ctx.String(hostFlag.Name), secret, ctx.String(ctrlSecretFlag.Name))
+	if err != nil {
+		return handleError(err)
+	}
+
+	fmt.Printf("{\"Secret\": %q}", secret)
+	return nil
+}
+
+func targetAuthRemove(ctx *cli.Context) error {
+	client := mustCreateClient(ctx)
+
+	err := client.RemoveHostSecret(ctx.String(uuidFlag.Name), ctx.String(hostFlag.Name))
+	if err != nil {
+		return handleError(err)
+	}
+
+	fmt.Printf("{}")
+	return nil
+}
+
+func targetAuthRequire(ctx *cli.Context) error {
+	client := mustCreateClient(ctx)
+
+	err := client.SetAuthentication(ctx.String(uuidFlag.Name), ctx.Bool(requiredFlag.Name))
+	if err != nil {
+		return handleError(err)
+	}
+
+	fmt.Printf("{}")
+	return nil
+}
+
+func targetHostAllow(ctx *cli.Context) error {
+	client := mustCreateClient(ctx)
+
+	err := client.AllowHost(ctx.String(uuidFlag.Name), ctx.String(hostFlag.Name), ctx.String(hostIDFlag.Name))
+	if err != nil {
+		return handleError(err)
+	}
+
+	fmt.Printf("{}")
+	return nil
+}
+
+func targetHostDisallow(ctx *cli.Context) error {
+	client := mustCreateClient(ctx)
+
+	err := client.DisallowHost(ctx.String(uuidFlag.Name), ctx.String(hostFlag.Name))
+	if err != nil {
+		return handleError(err)
+	}
+
+	fmt.Printf("{}")
+	return nil
+}
@@ -14,10 +14,85 @@ type TargetConfig struct {
 	FirmwareVersion string
 	UUID            string
 	Options         map[string]string
+	// BlockSize is the LBA data size of the single namespace (512 or 4096), 0 for 512
+	BlockSize uint32
+
+	// Namespaces lists the volumes of the subsystem, each with its own target. When it is empty Type and
+	// Options describe the single namespace of the subsystem
+	Namespaces []*NamespaceConfig
+	// NamespaceBackend lets hosts create namespaces with Namespace Management
+	NamespaceBackend *NamespaceBackendConfig
+
+	// MaxTransferSize is the largest transfer of a single command in bytes (MDTS), 0 for the default
+	MaxTransferSize uint32
+	// WriteThrough starts the target with its volatile write cache disabled, hosts can change it
+	WriteThrough bool
+
+	// SecureChannel requires hosts to connect over TLS
+	SecureChannel bool
+	// PSK maps host NQNs to their configured TLS pre-shared key in interchange format, used when TLS
+	// runs in TLSModePSK
+	PSK map[string]string
+	// AuthRequired requires hosts to authenticate with their secret from Auth, other hosts cannot connect
+	AuthRequired bool
+	// Auth maps host NQNs to their DH-HMAC-CHAP secrets
+	Auth map[string]*HostAuthConfig
+	// AllowedHosts limits the hosts that can connect and discover the target
+	AllowedHosts []*AllowedHostConfig
+}
+
+type NamespaceConfig struct {
+	// ID is the namespace ID, 0 numbers the namespace by its position in the list
+	ID      uint32
+	Type    string
+	Options map[string]string
+	UUID    string
+	// BlockSize is the LBA data size of the namespace (512 or 4096), 0 for 512
+	BlockSize uint32
+	// NGUID (16 bytes) and EUI64 (8 bytes) are optional hex strings, by default they are derived from UUID
+	NGUID string
+	EUI64 string
+}
+
+type NamespaceBackendConfig struct {
+	// Type is the target type of created namespaces, Options its defaults (e.g. "dir" for "file")
+	Type    string
+	Options map[string]string
+}
+
+type AllowedHostConfig struct {
+	NQN string
+	// HostID is an optional host identifier (UUID) the host must present
+	HostID string
+}
+
+type HostAuthConfig struct {
+	Secret string
+	// ControllerSecret is optional and enables bidirectional authentication
+	ControllerSecret string
+}
+
+const (
+	TLSModeX509 = "x509"
+	TLSModePSK  = "psk"
+)
+
+type TLSConfig struct {
+	// Mode selects how secure channels are keyed: TLSModeX509 (the default) with Certificate, or
+	// TLSModePSK with the PSK of each target, Certificate is then used by hosts that send no PSK identity
+	Mode string
+	// Certificate and Key are the X.509 certificate of the server and its private key
+	Certificate string
+	Key         string
 }
 
 type Config struct {
-	Targets []*TargetConfig
+	TLS *TLSConfig
+	// MaxC2HDataLength is the largest C2HData PDU sent to hosts, 0 for the default
+	MaxC2HDataLength uint32
+	// C2HSuccess completes successful reads without a response capsule when the host allows it
+	C2HSuccess bool
+	Targets    []*TargetConfig
 }
 
 func LoadConfig(name string) (*Config, error) {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -16,6 +18,8 @@ import (
 
 	"github.com/thirdmartini/go-nvme"
 	"github.com/thirdmartini/go-nvme/api"
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
+	"github.com/thirdmartini/go-nvme/pkg/psk"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
 	"github.com/thirdmartini/go-nvme/targets"
 
@@ -25,11 +29,275 @@ import (
 var targetNum = uint64(0)
 
 type TargetState struct {
-	Id          string
-	Name        string
-	Description string
-	Size        uint64
-	Path        string
+	Id           string
+	Name         string
+	Description  string
+	Size         uint64
+	Path         string
+	AuthRequired bool                       `json:",omitempty"`
+	HostSecrets  map[string]*HostAuthConfig `json:",omitempty"`
+	AllowedHosts []*AllowedHostConfig       `json:",omitempty"`
+}
+
+// serverTLSConfig builds the TLS configuration for the secure channel mode selected in conf
+func serverTLSConfig(conf *TLSConfig, keyring *psk.Keyring) (*tls.Config, error) {
+	config := &tls.Config{}
+	switch conf.Mode {
+	case "", TLSModeX509:
+	case TLSModePSK:
+		config = psk.ServerConfig(keyring)
+		if conf.Certificate == "" {
+			return config, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown tls mode %q", conf.Mode)
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.Certificate, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// setHostSecret parses the secrets hostNQN authenticates to subsys with
+func setHostSecret(subsys *nvme.TargetSubsystem, hostNQN string, auth *HostAuthConfig) error {
+	secret, err := dhchap.ParseSecret(auth.Secret)
+	if err != nil {
+		return err
+	}
+
+	hs := nvme.HostSecret{Host: secret}
+	if auth.ControllerSecret != "" {
+		hs.Controller, err = dhchap.ParseSecret(auth.ControllerSecret)
+		if err != nil {
+			return err
+		}
+	}
+	subsys.SetHostSecret(hostNQN, hs)
+	return nil
+}
+
+// allowHost adds a host to the allowed hosts of subsys
+func allowHost(subsys *nvme.TargetSubsystem, host *AllowedHostConfig) error {
+	var hostID [16]byte
+	if host.HostID != "" {
+		id, err := uuid.Parse(host.HostID)
+		if err != nil {
+			return err
+		}
+		copy(hostID[:], id[:])
+	}
+
+	subsys.AllowHost(host.NQN, hostID)
+	return nil
+}
+
+// parseIdentifier decodes a hex NGUID/EUI64 into id, separators (- or :) are ignored and an empty string
+// leaves id zero
+func parseIdentifier(id []byte, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	value = strings.NewReplacer("-", "", ":", "").Replace(value)
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(data) != len(id) {
+		return fmt.Errorf("identifier %s is not %d bytes", value, len(id))
+	}
+	copy(id, data)
+	return nil
+}
+
+// addNamespaces creates the target of each namespace and attaches it to subsys, namespaces without an
+// ID are numbered by their position in the list
+func addNamespaces(subsys *nvme.TargetSubsystem, namespaces []*NamespaceConfig) error {
+	for idx, nc := range namespaces {
+		ns := &nvme.Namespace{
+			ID:        nc.ID,
+			BlockSize: nc.BlockSize,
+		}
+		if ns.ID == 0 {
+			ns.ID = uint32(idx + 1)
+		}
+
+		id, err := uuid.Parse(nc.UUID)
+		if err != nil {
+			return fmt.Errorf("namespace %d missing UUID", ns.ID)
+		}
+		copy(ns.UUID[:], id[:])
+
+		if err = parseIdentifier(ns.NGUID[:], nc.NGUID); err != nil {
+			return fmt.Errorf("namespace %d has invalid NGUID: %w", ns.ID, err)
+		}
+		if err = parseIdentifier(ns.EUI64[:], nc.EUI64); err != nil {
+			return fmt.Errorf("namespace %d has invalid EUI64: %w", ns.ID, err)
+		}
+
+		ns.Target, err = targets.New(nc.Type, nc.Options)
+		if err != nil {
+			return fmt.Errorf("namespace %d: %w", ns.ID, err)
+		}
+		ns.Target.Start()
+
+		if err = subsys.AddNamespace(ns); err != nil {
+			ns.Target.Close()
+			return err
+		}
+		fmt.Printf("  Namespace %d: %s (%s)\n", ns.ID, id.String(), nc.Type)
+	}
+	return nil
+}
+
+// writeTargetState writes a volume state file, it holds host secrets so only the owner can read it
+func writeTargetState(stateFile string, targetState *TargetState) error {
+	data, err := json.Marshal(targetState)
+	if err != nil {
+		return err
+	}
+
+	// os.WriteFile keeps the mode of an existing file, renaming replaces files written before with 0644
+	tmp := stateFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+// updateTargetState applies update to the state file of a volume created through the api
+//
+//	Targets from targets.yaml have no state file, changes to them only last until restart
+func updateTargetState(subsys *nvme.TargetSubsystem, update func(state *TargetState)) error {
+	id, _ := uuid.FromBytes(subsys.UUID[:])
+	stateFile := fmt.Sprintf("data/%s.raw.json", id.String())
+
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	targetState := TargetState{}
+	err = json.Unmarshal(data, &targetState)
+	if err != nil {
+		return err
+	}
+
+	update(&targetState)
+	return writeTargetState(stateFile, &targetState)
+}
+
+// NamespaceState is a namespace hosts created with Namespace Management, the namespaces of a subsystem
+// are saved in data/<subsystem uuid>.namespaces.json
+type NamespaceState struct {
+	ID        uint32
+	UUID      string
+	BlockSize uint32
+	Options   map[string]string
+	Hosts     []string `json:",omitempty"`
+}
+
+func namespaceStateFile(subsys *nvme.TargetSubsystem) string {
+	id, _ := uuid.FromBytes(subsys.UUID[:])
+	return fmt.Sprintf("data/%s.namespaces.json", id.String())
+}
+
+// saveNamespaces writes the namespaces hosts created on subsys to its namespace state file
+func saveNamespaces(subsys *nvme.TargetSubsystem) error {
+	var states []*NamespaceState
+	for _, ns := range subsys.CreatedNamespaces() {
+		id, _ := uuid.FromBytes(ns.UUID[:])
+		states = append(states, &NamespaceState{
+			ID:        ns.ID,
+			UUID:      id.String(),
+			BlockSize: ns.BlockSize,
+			Options:   ns.Options,
+			Hosts:     ns.Hosts,
+		})
+	}
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll("data", 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(namespaceStateFile(subsys), data, 0644)
+}
+
+// restoreNamespaces adds the namespaces saved by saveNamespaces back to subsys
+func restoreNamespaces(subsys *nvme.TargetSubsystem) error {
+	data, err := os.ReadFile(namespaceStateFile(subsys))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var states []*NamespaceState
+	if err = json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		id, err := uuid.Parse(state.UUID)
+		if err != nil {
+			return fmt.Errorf("namespace %d missing UUID", state.ID)
+		}
+
+		ns := nvme.NamespaceState{
+			ID:        state.ID,
+			BlockSize: state.BlockSize,
+			Options:   state.Options,
+			Hosts:     state.Hosts,
+		}
+		copy(ns.UUID[:], id[:])
+		if err = subsys.RestoreNamespace(ns); err != nil {
+			return err
+		}
+		fmt.Printf("  Namespace %d: %s (%s, created)\n", ns.ID, id.String(), subsys.NamespaceBackend.Type)
+	}
+	return nil
+}
+
+func removeAllowedHost(hosts []*AllowedHostConfig, hostNQN string) []*AllowedHostConfig {
+	kept := hosts[:0]
+	for _, host := range hosts {
+		if host.NQN != hostNQN {
+			kept = append(kept, host)
+		}
+	}
+	return kept
+}
+
+func allowedHosts(subsys *nvme.TargetSubsystem) []string {
+	var hosts []string
+	for _, host := range subsys.ListAllowedHosts() {
+		hosts = append(hosts, host.HostNQN)
+	}
+	return hosts
+}
+
+func findSubsystem(s *nvme.Server, UUID string) *nvme.TargetSubsystem {
+	subSystems := s.ListSubSystems()
+	for idx := range subSystems {
+		subsys, ok := subSystems[idx].(*nvme.TargetSubsystem)
+		if !ok {
+			continue
+		}
+
+		uid, _ := uuid.FromBytes(subsys.UUID[:])
+		if UUID == uid.String() {
+			return subsys
+		}
+	}
+	return nil
 }
 
 func GetLocalIP() string {
@@ -114,11 +382,24 @@ func main() {
 		panic(err)
 	}
 
-	s, err := nvme.New(addrFlag)
+	var s *nvme.Server
+	keyring := psk.NewKeyring()
+	if conf.TLS != nil {
+		var tlsConfig *tls.Config
+		tlsConfig, err = serverTLSConfig(conf.TLS, keyring)
+		if err != nil {
+			panic(err)
+		}
+		s, err = nvme.NewTLS(addrFlag, tlsConfig)
+	} else {
+		s, err = nvme.New(addrFlag)
+	}
 	if err != nil {
 		panic(err)
 	}
 	s.SetDebugLevel(*debugLevel)
+	s.SetMaxC2HDataLength(conf.MaxC2HDataLength)
+	s.SetC2HSuccess(conf.C2HSuccess)
 
 	for _, t := range conf.Targets {
 		id, err := uuid.Parse(t.UUID)
@@ -127,31 +408,99 @@ func main() {
 			continue
 		}
 
-		target, err := targets.New(t.Type, t.Options)
-		if err != nil {
-			panic(err)
-		}
-		target.Start()
-
 		subsys := &nvme.TargetSubsystem{
 			NQN:             t.Name,
-			Target:          target,
 			ModelName:       t.ModelName,
 			SerialNumber:    t.SerialNumber,
 			FirmwareVersion: t.FirmwareVersion,
+			MaxTransferSize: t.MaxTransferSize,
+			BlockSize:       t.BlockSize,
+
+			SecureChannelRequired: t.SecureChannel,
 		}
 		copy(subsys.UUID[:], id[:])
 
+		if t.NamespaceBackend != nil {
+			subsys.NamespaceBackend = nvme.NamespaceBackend{
+				Type:    t.NamespaceBackend.Type,
+				Options: t.NamespaceBackend.Options,
+			}
+		}
+
+		// without a namespace list the target itself is the only namespace, a subsystem with a namespace
+		// backend may start without any
+		if len(t.Namespaces) == 0 && (t.Type != "" || t.NamespaceBackend == nil) {
+			target, err := targets.New(t.Type, t.Options)
+			if err != nil {
+				panic(err)
+			}
+			target.Start()
+			subsys.Target = target
+		} else if err = addNamespaces(subsys, t.Namespaces); err != nil {
+			fmt.Printf("Error: Target %s: %s\n", t.Name, err.Error())
+			continue
+		}
+
+		// namespaces hosts created are saved whenever they change and come back on restart
+		if t.NamespaceBackend != nil {
+			if err = restoreNamespaces(subsys); err != nil {
+				fmt.Printf("Error: Target %s: restoring namespaces: %s\n", t.Name, err.Error())
+			}
+			subsys.NamespacesChanged = func() {
+				if err := saveNamespaces(subsys); err != nil {
+					fmt.Printf("Error: Target %s: saving namespaces: %s\n", subsys.NQN, err.Error())
+				}
+			}
+		}
+
+		if t.WriteThrough {
+			if err := subsys.SetVolatileWriteCache(false); err != nil {
+				fmt.Printf("Warning: Target %s: %s\n", t.Name, err.Error())
+			}
+		}
+
+		if len(t.PSK) != 0 && (conf.TLS == nil || conf.TLS.Mode != TLSModePSK) {
+			fmt.Printf("Warning: Target %s has PSKs but TLS is not in %s mode\n", t.Name, TLSModePSK)
+		}
+
+		for host, encoded := range t.PSK {
+			key, err := psk.ParseKey(encoded)
+			if err != nil {
+				fmt.Printf("Error: Target %s has invalid PSK for %s: %s\n", t.Name, host, err.Error())
+				continue
+			}
+			// hosts discover over the same secured port so they need the key for discovery too
+			keyring.Add(host, t.Name, key)
+			keyring.Add(host, nvme.NVMEDiscoverySubsystemName, key)
+		}
+
+		subsys.SetAuthenticationRequired(t.AuthRequired)
+		for host, auth := range t.Auth {
+			err = setHostSecret(subsys, host, auth)
+			if err != nil {
+				fmt.Printf("Error: Target %s has invalid secret for %s: %s\n", t.Name, host, err.Error())
+			}
+		}
+
+		for _, host := range t.AllowedHosts {
+			err = allowHost(subsys, host)
+			if err != nil {
+				fmt.Printf("Error: Target %s has invalid host id for %s: %s\n", t.Name, host.NQN, err.Error())
+			}
+		}
+
 		fmt.Printf("Registering Target: %s (%s)\n", t.Name, t.Type)
 		fmt.Printf("  Subsys: %+v\n", subsys)
-		s.AddSubSystem(subsys)
+		if err = s.AddSubSystem(subsys); err != nil {
+			fmt.Printf("Error: Target %s: %s\n", t.Name, err.Error())
+		}
 	}
 
 	files, err := os.ReadDir("./data")
 	if err == nil {
 		for _, file := range files {
 			targetConfig := path.Join("./data", file.Name())
-			if !strings.HasSuffix(targetConfig, ".json") {
+			if !strings.HasSuffix(targetConfig, ".json") || strings.HasSuffix(targetConfig, ".namespaces.json") {
 				continue
 			}
 
@@ -193,6 +542,22 @@ func main() {
 				FirmwareVersion: "0.1.0",
 			}
 			copy(subsys.UUID[:], id[:])
+
+			subsys.SetAuthenticationRequired(targetState.AuthRequired)
+			for host, auth := range targetState.HostSecrets {
+				err = setHostSecret(subsys, host, auth)
+				if err != nil {
+					fmt.Printf("skip secret: %s %s %s\n", targetConfig, host, err.Error())
+				}
+			}
+
+			for _, host := range targetState.AllowedHosts {
+				err = allowHost(subsys, host)
+				if err != nil {
+					fmt.Printf("skip host: %s %s %s\n", targetConfig, host.NQN, err.Error())
+				}
+			}
+
 			fmt.Printf("Registering Target: %s (%s) -> %+v\n", subsys.NQN, "file", subsys.UUID)
 			fmt.Printf("  Subsys: %+v\n", subsys)
 			s.AddSubSystem(subsys)
@@ -218,7 +583,7 @@ func main() {
 				fmt.Fprintf(w, "%s : %s\n", s.Source, s.Ctrl.ConnectedHostNQN)
 				fmt.Fprintf(w, "  %s\n", s.Ctrl.ConnectedSubNQN)
 				fmt.Fprintf(w, "       Controller: %d       QueueID: %d\n", s.Ctrl.ControllerID, s.Ctrl.QueueID)
-				fmt.Fprintf(w, "       Queue Head: %d     QueueSize: %d\n", s.Ctrl.SQHD, s.Ctrl.QueueSize)
+				fmt.Fprintf(w, "       Queue Head: %d     QueueSize: %d\n", s.Ctrl.SubmissionQueueHead(), s.Ctrl.QueueSize)
 				fmt.Fprintf(w, "     Request Count: %d   RequestTime: (%s/request)\n", s.Ctrl.RequestCount, s.Ctrl.RequestTime/time.Duration(s.Ctrl.RequestCount))
 			}
 			fmt.Fprintf(w, "</pre></html>\n")
@@ -262,13 +627,7 @@ func main() {
 				Path:        raw,
 			}
 
-			state, err := json.Marshal(&targetState)
-			if err != nil {
-				setStatus(w, http.StatusBadRequest, err.Error())
-				return
-
-			}
-			err = os.WriteFile(fmt.Sprintf("%s.json", raw), state, 0644)
+			err = writeTargetState(fmt.Sprintf("%s.json", raw), &targetState)
 			if err != nil {
 				setStatus(w, http.StatusBadRequest, err.Error())
 				return
@@ -365,8 +724,12 @@ func main() {
 				volume := api.Volume{
 					UUID: uid.String(),
 					Name: uid.String(),
-					Size: subsys.Target.GetSize(),
+					Size: subsys.Capacity(),
 					NQN:  subsys.GetNQN(),
+
+					AuthenticationRequired: subsys.AuthenticationRequired(),
+					AuthenticatedHosts:     subsys.ListAuthenticatedHosts(),
+					AllowedHosts:           allowedHosts(subsys),
 				}
 				resp.Volumes = append(resp.Volumes, volume)
 			}
@@ -395,8 +758,12 @@ func main() {
 					resp.Volume = &api.Volume{
 						UUID: uid.String(),
 						Name: uid.String(),
-						Size: subsys.Target.GetSize(),
+						Size: subsys.Capacity(),
 						NQN:  subsys.GetNQN(),
+
+						AuthenticationRequired: subsys.AuthenticationRequired(),
+						AuthenticatedHosts:     subsys.ListAuthenticatedHosts(),
+						AllowedHosts:           allowedHosts(subsys),
 					}
 					respond(w, &resp)
 					return
@@ -405,6 +772,165 @@ func main() {
 			setStatus(w, http.StatusBadRequest, "does not exist")
 		})
 
+		http.HandleFunc("/api/v1/SetHostSecretRequest", func(w http.ResponseWriter, r *http.Request) {
+			req := api.SetHostSecretRequest{}
+			resp := api.SetHostSecretResponse{}
+
+			err := receive(r, &req)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, "bad request")
+				return
+			}
+
+			subsys := findSubsystem(s, req.UUID)
+			if subsys == nil {
+				setStatus(w, http.StatusBadRequest, "does not exist")
+				return
+			}
+
+			auth := &HostAuthConfig{
+				Secret:           req.Secret,
+				ControllerSecret: req.ControllerSecret,
+			}
+			err = setHostSecret(subsys, req.HostNQN, auth)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			err = updateTargetState(subsys, func(state *TargetState) {
+				if state.HostSecrets == nil {
+					state.HostSecrets = make(map[string]*HostAuthConfig)
+				}
+				state.HostSecrets[req.HostNQN] = auth
+			})
+			if err != nil {
+				setStatus(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			respond(w, &resp)
+		})
+
+		http.HandleFunc("/api/v1/RemoveHostSecretRequest", func(w http.ResponseWriter, r *http.Request) {
+			req := api.RemoveHostSecretRequest{}
+			resp := api.RemoveHostSecretResponse{}
+
+			err := receive(r, &req)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, "bad request")
+				return
+			}
+
+			subsys := findSubsystem(s, req.UUID)
+			if subsys == nil {
+				setStatus(w, http.StatusBadRequest, "does not exist")
+				return
+			}
+
+			subsys.RemoveHostSecret(req.HostNQN)
+			err = updateTargetState(subsys, func(state *TargetState) {
+				delete(state.HostSecrets, req.HostNQN)
+			})
+			if err != nil {
+				setStatus(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			respond(w, &resp)
+		})
+
+		http.HandleFunc("/api/v1/SetAuthenticationRequest", func(w http.ResponseWriter, r *http.Request) {
+			req := api.SetAuthenticationRequest{}
+			resp := api.SetAuthenticationResponse{}
+
+			err := receive(r, &req)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, "bad request")
+				return
+			}
+
+			subsys := findSubsystem(s, req.UUID)
+			if subsys == nil {
+				setStatus(w, http.StatusBadRequest, "does not exist")
+				return
+			}
+
+			subsys.SetAuthenticationRequired(req.Required)
+			err = updateTargetState(subsys, func(state *TargetState) {
+				state.AuthRequired = req.Required
+			})
+			if err != nil {
+				setStatus(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			respond(w, &resp)
+		})
+
+		http.HandleFunc("/api/v1/AllowHostRequest", func(w http.ResponseWriter, r *http.Request) {
+			req := api.AllowHostRequest{}
+			resp := api.AllowHostResponse{}
+
+			err := receive(r, &req)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, "bad request")
+				return
+			}
+
+			subsys := findSubsystem(s, req.UUID)
+			if subsys == nil {
+				setStatus(w, http.StatusBadRequest, "does not exist")
+				return
+			}
+
+			host := &AllowedHostConfig{
+				NQN:    req.HostNQN,
+				HostID: req.HostID,
+			}
+			err = allowHost(subsys, host)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			err = updateTargetState(subsys, func(state *TargetState) {
+				state.AllowedHosts = removeAllowedHost(state.AllowedHosts, req.HostNQN)
+				state.AllowedHosts = append(state.AllowedHosts, host)
+			})
+			if err != nil {
+				setStatus(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			s.NotifyDiscoveryChange()
+			respond(w, &resp)
+		})
+
+		http.HandleFunc("/api/v1/DisallowHostRequest", func(w http.ResponseWriter, r *http.Request) {
+			req := api.DisallowHostRequest{}
+			resp := api.DisallowHostResponse{}
+
+			err := receive(r, &req)
+			if err != nil {
+				setStatus(w, http.StatusBadRequest, "bad request")
+				return
+			}
+
+			subsys := findSubsystem(s, req.UUID)
+			if subsys == nil {
+				setStatus(w, http.StatusBadRequest, "does not exist")
+				return
+			}
+
+			subsys.DisallowHost(req.HostNQN)
+			err = updateTargetState(subsys, func(state *TargetState) {
+				state.AllowedHosts = removeAllowedHost(state.AllowedHosts, req.HostNQN)
+			})
+			if err != nil {
+				setStatus(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			s.NotifyDiscoveryChange()
+			respond(w, &resp)
+		})
+
 		http.HandleFunc("/targets", func(w http.ResponseWriter, req *http.Request) {
 			fmt.Fprintf(w, "<html><pre>\n")
 			fmt.Fprintf(w, "<h2><a href=\"/sessions\">Sessions</a> | Targets</h2><hr>\n")
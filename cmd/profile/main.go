@@ -97,7 +97,7 @@ func main() {
 				fmt.Fprintf(w, "%s : %s\n", s.Source, s.Ctrl.ConnectedHostNQN)
 				fmt.Fprintf(w, "  %s\n", s.Ctrl.ConnectedSubNQN)
 				fmt.Fprintf(w, "       Controller: %d       QueueID: %d\n", s.Ctrl.ControllerID, s.Ctrl.QueueID)
-				fmt.Fprintf(w, "       Queue Head: %d     QueueSize: %d\n", s.Ctrl.SQHD, s.Ctrl.QueueSize)
+				fmt.Fprintf(w, "       Queue Head: %d     QueueSize: %d\n", s.Ctrl.SubmissionQueueHead(), s.Ctrl.QueueSize)
 				fmt.Fprintf(w, "     Request Count: %d   RequestTime: (%s/request)\n", s.Ctrl.RequestCount, s.Ctrl.RequestTime/time.Duration(s.Ctrl.RequestCount))
 			}
 			fmt.Fprintf(w, "</pre></html>\n")
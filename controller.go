@@ -1,24 +1,37 @@
 package nvme
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/thirdmartini/go-nvme/internal/buffers"
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
 	"github.com/thirdmartini/go-nvme/protocol"
 	"github.com/thirdmartini/go-nvme/stream"
 	"github.com/thirdmartini/go-nvme/targets"
 )
 
-var controllersAvailable = uint64(0)
+// maxCompletionBatch bounds how many completions are coalesced into one write
+const maxCompletionBatch = 32
+
+// payloadBufferSize is the size of the pooled buffers backing command data, larger transfers
+// use buffers of the largest transfer the subsystem allows (see payloadBuffer)
+const payloadBufferSize = protocol.MaxH2CPDUSize * 8
+
+// largeBufferCount is how many large buffers a queue keeps for reuse, transfers past that allocate
+// theirs and let them go once done
+const largeBufferCount = 4
 
 type Controller struct {
 	SessionID string
-	// Controller registers
+	// Controller registers, CC and CSTS are guarded by regLock (see controller_reset.go)
+	regLock       sync.Mutex
 	REGCtrlCaps   uint64
 	REGCtrlConfig uint32
 
@@ -30,25 +43,39 @@ type Controller struct {
 	REGCtrlStatus    uint32
 	Version          uint32
 	ConnectedHostNQN string
+	ConnectedHostID  [16]byte
 	ConnectedSubNQN  string
 	ControllerID     uint16
 
-	AEC uint32
-
-	NCQR uint16
-	NSQR uint16
+	// State is shared by the admin queue and all I/O queues of the controller, set by Connect
+	State *ControllerState
 
 	// FlowControlDisabled manages whether the controller will perform flow control
-	// through use of SQHD/SQCUR.  This is set in the FabricConnect command
+	// through use of SQHD.  This is set in the FabricConnect command
 	//  Preference: we would prefer this is always disabled
 	FlowControlDisabled bool
-	SQHD                uint16 // head of queue (next available slot)
-	SQCUR               uint16 // current slot being processed
+
+	// sqHead is the SQ head pointer (the slot of the last command we fetched) and outstanding is the
+	// number of commands fetched whose completion has not gone out, both wrap/limit at QueueSize.
+	// They are updated by Serve and read by the completion handler so use atomics
+	sqHead      uint32
+	outstanding int32
+
+	// C2HSuccess completes successful reads with the SUCCESS flag on the last C2HData PDU, the response
+	// capsule is only skipped when flow control is disabled as the host would not see SQHD otherwise
+	C2HSuccess bool
 
 	QueueID   uint16
 	QueueSize uint16
 	Queue     []NVMERequest
 
+	// MaxR2T is the number of outstanding R2T PDUs the host allows per command (negotiated in ICReq)
+	// MaxH2CDataLength is the largest H2CData PDU we will accept (advertised in ICResp)
+	// MaxC2HDataLength is the largest C2HData PDU we send, reads are split into PDUs of this size
+	MaxR2T           uint64
+	MaxH2CDataLength uint32
+	MaxC2HDataLength uint32
+
 	Server    *Server
 	Subsystem Subsystem
 
@@ -59,56 +86,106 @@ type Controller struct {
 	in   *stream.Reader
 	out  *stream.Writer
 
+	// outLock serializes PDUs sent by the completion handler with those sent from Serve
+	// terminated is set once a C2HTermReq went out, nothing may follow it
+	outLock    sync.Mutex
+	terminated bool
+
+	// HeaderDigest/DataDigest are set when the host negotiated CRC32C digests in ICReq
+	HeaderDigest bool
+	DataDigest   bool
+
+	// SecureChannel is set when the connection is running over TLS, TLSServerName is the SNI
+	// the host sent which carries the PSK identity when using psk.ClientConfig
+	SecureChannel bool
+	TLSServerName string
+
+	// auth is the DH-HMAC-CHAP transaction when the subsystem requires hosts to authenticate
+	auth *dhchap.Controller
+
 	Log tracer.Tracer
 
 	bufferManager *buffers.Buffers
+	// largeBuffers holds buffers of maxTransferSize for transfers above payloadBufferSize, it is set on
+	// Connect when the subsystem allows them
+	largeBuffers *buffers.Buffers
 
 	// queue for handling bottom half
 	waiting     chan *NVMERequest
 	completions chan *NVMERequest
 
+	// inflight maps the CID of every outstanding command to its request so Abort can find it
+	inflightLock sync.Mutex
+	inflight     map[uint16]*NVMERequest
+
 	// close needs to wait for all sun routines to exit
 	wg sync.WaitGroup
 }
 
+// ProcessResponse queues the PDUs for the response, they go out with the next c.out.Sync
+//
+//	Returns true when the request is done, false if we still need data from the host
 func (c *Controller) ProcessResponse(w *NVMEResponse) (error, bool) {
-	// TODO: we really need to deal with this in the SGL style
-	sgl := w.sgl
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	// the connection is going away, the requests only have to finish
+	if c.terminated {
+		return nil, true
+	}
+
+	// request is not done, we still need data from the host
+	if w.State&RequestNeedsData != 0 {
+		c.sendR2T(w)
+		return nil, false
+	}
+
+	success := c.C2HSuccess && c.FlowControlDisabled && w.sglc != 0 && w.Response.Status == 0
+
 	offset := uint32(0)
 	for idx := 0; idx < w.sglc; idx++ {
-		flags := uint8(0)
-		if idx+1 == len(sgl) {
-			flags = 0x1 << 2 // last transfer
-		}
-
-		data := sgl[idx].Data
-		dataLen := uint32(len(data))
+		data := w.sgl[idx].Data
+		for len(data) != 0 {
+			chunk := data
+			if uint32(len(chunk)) > c.MaxC2HDataLength {
+				chunk = chunk[:c.MaxC2HDataLength]
+			}
+			data = data[len(chunk):]
+
+			flags := uint8(0)
+			if idx+1 == w.sglc && len(data) == 0 {
+				flags = protocol.PDUFlagLastPDU
+				if success {
+					flags |= protocol.PDUFlagSuccess
+				}
+			}
 
-		w.C2H.CCCID = w.CID
-		w.C2H.DATAO = offset
-		w.C2H.DATAL = dataLen
-		offset += dataLen
+			w.C2H.CCCID = w.CID
+			w.C2H.DATAO = offset
+			w.C2H.DATAL = uint32(len(chunk))
+			offset += w.C2H.DATAL
 
-		c.Log.TraceProtocol(tracer.TraceData, &w.C2H)
+			c.Log.TraceProtocol(tracer.TraceData, &w.C2H)
 
-		c.out.MarshalWithData2(protocol.C2HData, flags, &w.C2H, 16, data)
-		err := c.out.Flush()
-		if err != nil {
-			tracer.Fatal(err.Error())
+			c.out.MarshalWithData2(protocol.C2HData, flags, &w.C2H, 16, chunk)
+			c.out.Queue()
 		}
 	}
 
 	if c.FlowControlDisabled {
 		w.Response.SQHD = 0xFFFF
+	} else {
+		w.Response.SQHD = c.SubmissionQueueHead()
 	}
 
 	c.Log.TraceProtocol(tracer.TraceCapsule, &w.Response)
-	if w.NoReply {
+	if w.NoReply || success {
 		return nil, true
 	}
 
 	c.out.Send(protocol.CapsuleResp, &w.Response, 16)
-	return c.out.Flush(), true
+	c.out.Queue()
+	return nil, true
 }
 
 func (c *Controller) Serve(conn net.Conn) error {
@@ -129,6 +206,14 @@ func (c *Controller) Serve(conn net.Conn) error {
 		// need to wait for all outstanding commands to drain
 		fmt.Printf("Signal Controler(%d:%s/%s).Serve exit\n", c.ControllerID, c.Subsystem.GetNQN(), c.SessionID)
 
+		// requests waiting on data from the host will never reach the target
+		c.abortDataTransfers()
+
+		// AERs are held until an event occurs, they have to complete for the queue to drain
+		if c.State != nil && c.QueueID == 0 {
+			c.State.abortAsyncEvents()
+		}
+
 		fmt.Printf("Controler(%d).WaitDrain(%d/%d)\n", c.ControllerID, len(c.waiting), cap(c.waiting))
 		count := 0
 		for _ = range c.waiting {
@@ -139,11 +224,14 @@ func (c *Controller) Serve(conn net.Conn) error {
 			}
 		}
 		fmt.Printf("Controler(%d).Serve request queue drained\n", c.ControllerID)
+		if c.largeBuffers != nil {
+			c.largeBuffers.Release()
+		}
 		close(c.completions)
 		c.wg.Done()
 	}()
 
-	c.bufferManager = buffers.New(128, protocol.MaxH2CPDUSize*8)
+	c.bufferManager = buffers.New(128, payloadBufferSize)
 	for {
 		hdr, err := c.in.Dequeue()
 		if err != nil {
@@ -162,13 +250,23 @@ func (c *Controller) Serve(conn net.Conn) error {
 			err = c.in.Receive(&req)
 			if err != nil {
 				c.Log.Trace(tracer.TraceCommands, "Session Error: %s", err.Error())
+				c.terminate(err)
 				return err
 			}
 			c.Log.TraceProtocol(tracer.TraceCommands, &req)
 
+			// PDUMaxR2T is 0 based, 0xFFFFFFFF must not wrap to 0
+			c.MaxR2T = uint64(req.PDUMaxR2T) + 1
+			c.MaxH2CDataLength = protocol.MaxH2CPDUSize
+
+			// we support both digests, so grant whatever the host asked for
+			digests := req.PDUDataDigest & (protocol.DigestHeader | protocol.DigestData)
+			c.HeaderDigest = digests&protocol.DigestHeader != 0
+			c.DataDigest = digests&protocol.DigestData != 0
+
 			rsp := protocol.ICResponse{
-				PDUDataDigest:    0,      // no digests for now
-				MaxH2CDataLength: 0x8000, // 32K
+				PDUDataDigest:    digests,
+				MaxH2CDataLength: c.MaxH2CDataLength,
 			}
 
 			err = c.out.Send(protocol.ICResp, &rsp, 120)
@@ -184,24 +282,40 @@ func (c *Controller) Serve(conn net.Conn) error {
 				return err
 			}
 
+			// all PDUs after ICResp carry the negotiated digests
+			c.in.EnableDigests(c.HeaderDigest, c.DataDigest)
+			c.out.EnableDigests(c.HeaderDigest, c.DataDigest)
+
 		case protocol.CapsuleCmd:
 			err = c.HandleCapsule(conn, quit)
 			if err != nil {
 				c.Log.Trace(tracer.TraceCommands, "Session Error: %s", err.Error())
+				c.terminate(err)
+				return err
+			}
+
+		case protocol.H2CData:
+			err = c.handleH2CData()
+			if err != nil {
+				c.Log.Trace(tracer.TraceCommands, "Session Error: %s", err.Error())
+				c.terminate(err)
 				return err
 			}
 
 		case protocol.H2CTermReq:
-			term := protocol.C2HTermRequest{}
+			term := protocol.H2CTermRequest{}
 			err = c.in.Receive(&term)
 			if err != nil {
 				return err
 			}
-			return fmt.Errorf("controller terminated connection: %x:%x", term.FatalErrorStatus, term.FatalErrorInformation)
+			return fmt.Errorf("host terminated connection: %x:%x", term.FatalErrorStatus, term.FatalErrorInformation)
 
 		default:
-			c.Log.Todo("Unknown h.Type: 0x%x", hdr.Type)
-			break
+			// we can't skip a PDU we don't understand, the stream is lost
+			err = newTransportError(protocol.FESInvalidHeaderField, 0, "unknown pdu type 0x%x", hdr.Type)
+			c.Log.Trace(tracer.TraceCommands, "Session Error: %s", err.Error())
+			c.terminate(err)
+			return err
 		}
 		c.RequestTime += time.Now().Sub(stime)
 		c.RequestCount++
@@ -213,46 +327,88 @@ func (c *Controller) Serve(conn net.Conn) error {
 func (c *Controller) HandleCapsule(conn net.Conn, quit chan bool) error {
 	var req *NVMERequest
 
+	// the host may only have QueueSize commands outstanding, past that it has overrun the queue
+	if !c.fetchCommand() {
+		return newTransportError(protocol.FESPDUSequenceError, 0, "submission queue overrun, %d commands outstanding", c.QueueSize)
+	}
+
 	select {
 	case <-quit:
 		return nil
 	case req = <-c.waiting:
 	}
-	c.SQHD++
-	if c.SQHD > c.QueueSize {
-		c.SQHD = 0
-	}
 
 	req.completion = c.completions
 	err := c.in.Receive(&req.capsule)
 	if err != nil {
 		c.Log.Trace(0x01, "Session Error: %s", err.Error())
+		c.recycle(req)
 		return err
 	}
 
 	dataLen := c.in.Length()
+	if dataLen > payloadBufferSize {
+		c.recycle(req)
+		return newTransportError(protocol.FESDataTransferLimitExceeded, 0, "in capsule data length %d", dataLen)
+	}
+
+	c.track(req)
+
+	dataDigestError := false
 	if dataLen != 0 {
 		req.payload = c.bufferManager.Get()
 		req.payloadLength = int(dataLen)
-		c.in.ReceiveData(req.payload[0:dataLen])
+		err = c.in.ReceiveData(req.payload[0:dataLen])
+		if err == stream.ErrDataDigest {
+			dataDigestError = true
+		} else if err != nil {
+			c.recycle(req)
+			return err
+		}
 	}
 
 	// we can do all this in dequeue
 	w := &req.response
 	w.Response.CID = req.capsule.CID
-	w.Response.SQHD = c.SQHD
 	w.SetStatus(protocol.SCSuccess)
 	w.State = 0
+	req.State = 0
 
 	capsule := req.Capsule()
 	w.Type = protocol.CapsuleResp
 	w.CID = capsule.CID
 
+	// the command data was corrupted in flight, the host may retry it
+	if dataDigestError {
+		c.Log.Trace(tracer.TraceCommands, "Data digest error on CID:%d", capsule.CID)
+		w.SetStatus(protocol.SCTransientTransportError)
+		req.Complete(targets.TargetErrorNone)
+		return nil
+	}
+
+	// nothing but Connect is allowed until the queue belongs to a controller
+	if c.State == nil && !isConnectCommand(capsule) {
+		c.Log.Trace(tracer.TraceCommands, "Rejecting CID:%d, queue not connected", capsule.CID)
+		w.SetStatus(protocol.SCCommandSequenceError)
+		req.Complete(targets.TargetErrorNone)
+		return nil
+	}
+
+	// until the host authenticated only the authentication commands are allowed
+	if !c.authenticated() && !isAuthCommand(capsule) {
+		c.Log.Trace(tracer.TraceCommands, "Rejecting CID:%d, host not authenticated", capsule.CID)
+		w.SetStatus(protocol.SCConnectAuthenticationNeeded)
+		req.Complete(targets.TargetErrorNone)
+		return nil
+	}
+
 	// QueueID:0 is reserved for admin commands
 	if c.QueueID == 0 {
 		c.Log.TraceCapsule(true, capsule)
 		err = c.handleAdminCapsule(w, req)
-		req.Complete(targets.TargetErrorNone)
+		if w.State&RequestDeferred == 0 {
+			req.Complete(targets.TargetErrorNone)
+		}
 	} else {
 		c.Log.TraceCapsule(false, capsule)
 		err = c.handleIOCapsule(w, req)
@@ -261,36 +417,188 @@ func (c *Controller) HandleCapsule(conn net.Conn, quit chan bool) error {
 	return err
 }
 
+// transportError is a fatal NVMe/TCP transport error, the connection is terminated with a
+// C2HTermReq carrying status and info (usually the offset of the offending field)
+type transportError struct {
+	status uint16
+	info   uint32
+	reason string
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("transport error 0x%x:0x%x %s", e.status, e.info, e.reason)
+}
+
+func newTransportError(status uint16, info uint32, f string, a ...interface{}) error {
+	return &transportError{
+		status: status,
+		info:   info,
+		reason: fmt.Sprintf(f, a...),
+	}
+}
+
+// terminate sends a C2HTermReq to the host for fatal transport errors
+//
+//	The caller is expected to close the connection afterwards
+func (c *Controller) terminate(err error) {
+	term := protocol.C2HTermRequest{}
+
+	var te *transportError
+	switch {
+	case err == stream.ErrHeaderDigest:
+		term.FatalErrorStatus = protocol.FESHeaderDigestError
+
+	case err == stream.ErrDigestFlags:
+		term.FatalErrorStatus = protocol.FESInvalidHeaderField
+		term.FatalErrorInformation = 1 // offset of CH.Flags
+
+	case err == stream.ErrHeaderLength:
+		term.FatalErrorStatus = protocol.FESInvalidHeaderField
+		term.FatalErrorInformation = 2 // offset of CH.HLEN
+
+	case err == stream.ErrPDULength:
+		term.FatalErrorStatus = protocol.FESInvalidHeaderField
+		term.FatalErrorInformation = 3 // offset of CH.PDO
+
+	case errors.As(err, &te):
+		term.FatalErrorStatus = te.status
+		term.FatalErrorInformation = te.info
+
+	default:
+		return
+	}
+
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	c.Log.TraceProtocol(tracer.TraceCommands, &term)
+	c.out.Send(protocol.C2HTermReq, &term, 16)
+	c.out.Flush()
+	c.terminated = true
+}
+
 // CompletionHandler sends the request responses back to the initiator
+//
+//	Whatever completed while we were busy is sent with a single write, requests are only recycled
+//	once their data went out
 func (c *Controller) CompletionHandler() error {
-	var req *NVMERequest
+	sent := make([]*NVMERequest, 0, maxCompletionBatch)
+
+	for req := range c.completions {
+		for req != nil {
+			err, done := c.ProcessResponse(&req.response)
+			if err != nil || done {
+				// the slot is free as soon as the completion is queued, the host may reuse it
+				// before we get around to recycling the request
+				c.completeCommand()
+				sent = append(sent, req)
+			} // else we are waiting for an R2T to requeue this command
+
+			req = nil
+			if len(sent) < maxCompletionBatch {
+				req = c.nextCompletion()
+			}
+		}
 
-	for req = range c.completions {
-		err, done := c.ProcessResponse(&req.response)
+		c.outLock.Lock()
+		err := c.out.Sync()
+		c.outLock.Unlock()
 		if err != nil {
+			// the connection is broken, make Serve give up on it
 			fmt.Printf("CompletionError: %s\n", err.Error())
-			if req.payload != nil {
-				c.bufferManager.Put(req.payload)
-				req.payload = nil
-			}
-			req.active = false
-			req.response.Reset()
-			c.waiting <- req
-			continue
+			c.conn.Close()
 		}
-		if done {
-			if req.payload != nil {
-				c.bufferManager.Put(req.payload)
-				req.payload = nil
-			}
-			req.active = false
-			req.response.Reset()
-			c.waiting <- req
-		} // else we are waiting for an R2T to requeue this command
+
+		for _, r := range sent {
+			c.recycle(r)
+		}
+		sent = sent[:0]
 	}
 	return nil
 }
 
+// fetchCommand advances the SQ head for a command the host submitted
+//
+//	Returns false if the host submitted more commands than the queue holds
+func (c *Controller) fetchCommand() bool {
+	if atomic.AddInt32(&c.outstanding, 1) > int32(c.QueueSize) {
+		return false
+	}
+	head := atomic.LoadUint32(&c.sqHead) + 1
+	if head >= uint32(c.QueueSize) {
+		head = 0
+	}
+	atomic.StoreUint32(&c.sqHead, head)
+	return true
+}
+
+// completeCommand releases the queue slot of a command once its completion is queued
+func (c *Controller) completeCommand() {
+	atomic.AddInt32(&c.outstanding, -1)
+}
+
+// SubmissionQueueHead returns the SQ head pointer reported to the host in SQHD
+func (c *Controller) SubmissionQueueHead() uint16 {
+	return uint16(atomic.LoadUint32(&c.sqHead))
+}
+
+// nextCompletion returns a completed request if one is ready, nil otherwise
+func (c *Controller) nextCompletion() *NVMERequest {
+	select {
+	case req := <-c.completions:
+		return req
+	default:
+		return nil
+	}
+}
+
+// payloadBuffer returns a buffer for length bytes of command data
+func (c *Controller) payloadBuffer(length uint32) []byte {
+	if length <= payloadBufferSize {
+		return c.bufferManager.Get()
+	}
+	if c.largeBuffers != nil && int(length) <= c.largeBuffers.Size() {
+		return c.largeBuffers.Get()
+	}
+	return make([]byte, length)
+}
+
+// recycle returns a finished request to the waiting pool
+func (c *Controller) recycle(req *NVMERequest) {
+	c.untrack(req)
+	if req.payload != nil {
+		if len(req.payload) == payloadBufferSize {
+			c.bufferManager.Put(req.payload)
+		} else if c.largeBuffers != nil && len(req.payload) == c.largeBuffers.Size() {
+			c.largeBuffers.Put(req.payload)
+		}
+		req.payload = nil
+	}
+	req.payloadLength = 0
+	req.active = false
+	req.response.Reset()
+	c.waiting <- req
+}
+
+// detachState removes the queue from its controller
+//
+//	Losing the admin queue ends the controller: its ID is released and the I/O queues are closed
+func (c *Controller) detachState() {
+	state := c.State
+	if state == nil {
+		return
+	}
+
+	state.detach(c)
+	if c.QueueID != 0 {
+		return
+	}
+
+	for _, q := range state.release() {
+		q.Close()
+	}
+}
+
 func (c *Controller) Close() error {
 	c.conn.Close()
 	c.wg.Wait()
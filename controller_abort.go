@@ -0,0 +1,65 @@
+package nvme
+
+import (
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// track records the request as outstanding so Abort can find it by CID
+func (c *Controller) track(r *NVMERequest) {
+	c.inflightLock.Lock()
+	defer c.inflightLock.Unlock()
+	if c.inflight == nil {
+		c.inflight = make(map[uint16]*NVMERequest)
+	}
+	c.inflight[r.capsule.CID] = r
+}
+
+// untrack is called once the response went out, the request is about to be reused
+func (c *Controller) untrack(r *NVMERequest) {
+	c.inflightLock.Lock()
+	defer c.inflightLock.Unlock()
+	if c.inflight[r.capsule.CID] == r {
+		delete(c.inflight, r.capsule.CID)
+	}
+	r.ior.Reset()
+}
+
+// cancel aborts the outstanding command if it has not started yet or its target can interrupt it,
+// false if there is no such command or it can't be aborted
+//
+//	The command completes with Command Abort Requested when whoever holds it notices, held AERs
+//	complete right away
+func (c *Controller) cancel(cid uint16) bool {
+	c.inflightLock.Lock()
+	r, ok := c.inflight[cid]
+	if !ok {
+		c.inflightLock.Unlock()
+		return false
+	}
+
+	if r.capsule.OpCode == protocol.CapsuleCmdAsyncEventRequest && c.QueueID == 0 {
+		c.inflightLock.Unlock()
+		if !c.State.cancelAsyncEventRequest(r) {
+			return false
+		}
+		r.Complete(targets.TargetErrorAborted)
+		return true
+	}
+
+	cancelled := r.ior.Cancel()
+	c.inflightLock.Unlock()
+	return cancelled
+}
+
+// abortCommand handles the Abort command for the command cid submitted on queue sqid
+//
+//	Dword 0 bit 0 of the completion is cleared when the command was aborted, commands that already
+//	run on a target that can't interrupt them are left to complete
+func (c *Controller) abortCommand(sqid, cid uint16) uint32 {
+	q := c.State.Queue(sqid)
+	if q == nil || !q.cancel(cid) {
+		return 1
+	}
+	return 0
+}
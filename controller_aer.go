@@ -0,0 +1,168 @@
+package nvme
+
+import (
+	"encoding/binary"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// AsyncEventRequestLimit is the number of outstanding Asynchronous Event Requests per controller (AERL+1)
+const AsyncEventRequestLimit = 4
+
+// queueAsyncEventRequest holds the AER until there is an event to report
+//
+//	Returns false when the host already has AsyncEventRequestLimit requests outstanding
+func (s *ControllerState) queueAsyncEventRequest(r *NVMERequest) bool {
+	s.lock.Lock()
+	if len(s.aers) >= AsyncEventRequestLimit {
+		s.lock.Unlock()
+		return false
+	}
+	s.aers = append(s.aers, r)
+	done := s.dispatchAsyncEvents()
+	s.lock.Unlock()
+
+	completeAsyncEvents(done)
+	return true
+}
+
+// cancelAsyncEventRequest removes the AER for an Abort, false if it already completed
+func (s *ControllerState) cancelAsyncEventRequest(r *NVMERequest) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.aers {
+		if s.aers[i] == r {
+			s.aers = append(s.aers[:i], s.aers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchAsyncEvents pairs pending events with outstanding AERs, must be called with the lock held
+func (s *ControllerState) dispatchAsyncEvents() []*NVMERequest {
+	var done []*NVMERequest
+	for len(s.events) != 0 && len(s.aers) != 0 {
+		ev, r := s.events[0], s.aers[0]
+		s.events, s.aers = s.events[1:], s.aers[1:]
+
+		binary.LittleEndian.PutUint32(r.response.Response.FabricResponse[0:], ev.Completion())
+		done = append(done, r)
+	}
+	return done
+}
+
+// completeAsyncEvents sends the AER completions, outside of the lock as the completion queue may block
+func completeAsyncEvents(done []*NVMERequest) {
+	for _, r := range done {
+		r.Complete(targets.TargetErrorNone)
+	}
+}
+
+// NotifyAsyncEvent reports an event to the host
+//
+//	Events disabled in AEC are dropped. Once an event was reported further events for the same log page
+//	are masked until the host reads that log page.
+func (s *ControllerState) NotifyAsyncEvent(ev protocol.AsyncEvent) {
+	s.lock.Lock()
+	if !ev.Enabled(s.AEC) || s.masked[ev.LogPage] {
+		s.lock.Unlock()
+		return
+	}
+	s.masked[ev.LogPage] = true
+	s.events = append(s.events, ev)
+	done := s.dispatchAsyncEvents()
+	s.lock.Unlock()
+
+	completeAsyncEvents(done)
+}
+
+// NotifyNamespaceChanged records the namespace in the Changed Namespace List and reports the notice
+func (s *ControllerState) NotifyNamespaceChanged(nsid uint32) {
+	s.lock.Lock()
+	switch {
+	case len(s.changedNamespaces) == 1 && s.changedNamespaces[0] == protocol.ChangedNamespaceOverflow:
+	case len(s.changedNamespaces) == protocol.MaxChangedNamespaces:
+		s.changedNamespaces = []uint32{protocol.ChangedNamespaceOverflow}
+	default:
+		found := false
+		for _, id := range s.changedNamespaces {
+			found = found || id == nsid
+		}
+		if !found {
+			s.changedNamespaces = append(s.changedNamespaces, nsid)
+		}
+	}
+	s.lock.Unlock()
+
+	s.NotifyAsyncEvent(protocol.NamespaceChangedEvent)
+}
+
+// asyncEventSupport returns the AEC bits of the events the subsystem reports, the OAES of its Identify
+func (c *Controller) asyncEventSupport() uint32 {
+	if _, ok := c.Subsystem.(*DiscoverySubsystem); ok {
+		return discoveryAsyncEvents
+	}
+	return targetAsyncEvents
+}
+
+// SetAsyncEventConfig sets the Asynchronous Event Configuration (Feature 0Bh)
+func (s *ControllerState) SetAsyncEventConfig(aec uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.AEC = aec
+}
+
+// AsyncEventConfig returns the Asynchronous Event Configuration
+func (s *ControllerState) AsyncEventConfig() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.AEC
+}
+
+// clearAsyncEvent unmasks events for the log page after the host read it
+func (s *ControllerState) clearAsyncEvent(logPage uint8) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.masked, logPage)
+	if logPage == protocol.LPChangedNamespaceList {
+		s.changedNamespaces = nil
+	}
+}
+
+// changedNamespaceLog returns the Changed Namespace List log page (Log Identifier 04h)
+//
+//	Reads are cut at the end of the 4096 byte page, returns false if offset is past it
+func (s *ControllerState) changedNamespaceLog(offset uint64, length int) ([]byte, bool) {
+	page := make([]byte, protocol.MaxChangedNamespaces*4)
+	if offset >= uint64(len(page)) {
+		return nil, false
+	}
+
+	s.lock.Lock()
+	for i, nsid := range s.changedNamespaces {
+		binary.LittleEndian.PutUint32(page[i*4:], nsid)
+	}
+	s.lock.Unlock()
+
+	page = page[offset:]
+	if length < len(page) {
+		page = page[:length]
+	}
+	return page, true
+}
+
+// abortAsyncEvents completes the outstanding AERs when the admin queue goes away
+func (s *ControllerState) abortAsyncEvents() {
+	s.lock.Lock()
+	aers := s.aers
+	s.aers = nil
+	s.lock.Unlock()
+
+	for _, r := range aers {
+		r.SetStatus(protocol.SCAbortedQueue)
+	}
+	completeAsyncEvents(aers)
+}
@@ -0,0 +1,93 @@
+package nvme
+
+import (
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+// startAuthentication prepares the DH-HMAC-CHAP transaction for the connecting host
+//
+//	returns true if the host has to authenticate before it can use the queue
+func (c *Controller) startAuthentication(subsys Subsystem, hostNQN string) bool {
+	ts, ok := subsys.(*TargetSubsystem)
+	if !ok || !ts.AuthenticationRequired() {
+		return false
+	}
+
+	// hosts without a secret still get a transaction, it just never succeeds
+	secret, _ := ts.GetHostSecret(hostNQN)
+	c.auth = dhchap.NewController(hostNQN, subsys.GetNQN(), secret.Host, secret.Controller)
+	return true
+}
+
+// authenticated returns false while the host still has to complete authentication on this queue
+func (c *Controller) authenticated() bool {
+	return c.auth == nil || c.auth.Authenticated()
+}
+
+// isAuthCommand returns true for the commands allowed before the host authenticated
+func isAuthCommand(capsule *protocol.CapsuleCommand) bool {
+	if capsule.OpCode != protocol.CapsuleCmdFabric {
+		return false
+	}
+	return capsule.FCType == protocol.FabricCmdAuthenticationSend ||
+		capsule.FCType == protocol.FabricCmdAuthenticationReceive ||
+		capsule.FCType == protocol.FabricCmdDisconnect
+}
+
+// handleAuthSend passes an authentication message from the host to the transaction
+func (c *Controller) handleAuthSend(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+
+	if capsule.D10 != protocol.AuthCDW10 || int(capsule.D11) > len(r.Payload()) {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	if c.auth == nil {
+		// the subsystem does not require authentication so there is nothing to authenticate against
+		w.SetStatus(protocol.SCCommandSequenceError)
+		return
+	}
+
+	err := c.auth.Send(r.Payload()[:capsule.D11])
+	if err != nil {
+		c.Log.Trace(tracer.TraceFabric, "    Auth Send: %s", err.Error())
+		w.SetStatus(protocol.SCCommandSequenceError)
+	}
+}
+
+// handleAuthReceive returns the next authentication message to the host
+func (c *Controller) handleAuthReceive(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+
+	if capsule.D10 != protocol.AuthCDW10 {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	if c.auth == nil {
+		w.SetStatus(protocol.SCCommandSequenceError)
+		return
+	}
+
+	data, err := c.auth.Receive()
+	if err != nil {
+		c.Log.Trace(tracer.TraceFabric, "    Auth Receive: %s", err.Error())
+		w.SetStatus(protocol.SCCommandSequenceError)
+		return
+	}
+
+	if len(data) > int(capsule.D11) {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	if c.auth.Authenticated() {
+		c.Log.Trace(tracer.TraceFabric, "    Host %s authenticated", c.ConnectedHostNQN)
+	} else if c.auth.Failed() {
+		c.Log.Trace(tracer.TraceFabric, "    Host %s failed authentication", c.ConnectedHostNQN)
+	}
+	w.Write(data)
+}
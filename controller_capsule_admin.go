@@ -1,6 +1,7 @@
 package nvme
 
 import (
+	"errors"
 	"log"
 
 	"github.com/thirdmartini/go-nvme/internal/serialize"
@@ -20,9 +21,19 @@ func (c *Controller) handleAdminCapsule(w *NVMEResponse, r *NVMERequest) error {
 	case protocol.CapsuleCmdIdentify:
 		CNTID := uint16(capsule.D10 >> 16 & 0xFFFF)
 		CNS := uint8(capsule.D10 & 0xFF)
-		c.Log.Trace(tracer.TraceCapsuleDetail, "    CTRL:%d/%d CNS:%d NSID:%d (%s)", CNTID, c.ControllerID, CNS, capsule.FCType, c.Subsystem.GetNQN())
-
-		data, err := c.Subsystem.Identify(c.ControllerID, CNS)
+		c.Log.Trace(tracer.TraceCapsuleDetail, "    CTRL:%d/%d CNS:%d NSID:%d (%s)", CNTID, c.ControllerID, CNS, capsule.NSID, c.Subsystem.GetNQN())
+
+		var data []byte
+		var err error
+		if ts, ok := c.Subsystem.(*TargetSubsystem); ok && (CNS == protocol.CNSIdentifyNamespaceAttachedControllers || CNS == protocol.CNSIdentifyControllerList) {
+			data, err = c.identifyControllerList(ts, CNS, capsule.NSID, CNTID)
+		} else {
+			data, err = c.Subsystem.Identify(c.ControllerID, CNS, capsule.NSID)
+		}
+		if errors.Is(err, ErrInvalidNamespace) {
+			w.SetStatus(protocol.SCInvalidNamespace)
+			return nil
+		}
 		if err != nil {
 			log.Printf("protocol.CapsuleCmdIdentify: identify failure from subsystem: %s | err:%s\n", c.Subsystem.GetNQN(), err.Error())
 			//tracer.Fatal("protocol.CapsuleCmdIdentify: identify failure from subsystem", capsule)
@@ -35,34 +46,63 @@ func (c *Controller) handleAdminCapsule(w *NVMEResponse, r *NVMERequest) error {
 		fid := capsule.D10 & 0xff
 
 		switch fid {
-		case 0x20: // controller reset
-			// FIXME: handle proper controller restet
-
 		// 5.21.1.7 Number of Queues (Feature Identifier 07h)
 		case protocol.FeatureNumberOfQueues:
-			c.NCQR = uint16((capsule.D11 >> 16) & 0xFFFF)
-			c.NSQR = uint16(capsule.D11 & 0xFFFF)
+			ncqr := uint16((capsule.D11 >> 16) & 0xFFFF)
+			nsqr := uint16(capsule.D11 & 0xFFFF)
 
-			c.Log.Trace(tracer.TraceCapsuleDetail, "    NCQR:%d  NSQR:%d", c.NCQR, c.NSQR)
+			c.Log.Trace(tracer.TraceCapsuleDetail, "    NCQR:%d  NSQR:%d", ncqr, nsqr)
 
-			// limit queue count to 1 for now
-			//c.NCQR = 0x0
-			//c.NSQR = 0x0
+			// 0xFFFF is not a valid request, anything above what we support is capped
+			if ncqr == 0xFFFF || nsqr == 0xFFFF {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				break
+			}
+			if ncqr > MaxIOQueues-1 {
+				ncqr = MaxIOQueues - 1
+			}
+			if nsqr > MaxIOQueues-1 {
+				nsqr = MaxIOQueues - 1
+			}
+			c.State.SetNumberOfQueues(ncqr, nsqr)
 
 			sm := serialize.New(w.Response.FabricResponse[:])
-			v := uint64(c.NCQR)<<16 | uint64(c.NSQR)
+			v := uint64(ncqr)<<16 | uint64(nsqr)
 			sm.Serialize(&v)
 			//sm.Serialize(&c.NSQS)
 
+		// 5.21.1.15 Keep Alive Timer (Feature Identifier 0Fh)
+		case protocol.FeatureKeepAliveTimer:
+			v := c.State.SetKeepAliveTimeout(capsule.D11)
+			c.Log.Trace(tracer.TraceCapsuleDetail, "    KATO:%d", v)
+			sm := serialize.New(w.Response.FabricResponse[:])
+			sm.Serialize(&v)
+
+		// 5.21.1.6 Volatile Write Cache (Feature Identifier 06h)
+		case protocol.FeatureVolatileWriteCache:
+			wce := capsule.D11&0x1 != 0
+			c.Log.Trace(tracer.TraceCapsuleDetail, "    WCE:%v", wce)
+
+			ts, ok := c.Subsystem.(*TargetSubsystem)
+			if !ok {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				break
+			}
+			if present, _ := ts.VolatileWriteCache(); !present {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				break
+			}
+			if err := ts.SetVolatileWriteCache(wce); err != nil {
+				log.Printf("protocol.FeatureVolatileWriteCache: %s\n", err.Error())
+				w.SetStatus(protocol.SCInternalError)
+			}
+
 		case protocol.FeatureAsyncEventConfig:
-			v := capsule.D11 // contains teh feature word to set
+			// events the subsystem never reports can't be enabled
+			v := capsule.D11 & c.asyncEventSupport() // contains teh feature word to set
 
 			c.Log.Trace(tracer.TraceCapsuleDetail, "    AEC:%d/%x", v, v)
-			// Enable async notification
-			if v&(1<<31) != 0 {
-				//c.EnableAsyncDiscoveryNotification = true
-			}
-			c.AEC = v
+			c.State.SetAsyncEventConfig(v)
 			sm := serialize.New(w.Response.FabricResponse[:])
 			sm.Serialize(&v)
 
@@ -77,17 +117,36 @@ func (c *Controller) handleAdminCapsule(w *NVMEResponse, r *NVMERequest) error {
 
 		lpc := protocol.GetLogPageCommand{}
 		if r.ReinterpretCapsule(&lpc) != nil {
-			tracer.Fatal("protocol.CapsuleCmdGetLogPage: reinterpret failure")
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return nil
 		}
 
 		dataLen := lpc.GetReturnBufferLength()
 		c.Log.Trace(tracer.TraceCapsuleDetail, "    LP:0x%0x  Offset:%d Len:%d", val, lpc.GetReturnOffset(), dataLen)
 
 		// Get the correct set based on what subsystem we are connected to
-		data, err := c.Subsystem.GetLogPage(int(val), lpc.GetReturnOffset(), int(dataLen))
+		var data []byte
+		var err error
+		if val == protocol.LPChangedNamespaceList {
+			var ok bool
+			if data, ok = c.State.changedNamespaceLog(lpc.GetReturnOffset(), int(dataLen)); !ok {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				return nil
+			}
+		} else if discovery, ok := c.Subsystem.(*DiscoverySubsystem); ok {
+			data, err = discovery.GetLogPageForHost(c.ConnectedHostNQN, c.ConnectedHostID, int(val), lpc.GetReturnOffset(), int(dataLen))
+		} else {
+			data, err = c.Subsystem.GetLogPage(int(val), lpc.GetReturnOffset(), int(dataLen))
+		}
 		if err != nil {
 			log.Printf("protocol.CapsuleCmdGetLogPage err:%s\n", err.Error())
-			tracer.Fatal("protocol.CapsuleCmdGetLogPage: %+v", capsule)
+			w.SetStatus(protocol.SCInvalidLogPage)
+			return nil
+		}
+
+		// reading the log re-enables its events unless the host asked us to Retain Asynchronous Event
+		if lpc.LogSp&protocol.LogPageRAE == 0 {
+			c.State.clearAsyncEvent(uint8(val))
 		}
 		w.Write(data)
 
@@ -95,31 +154,76 @@ func (c *Controller) handleAdminCapsule(w *NVMEResponse, r *NVMERequest) error {
 		feature := capsule.D10 & 0xff
 		switch feature {
 		case protocol.FeatureKeepAliveTimer:
-			v := uint64(60000)
+			v := uint64(c.State.KeepAliveTimeout())
 			sm := serialize.New(w.Response.FabricResponse[:])
 			sm.Serialize(&v)
 
 		case protocol.FeatureAsyncEventConfig:
-			v := uint64(c.AEC)
+			v := uint64(c.State.AsyncEventConfig())
+			sm := serialize.New(w.Response.FabricResponse[:])
+			sm.Serialize(&v)
+
+		case protocol.FeatureVolatileWriteCache:
+			ts, ok := c.Subsystem.(*TargetSubsystem)
+			if !ok {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				break
+			}
+			present, enabled := ts.VolatileWriteCache()
+			if !present {
+				w.SetStatus(protocol.SCInvalidFieldInCommand)
+				break
+			}
+			v := uint64(0)
+			if enabled {
+				v = 0x1
+			}
 			sm := serialize.New(w.Response.FabricResponse[:])
 			sm.Serialize(&v)
 
 		default:
-			w.SetStatus(protocol.SCInternalError)
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
 			c.Log.Todo("unsupported capsule feature command %+v", capsule)
 		}
 
 	case protocol.CapsuleCmdAsyncEventRequest:
-		w.NoReply = true
+		// the request completes when an event is reported (or the controller goes away)
+		w.State |= RequestDeferred
+		if !c.State.queueAsyncEventRequest(r) {
+			w.State &^= RequestDeferred
+			w.SetStatus(protocol.SCAsyncEventRequestLimitExceeded)
+		}
+
+	// 5.1 Abort command
+	case protocol.CapsuleCmdAbort:
+		sqid := uint16(capsule.D10 & 0xFFFF)
+		cid := uint16(capsule.D10 >> 16)
+		c.Log.Trace(tracer.TraceCapsuleDetail, "    SQID:%d CID:%d", sqid, cid)
+
+		v := c.abortCommand(sqid, cid)
+		sm := serialize.New(w.Response.FabricResponse[:])
+		sm.Serialize(&v)
 
 	case protocol.CapsuleCmdKeepAlive:
-		// Nothing to do
+		c.State.KeepAlive()
+
+	case protocol.CapsuleCmdNamespaceManagement:
+		c.namespaceManagement(w, r)
+
+	case protocol.CapsuleCmdNamespaceAttachment:
+		c.namespaceAttachment(w, r)
+
+	case protocol.CapsuleCmdFormatNVM:
+		c.formatNVM(w, r)
+
+	case protocol.CapsuleCmdSanitize:
+		c.sanitize(w, r)
 
 	case protocol.CapsuleCmdSecurityRecv:
 		w.SetStatus(protocol.CapsuleCmdInvalid)
 
 	default:
-		w.SetStatus(protocol.SCInternalError)
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
 		c.Log.Todo("unsupported capsule command %+v", capsule)
 	}
 	return nil
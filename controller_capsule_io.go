@@ -11,36 +11,46 @@ func (c *Controller) handleIOCapsule(w *NVMEResponse, r *NVMERequest) error {
 	capsule := r.Capsule()
 
 	switch capsule.OpCode {
+	// I/O queues authenticate on their own, the other fabrics commands belong to the admin queue
+	case protocol.CapsuleCmdFabric:
+		switch capsule.FCType {
+		case protocol.FabricCmdAuthenticationSend, protocol.FabricCmdAuthenticationReceive:
+			c.handleFabricCommand(w, r)
+		default:
+			c.Log.Trace(tracer.TraceFabric, "fabric command 0x%x on I/O queue %d", capsule.FCType, c.QueueID)
+			w.SetStatus(protocol.SCInvalidCommandOpcode)
+		}
+		status = targets.TargetErrorNone
+		r.Complete(targets.TargetErrorNone)
+
 	case protocol.CapsuleCmdFlush:
 		req := r.ior.Init(targets.IORequestCmdFlush, 0, 0, r.Complete)
-		status = c.Subsystem.QueueIO(req)
+		status = c.Subsystem.QueueIO(c.ControllerID, capsule.NSID, req)
 
 	case protocol.CapsuleCmdRead:
-		req := r.ior.Init(targets.IORequestCmdRead, capsule.Lba(), capsule.LbaLength()*512, r.Complete)
-		r.payload = c.bufferManager.Get()
+		req := c.initIO(r, targets.IORequestCmdRead)
+		if sc := c.checkTransfer(r, req.Length, false); sc != protocol.SCSuccess {
+			w.SetStatus(sc)
+			r.Complete(targets.TargetErrorNone)
+			return nil
+		}
+
+		r.payload = c.payloadBuffer(req.Length)
 		r.payloadLength = int(req.Length)
 		req.AddBuffer(r.Payload())
 		w.Write(r.Payload())
-		status = c.Subsystem.QueueIO(req)
+		status = c.Subsystem.QueueIO(c.ControllerID, capsule.NSID, req)
 
 	case protocol.CapsuleCmdWrite:
-		req := r.ior.Init(targets.IORequestCmdWrite, capsule.Lba(), capsule.LbaLength()*512, r.Complete)
-		req.AddBuffer(r.Payload())
-
-		// fixme: alloc c.Log.Trace(TraceCapsuleDetail, "    Lba: %d  Length: %d  [in Payload: %d]", req.Lba, req.Length, len(req.SGL[0].Data))
-		if uint32(len(req.SGL[0].Data)) == req.Length {
-			status = c.Subsystem.QueueIO(req)
-		} else {
-			tracer.Fatal("Implement R2T")
-			// Need to request data segments
-			/*
-				req.SGL[0].Data = make([]byte, req.Length, req.Length)
-				r.State |= RequestNeedsData
-				w.DataLength = req.Length
-			*/
-			// fixme: alloc c.Log.Trace(TraceCapsuleDetail, "    Lba: %d  Length: %d  [in Payload: %d] -- Needs Data", req.Lba, req.Length, len(req.SGL[0].Data))
+		req := c.initIO(r, targets.IORequestCmdWrite)
+		if sc := c.checkTransfer(r, req.Length, true); sc != protocol.SCSuccess {
+			w.SetStatus(sc)
+			r.Complete(targets.TargetErrorNone)
+			return nil
 		}
 
+		status = c.receiveData(r, req.Length)
+
 	case protocol.CapsuleCmdWriteZeros:
 		var cmd targets.TargetCommand
 		if capsule.D12&protocol.CommandBitDeallocateSet != 0 {
@@ -49,23 +59,144 @@ func (c *Controller) handleIOCapsule(w *NVMEResponse, r *NVMERequest) error {
 			cmd = targets.IORequestCmdWriteZero
 		}
 
-		req := r.ior.Init(cmd, capsule.Lba(), capsule.LbaLength()*512, r.Complete)
-		status = c.Subsystem.QueueIO(req)
+		req := c.initIO(r, cmd)
+		status = c.Subsystem.QueueIO(c.ControllerID, capsule.NSID, req)
 
 	case protocol.CapsuleCmdDatasetMgmt:
-		// FIXME: this is typically a trim operation but there are additonal things that usefull (such as cache region ops)
-		status = targets.TargetErrorNone
-		c.Log.Todo("protocol.CapsuleCmdDatasetMgmt: %+v", capsule)
-		r.Complete(targets.TargetErrorNone)
+		length := (capsule.D10&0xFF + 1) * protocol.DSMRangeSize
+		if sc := c.checkTransfer(r, length, true); sc != protocol.SCSuccess {
+			w.SetStatus(sc)
+			r.Complete(targets.TargetErrorNone)
+			return nil
+		}
+
+		r.ior.Init(targets.IORequestCmdTrim, 0, 0, r.Complete)
+		status = c.receiveData(r, length)
 
 	default:
-		tracer.Fatal("OpCode:default %+v", capsule)
-		r.Complete(targets.TargetErrorUnsupported)
+		c.Log.Todo("unsupported io command %+v", capsule)
+		status = targets.TargetErrorUnsupported
 	}
 
+	// the target did not take the request, fail it here
 	if status != targets.TargetErrorNone {
-		w.SetStatus(protocol.SCInternalError)
-		tracer.Fatal("bad status")
+		r.Complete(status)
 	}
 	return nil
 }
+
+// receiveData gets the length bytes of data a command sends us, from the capsule or by R2T
+//
+//	The command goes to the target (see submitIO) once all of the data is in
+func (c *Controller) receiveData(r *NVMERequest, length uint32) targets.TargetError {
+	sgl := r.capsule.SGL()
+	if sgl.InCapsule() {
+		// the target wants the data at the start of the buffer
+		if sgl.Address != 0 {
+			copy(r.payload, r.payload[sgl.Address:sgl.Address+uint64(sgl.Length)])
+		}
+		r.payloadLength = int(length)
+		r.ior.AddBuffer(r.Payload())
+		return c.submitIO(r)
+	}
+
+	// Need to request the data from the host
+	r.payload = c.payloadBuffer(length)
+
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    Lba: %d  Length: %d -- Needs Data", r.ior.Lba, length)
+
+	r.State |= RequestNeedsData
+	r.R2TOffset = 0
+	r.R2TReceived = 0
+	r.R2TLength = length
+	r.payloadLength = int(length)
+	r.ior.AddBuffer(r.Payload())
+
+	// the command can be aborted until all of its data arrived
+	r.ior.Wait()
+	c.requestData(r)
+	return targets.TargetErrorNone
+}
+
+// submitIO hands a command that has all of its data to the target
+func (c *Controller) submitIO(r *NVMERequest) targets.TargetError {
+	if r.capsule.OpCode == protocol.CapsuleCmdDatasetMgmt {
+		return c.datasetManagement(r)
+	}
+	return c.Subsystem.QueueIO(c.ControllerID, r.capsule.NSID, &r.ior)
+}
+
+// initIO sets up the IORequest of a Read/Write/Write Zeroes in the LBA size of the namespace
+func (c *Controller) initIO(r *NVMERequest, cmd targets.TargetCommand) *targets.IORequest {
+	capsule := r.Capsule()
+	blockSize := c.lbaSize(capsule.NSID)
+
+	req := r.ior.Init(cmd, capsule.Lba(), capsule.LbaLength()*blockSize, r.Complete)
+	req.BlockSize = blockSize
+	setIOFlags(req, capsule)
+	return req
+}
+
+// setIOFlags passes the FUA/Limited Retry bits and the Dataset Management hints on to the target
+func setIOFlags(req *targets.IORequest, capsule *protocol.CapsuleCommand) {
+	if capsule.D12&protocol.CommandBitFUA != 0 {
+		req.Flags |= targets.IORequestFlagFUA
+	}
+	if capsule.D12&protocol.CommandBitLimitedRetry != 0 {
+		req.Flags |= targets.IORequestFlagLimitedRetry
+	}
+	req.Hints = targets.IOHints(capsule.D13 & protocol.CommandDSMMask)
+}
+
+// checkTransfer validates the data descriptor of a command that transfers length bytes
+//
+//	Data from the host is either in the capsule (data block with an offset into the in capsule data)
+//	or requested with R2T (transport data block), data to the host always goes out in C2HData PDUs
+func (c *Controller) checkTransfer(r *NVMERequest, length uint32, toController bool) protocol.NVMEStatusCode {
+	if length > c.maxTransferSize() {
+		return protocol.SCInvalidFieldInCommand
+	}
+
+	sgl := r.capsule.SGL()
+
+	switch {
+	case sgl.Transport():
+		if r.payloadLength != 0 {
+			return protocol.SCInvalidSGLData
+		}
+
+	case sgl.InCapsule() && toController:
+		if sgl.Address > uint64(r.payloadLength) {
+			return protocol.SCInvalidSGLOffset
+		}
+		if sgl.Address+uint64(sgl.Length) > uint64(r.payloadLength) {
+			return protocol.SCInvalidSGLData
+		}
+
+	default:
+		return protocol.SCInvalidSGLType
+	}
+
+	if sgl.Length != length {
+		return protocol.SCInvalidSGLData
+	}
+	return protocol.SCSuccess
+}
+
+// lbaSize returns the LBA data size of the namespace, subsystems without namespaces of their own use 512 bytes
+func (c *Controller) lbaSize(nsid uint32) uint32 {
+	if ts, ok := c.Subsystem.(*TargetSubsystem); ok {
+		if ns := ts.AttachedNamespace(c.ControllerID, nsid); ns != nil {
+			return ns.LBASize()
+		}
+	}
+	return targets.DefaultBlockSize
+}
+
+// maxTransferSize is the largest data transfer of a single command (MDTS)
+func (c *Controller) maxTransferSize() uint32 {
+	if ts, ok := c.Subsystem.(*TargetSubsystem); ok {
+		return ts.TransferSize()
+	}
+	return DefaultMaxTransferSize
+}
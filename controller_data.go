@@ -0,0 +1,145 @@
+package nvme
+
+import (
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/stream"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// requestData schedules R2Ts for the next window of data we need from the host
+//
+//	The window is bounded by the number of R2Ts the host allows to be outstanding (MaxR2T)
+//	and the size of each H2CData PDU (MaxH2CDataLength). The R2Ts themselves are sent by
+//	the completion handler, so they are serialized with all our other outbound PDUs
+func (c *Controller) requestData(r *NVMERequest) {
+	w := &r.response
+
+	window := uint64(c.MaxR2T) * uint64(c.MaxH2CDataLength)
+	remaining := uint64(r.R2TLength - r.R2TOffset)
+	if remaining > window {
+		remaining = window
+	}
+
+	w.R2T.CCCID = r.capsule.CID
+	w.R2T.TTAG = r.tag
+	w.R2T.DATAO = r.R2TOffset
+	w.R2T.DATAL = uint32(remaining)
+	w.State |= RequestNeedsData
+
+	r.R2TOffset += uint32(remaining)
+	r.completion <- r
+}
+
+// sendR2T queues the R2T PDUs for the window described in w.R2T
+func (c *Controller) sendR2T(w *NVMEResponse) {
+	offset := w.R2T.DATAO
+	end := w.R2T.DATAO + w.R2T.DATAL
+
+	for offset < end {
+		length := end - offset
+		if length > c.MaxH2CDataLength {
+			length = c.MaxH2CDataLength
+		}
+
+		r2t := protocol.R2TRequest{
+			CCCID: w.R2T.CCCID,
+			TTAG:  w.R2T.TTAG,
+			DATAO: offset,
+			DATAL: length,
+		}
+		c.Log.TraceProtocol(tracer.TraceData, &r2t)
+
+		c.out.Send(protocol.R2T, &r2t, 16)
+		c.out.Queue()
+		offset += length
+	}
+}
+
+// handleH2CData receives data the host sent us in response to an R2T
+//
+//	Once all the data for the command has been received the request is queued to the target
+func (c *Controller) handleH2CData() error {
+	h2c := protocol.H2CDataTransfer{}
+	err := c.in.Receive(&h2c)
+	if err != nil {
+		return err
+	}
+	c.Log.TraceProtocol(tracer.TraceData, &h2c)
+
+	if int(h2c.TTAG) >= len(c.Queue) {
+		return newTransportError(protocol.FESInvalidHeaderField, 10, "h2c data with invalid transfer tag:%d", h2c.TTAG)
+	}
+
+	r := &c.Queue[h2c.TTAG]
+	if r.State&RequestNeedsData == 0 || r.capsule.CID != h2c.CCCID {
+		return newTransportError(protocol.FESPDUSequenceError, 0, "h2c data for cid:%d tag:%d with no outstanding r2t", h2c.CCCID, h2c.TTAG)
+	}
+
+	dataLen := c.in.Length()
+	if dataLen > c.MaxH2CDataLength {
+		return newTransportError(protocol.FESDataTransferLimitExceeded, 0, "h2c data for cid:%d length %d exceeds %d", h2c.CCCID, dataLen, c.MaxH2CDataLength)
+	}
+	// the data has to continue where the last PDU left off and stay within what we asked for,
+	// R2TReceived <= R2TOffset so the subtraction can not wrap
+	if dataLen != h2c.DATAL || h2c.DATAO != r.R2TReceived || h2c.DATAL > r.R2TOffset-h2c.DATAO {
+		return newTransportError(protocol.FESDataTransferOutOfRange, 0, "h2c data for cid:%d out of range offset:%d length:%d/%d", h2c.CCCID, h2c.DATAO, h2c.DATAL, dataLen)
+	}
+
+	err = c.in.ReceiveData(r.payload[h2c.DATAO : h2c.DATAO+h2c.DATAL])
+	if err == stream.ErrDataDigest {
+		// keep accepting the data so the transfer completes, but fail the command
+		r.State |= RequestDataDigestError
+	} else if err != nil {
+		return err
+	}
+	r.R2TReceived += h2c.DATAL
+
+	// still waiting on data for the current window
+	if r.R2TReceived < r.R2TOffset {
+		return nil
+	}
+
+	if r.R2TOffset < r.R2TLength {
+		c.requestData(r)
+		return nil
+	}
+
+	// we have all our data, hand it off to the target
+	digestError := r.State&RequestDataDigestError != 0
+	r.State = 0
+	r.response.State = 0
+
+	if digestError {
+		r.SetStatus(protocol.SCTransientTransportError)
+		r.Complete(targets.TargetErrorNone)
+		return nil
+	}
+
+	// the host gave up on the command while we were collecting its data
+	if !r.ior.Resume() {
+		r.Complete(targets.TargetErrorAborted)
+		return nil
+	}
+
+	status := c.submitIO(r)
+	if status != targets.TargetErrorNone {
+		r.Complete(status)
+	}
+	return nil
+}
+
+// abortDataTransfers fails any requests that are still waiting on data from the host
+func (c *Controller) abortDataTransfers() {
+	for idx := range c.Queue {
+		r := &c.Queue[idx]
+		if r.State&RequestNeedsData == 0 {
+			continue
+		}
+
+		r.State = 0
+		r.response.State = 0
+		r.SetStatus(protocol.SCAbortedQueue)
+		r.completion <- r
+	}
+}
@@ -0,0 +1,94 @@
+package nvme
+
+import (
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// dsmMaxTrimSize bounds a single trim so its length in bytes fits IORequest.Length
+const dsmMaxTrimSize = 1 << 30
+
+// dsmTrim walks the ranges of a Dataset Management deallocate
+//
+//	The ranges are trimmed one after the other using the request's IORequest, each completion
+//	issues the next trim. The command completes with the first error any trim reported.
+type dsmTrim struct {
+	c         *Controller
+	r         *NVMERequest
+	ranges    []protocol.DSMRange
+	blockSize uint32
+	status    targets.TargetError
+}
+
+// datasetManagement handles the ranges of a Dataset Management command once its data is in
+func (c *Controller) datasetManagement(r *NVMERequest) targets.TargetError {
+	capsule := r.Capsule()
+	ranges := protocol.UnmarshalDSMRanges(r.Payload())
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    Ranges: %d  Attributes: 0x%x", len(ranges), capsule.D11)
+
+	// Integral Dataset for Read/Write are hints we have no use for
+	if capsule.D11&protocol.DSMAttributeDeallocate == 0 {
+		r.Complete(targets.TargetErrorNone)
+		return targets.TargetErrorNone
+	}
+
+	// nothing is trimmed if any of the ranges is bad
+	if ts, ok := c.Subsystem.(*TargetSubsystem); ok {
+		ns := ts.AttachedNamespace(c.ControllerID, capsule.NSID)
+		if ns == nil {
+			return targets.TargetErrorInvalidNamespace
+		}
+		blocks := ns.Blocks()
+		for i := range ranges {
+			// written so a StartingLBA close to 2^64 does not wrap around
+			if uint64(ranges[i].Length) > blocks || ranges[i].StartingLBA > blocks-uint64(ranges[i].Length) {
+				return targets.TargetErrorLbaOutOfRange
+			}
+		}
+	}
+
+	t := &dsmTrim{
+		c:         c,
+		r:         r,
+		ranges:    ranges,
+		blockSize: c.lbaSize(capsule.NSID),
+	}
+	t.next(targets.TargetErrorNone)
+	return targets.TargetErrorNone
+}
+
+// next is the completion of the previous trim, it issues the next one or completes the command
+func (t *dsmTrim) next(status targets.TargetError) {
+	for {
+		if t.status == targets.TargetErrorNone {
+			t.status = status
+		}
+
+		// skip past what is done, ranges may be empty
+		for len(t.ranges) != 0 && t.ranges[0].Length == 0 {
+			t.ranges = t.ranges[1:]
+		}
+		if len(t.ranges) == 0 {
+			t.r.Complete(t.status)
+			return
+		}
+
+		rg := &t.ranges[0]
+		blocks := rg.Length
+		if blocks > dsmMaxTrimSize/t.blockSize {
+			blocks = dsmMaxTrimSize / t.blockSize
+		}
+		lba := rg.StartingLBA
+		rg.StartingLBA += uint64(blocks)
+		rg.Length -= blocks
+
+		req := t.r.ior.Init(targets.IORequestCmdTrim, lba, blocks*t.blockSize, t.next)
+		req.BlockSize = t.blockSize
+		status = t.c.Subsystem.QueueIO(t.c.ControllerID, t.r.capsule.NSID, req)
+		if status == targets.TargetErrorNone {
+			return
+		}
+		// the target refused this one, keep going with the rest
+	}
+}
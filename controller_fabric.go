@@ -1,17 +1,136 @@
 package nvme
 
 import (
-	"fmt"
+	"encoding/binary"
 
+	"github.com/thirdmartini/go-nvme/internal/buffers"
 	"github.com/thirdmartini/go-nvme/internal/serialize"
+	"github.com/thirdmartini/go-nvme/pkg/psk"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
 	"github.com/thirdmartini/go-nvme/protocol"
 )
 
 const (
 	SQFlowControlDisabled = 1 << 2
+
+	// offsets reported in Connect Invalid Parameters responses
+	connectQueueIDOffset   = 42  // QID in the command
+	connectQueueSizeOffset = 44  // SQSIZE in the command
+	connectCNTLIDOffset    = 16  // CNTLID in the connect data
+	connectSubNQNOffset    = 256 // SUBNQN in the connect data
+
+	// minAdminQueueSize is the smallest admin queue a fabrics host may ask for (SQSIZE is 0 based)
+	minAdminQueueSize = 32
 )
 
+// isConnectCommand returns true for the fabric Connect command
+func isConnectCommand(capsule *protocol.CapsuleCommand) bool {
+	return capsule.OpCode == protocol.CapsuleCmdFabric && capsule.FCType == protocol.FabricCmdConnect
+}
+
+// connectInvalidParameter fails Connect with Connect Invalid Parameters
+//
+//	IPO points at the offending field, IATTR selects the connect data instead of the command
+func connectInvalidParameter(w *NVMEResponse, offset uint16, inData bool) {
+	w.SetStatus(protocol.SCConnectInvalidParameters)
+	binary.LittleEndian.PutUint16(w.Response.FabricResponse[0:], offset)
+	if inData {
+		w.Response.FabricResponse[2] = 1
+	}
+}
+
+// maxQueueSize returns the largest queue we allow, CAP.MQES is 0 based and never larger than MAXCMD
+func (c *Controller) maxQueueSize() int {
+	return int(c.REGCtrlCaps&0xFFFF) + 1
+}
+
+// minQueueSize returns the smallest queue we allow, an SQSIZE of 0 is always invalid
+func (c *Controller) minQueueSize() int {
+	if c.QueueID == 0 {
+		return minAdminQueueSize
+	}
+	return 2
+}
+
+// validQueueSize checks the SQSIZE the host asked for in Connect
+func (c *Controller) validQueueSize(fcc *protocol.ConnectCommand) bool {
+	size := int(fcc.QueueSize) + 1
+	return size >= c.minQueueSize() && size <= c.maxQueueSize() && size <= len(c.Queue)
+}
+
+// bindControllerState associates the queue with its controller
+//
+//	The admin queue allocates a new controller ID (we only support the dynamic controller model),
+//	I/O queues must name the controller of their admin queue and come from the same host.
+func (c *Controller) bindControllerState(w *NVMEResponse, fcc *protocol.ConnectCommand, fcd *protocol.ConnectData) bool {
+	registry := c.Server.Controllers(c.Subsystem.GetNQN())
+
+	if fcc.QueueID == 0 {
+		if fcd.CNTLID != 0xFFFF {
+			c.Log.Trace(tracer.TraceFabric, "Connect: admin queue asked for static controller 0x%x", fcd.CNTLID)
+			connectInvalidParameter(w, connectCNTLIDOffset, true)
+			return false
+		}
+
+		state, err := registry.Allocate(c.Subsystem, fcd.HostNQN, fcd.HostIdentifier)
+		if err != nil {
+			c.Log.Trace(tracer.TraceFabric, "Connect: %s", err.Error())
+			w.SetStatus(protocol.SCConnectControllerBusy)
+			return false
+		}
+		state.attach(c)
+		c.State = state
+		c.ControllerID = state.ID
+		state.startKeepAlive(fcc.KATO, c.keepAliveExpired)
+		return true
+	}
+
+	state := registry.Lookup(fcd.CNTLID)
+	if state == nil || state.HostNQN != fcd.HostNQN || state.HostID != fcd.HostIdentifier {
+		c.Log.Trace(tracer.TraceFabric, "Connect: no controller 0x%x for host %s", fcd.CNTLID, fcd.HostNQN)
+		connectInvalidParameter(w, connectCNTLIDOffset, true)
+		return false
+	}
+
+	if _, nsqr := state.NumberOfQueues(); fcc.QueueID > nsqr+1 {
+		c.Log.Trace(tracer.TraceFabric, "Connect: QID %d exceeds the %d allocated queues", fcc.QueueID, nsqr+1)
+		connectInvalidParameter(w, connectQueueIDOffset, false)
+		return false
+	}
+
+	err := state.attach(c)
+	if err == ErrQueueInUse {
+		c.Log.Trace(tracer.TraceFabric, "Connect: QID %d already connected to controller 0x%x", fcc.QueueID, state.ID)
+		connectInvalidParameter(w, connectQueueIDOffset, false)
+		return false
+	} else if err != nil {
+		c.Log.Trace(tracer.TraceFabric, "Connect: %s", err.Error())
+		connectInvalidParameter(w, connectCNTLIDOffset, true)
+		return false
+	}
+
+	c.State = state
+	c.ControllerID = state.ID
+	return true
+}
+
+// checkSecureChannel verifies the connection meets the subsystem's secure channel requirements
+//
+//	When the host used a PSK identity it must name the host and subsystem it is connecting as
+func (c *Controller) checkSecureChannel(subsys Subsystem, hostNQN string) protocol.NVMEStatusCode {
+	if ts, ok := subsys.(*TargetSubsystem); ok && ts.SecureChannelRequired && !c.SecureChannel {
+		c.Log.Trace(tracer.TraceFabric, "Connect: %s requires a secure channel", subsys.GetNQN())
+		return protocol.SCConnectInvalidHost
+	}
+
+	host, sub, ok := psk.ParseIdentity(c.TLSServerName)
+	if ok && (host != hostNQN || sub != subsys.GetNQN()) {
+		c.Log.Trace(tracer.TraceFabric, "Connect: psk identity %q does not match host %s", c.TLSServerName, hostNQN)
+		return protocol.SCConnectInvalidHost
+	}
+	return protocol.SCSuccess
+}
+
 func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error {
 	capsule := r.Capsule()
 
@@ -28,14 +147,18 @@ func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error
 
 		// reinterpret the command
 		fcc := protocol.ConnectCommand{}
-		if r.ReinterpretCapsule(&fcc) != nil {
-			tracer.Fatal("reinterpret error")
+		if err := r.ReinterpretCapsule(&fcc); err != nil {
+			c.Log.Trace(tracer.TraceFabric, "Connect: bad command: %s", err.Error())
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return nil
 		}
 
 		ds := serialize.NewDeserializer(r.Payload())
 		fcd := protocol.ConnectData{}
 		if err := ds.Deserialize(&fcd); err != nil {
-			tracer.Fatal("deserialize error:" + err.Error())
+			c.Log.Trace(tracer.TraceFabric, "Connect: bad connect data: %s", err.Error())
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return nil
 		}
 
 		//utilPrettyPrint(fcc)
@@ -46,7 +169,14 @@ func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error
 		c.Log.Trace(tracer.TraceCapsuleDetail, "    HOST NQN: %s", fcd.HostNQN)
 		c.Log.Trace(tracer.TraceCapsuleDetail, "     SUB NQN: %s", fcd.SubNQN)
 
+		// a queue connects exactly once
+		if c.State != nil {
+			w.SetStatus(protocol.SCCommandSequenceError)
+			return nil
+		}
+
 		c.ConnectedHostNQN = fcd.HostNQN
+		c.ConnectedHostID = fcd.HostIdentifier
 		c.ConnectedSubNQN = fcd.SubNQN
 
 		// TODO: rework this, we will alias ourselves to this queue now
@@ -56,44 +186,56 @@ func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error
 		// did not find the subsystem we need
 		subsys := c.Server.GetSubSystem(c.ConnectedSubNQN)
 		if subsys == nil {
-			offset := uint64(256) | 0x10000 // offset of NQN in request + set the start of data
-			w.SetStatus(protocol.SCNamespaceNotReady)
-			sm := serialize.New(w.Response.FabricResponse[0:])
-			sm.Serialize(&offset)
+			c.Log.Trace(tracer.TraceFabric, "Connect: no subsystem %s", c.ConnectedSubNQN)
+			connectInvalidParameter(w, connectSubNQNOffset, true)
+			return nil
+		}
+
+		if !isHostAllowed(subsys, fcd.HostNQN, fcd.HostIdentifier) {
+			c.Log.Trace(tracer.TraceFabric, "Connect: host %s is not allowed on %s", fcd.HostNQN, subsys.GetNQN())
+			w.SetStatus(protocol.SCConnectInvalidHost)
+			return nil
+		}
+
+		status := c.checkSecureChannel(subsys, fcd.HostNQN)
+		if status != protocol.SCSuccess {
+			w.SetStatus(status)
 			return nil
 		}
 
 		//  New
 		c.Subsystem = subsys
 
-		// we can resize past our controller limits!
-		if int(fcc.QueueSize+1) > len(c.Queue) {
-			tracer.Fatal("protocol.FabricCmdConnect: cant resize past queue size: %+v", capsule)
+		// transfers above payloadBufferSize reuse buffers of the largest transfer the subsystem allows
+		if size := c.maxTransferSize(); size > payloadBufferSize {
+			c.largeBuffers = buffers.NewOnDemand(largeBufferCount, int(size))
+		}
+
+		// we can't resize past our controller limits
+		if !c.validQueueSize(&fcc) {
+			c.Log.Trace(tracer.TraceFabric, "Connect: SQSIZE %d not in [%d, %d]", int(fcc.QueueSize)+1, c.minQueueSize(), c.maxQueueSize())
+			connectInvalidParameter(w, connectQueueSizeOffset, false)
+			return nil
 		}
 		c.QueueSize = fcc.QueueSize + 1
 
 		// Controller ID (CNTLID): Specifies the controller ID allocated to the host. If a
 		// particular controller was specified in the CNTLID field of the Connect command,
 		// then this field shall contain the same value
-		if fcd.CNTLID == 0xFFFF {
-			if c.ControllerID == 0 {
-				c.ControllerID = 7
-				//atomic.AddInt32(controllersAvailable)
-				//controllersAvailable++
-				val := uint32(c.ControllerID)
-				sm := serialize.New(w.Response.FabricResponse[:])
-				sm.Serialize(&val)
-				fmt.Printf("C: %d  FCR: %+v\n", c.ControllerID, w.Response.FabricResponse)
-			}
-		} else {
-			// FIXME: this may not be the correct thing to do
-			c.ControllerID = fcd.CNTLID
+		if !c.bindControllerState(w, &fcc, &fcd) {
+			return nil
 		}
+		binary.LittleEndian.PutUint16(w.Response.FabricResponse[0:], c.ControllerID)
 
 		if fcc.CATTR&SQFlowControlDisabled == SQFlowControlDisabled {
 			c.FlowControlDisabled = true
 		}
 
+		// AUTHREQ follows CNTLID in the response
+		if c.startAuthentication(subsys, fcd.HostNQN) {
+			binary.LittleEndian.PutUint16(w.Response.FabricResponse[2:], protocol.ConnectAuthReqATR)
+		}
+
 		w.Response.QueueID = c.QueueID
 		// w.Response.QueueID = 0
 
@@ -111,17 +253,18 @@ func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error
 			val = uint64(c.Version)
 
 		case protocol.PropertyControllerStatus: // Controller Status Register (0x1c)
-			c.Log.Trace(tracer.TraceAll, "Get: protocol.PropertyControllerStatus: 0x%x\n", c.REGCtrlStatus)
-			val = uint64(c.REGCtrlStatus)
+			val = uint64(c.controllerStatus())
+			c.Log.Trace(tracer.TraceAll, "Get: protocol.PropertyControllerStatus: 0x%x\n", val)
 
 		case protocol.PropertyControllerConfiguration: // Controller Configuration
-			val = uint64(c.REGCtrlConfig)
+			val = uint64(c.controllerConfig())
 
-		case protocol.PropertySubsystemReset: // RESET
-			// FIXME: pretend we reset
+		case protocol.PropertySubsystemReset: // NSSR always reads as 0
 
 		default:
-			tracer.Fatal("protocol.FabricCmdPropertyGet %+v", capsule)
+			c.Log.Trace(tracer.TraceFabric, "PropertyGet: unknown property 0x%x", capsule.D11)
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return nil
 		}
 
 		sm := serialize.New(w.Response.FabricResponse[:])
@@ -132,50 +275,42 @@ func (c *Controller) handleFabricCommand(w *NVMEResponse, r *NVMERequest) error
 
 		switch capsule.D11 {
 		case protocol.PropertyControllerConfiguration: // Controller Configuration
-
 			// bits 04:06  000 (NVM Command Set) | 111 Admin Command Set
 			// bits 07:10 MPS (2 ^ (12 + MPS)).
 			// RW bits 11:13 AMS
 			// RW bits 14:15 SHN (00 no notification, 01 normal, 10 Abrupt )
 			// RW bits 16:19 IO Q Size ( 2^n )
 			// RW Completion Q Size (2^n)
+			c.setControllerConfiguration(capsule.D12)
+			c.Log.Trace(tracer.TraceCommands, "     Status: %x", c.controllerStatus())
 
-			c.REGCtrlConfig = capsule.D12
-			if c.REGCtrlConfig&0xc000 != 0 {
-				// we instantly go to shutdown mode
-				c.REGCtrlStatus |= 0x2 << 2
-				c.REGCtrlStatus &= ^uint32(1) // clear ready bit
-				// We're being asked for a shutdown
+		case protocol.PropertyControllerStatus:
+			// NSSRO is the only writable bit, writing 1 clears it
+			c.updateControllerStatus(0, capsule.D12&protocol.CSTSSubsystemReset)
 
-				c.Log.Trace(tracer.TraceCommands, "     Shutdown: %x", c.REGCtrlStatus)
-				//w.Shutdown = true
-				return nil
-			}
-
-			// 1.0 The controller starts with REGCtrlStatus:0 indicating the controller is offline
-			if c.REGCtrlStatus == 0 {
-				// (1.1) host has to first set  REGCtrlConfig:1 indicating it wants to enable the controller
-				if c.REGCtrlConfig&0x1 == 0x1 {
-					// (1.2) in response the controller (we) set  c.REGCtrlStatus |= 0x1
-					c.REGCtrlStatus |= 0x1 // enable controller
-				}
+		case protocol.PropertySubsystemReset:
+			if capsule.D12 == protocol.NSSRReset {
+				c.subsystemReset()
 			}
 
 		default:
-			tracer.Fatal("protocol.FabricCmdPropertySet %+v", capsule)
+			c.Log.Trace(tracer.TraceFabric, "PropertySet: unknown property 0x%x", capsule.D11)
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
 		}
 
+	case protocol.FabricCmdAuthenticationSend:
+		c.handleAuthSend(w, r)
+
 	case protocol.FabricCmdAuthenticationReceive:
-		c.Log.Todo("protocol.FabricCmdAuthenticationReceive: %+v", capsule)
-		// Nothing to do here
+		c.handleAuthReceive(w, r)
 
 	case protocol.FabricCmdDisconnect:
 		c.Log.Todo("protocol.FabricCmdDisconnect %+v", capsule)
 		// Nothing to do here, target about to close the session
 
 	default:
-		c.Log.Todo("protocol.FabricCmdAuthenticationReceive: %+v", capsule)
-		tracer.Fatal("unknown fabric command %x", capsule.FCType)
+		c.Log.Trace(tracer.TraceFabric, "unknown fabric command 0x%x", capsule.FCType)
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
 	}
 
 	return nil
@@ -0,0 +1,70 @@
+package nvme
+
+import (
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// formatNVM formats the namespace, or every namespace attached to the controller for the broadcast NSID
+// (Format NVM, opcode 80h)
+//
+//	The format runs in the background and the command completes when it is done, meanwhile the admin
+//	queue keeps working and Identify Namespace reports the progress
+func (c *Controller) formatNVM(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+	ts, ok := c.Subsystem.(*TargetSubsystem)
+	if !ok {
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
+		return
+	}
+
+	lbaf := int(capsule.D10 & protocol.FormatLBAFMask)
+	ses := uint8(capsule.D10 >> protocol.FormatSESShift & protocol.FormatSESMask)
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    NSID:%d LBAF:%d SES:%d", capsule.NSID, lbaf, ses)
+
+	// we have no metadata or protection information to format
+	if lbaf >= len(LBAFormats) || capsule.D10&(protocol.FormatLBAFUMask|protocol.FormatMSET|protocol.FormatPIMask|protocol.FormatPIL) != 0 {
+		w.SetStatus(protocol.SCInvalidFormat)
+		return
+	}
+	if ses > protocol.SecureEraseCrypto {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	var namespaces []*Namespace
+	if capsule.NSID == protocol.NSIDBroadcast {
+		namespaces = ts.AttachedNamespaces(c.ControllerID)
+	} else if ns := ts.AttachedNamespace(c.ControllerID, capsule.NSID); ns != nil {
+		namespaces = []*Namespace{ns}
+	}
+	if len(namespaces) == 0 {
+		w.SetStatus(protocol.SCInvalidNamespace)
+		return
+	}
+
+	if err := ts.beginFormat(namespaces); err != nil {
+		w.SetStatus(sanitizeStatus(err))
+		return
+	}
+
+	blockSize := LBAFormats[lbaf]
+	live := c.subsystemControllers()
+	w.State |= RequestDeferred
+	go func() {
+		for _, ns := range namespaces {
+			changed := ns.LBASize() != blockSize
+			if err := ns.format(blockSize, ses); err != nil {
+				c.Log.Trace(tracer.TraceCapsuleDetail, "    format failed: %s", err.Error())
+				r.SetStatus(protocol.SCInternalError)
+				continue
+			}
+			if changed {
+				c.notifyNamespaceChanged(ns.ID, ts.AttachedControllers(ns.ID, live))
+			}
+		}
+		ts.namespacesChanged()
+		r.Complete(targets.TargetErrorNone)
+	}()
+}
@@ -0,0 +1,108 @@
+package nvme
+
+import (
+	"time"
+
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+)
+
+const (
+	// KeepAliveGranularity is the Keep Alive Support (KAS) we report in Identify Controller (100ms units),
+	// timeouts are rounded up to a multiple of it
+	KeepAliveGranularity = 1
+
+	keepAliveUnit = 100 * time.Millisecond
+)
+
+// roundKeepAliveTimeout rounds the host requested timeout (ms) up to our granularity
+func roundKeepAliveTimeout(kato uint32) uint32 {
+	granularity := uint32(KeepAliveGranularity * keepAliveUnit / time.Millisecond)
+	if rem := kato % granularity; rem != 0 {
+		kato += granularity - rem
+	}
+	return kato
+}
+
+// keepAliveExpired tears down the controller when the host stopped sending Keep Alive
+//
+//	Closing the admin queue releases the controller and closes its I/O queues, outstanding requests are
+//	drained as with any other disconnect
+func (c *Controller) keepAliveExpired() {
+	c.Log.Trace(tracer.TraceController, "Controller %d keep alive timer expired (%dms)", c.ControllerID, c.State.KeepAliveTimeout())
+	c.Close()
+}
+
+// startKeepAlive arms the keep alive timer, expired is called once the host stopped sending Keep Alive
+// for KATO. A timeout of 0 disables the timer.
+func (s *ControllerState) startKeepAlive(kato uint32, expired func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expired = expired
+	s.setKeepAliveTimeout(kato)
+}
+
+// SetKeepAliveTimeout changes the keep alive timeout (ms) and restarts the timer, returns the timeout in use
+func (s *ControllerState) SetKeepAliveTimeout(kato uint32) uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.setKeepAliveTimeout(kato)
+}
+
+func (s *ControllerState) setKeepAliveTimeout(kato uint32) uint32 {
+	s.KATO = roundKeepAliveTimeout(kato)
+	s.LastKeepAlive = time.Now()
+
+	s.stopKeepAlive()
+	if s.KATO != 0 && !s.closed {
+		s.keepAlive = time.AfterFunc(s.keepAliveTimeout(), s.checkKeepAlive)
+	}
+	return s.KATO
+}
+
+// KeepAliveTimeout returns the keep alive timeout (ms), 0 if disabled
+func (s *ControllerState) KeepAliveTimeout() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.KATO
+}
+
+// KeepAlive restarts the keep alive timer
+func (s *ControllerState) KeepAlive() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.LastKeepAlive = time.Now()
+	if s.keepAlive != nil {
+		s.keepAlive.Reset(s.keepAliveTimeout())
+	}
+}
+
+func (s *ControllerState) keepAliveTimeout() time.Duration {
+	return time.Duration(s.KATO) * time.Millisecond
+}
+
+// checkKeepAlive runs when the timer fires, a Keep Alive may have raced with it
+func (s *ControllerState) checkKeepAlive() {
+	s.lock.Lock()
+	if s.keepAlive == nil || s.closed || time.Since(s.LastKeepAlive) < s.keepAliveTimeout() {
+		s.lock.Unlock()
+		return
+	}
+	s.keepAlive = nil
+	expired := s.expired
+	s.lock.Unlock()
+
+	if expired != nil {
+		expired()
+	}
+}
+
+// stopKeepAlive disarms the timer, must be called with the lock held
+func (s *ControllerState) stopKeepAlive() {
+	if s.keepAlive != nil {
+		s.keepAlive.Stop()
+		s.keepAlive = nil
+	}
+}
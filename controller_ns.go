@@ -0,0 +1,214 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/thirdmartini/go-nvme/internal/serialize"
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+// namespaceStatus maps the errors of the TargetSubsystem namespace calls to their status
+func namespaceStatus(err error) protocol.NVMEStatusCode {
+	switch {
+	case err == nil:
+		return protocol.SCSuccess
+	case errors.Is(err, ErrInvalidNamespace):
+		return protocol.SCInvalidNamespace
+	case errors.Is(err, ErrNamespaceIDUnavailable):
+		return protocol.SCNamespaceIDUnavailable
+	case errors.Is(err, ErrNamespaceAlreadyAttached):
+		return protocol.SCNamespaceAlreadyAttached
+	case errors.Is(err, ErrNamespaceNotAttached):
+		return protocol.SCNamespaceNotAttached
+	case errors.Is(err, ErrInvalidFormat):
+		return protocol.SCInvalidFormat
+	case errors.Is(err, ErrInsufficientCapacity):
+		return protocol.SCNamespaceInsufficientCapacity
+	default:
+		return protocol.SCInternalError
+	}
+}
+
+// adminData returns the length bytes of data an admin command sent, admin commands only take in capsule data
+func adminData(r *NVMERequest, length int) ([]byte, bool) {
+	sgl := r.capsule.SGL()
+	if !sgl.InCapsule() || int(sgl.Length) < length {
+		return nil, false
+	}
+
+	payload := r.Payload()
+	if sgl.Address+uint64(length) > uint64(len(payload)) {
+		return nil, false
+	}
+	return payload[sgl.Address : sgl.Address+uint64(length)], true
+}
+
+// subsystemControllers returns the IDs of the live controllers of our subsystem
+func (c *Controller) subsystemControllers() []uint16 {
+	states := c.Server.Controllers(c.Subsystem.GetNQN()).List()
+	ids := make([]uint16, len(states))
+	for i, state := range states {
+		ids[i] = state.ID
+	}
+	return ids
+}
+
+// notifyNamespaceChanged reports the namespace change to the controllers, the controller that made the
+// change is not told about it
+func (c *Controller) notifyNamespaceChanged(nsid uint32, ctrlIDs []uint16) {
+	registry := c.Server.Controllers(c.Subsystem.GetNQN())
+	for _, id := range ctrlIDs {
+		if id == c.ControllerID {
+			continue
+		}
+		if state := registry.Lookup(id); state != nil {
+			state.NotifyNamespaceChanged(nsid)
+		}
+	}
+}
+
+// identifyControllerList returns the controllers attached to nsid (CNS 12h) or all controllers of the
+// subsystem (CNS 13h) with an ID of at least cntid
+func (c *Controller) identifyControllerList(ts *TargetSubsystem, cns uint8, nsid uint32, cntid uint16) ([]byte, error) {
+	ids := c.subsystemControllers()
+	if cns == protocol.CNSIdentifyNamespaceAttachedControllers {
+		if ts.Namespace(nsid) == nil {
+			return nil, ErrInvalidNamespace
+		}
+		ids = ts.AttachedControllers(nsid, ids)
+	}
+
+	list := make([]uint16, 0, len(ids))
+	for _, id := range ids {
+		if id >= cntid {
+			list = append(list, id)
+		}
+	}
+	return protocol.MarshalControllerList(list), nil
+}
+
+// namespaceManagement creates and deletes namespaces (Namespace Management, opcode 0Dh)
+func (c *Controller) namespaceManagement(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+	ts, ok := c.Subsystem.(*TargetSubsystem)
+	if !ok || !ts.NamespaceManagement() {
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
+		return
+	}
+
+	sel := capsule.D10 & protocol.NamespaceSelectMask
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    SEL:%d NSID:%d", sel, capsule.NSID)
+
+	switch sel {
+	case protocol.NamespaceManagementCreate:
+		data, ok := adminData(r, 4096)
+		if !ok || capsule.NSID != 0 {
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return
+		}
+
+		id := protocol.IdentifyNamespaceData{}
+		if serialize.NewDeserializer(data).Deserialize(&id) != nil || id.NSZE == 0 || id.NCAP > id.NSZE {
+			w.SetStatus(protocol.SCInvalidFieldInCommand)
+			return
+		}
+		format := int(id.FLBAS & protocol.FLBASFormatMask)
+		if format >= len(LBAFormats) {
+			w.SetStatus(protocol.SCInvalidFormat)
+			return
+		}
+
+		ns, err := ts.CreateNamespace(id.NSZE, LBAFormats[format])
+		if err != nil {
+			c.Log.Trace(tracer.TraceCapsuleDetail, "    create failed: %s", err.Error())
+			w.SetStatus(namespaceStatus(err))
+			return
+		}
+		c.Log.Trace(tracer.TraceCapsuleDetail, "    created NSID:%d blocks:%d size:%d", ns.ID, id.NSZE, ns.LBASize())
+		binary.LittleEndian.PutUint32(w.Response.FabricResponse[0:], ns.ID)
+
+	case protocol.NamespaceManagementDelete:
+		nsids := []uint32{capsule.NSID}
+		if capsule.NSID == protocol.NSIDBroadcast {
+			nsids = nsids[:0]
+			for _, ns := range ts.Namespaces() {
+				nsids = append(nsids, ns.ID)
+			}
+		}
+
+		live := c.subsystemControllers()
+		for _, nsid := range nsids {
+			attached := ts.AttachedControllers(nsid, live)
+			err := ts.DeleteNamespace(nsid)
+			if !errors.Is(err, ErrInvalidNamespace) {
+				// the namespace was removed even when releasing its storage failed
+				c.notifyNamespaceChanged(nsid, attached)
+			}
+			if err != nil {
+				w.SetStatus(namespaceStatus(err))
+				return
+			}
+		}
+
+	default:
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+	}
+}
+
+// namespaceAttachment attaches and detaches namespaces to controllers (Namespace Attachment, opcode 15h)
+func (c *Controller) namespaceAttachment(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+	ts, ok := c.Subsystem.(*TargetSubsystem)
+	if !ok || !ts.NamespaceManagement() {
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
+		return
+	}
+
+	sel := capsule.D10 & protocol.NamespaceSelectMask
+	data, ok := adminData(r, protocol.ControllerListSize)
+	if !ok || (sel != protocol.NamespaceAttachmentAttach && sel != protocol.NamespaceAttachmentDetach) {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	if ts.Namespace(capsule.NSID) == nil {
+		w.SetStatus(protocol.SCInvalidNamespace)
+		return
+	}
+
+	// every controller in the list has to exist and be listed once
+	ids := protocol.UnmarshalControllerList(data)
+	live := c.subsystemControllers()
+	seen := make(map[uint16]bool)
+	for _, id := range ids {
+		found := false
+		for _, l := range live {
+			found = found || l == id
+		}
+		if !found || seen[id] {
+			w.SetStatus(protocol.SCControllerListInvalid)
+			return
+		}
+		seen[id] = true
+	}
+	if len(ids) == 0 {
+		w.SetStatus(protocol.SCControllerListInvalid)
+		return
+	}
+
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    SEL:%d NSID:%d Controllers:%v", sel, capsule.NSID, ids)
+
+	var err error
+	if sel == protocol.NamespaceAttachmentAttach {
+		err = ts.AttachNamespace(capsule.NSID, ids)
+	} else {
+		err = ts.DetachNamespace(capsule.NSID, ids, live)
+	}
+	if err != nil {
+		w.SetStatus(namespaceStatus(err))
+		return
+	}
+	c.notifyNamespaceChanged(capsule.NSID, ids)
+}
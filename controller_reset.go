@@ -0,0 +1,174 @@
+package nvme
+
+import (
+	"time"
+
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// shutdownTimeout bounds how long a shutdown waits for outstanding commands (CAP.TO is 15 * 500ms)
+const shutdownTimeout = 7500 * time.Millisecond
+
+// controllerStatus returns CSTS
+func (c *Controller) controllerStatus() uint32 {
+	c.regLock.Lock()
+	defer c.regLock.Unlock()
+	return c.REGCtrlStatus
+}
+
+// controllerConfig returns CC
+func (c *Controller) controllerConfig() uint32 {
+	c.regLock.Lock()
+	defer c.regLock.Unlock()
+	return c.REGCtrlConfig
+}
+
+// updateControllerStatus clears then sets bits in CSTS
+func (c *Controller) updateControllerStatus(set, clear uint32) {
+	c.regLock.Lock()
+	defer c.regLock.Unlock()
+	c.REGCtrlStatus = c.REGCtrlStatus&^clear | set
+}
+
+// setControllerConfiguration handles a host write to CC
+//
+//	EN 1->0 resets the controller, EN 0->1 makes it ready again and a new SHN starts a shutdown
+func (c *Controller) setControllerConfiguration(cc uint32) {
+	c.regLock.Lock()
+	old := c.REGCtrlConfig
+	c.REGCtrlConfig = cc
+	c.regLock.Unlock()
+
+	switch {
+	case old&protocol.CCEnable != 0 && cc&protocol.CCEnable == 0:
+		c.Log.Trace(tracer.TraceController, "Controller %d reset", c.ControllerID)
+		c.resetController(c)
+		return
+
+	case old&protocol.CCEnable == 0 && cc&protocol.CCEnable != 0:
+		c.updateControllerStatus(protocol.CSTSReady, 0)
+	}
+
+	if cc&protocol.CCShutdownMask != 0 && old&protocol.CCShutdownMask == 0 {
+		c.shutdown(cc&protocol.CCShutdownMask == protocol.CCShutdownAbrupt)
+	}
+}
+
+// resetController returns the controller to its initial state, caller is the queue whose command
+// asked for the reset
+//
+//	Outstanding I/O is aborted and the I/O queues are dropped, the host has to connect them again once
+//	the controller is enabled. Commands that can't be aborted complete before CSTS.RDY clears. The admin
+//	queue stays connected.
+func (c *Controller) resetController(caller *Controller) {
+	state := c.State
+	queues := make([]*Controller, 0)
+	for _, q := range state.Queues() {
+		if q.QueueID == 0 {
+			continue
+		}
+		state.detach(q)
+		q.cancelAll()
+		queues = append(queues, q)
+	}
+
+	// the host gets the completions of what was running before the queues go away
+	deadline := time.Now().Add(shutdownTimeout)
+	for _, q := range queues {
+		if q != caller && !q.waitIdle(deadline) {
+			c.Log.Trace(tracer.TraceController, "Controller %d reset, queue %d did not drain", c.ControllerID, q.QueueID)
+		}
+	}
+
+	for _, q := range queues {
+		// Close waits for the queue to stop, which the caller can only do once its command returned
+		if q == caller {
+			go q.Close()
+			continue
+		}
+		q.Close()
+	}
+
+	state.abortAsyncEvents()
+	state.reset()
+
+	c.regLock.Lock()
+	c.REGCtrlConfig = 0
+	c.REGCtrlStatus &= protocol.CSTSSubsystemReset
+	c.regLock.Unlock()
+}
+
+// shutdown waits for the I/O queues to go idle and flushes the target before reporting SHST complete
+//
+//	An abrupt shutdown aborts outstanding I/O instead of waiting for it
+func (c *Controller) shutdown(abrupt bool) {
+	c.Log.Trace(tracer.TraceController, "Controller %d shutdown (abrupt:%v)", c.ControllerID, abrupt)
+	c.updateControllerStatus(protocol.CSTSShutdownProcessing, protocol.CSTSShutdownMask)
+
+	go func() {
+		deadline := time.Now().Add(shutdownTimeout)
+		for _, q := range c.State.Queues() {
+			if q.QueueID == 0 {
+				continue
+			}
+			if abrupt {
+				q.cancelAll()
+			}
+			q.waitIdle(deadline)
+		}
+
+		if ts, ok := c.Subsystem.(*TargetSubsystem); ok {
+			if status := ts.Flush(); status != targets.TargetErrorNone {
+				c.Log.Trace(tracer.TraceController, "Controller %d shutdown flush failed: %d", c.ControllerID, status)
+			}
+		}
+		c.updateControllerStatus(protocol.CSTSShutdownComplete, protocol.CSTSShutdownMask)
+	}()
+}
+
+// subsystemReset implements NSSR, every controller of the subsystem is reset and reports CSTS.NSSRO
+func (c *Controller) subsystemReset() {
+	c.Log.Trace(tracer.TraceController, "Subsystem reset of %s", c.Subsystem.GetNQN())
+
+	for _, state := range c.Server.Controllers(c.Subsystem.GetNQN()).List() {
+		admin := state.Queue(0)
+		if admin == nil {
+			continue
+		}
+		admin.resetController(c)
+		admin.updateControllerStatus(protocol.CSTSSubsystemReset, 0)
+	}
+
+	if ts, ok := c.Subsystem.(*TargetSubsystem); ok {
+		ts.Flush()
+	}
+}
+
+// cancelAll aborts the outstanding commands of the queue that did not start yet or that their target
+// can interrupt, the others complete
+func (c *Controller) cancelAll() {
+	c.inflightLock.Lock()
+	defer c.inflightLock.Unlock()
+	for _, r := range c.inflight {
+		r.ior.Cancel()
+	}
+}
+
+// waitIdle waits until the queue has no outstanding commands or the deadline passed
+func (c *Controller) waitIdle(deadline time.Time) bool {
+	for {
+		c.inflightLock.Lock()
+		idle := len(c.inflight) == 0
+		c.inflightLock.Unlock()
+
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,53 @@
+package nvme
+
+import (
+	"errors"
+
+	"github.com/thirdmartini/go-nvme/pkg/tracer"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+// sanitizeStatus maps the errors of Sanitize and Format NVM to an NVMe status
+func sanitizeStatus(err error) protocol.NVMEStatusCode {
+	switch {
+	case err == nil:
+		return protocol.SCSuccess
+	case errors.Is(err, ErrSanitizeInProgress):
+		return protocol.SCSanitizeInProgress
+	case errors.Is(err, ErrSanitizeFailed):
+		return protocol.SCSanitizeFailed
+	case errors.Is(err, ErrFormatInProgress):
+		return protocol.SCFormatInProgress
+	case errors.Is(err, ErrInvalidSanitize):
+		return protocol.SCInvalidFieldInCommand
+	default:
+		return protocol.SCInternalError
+	}
+}
+
+// sanitize starts a sanitize of all namespaces of the subsystem (Sanitize, opcode 84h)
+//
+//	The command completes once the sanitize started, the host follows it in the Sanitize Status log and
+//	every controller of the subsystem gets a Sanitize Operation Completed event when it is done
+func (c *Controller) sanitize(w *NVMEResponse, r *NVMERequest) {
+	capsule := r.Capsule()
+	ts, ok := c.Subsystem.(*TargetSubsystem)
+	if !ok {
+		w.SetStatus(protocol.SCInvalidCommandOpcode)
+		return
+	}
+	c.Log.Trace(tracer.TraceCapsuleDetail, "    SANACT:%d CDW10:0x%x OVRPAT:0x%x", capsule.D10&protocol.SanitizeActionMask, capsule.D10, capsule.D11)
+
+	// we have no media that would need No-Deallocate After Sanitize
+	if capsule.D10&protocol.SanitizeNDAS != 0 {
+		w.SetStatus(protocol.SCInvalidFieldInCommand)
+		return
+	}
+
+	nqn := c.Subsystem.GetNQN()
+	server := c.Server
+	err := ts.Sanitize(capsule.D10, capsule.D11, func() {
+		server.NotifyAsyncEvent(nqn, protocol.SanitizeCompletedEvent)
+	})
+	w.SetStatus(sanitizeStatus(err))
+}
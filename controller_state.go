@@ -0,0 +1,234 @@
+package nvme
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+const (
+	// MinControllerID/MaxControllerID bound the dynamic controller IDs we hand out,
+	// 0xFFF0-0xFFFF are reserved by the spec
+	MinControllerID = 0x1
+	MaxControllerID = 0xFFEF
+
+	// MaxIOQueues is the number of I/O queues a controller supports (reported 0 based in Number of Queues)
+	MaxIOQueues = 64
+)
+
+var (
+	ErrNoControllerID = errors.New("no controller IDs available")
+	ErrQueueInUse     = errors.New("queue already connected")
+	ErrControllerGone = errors.New("controller is shutting down")
+)
+
+// ControllerState is the state of a logical NVMe controller
+//
+//	Every queue is its own connection (Controller), the admin queue creates the state
+//	and the I/O queues attach to it by connecting with its controller ID. Features set through
+//	the admin queue apply to all queues of the controller.
+type ControllerState struct {
+	ID        uint16
+	HostNQN   string
+	HostID    [16]byte
+	Subsystem Subsystem
+
+	registry *ControllerRegistry
+	lock     sync.Mutex
+	queues   map[uint16]*Controller
+	closed   bool
+
+	// Asynchronous Event Configuration (Feature 0Bh)
+	AEC uint32
+
+	// Number of Queues (Feature 07h), both are 0 based
+	NCQR uint16
+	NSQR uint16
+
+	// KATO is the keep alive timeout (ms) from the admin Connect or Keep Alive Timer (Feature 0Fh),
+	// the controller is torn down when no Keep Alive arrives within it
+	KATO          uint32
+	LastKeepAlive time.Time
+	keepAlive     *time.Timer
+	expired       func()
+
+	// outstanding AERs, events waiting for an AER and log pages whose events are masked
+	// until the host reads them, see controller_aer.go
+	aers              []*NVMERequest
+	events            []protocol.AsyncEvent
+	masked            map[uint8]bool
+	changedNamespaces []uint32
+}
+
+// Queue returns the queue connected as qid, nil if there is none
+func (s *ControllerState) Queue(qid uint16) *Controller {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queues[qid]
+}
+
+// Queues returns all queues connected to the controller
+func (s *ControllerState) Queues() []*Controller {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queues := make([]*Controller, 0, len(s.queues))
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].QueueID < queues[j].QueueID
+	})
+	return queues
+}
+
+func (s *ControllerState) attach(c *Controller) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrControllerGone
+	}
+	if _, ok := s.queues[c.QueueID]; ok {
+		return ErrQueueInUse
+	}
+	s.queues[c.QueueID] = c
+	return nil
+}
+
+func (s *ControllerState) detach(c *Controller) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queues[c.QueueID] == c {
+		delete(s.queues, c.QueueID)
+	}
+}
+
+// reset returns the features to their defaults after a controller reset
+func (s *ControllerState) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.AEC = 0
+	s.NCQR = MaxIOQueues - 1
+	s.NSQR = MaxIOQueues - 1
+	s.events = nil
+	s.masked = make(map[uint8]bool)
+	s.changedNamespaces = nil
+}
+
+// SetNumberOfQueues sets the I/O queues allocated to the host (Feature 07h), both counts are 0 based
+func (s *ControllerState) SetNumberOfQueues(ncqr, nsqr uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.NCQR = ncqr
+	s.NSQR = nsqr
+}
+
+// NumberOfQueues returns the 0 based counts of I/O completion and submission queues allocated to the host
+func (s *ControllerState) NumberOfQueues() (ncqr, nsqr uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.NCQR, s.NSQR
+}
+
+// release frees the controller ID and returns the queues still connected, no queue can attach afterwards
+func (s *ControllerState) release() []*Controller {
+	s.lock.Lock()
+	s.closed = true
+	s.stopKeepAlive()
+	s.lock.Unlock()
+
+	s.registry.Release(s.ID)
+	return s.Queues()
+}
+
+// ControllerRegistry allocates controller IDs for a subsystem and tracks the live controllers
+type ControllerRegistry struct {
+	lock        sync.Mutex
+	next        uint16
+	controllers map[uint16]*ControllerState
+}
+
+func NewControllerRegistry() *ControllerRegistry {
+	return &ControllerRegistry{
+		next:        MinControllerID,
+		controllers: make(map[uint16]*ControllerState),
+	}
+}
+
+// Allocate creates a controller for the host with the next free controller ID
+//
+//	IDs are handed out round robin so a host reconnecting does not immediately reuse the ID of a
+//	controller it just lost
+func (r *ControllerRegistry) Allocate(subsys Subsystem, hostNQN string, hostID [16]byte) (*ControllerState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := 0; i <= MaxControllerID-MinControllerID; i++ {
+		id := r.next
+		r.next++
+		if r.next > MaxControllerID {
+			r.next = MinControllerID
+		}
+
+		if _, ok := r.controllers[id]; ok {
+			continue
+		}
+
+		state := &ControllerState{
+			ID:        id,
+			HostNQN:   hostNQN,
+			HostID:    hostID,
+			Subsystem: subsys,
+			registry:  r,
+			queues:    make(map[uint16]*Controller),
+			masked:    make(map[uint8]bool),
+			NCQR:      MaxIOQueues - 1,
+			NSQR:      MaxIOQueues - 1,
+		}
+		r.controllers[id] = state
+		if ts, ok := subsys.(*TargetSubsystem); ok {
+			ts.registerController(id, hostNQN)
+		}
+		return state, nil
+	}
+	return nil, ErrNoControllerID
+}
+
+// Lookup returns the controller with the given ID, nil if it does not exist
+func (r *ControllerRegistry) Lookup(id uint16) *ControllerState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.controllers[id]
+}
+
+// Release frees the controller ID, the namespace attachments of its host are kept
+func (r *ControllerRegistry) Release(id uint16) {
+	r.lock.Lock()
+	state := r.controllers[id]
+	delete(r.controllers, id)
+	r.lock.Unlock()
+
+	if state == nil {
+		return
+	}
+	if ts, ok := state.Subsystem.(*TargetSubsystem); ok {
+		ts.releaseController(id)
+	}
+}
+
+// List returns the live controllers ordered by ID
+func (r *ControllerRegistry) List() []*ControllerState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]*ControllerState, 0, len(r.controllers))
+	for _, state := range r.controllers {
+		list = append(list, state)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -4,6 +4,8 @@ type Buffer []byte
 
 type Buffers struct {
 	c chan Buffer
+	// size is set for pools that allocate their buffers on demand, see NewOnDemand
+	size int
 }
 
 func New(count int, size int) *Buffers {
@@ -19,10 +21,56 @@ func New(count int, size int) *Buffers {
 	return b
 }
 
+// NewOnDemand returns a pool that keeps up to count buffers of size, buffers are only allocated when the
+// pool is empty and Get never blocks
+func NewOnDemand(count int, size int) *Buffers {
+	return &Buffers{
+		c:    make(chan Buffer, count),
+		size: size,
+	}
+}
+
 func (b *Buffers) Put(buf Buffer) {
-	b.c <- buf
+	if b.size == 0 {
+		b.c <- buf
+		return
+	}
+
+	// a full on demand pool lets the buffer go
+	select {
+	case b.c <- buf:
+	default:
+	}
 }
 
 func (b *Buffers) Get() Buffer {
-	return <-b.c
+	if b.size == 0 {
+		return <-b.c
+	}
+
+	select {
+	case buf := <-b.c:
+		return buf
+	default:
+		return make(Buffer, b.size, b.size)
+	}
+}
+
+// Release lets go of the buffers an on demand pool keeps, it allocates new ones if it is used again
+func (b *Buffers) Release() {
+	if b.size == 0 {
+		return
+	}
+	for {
+		select {
+		case <-b.c:
+		default:
+			return
+		}
+	}
+}
+
+// Size returns the size of the buffers of an on demand pool
+func (b *Buffers) Size() int {
+	return b.size
 }
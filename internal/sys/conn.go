@@ -9,8 +9,11 @@ type Conn struct {
 	net.Conn
 }
 
-func (c *Conn) Writev(_ [][]byte) error {
-	return errors.New("not implemented")
+// Writev writes all buffers in order, on TCP connections this is a single writev(2)
+func (c *Conn) Writev(bufs [][]byte) error {
+	v := net.Buffers(bufs)
+	_, err := v.WriteTo(c.Conn)
+	return err
 }
 
 func (c *Conn) Readv(_ [][]byte) error {
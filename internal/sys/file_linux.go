@@ -0,0 +1,22 @@
+package sys
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+// Fdatasync writes back the data of f (and only the metadata needed to read it back)
+func Fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// PunchHole deallocates length bytes of f at offset without changing its size, the range reads back
+// as zeros
+func PunchHole(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sys
+
+import (
+	"errors"
+	"os"
+)
+
+// Fdatasync writes back the data of f, without fdatasync(2) this is a full fsync
+func Fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// PunchHole is not supported, callers have to write zeros instead
+func PunchHole(_ *os.File, _, _ int64) error {
+	return errors.New("not implemented")
+}
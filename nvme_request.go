@@ -20,14 +20,21 @@ type NVMERequest struct {
 	// The Queue ID that this request belongs to
 	qid uint16
 
+	// tag is the index of this request in the controller queue, used as the R2T transfer tag
+	tag uint16
+
 	// flag indicating if this request is active
 	// fixme: we should not need this in the new processing model
 	active bool
 
-	// State tracking for any R2T requests that need to be made (Fixme this does not work right now)
-	State     uint32
-	R2TOffset uint32
-	R2TLength uint32
+	// State tracking for any R2T requests that need to be made
+	//  R2TOffset is the offset of the next byte we will request from the host
+	//  R2TLength is the total length of the data transfer
+	//  R2TReceived is the number of bytes received so far (including in capsule data)
+	State       uint32
+	R2TOffset   uint32
+	R2TLength   uint32
+	R2TReceived uint32
 }
 
 // Capsule returns the unmarshaled capsule
@@ -80,8 +87,28 @@ func (r *NVMERequest) Complete(status targets.TargetError) {
 	case targets.TargetErrorUnsupported:
 		r.SetStatus(protocol.SCInvalidCommandOpcode)
 
+	case targets.TargetErrorAborted:
+		r.SetStatus(protocol.SCAbortedRequest)
+
+	case targets.TargetErrorInvalidNamespace:
+		r.SetStatus(protocol.SCInvalidNamespace)
+
+	case targets.TargetErrorFormatInProgress:
+		r.SetStatus(protocol.SCFormatInProgress)
+
+	case targets.TargetErrorSanitizeInProgress:
+		r.SetStatus(protocol.SCSanitizeInProgress)
+
+	case targets.TargetErrorSanitizeFailed:
+		r.SetStatus(protocol.SCSanitizeFailed)
+
 	default:
 		r.SetStatus(protocol.SCInternalError)
 	}
+
+	// no data goes back for a failed command
+	if status != targets.TargetErrorNone {
+		r.response.sglc = 0
+	}
 	r.completion <- r
 }
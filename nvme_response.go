@@ -12,8 +12,10 @@ type DataSGLE struct {
 type SGL []DataSGLE
 
 const (
-	MaxSGL           = 16
-	RequestNeedsData = 0x1
+	MaxSGL                 = 16
+	RequestNeedsData       = 0x1
+	RequestDataDigestError = 0x2
+	RequestDeferred        = 0x4 // completed later by whoever holds the request (AERs)
 )
 
 type NVMEResponse struct {
@@ -25,6 +27,7 @@ type NVMEResponse struct {
 
 	Response protocol.CapsuleResponse
 	C2H      protocol.C2HDataTransfer
+	R2T      protocol.R2TRequest
 
 	State      uint32 // state flags on the request
 	DataLength uint32 // how much data is needed to be received
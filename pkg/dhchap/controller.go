@@ -0,0 +1,277 @@
+package dhchap
+
+import (
+	"crypto/hmac"
+	"errors"
+	"math/big"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+var ErrSequence = errors.New("authentication message out of sequence")
+
+const (
+	controllerNegotiate = iota
+	controllerChallenge
+	controllerReply
+	controllerSuccess1
+	controllerSuccess2
+	controllerFailure1
+	controllerDone
+	controllerFailed
+)
+
+// Controller is the controller side of a DH-HMAC-CHAP transaction
+//
+//	Messages from Authentication Send are passed to Send, Receive returns the payload for
+//	Authentication Receive. A failed exchange is reported to the host with AUTH_Failure1.
+type Controller struct {
+	hostNQN string
+	subNQN  string
+
+	hostKey *Secret
+	ctrlKey *Secret
+
+	state       int
+	explanation uint8
+
+	tid       uint16
+	hashID    uint8
+	dhGroupID uint8
+	group     *group
+	x         *big.Int
+	public    []byte
+
+	challenge []byte
+	seq       uint32
+
+	// set when the host asked us to authenticate ourselves
+	hostChallenge []byte
+	hostSeq       uint32
+	shared        []byte
+}
+
+// NewController starts a transaction for hostNQN, ctrlKey is only needed for bidirectional authentication
+func NewController(hostNQN, subNQN string, hostKey, ctrlKey *Secret) *Controller {
+	return &Controller{
+		hostNQN: hostNQN,
+		subNQN:  subNQN,
+		hostKey: hostKey,
+		ctrlKey: ctrlKey,
+	}
+}
+
+// Authenticated returns true once the transaction completed successfully
+func (c *Controller) Authenticated() bool {
+	return c.state == controllerDone
+}
+
+// Failed returns true if the transaction was aborted by either side
+func (c *Controller) Failed() bool {
+	return c.state == controllerFailed
+}
+
+func (c *Controller) fail(explanation uint8) {
+	c.state = controllerFailure1
+	c.explanation = explanation
+}
+
+// Send processes a message the host sent with Authentication Send
+//
+//	Protocol failures are not returned as errors, they are reported by the next Receive
+func (c *Controller) Send(data []byte) error {
+	typ, id, err := protocol.AuthMessageType(data)
+	if err != nil {
+		return err
+	}
+
+	if typ == protocol.AuthTypeCommon && id == protocol.AuthIDFailure2 {
+		c.state = controllerFailed
+		return nil
+	}
+
+	switch c.state {
+	case controllerNegotiate, controllerDone, controllerFailed:
+		// the host may start a new transaction at any time (re-authentication)
+		if typ != protocol.AuthTypeCommon || id != protocol.AuthIDNegotiate {
+			return ErrSequence
+		}
+		c.negotiate(data)
+
+	case controllerReply:
+		if typ != protocol.AuthTypeDHChap || id != protocol.AuthIDReply {
+			c.fail(protocol.AuthFailureIncorrectMessage)
+			return nil
+		}
+		c.reply(data)
+
+	case controllerSuccess2:
+		success2 := protocol.AuthSuccess2{}
+		if success2.Unmarshal(data) != nil || success2.TID != c.tid {
+			c.fail(protocol.AuthFailureIncorrectMessage)
+			return nil
+		}
+		c.state = controllerDone
+
+	default:
+		return ErrSequence
+	}
+	return nil
+}
+
+// Receive returns the message the host retrieves with Authentication Receive
+func (c *Controller) Receive() ([]byte, error) {
+	switch c.state {
+	case controllerChallenge:
+		challenge := protocol.AuthChallenge{
+			TID:       c.tid,
+			HashID:    c.hashID,
+			DHGroupID: c.dhGroupID,
+			SeqNum:    c.seq,
+			Challenge: c.challenge,
+			DHValue:   c.public,
+		}
+		c.state = controllerReply
+		return challenge.Marshal(), nil
+
+	case controllerSuccess1:
+		success1 := protocol.AuthSuccess1{
+			TID: c.tid,
+			HL:  uint8(hashLength(c.hashID)),
+		}
+
+		if c.hostChallenge == nil {
+			c.state = controllerDone
+			return success1.Marshal(), nil
+		}
+
+		key, err := c.ctrlKey.transform(c.subNQN)
+		if err != nil {
+			return nil, err
+		}
+		success1.RValid = true
+		success1.Response = response(c.hashID, key, augment(c.hashID, c.shared, c.hostChallenge),
+			c.hostSeq, c.tid, 0, "Controller", c.subNQN, c.hostNQN)
+		c.state = controllerSuccess2
+		return success1.Marshal(), nil
+
+	case controllerFailure1:
+		failure := protocol.AuthFailure{
+			ID:          protocol.AuthIDFailure1,
+			TID:         c.tid,
+			Explanation: c.explanation,
+		}
+		c.state = controllerFailed
+		return failure.Marshal(), nil
+	}
+	return nil, ErrSequence
+}
+
+func (c *Controller) negotiate(data []byte) {
+	neg := protocol.AuthNegotiate{}
+	err := neg.Unmarshal(data)
+
+	*c = Controller{
+		hostNQN: c.hostNQN,
+		subNQN:  c.subNQN,
+		hostKey: c.hostKey,
+		ctrlKey: c.ctrlKey,
+		tid:     neg.TID,
+	}
+
+	if err != nil {
+		c.fail(protocol.AuthFailureIncorrectPayload)
+		return
+	}
+
+	if neg.SCC != 0 {
+		c.fail(protocol.AuthFailureConcatMismatch)
+		return
+	}
+
+	if c.hostKey == nil {
+		c.fail(protocol.AuthFailureFailed)
+		return
+	}
+
+	c.hashID = 0
+	for _, id := range neg.HashIDs {
+		if contains(Hashes, id) {
+			c.hashID = id
+			break
+		}
+	}
+	if c.hashID == 0 {
+		c.fail(protocol.AuthFailureHashUnusable)
+		return
+	}
+
+	found := false
+	for _, id := range neg.DHGroupIDs {
+		if contains(DHGroups, id) {
+			c.dhGroupID = id
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.fail(protocol.AuthFailureDHGroupUnusable)
+		return
+	}
+
+	c.group, _ = dhGroup(c.dhGroupID)
+	if c.group != nil {
+		c.x, c.public, err = c.group.generate()
+		if err != nil {
+			c.fail(protocol.AuthFailureFailed)
+			return
+		}
+	}
+
+	c.challenge = randomBytes(hashLength(c.hashID))
+	c.seq = sequenceNumber()
+	c.state = controllerChallenge
+}
+
+func (c *Controller) reply(data []byte) {
+	reply := protocol.AuthReply{}
+	if reply.Unmarshal(data) != nil || reply.TID != c.tid || len(reply.Response) != hashLength(c.hashID) {
+		c.fail(protocol.AuthFailureIncorrectPayload)
+		return
+	}
+
+	if c.group != nil {
+		shared, err := c.group.shared(c.x, reply.DHValue)
+		if err != nil {
+			c.fail(protocol.AuthFailureIncorrectPayload)
+			return
+		}
+		c.shared = shared
+	} else if len(reply.DHValue) != 0 {
+		c.fail(protocol.AuthFailureIncorrectPayload)
+		return
+	}
+
+	key, err := c.hostKey.transform(c.hostNQN)
+	if err != nil {
+		c.fail(protocol.AuthFailureFailed)
+		return
+	}
+
+	expected := response(c.hashID, key, augment(c.hashID, c.shared, c.challenge),
+		c.seq, c.tid, 0, "HostHost", c.hostNQN, c.subNQN)
+	if !hmac.Equal(expected, reply.Response) {
+		c.fail(protocol.AuthFailureFailed)
+		return
+	}
+
+	if reply.CValid {
+		if c.ctrlKey == nil || reply.SeqNum == 0 {
+			c.fail(protocol.AuthFailureFailed)
+			return
+		}
+		c.hostChallenge = reply.Challenge
+		c.hostSeq = reply.SeqNum
+	}
+	c.state = controllerSuccess1
+}
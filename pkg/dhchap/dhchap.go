@@ -0,0 +1,273 @@
+// Package dhchap implements NVMe in-band authentication using DH-HMAC-CHAP
+//
+//	The Host and Controller types drive the two sides of an authentication transaction and only
+//	deal in message payloads, the caller moves them through Authentication Send/Receive commands.
+package dhchap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math/big"
+	"strings"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+const (
+	// SecretPrefix is the prefix of a DH-HMAC-CHAP secret in its textual representation
+	SecretPrefix = "DHHC-1"
+)
+
+var (
+	ErrInvalidSecret   = errors.New("invalid dh-hmac-chap secret")
+	ErrInvalidDHValue  = errors.New("invalid diffie-hellman value")
+	ErrUnsupportedHash = errors.New("unsupported hash function")
+	ErrUnsupportedDH   = errors.New("unsupported diffie-hellman group")
+)
+
+// Hashes we support in order of preference
+var Hashes = []uint8{
+	protocol.AuthHashSHA256,
+	protocol.AuthHashSHA384,
+	protocol.AuthHashSHA512,
+}
+
+// DHGroups we support in order of preference
+var DHGroups = []uint8{
+	protocol.AuthDHGroupFFDHE2048,
+	protocol.AuthDHGroupFFDHE3072,
+	protocol.AuthDHGroupFFDHE4096,
+	protocol.AuthDHGroupFFDHE6144,
+	protocol.AuthDHGroupFFDHE8192,
+	protocol.AuthDHGroupNull,
+}
+
+func hashFunc(id uint8) (func() hash.Hash, error) {
+	switch id {
+	case protocol.AuthHashSHA256:
+		return sha256.New, nil
+	case protocol.AuthHashSHA384:
+		return sha512.New384, nil
+	case protocol.AuthHashSHA512:
+		return sha512.New, nil
+	}
+	return nil, ErrUnsupportedHash
+}
+
+// hashLength returns the digest size of the hash, also the length of challenges and responses
+func hashLength(id uint8) int {
+	h, err := hashFunc(id)
+	if err != nil {
+		return 0
+	}
+	return h().Size()
+}
+
+// Secret is a DH-HMAC-CHAP secret as configured for a host or controller
+type Secret struct {
+	Key []byte
+	// HashID selects the hash used to transform the key (0 for no transform)
+	HashID uint8
+}
+
+// ParseSecret decodes a secret in the form DHHC-1:<hash>:<base64 key+crc32>:
+func ParseSecret(s string) (*Secret, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 || parts[0] != SecretPrefix || parts[3] != "" {
+		return nil, ErrInvalidSecret
+	}
+
+	secret := &Secret{}
+	switch parts[1] {
+	case "00":
+		secret.HashID = 0
+	case "01":
+		secret.HashID = protocol.AuthHashSHA256
+	case "02":
+		secret.HashID = protocol.AuthHashSHA384
+	case "03":
+		secret.HashID = protocol.AuthHashSHA512
+	default:
+		return nil, ErrInvalidSecret
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSecret
+	}
+
+	switch len(raw) - 4 {
+	case 32, 48, 64:
+	default:
+		return nil, ErrInvalidSecret
+	}
+
+	secret.Key = raw[:len(raw)-4]
+	if crc32.ChecksumIEEE(secret.Key) != binary.LittleEndian.Uint32(raw[len(raw)-4:]) {
+		return nil, ErrInvalidSecret
+	}
+	return secret, nil
+}
+
+// NewSecret generates a random 32 byte secret that is transformed with SHA-256
+func NewSecret() (*Secret, error) {
+	secret := &Secret{
+		Key:    make([]byte, 32),
+		HashID: protocol.AuthHashSHA256,
+	}
+	_, err := rand.Read(secret.Key)
+	return secret, err
+}
+
+// String encodes the secret in its textual representation
+func (s *Secret) String() string {
+	raw := make([]byte, len(s.Key)+4)
+	copy(raw, s.Key)
+	binary.LittleEndian.PutUint32(raw[len(s.Key):], crc32.ChecksumIEEE(s.Key))
+	return fmt.Sprintf("%s:%02x:%s:", SecretPrefix, s.HashID, base64.StdEncoding.EncodeToString(raw))
+}
+
+// transform derives the key used for responses from the secret and the NQN of its owner
+func (s *Secret) transform(nqn string) ([]byte, error) {
+	if s.HashID == 0 {
+		return s.Key, nil
+	}
+
+	h, err := hashFunc(s.HashID)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(h, s.Key)
+	mac.Write([]byte(nqn))
+	mac.Write([]byte("NVMe-over-Fabrics"))
+	return mac.Sum(nil), nil
+}
+
+// group is a finite field Diffie-Hellman group
+type group struct {
+	p    *big.Int
+	size int
+}
+
+var two = big.NewInt(2)
+
+func dhGroup(id uint8) (*group, error) {
+	var prime string
+	switch id {
+	case protocol.AuthDHGroupNull:
+		return nil, nil
+	case protocol.AuthDHGroupFFDHE2048:
+		prime = ffdhe2048Prime
+	case protocol.AuthDHGroupFFDHE3072:
+		prime = ffdhe3072Prime
+	case protocol.AuthDHGroupFFDHE4096:
+		prime = ffdhe4096Prime
+	case protocol.AuthDHGroupFFDHE6144:
+		prime = ffdhe6144Prime
+	case protocol.AuthDHGroupFFDHE8192:
+		prime = ffdhe8192Prime
+	default:
+		return nil, ErrUnsupportedDH
+	}
+
+	p, _ := new(big.Int).SetString(prime, 16)
+	return &group{p: p, size: len(prime) / 2}, nil
+}
+
+// generate returns a private exponent and the public value g^x mod p
+func (g *group) generate() (*big.Int, []byte, error) {
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(g.p, two))
+	if err != nil {
+		return nil, nil, err
+	}
+	x.Add(x, two)
+
+	public := new(big.Int).Exp(two, x, g.p)
+	return x, public.FillBytes(make([]byte, g.size)), nil
+}
+
+// shared computes the shared secret from our private exponent and the peer's public value
+func (g *group) shared(x *big.Int, peer []byte) ([]byte, error) {
+	if len(peer) != g.size {
+		return nil, ErrInvalidDHValue
+	}
+
+	y := new(big.Int).SetBytes(peer)
+	limit := new(big.Int).Sub(g.p, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(limit) >= 0 {
+		return nil, ErrInvalidDHValue
+	}
+
+	return new(big.Int).Exp(y, x, g.p).FillBytes(make([]byte, g.size)), nil
+}
+
+// augment mixes the DH shared secret into a challenge, with the NULL group the challenge is used as is
+func augment(hashID uint8, shared, challenge []byte) []byte {
+	if shared == nil {
+		return challenge
+	}
+
+	h, _ := hashFunc(hashID)
+	key := h()
+	key.Write(shared)
+
+	mac := hmac.New(h, key.Sum(nil))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// response computes the DH-HMAC-CHAP response for a challenge
+//
+//	role is "HostHost" for the host response and "Controller" for the controller response,
+//	nqn1 is the responder and nqn2 the peer.
+func response(hashID uint8, key, challenge []byte, seq uint32, tid uint16, scc uint8, role, nqn1, nqn2 string) []byte {
+	h, _ := hashFunc(hashID)
+	mac := hmac.New(h, key)
+
+	var buf [4]byte
+	mac.Write(challenge)
+	binary.LittleEndian.PutUint32(buf[:], seq)
+	mac.Write(buf[:4])
+	binary.LittleEndian.PutUint16(buf[:], tid)
+	mac.Write(buf[:2])
+	mac.Write([]byte{scc})
+	mac.Write([]byte(role))
+	mac.Write([]byte(nqn1))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nqn2))
+	return mac.Sum(nil)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// sequenceNumber returns a random non zero sequence number
+func sequenceNumber() uint32 {
+	for {
+		seq := binary.LittleEndian.Uint32(randomBytes(4))
+		if seq != 0 {
+			return seq
+		}
+	}
+}
+
+func contains(ids []uint8, id uint8) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package dhchap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+const (
+	testHostNQN = "nqn.2020-20.com.thirdmartini.nvme:initiator0"
+	testSubNQN  = "nqn.2020-20.com.thirdmartini.nvme:null"
+)
+
+func newTestSecret(t *testing.T) *Secret {
+	s, err := NewSecret()
+	require.Nil(t, err)
+	return s
+}
+
+// exchange runs a transaction between h and c, negotiate may replace the default AUTH_Negotiate
+func exchange(t *testing.T, h *Host, c *Controller, negotiate []byte) error {
+	if negotiate == nil {
+		negotiate = h.Negotiate(1)
+	}
+	require.Nil(t, c.Send(negotiate))
+
+	challenge, err := c.Receive()
+	require.Nil(t, err)
+
+	reply, err := h.Reply(challenge)
+	if err != nil {
+		return err
+	}
+	require.Nil(t, c.Send(reply))
+
+	success1, err := c.Receive()
+	require.Nil(t, err)
+
+	msg, err := h.Success(success1)
+	if msg != nil {
+		require.Nil(t, c.Send(msg))
+	}
+	return err
+}
+
+func TestSecret(t *testing.T) {
+	s := newTestSecret(t)
+
+	parsed, err := ParseSecret(s.String())
+	require.Nil(t, err)
+	require.Equal(t, s, parsed)
+
+	_, err = ParseSecret("DHHC-1:04:" + s.String()[10:])
+	require.Equal(t, ErrInvalidSecret, err)
+
+	raw := []byte(s.String())
+	raw[12] ^= 0x1
+	_, err = ParseSecret(string(raw))
+	require.Equal(t, ErrInvalidSecret, err)
+}
+
+func TestAuthenticate(t *testing.T) {
+	hostKey := newTestSecret(t)
+	ctrlKey := newTestSecret(t)
+
+	// unidirectional with the default (ffdhe2048) group
+	c := NewController(testHostNQN, testSubNQN, hostKey, nil)
+	require.Nil(t, exchange(t, NewHost(testHostNQN, testSubNQN, hostKey, nil), c, nil))
+	require.True(t, c.Authenticated())
+
+	// bidirectional
+	c = NewController(testHostNQN, testSubNQN, hostKey, ctrlKey)
+	require.Nil(t, exchange(t, NewHost(testHostNQN, testSubNQN, hostKey, ctrlKey), c, nil))
+	require.True(t, c.Authenticated())
+
+	// NULL DH group with SHA-512
+	neg := protocol.AuthNegotiate{
+		TID:        1,
+		HashIDs:    []uint8{protocol.AuthHashSHA512},
+		DHGroupIDs: []uint8{protocol.AuthDHGroupNull},
+	}
+	h := NewHost(testHostNQN, testSubNQN, hostKey, ctrlKey)
+	h.tid = 1
+	c = NewController(testHostNQN, testSubNQN, hostKey, ctrlKey)
+	require.Nil(t, exchange(t, h, c, neg.Marshal()))
+	require.True(t, c.Authenticated())
+}
+
+func TestAuthenticateFailure(t *testing.T) {
+	hostKey := newTestSecret(t)
+	ctrlKey := newTestSecret(t)
+
+	// host uses the wrong secret
+	c := NewController(testHostNQN, testSubNQN, hostKey, nil)
+	err := exchange(t, NewHost(testHostNQN, testSubNQN, newTestSecret(t), nil), c, nil)
+	require.Equal(t, &FailureError{Explanation: protocol.AuthFailureFailed}, err)
+	require.True(t, c.Failed())
+
+	// controller can not prove it knows the controller secret
+	c = NewController(testHostNQN, testSubNQN, hostKey, newTestSecret(t))
+	err = exchange(t, NewHost(testHostNQN, testSubNQN, hostKey, ctrlKey), c, nil)
+	require.Equal(t, ErrControllerResponse, err)
+	require.True(t, c.Failed())
+
+	// host responds as a different host
+	c = NewController("nqn.2020-20.com.thirdmartini.nvme:initiator1", testSubNQN, hostKey, nil)
+	err = exchange(t, NewHost(testHostNQN, testSubNQN, hostKey, nil), c, nil)
+	require.NotNil(t, err)
+	require.False(t, c.Authenticated())
+
+	// no hash in common
+	neg := protocol.AuthNegotiate{
+		TID:        1,
+		HashIDs:    []uint8{0x7},
+		DHGroupIDs: []uint8{protocol.AuthDHGroupNull},
+	}
+	c = NewController(testHostNQN, testSubNQN, hostKey, nil)
+	require.Nil(t, c.Send(neg.Marshal()))
+	msg, err := c.Receive()
+	require.Nil(t, err)
+	require.Equal(t, &FailureError{Explanation: protocol.AuthFailureHashUnusable}, checkFailure(msg))
+}
@@ -0,0 +1,165 @@
+package dhchap
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+var ErrControllerResponse = errors.New("controller failed to authenticate")
+
+// FailureError is returned when the controller aborted the transaction with AUTH_Failure1
+type FailureError struct {
+	Explanation uint8
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("authentication failed: explanation 0x%x", e.Explanation)
+}
+
+// Host is the host side of a DH-HMAC-CHAP transaction
+type Host struct {
+	hostNQN string
+	subNQN  string
+
+	hostKey *Secret
+	ctrlKey *Secret
+
+	tid      uint16
+	hashID   uint8
+	shared   []byte
+	seq      uint32
+	expected []byte
+}
+
+// NewHost creates a host authenticating to subNQN, when ctrlKey is set the controller must authenticate as well
+func NewHost(hostNQN, subNQN string, hostKey, ctrlKey *Secret) *Host {
+	return &Host{
+		hostNQN: hostNQN,
+		subNQN:  subNQN,
+		hostKey: hostKey,
+		ctrlKey: ctrlKey,
+	}
+}
+
+// Negotiate returns the AUTH_Negotiate message starting transaction tid
+func (h *Host) Negotiate(tid uint16) []byte {
+	h.tid = tid
+	neg := protocol.AuthNegotiate{
+		TID:        tid,
+		HashIDs:    Hashes,
+		DHGroupIDs: DHGroups,
+	}
+	return neg.Marshal()
+}
+
+// failure returns the AUTH_Failure2 message the host sends when it aborts a transaction
+func (h *Host) failure(explanation uint8) []byte {
+	failure := protocol.AuthFailure{
+		ID:          protocol.AuthIDFailure2,
+		TID:         h.tid,
+		Explanation: explanation,
+	}
+	return failure.Marshal()
+}
+
+// checkFailure converts an AUTH_Failure1 from the controller to an error
+func checkFailure(data []byte) error {
+	failure := protocol.AuthFailure{}
+	if failure.Unmarshal(data) == nil && failure.ID == protocol.AuthIDFailure1 {
+		return &FailureError{Explanation: failure.Explanation}
+	}
+	return nil
+}
+
+// Reply answers the controller challenge
+//
+//	On error the returned message is an AUTH_Failure2 that should be sent to the controller (if not nil)
+func (h *Host) Reply(data []byte) ([]byte, error) {
+	if err := checkFailure(data); err != nil {
+		return nil, err
+	}
+
+	challenge := protocol.AuthChallenge{}
+	err := challenge.Unmarshal(data)
+	if err != nil || challenge.TID != h.tid || len(challenge.Challenge) != hashLength(challenge.HashID) {
+		return h.failure(protocol.AuthFailureIncorrectPayload), protocol.ErrAuthMessage
+	}
+
+	if !contains(Hashes, challenge.HashID) {
+		return h.failure(protocol.AuthFailureHashUnusable), ErrUnsupportedHash
+	}
+	h.hashID = challenge.HashID
+
+	g, err := dhGroup(challenge.DHGroupID)
+	if err != nil {
+		return h.failure(protocol.AuthFailureDHGroupUnusable), err
+	}
+
+	reply := protocol.AuthReply{
+		TID: h.tid,
+	}
+
+	if g != nil {
+		x, public, err := g.generate()
+		if err != nil {
+			return h.failure(protocol.AuthFailureFailed), err
+		}
+
+		h.shared, err = g.shared(x, challenge.DHValue)
+		if err != nil {
+			return h.failure(protocol.AuthFailureIncorrectPayload), err
+		}
+		reply.DHValue = public
+	}
+
+	key, err := h.hostKey.transform(h.hostNQN)
+	if err != nil {
+		return h.failure(protocol.AuthFailureFailed), err
+	}
+	reply.Response = response(h.hashID, key, augment(h.hashID, h.shared, challenge.Challenge),
+		challenge.SeqNum, h.tid, 0, "HostHost", h.hostNQN, h.subNQN)
+
+	if h.ctrlKey != nil {
+		ctrlKey, err := h.ctrlKey.transform(h.subNQN)
+		if err != nil {
+			return h.failure(protocol.AuthFailureFailed), err
+		}
+
+		reply.CValid = true
+		reply.Challenge = randomBytes(hashLength(h.hashID))
+		reply.SeqNum = sequenceNumber()
+		h.expected = response(h.hashID, ctrlKey, augment(h.hashID, h.shared, reply.Challenge),
+			reply.SeqNum, h.tid, 0, "Controller", h.subNQN, h.hostNQN)
+	}
+
+	return reply.Marshal(), nil
+}
+
+// Success checks the controller accepted our response and, for bidirectional authentication,
+// verifies the controller response.
+//
+//	The returned message (AUTH_Success2 or AUTH_Failure2) must be sent to the controller if not nil
+func (h *Host) Success(data []byte) ([]byte, error) {
+	if err := checkFailure(data); err != nil {
+		return nil, err
+	}
+
+	success1 := protocol.AuthSuccess1{}
+	if success1.Unmarshal(data) != nil || success1.TID != h.tid {
+		return h.failure(protocol.AuthFailureIncorrectMessage), protocol.ErrAuthMessage
+	}
+
+	if h.expected == nil {
+		return nil, nil
+	}
+
+	if !success1.RValid || !hmac.Equal(h.expected, success1.Response) {
+		return h.failure(protocol.AuthFailureFailed), ErrControllerResponse
+	}
+
+	success2 := protocol.AuthSuccess2{TID: h.tid}
+	return success2.Marshal(), nil
+}
@@ -0,0 +1,287 @@
+// Package psk implements NVMe/TCP secure channels keyed by NVMe TLS pre-shared keys (TP 8011)
+//
+//	The configured PSK of a host is never used directly, both ends derive the retained PSK for the
+//	host NQN from it (HKDF-Expand-Label "HostNQN") and key the TLS PSK identity of each host and
+//	subsystem pair with it.
+//
+//	crypto/tls does not support external PSKs, so instead both ends derive an ed25519 certificate
+//	from the retained PSK and the TLS PSK identity and require the peer to present the certificate
+//	derived for its role. Only holders of the PSK can produce the matching private key which gives us
+//	mutual authentication over a TLS 1.3 channel. The identity travels in the SNI extension.
+//
+//	This is not wire compatible with hosts that negotiate a real TLS PSK (ie. the Linux kernel), use
+//	certificates for those.
+package psk
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IdentityPrefix is the prefix of a retained PSK identity using SHA-256
+	IdentityPrefix = "NVMe0R01"
+
+	// KeyPrefix is the prefix of the PSK interchange format
+	KeyPrefix = "NVMeTLSkey-1"
+
+	roleHost       = "host"
+	roleController = "controller"
+)
+
+var (
+	ErrInvalidKey      = errors.New("invalid psk interchange format")
+	ErrUnknownIdentity = errors.New("no psk for identity")
+	ErrPeerMismatch    = errors.New("peer certificate does not match psk")
+)
+
+// Identity returns the TLS PSK identity for a host/subsystem pair
+func Identity(hostNQN, subNQN string) string {
+	return fmt.Sprintf("%s %s %s", IdentityPrefix, hostNQN, subNQN)
+}
+
+// ParseIdentity splits a TLS PSK identity into its host and subsystem NQN
+func ParseIdentity(identity string) (string, string, bool) {
+	fields := strings.Fields(identity)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "NVMe0") {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// ParseKey decodes a PSK in interchange format: NVMeTLSkey-1:<hash>:<base64 key+crc32>:
+func ParseKey(s string) ([]byte, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 || parts[0] != KeyPrefix || parts[3] != "" {
+		return nil, ErrInvalidKey
+	}
+
+	switch parts[1] {
+	case "00", "01", "02":
+	default:
+		return nil, ErrInvalidKey
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	if len(raw) != 32+4 && len(raw) != 48+4 {
+		return nil, ErrInvalidKey
+	}
+
+	key := raw[:len(raw)-4]
+	if crc32.ChecksumIEEE(key) != binary.LittleEndian.Uint32(raw[len(raw)-4:]) {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// FormatKey encodes a 32 or 48 byte PSK into the interchange format
+func FormatKey(key []byte) string {
+	hash := "01"
+	if len(key) == 48 {
+		hash = "02"
+	}
+
+	raw := make([]byte, len(key)+4)
+	copy(raw, key)
+	binary.LittleEndian.PutUint32(raw[len(key):], crc32.ChecksumIEEE(key))
+	return fmt.Sprintf("%s:%s:%s:", KeyPrefix, hash, base64.StdEncoding.EncodeToString(raw))
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from RFC 8446 7.1 on the pseudorandom key prk
+func hkdfExpandLabel(hash func() hash.Hash, prk []byte, label string, context []byte, length int) []byte {
+	info := make([]byte, 0, 4+len(label)+6+len(context))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len("tls13 ")+len(label)))
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+	return hkdfExpand(hash, prk, info, length)
+}
+
+// hkdfExpand is HKDF-Expand from RFC 5869 2.3
+func hkdfExpand(hash func() hash.Hash, prk []byte, info []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	var block []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(hash, prk)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// Retained derives the retained PSK of hostNQN from its configured PSK (NVMe/TCP 3.6.1.3)
+//
+//	32 byte keys use SHA-256, 48 byte keys SHA-384
+func Retained(configured []byte, hostNQN string) []byte {
+	h := sha256.New
+	if len(configured) == 48 {
+		h = sha512.New384
+	}
+
+	// HKDF-Extract with a zero salt
+	mac := hmac.New(h, make([]byte, h().Size()))
+	mac.Write(configured)
+	prk := mac.Sum(nil)
+
+	return hkdfExpandLabel(h, prk, "HostNQN", []byte(hostNQN), len(configured))
+}
+
+// Keyring holds the PSKs a controller accepts, keyed by identity
+type Keyring struct {
+	lock sync.Mutex
+	keys map[string][]byte
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Add registers the configured PSK a host uses to reach a subsystem, the keyring keeps the retained
+// PSK derived from it
+func (k *Keyring) Add(hostNQN, subNQN string, configured []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[Identity(hostNQN, subNQN)] = Retained(configured, hostNQN)
+}
+
+// Remove drops the PSK for a host/subsystem pair
+func (k *Keyring) Remove(hostNQN, subNQN string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.keys, Identity(hostNQN, subNQN))
+}
+
+// Lookup returns the retained PSK for identity
+func (k *Keyring) Lookup(identity string) ([]byte, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key, ok := k.keys[identity]
+	return key, ok
+}
+
+func derive(key []byte, role, identity string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("nvme-tls-psk " + role + " " + identity))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+func certificate(key []byte, role, identity string) (tls.Certificate, error) {
+	priv := derive(key, role, identity)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: identity},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
+
+// verifyPeer checks the peer presented the certificate derived from the PSK for its role
+func verifyPeer(key []byte, role, identity string) func([][]byte, [][]*x509.Certificate) error {
+	expected := derive(key, role, identity).Public().(ed25519.PublicKey)
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrPeerMismatch
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !expected.Equal(pub) {
+			return ErrPeerMismatch
+		}
+		return nil
+	}
+}
+
+// ServerConfig returns a TLS 1.3 configuration for a controller accepting the PSKs in keys
+//
+//	Hosts that do not send a PSK identity fall back to the Certificates set on the returned config
+func ServerConfig(keys *Keyring) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			if _, _, ok := ParseIdentity(chi.ServerName); !ok {
+				return nil, nil
+			}
+
+			key, ok := keys.Lookup(chi.ServerName)
+			if !ok {
+				return nil, fmt.Errorf("%w: %q", ErrUnknownIdentity, chi.ServerName)
+			}
+
+			cert, err := certificate(key, roleController, chi.ServerName)
+			if err != nil {
+				return nil, err
+			}
+
+			return &tls.Config{
+				MinVersion:            tls.VersionTLS13,
+				Certificates:          []tls.Certificate{cert},
+				ClientAuth:            tls.RequireAnyClientCert,
+				VerifyPeerCertificate: verifyPeer(key, roleHost, chi.ServerName),
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS 1.3 configuration for a host connecting to subNQN with its configured PSK
+func ClientConfig(hostNQN, subNQN string, configured []byte) (*tls.Config, error) {
+	identity := Identity(hostNQN, subNQN)
+	key := Retained(configured, hostNQN)
+
+	cert, err := certificate(key, roleHost, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		ServerName:   identity,
+		Certificates: []tls.Certificate{cert},
+		// the chain is never signed by a CA, verifyPeer checks it was derived from our key
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeer(key, roleController, identity),
+	}, nil
+}
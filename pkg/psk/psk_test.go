@@ -0,0 +1,123 @@
+package psk
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testHostNQN = "nqn.2020-20.com.thirdmartini.nvme:initiator0"
+	testSubNQN  = "nqn.2020-20.com.thirdmartini.nvme:null"
+)
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	return key
+}
+
+func TestKeyFormat(t *testing.T) {
+	key := newTestKey(t)
+
+	encoded := FormatKey(key)
+	decoded, err := ParseKey(encoded)
+	require.Nil(t, err)
+	require.Equal(t, key, decoded)
+
+	// corrupt the crc
+	raw := []byte(encoded)
+	raw[len(KeyPrefix)+5] ^= 0x1
+	_, err = ParseKey(string(raw))
+	require.Equal(t, ErrInvalidKey, err)
+
+	_, err = ParseKey("NVMeTLSkey-1:03:AAAA:")
+	require.Equal(t, ErrInvalidKey, err)
+}
+
+func TestIdentity(t *testing.T) {
+	host, sub, ok := ParseIdentity(Identity(testHostNQN, testSubNQN))
+	require.True(t, ok)
+	require.Equal(t, testHostNQN, host)
+	require.Equal(t, testSubNQN, sub)
+
+	_, _, ok = ParseIdentity("localhost")
+	require.False(t, ok)
+}
+
+func TestRetained(t *testing.T) {
+	// RFC 5869 test case 1
+	prk, _ := hex.DecodeString("077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := hkdfExpand(sha256.New, prk, info, 42)
+	require.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865", hex.EncodeToString(okm))
+
+	// every host gets its own retained PSK of the size of the configured one
+	key := newTestKey(t)
+	retained := Retained(key, testHostNQN)
+	require.Len(t, retained, len(key))
+	require.Equal(t, retained, Retained(key, testHostNQN))
+	require.NotEqual(t, retained, Retained(key, "nqn.2020-20.com.thirdmartini.nvme:initiator1"))
+	require.NotEqual(t, key, retained)
+	require.Len(t, Retained(make([]byte, 48), testHostNQN), 48)
+}
+
+func handshake(t *testing.T, server, client *tls.Config) (error, error) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	done := make(chan error)
+	go func() {
+		s := tls.Server(sc, server)
+		err := s.Handshake()
+		// unblock the client if we failed
+		sc.Close()
+		done <- err
+	}()
+
+	err := tls.Client(cc, client).Handshake()
+	cc.Close()
+	return <-done, err
+}
+
+func TestHandshake(t *testing.T) {
+	key := newTestKey(t)
+
+	keys := NewKeyring()
+	keys.Add(testHostNQN, testSubNQN, key)
+
+	client, err := ClientConfig(testHostNQN, testSubNQN, key)
+	require.Nil(t, err)
+
+	serr, cerr := handshake(t, ServerConfig(keys), client)
+	require.Nil(t, serr)
+	require.Nil(t, cerr)
+
+	// host with the wrong key
+	client, err = ClientConfig(testHostNQN, testSubNQN, newTestKey(t))
+	require.Nil(t, err)
+	serr, cerr = handshake(t, ServerConfig(keys), client)
+	require.NotNil(t, serr)
+	require.NotNil(t, cerr)
+
+	// identity the controller has no key for
+	client, err = ClientConfig("nqn.2020-20.com.thirdmartini.nvme:initiator1", testSubNQN, key)
+	require.Nil(t, err)
+	serr, cerr = handshake(t, ServerConfig(keys), client)
+	require.NotNil(t, serr)
+	require.NotNil(t, cerr)
+
+	// the key of one subsystem does not open another
+	client, err = ClientConfig(testHostNQN, "nqn.2020-20.com.thirdmartini.nvme:other", key)
+	require.Nil(t, err)
+	serr, cerr = handshake(t, ServerConfig(keys), client)
+	require.NotNil(t, serr)
+	require.NotNil(t, cerr)
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import "fmt"
+
+// 5.2 Asynchronous Event Request command, Figure 146: Completion Queue Entry Dword 0
+const (
+	AsyncEventTypeError  = 0x0
+	AsyncEventTypeSMART  = 0x1
+	AsyncEventTypeNotice = 0x2
+	AsyncEventTypeIO     = 0x6
+	AsyncEventTypeVendor = 0x7
+)
+
+// Asynchronous Event Information - SMART / Health Status
+const (
+	AsyncEventSMARTReliability = 0x00
+	AsyncEventSMARTTemperature = 0x01
+	AsyncEventSMARTSpare       = 0x02
+)
+
+// Asynchronous Event Information - Notice
+const (
+	AsyncEventNoticeNamespaceChanged = 0x00
+	AsyncEventNoticeANAChange        = 0x03
+	AsyncEventNoticeDiscoveryChange  = 0xF0
+)
+
+// Asynchronous Event Information - I/O Command Set specific
+const (
+	AsyncEventIOSanitizeCompleted = 0x01
+)
+
+// Critical Warning bits of the SMART / Health log, the same bits enable SMART events in AEC
+const (
+	CriticalWarningSpare       = 1 << 0
+	CriticalWarningTemperature = 1 << 1
+	CriticalWarningReliability = 1 << 2
+	CriticalWarningReadOnly    = 1 << 3
+	CriticalWarningVolatile    = 1 << 4
+)
+
+// Asynchronous Event Configuration (Feature 0Bh) notice bits
+const (
+	AECNamespaceAttribute = 1 << 8
+	AECANAChange          = 1 << 11
+	AECDiscoveryChange    = 1 << 31
+)
+
+// MaxChangedNamespaces is the number of entries in the Changed Namespace List log,
+// when more namespaces changed the first entry is set to ChangedNamespaceOverflow
+const (
+	MaxChangedNamespaces     = 1024
+	ChangedNamespaceOverflow = 0xFFFFFFFF
+)
+
+// AsyncEvent is an event reported in the completion of an Asynchronous Event Request
+type AsyncEvent struct {
+	Type    uint8
+	Info    uint8
+	LogPage uint8
+}
+
+// Completion returns the Dword 0 of the AER completion
+func (e AsyncEvent) Completion() uint32 {
+	return uint32(e.Type&0x7) | uint32(e.Info)<<8 | uint32(e.LogPage)<<16
+}
+
+// Enabled returns true if the Asynchronous Event Configuration allows reporting the event
+//
+//	Error and vendor events can not be masked through AEC
+func (e AsyncEvent) Enabled(aec uint32) bool {
+	switch e.Type {
+	case AsyncEventTypeSMART:
+		switch e.Info {
+		case AsyncEventSMARTReliability:
+			return aec&(CriticalWarningReliability|CriticalWarningReadOnly|CriticalWarningVolatile) != 0
+		case AsyncEventSMARTTemperature:
+			return aec&CriticalWarningTemperature != 0
+		case AsyncEventSMARTSpare:
+			return aec&CriticalWarningSpare != 0
+		}
+		return false
+
+	case AsyncEventTypeNotice:
+		switch e.Info {
+		case AsyncEventNoticeNamespaceChanged:
+			return aec&AECNamespaceAttribute != 0
+		case AsyncEventNoticeANAChange:
+			return aec&AECANAChange != 0
+		case AsyncEventNoticeDiscoveryChange:
+			return aec&AECDiscoveryChange != 0
+		}
+		return false
+	}
+	return true
+}
+
+func (e AsyncEvent) String() string {
+	return fmt.Sprintf("AsyncEvent(Type:%d Info:0x%x LP:0x%x)", e.Type, e.Info, e.LogPage)
+}
+
+var (
+	NamespaceChangedEvent  = AsyncEvent{AsyncEventTypeNotice, AsyncEventNoticeNamespaceChanged, LPChangedNamespaceList}
+	ANAChangeEvent         = AsyncEvent{AsyncEventTypeNotice, AsyncEventNoticeANAChange, LPAsymmetricNamespaceAccess}
+	DiscoveryChangeEvent   = AsyncEvent{AsyncEventTypeNotice, AsyncEventNoticeDiscoveryChange, LPDiscovery}
+	SanitizeCompletedEvent = AsyncEvent{AsyncEventTypeIO, AsyncEventIOSanitizeCompleted, LPSanitizeStatus}
+)
@@ -0,0 +1,366 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Authentication Send/Receive (Fabrics 5.5) carry NVMe in-band authentication messages
+//
+//	CDW10 holds SECP (31:24), SPSP1 (23:16), SPSP0 (15:8) and CDW11 the transfer/allocation length
+const (
+	AuthSecurityProtocol = 0xe9
+	AuthSPSP0            = 0x01
+	AuthSPSP1            = 0x01
+
+	// AuthCDW10 is the CDW10 value of every Authentication Send/Receive command
+	AuthCDW10 = AuthSecurityProtocol<<24 | AuthSPSP1<<16 | AuthSPSP0<<8
+
+	// ConnectAuthReqATR is set in the AUTHREQ field of a Connect response when the host must authenticate
+	ConnectAuthReqATR = 0x1 << 1
+)
+
+// Authentication message types
+const (
+	AuthTypeCommon = 0x00
+	AuthTypeDHChap = 0x01
+)
+
+// Authentication message identifiers
+const (
+	AuthIDNegotiate = 0x00
+	AuthIDChallenge = 0x01
+	AuthIDReply     = 0x02
+	AuthIDSuccess1  = 0x03
+	AuthIDSuccess2  = 0x04
+	AuthIDFailure2  = 0xf0
+	AuthIDFailure1  = 0xf1
+)
+
+// AuthProtocolDHChap is the authentication protocol identifier for DH-HMAC-CHAP
+const AuthProtocolDHChap = 0x01
+
+// DH-HMAC-CHAP hash function identifiers
+const (
+	AuthHashSHA256 = 0x01
+	AuthHashSHA384 = 0x02
+	AuthHashSHA512 = 0x03
+)
+
+// DH-HMAC-CHAP Diffie-Hellman group identifiers
+const (
+	AuthDHGroupNull      = 0x00
+	AuthDHGroupFFDHE2048 = 0x01
+	AuthDHGroupFFDHE3072 = 0x02
+	AuthDHGroupFFDHE4096 = 0x03
+	AuthDHGroupFFDHE6144 = 0x04
+	AuthDHGroupFFDHE8192 = 0x05
+)
+
+// Authentication failure reason code explanations, the reason code is always AuthFailureReason
+const (
+	AuthFailureReason = 0x01
+
+	AuthFailureFailed           = 0x01
+	AuthFailureNotUsable        = 0x02
+	AuthFailureConcatMismatch   = 0x03
+	AuthFailureHashUnusable     = 0x04
+	AuthFailureDHGroupUnusable  = 0x05
+	AuthFailureIncorrectPayload = 0x06
+	AuthFailureIncorrectMessage = 0x07
+)
+
+const (
+	authHeaderSize     = 16
+	authNegotiateSize  = 8
+	authDescriptorSize = 64
+	authDescriptorIDs  = 30
+	authFailureSize    = 8
+	authMaxDescriptors = 1
+)
+
+var ErrAuthMessage = errors.New("malformed authentication message")
+
+// AuthMessageType returns the type and identifier of an authentication message
+func AuthMessageType(data []byte) (uint8, uint8, error) {
+	if len(data) < 2 {
+		return 0, 0, ErrAuthMessage
+	}
+	return data[0], data[1], nil
+}
+
+// AuthNegotiate (AUTH_Negotiate) is sent by the host to start an authentication transaction
+type AuthNegotiate struct {
+	TID        uint16
+	SCC        uint8
+	HashIDs    []uint8
+	DHGroupIDs []uint8
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthNegotiate) String() string {
+	return fmt.Sprintf("[AuthNeg] TID:%d SCC:%d Hash:%v DH:%v", m.TID, m.SCC, m.HashIDs, m.DHGroupIDs)
+}
+
+// Marshal encodes the message with a single DH-HMAC-CHAP protocol descriptor
+func (m *AuthNegotiate) Marshal() []byte {
+	data := make([]byte, authNegotiateSize+authDescriptorSize)
+	data[0] = AuthTypeCommon
+	data[1] = AuthIDNegotiate
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	data[6] = m.SCC
+	data[7] = authMaxDescriptors
+
+	desc := data[authNegotiateSize:]
+	desc[0] = AuthProtocolDHChap
+	desc[2] = uint8(copy(desc[4:4+authDescriptorIDs], m.HashIDs))
+	desc[3] = uint8(copy(desc[4+authDescriptorIDs:], m.DHGroupIDs))
+	return data
+}
+
+// Unmarshal decodes the message, only the DH-HMAC-CHAP descriptor is kept
+func (m *AuthNegotiate) Unmarshal(data []byte) error {
+	if len(data) < authNegotiateSize || data[0] != AuthTypeCommon || data[1] != AuthIDNegotiate {
+		return ErrAuthMessage
+	}
+
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	m.SCC = data[6]
+	napd := int(data[7])
+	if len(data) < authNegotiateSize+napd*authDescriptorSize {
+		return ErrAuthMessage
+	}
+
+	for i := 0; i < napd; i++ {
+		desc := data[authNegotiateSize+i*authDescriptorSize:]
+		if desc[0] != AuthProtocolDHChap {
+			continue
+		}
+
+		halen, dhlen := int(desc[2]), int(desc[3])
+		if halen > authDescriptorIDs || dhlen > authDescriptorIDs {
+			return ErrAuthMessage
+		}
+		m.HashIDs = append([]uint8{}, desc[4:4+halen]...)
+		m.DHGroupIDs = append([]uint8{}, desc[4+authDescriptorIDs:4+authDescriptorIDs+dhlen]...)
+	}
+	return nil
+}
+
+// AuthChallenge (DH-HMAC-CHAP_Challenge) is returned by the controller after negotiation
+type AuthChallenge struct {
+	TID       uint16
+	HashID    uint8
+	DHGroupID uint8
+	SeqNum    uint32
+	Challenge []byte
+	DHValue   []byte
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthChallenge) String() string {
+	return fmt.Sprintf("[AuthChl] TID:%d Hash:%d DH:%d Seq:%d", m.TID, m.HashID, m.DHGroupID, m.SeqNum)
+}
+
+// Marshal encodes the message
+func (m *AuthChallenge) Marshal() []byte {
+	data := make([]byte, authHeaderSize+len(m.Challenge)+len(m.DHValue))
+	data[0] = AuthTypeDHChap
+	data[1] = AuthIDChallenge
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	data[6] = uint8(len(m.Challenge))
+	data[8] = m.HashID
+	data[9] = m.DHGroupID
+	binary.LittleEndian.PutUint16(data[10:], uint16(len(m.DHValue)))
+	binary.LittleEndian.PutUint32(data[12:], m.SeqNum)
+	copy(data[authHeaderSize:], m.Challenge)
+	copy(data[authHeaderSize+len(m.Challenge):], m.DHValue)
+	return data
+}
+
+// Unmarshal decodes the message
+func (m *AuthChallenge) Unmarshal(data []byte) error {
+	if len(data) < authHeaderSize || data[0] != AuthTypeDHChap || data[1] != AuthIDChallenge {
+		return ErrAuthMessage
+	}
+
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	hl := int(data[6])
+	m.HashID = data[8]
+	m.DHGroupID = data[9]
+	dhvlen := int(binary.LittleEndian.Uint16(data[10:]))
+	m.SeqNum = binary.LittleEndian.Uint32(data[12:])
+
+	if len(data) < authHeaderSize+hl+dhvlen {
+		return ErrAuthMessage
+	}
+	m.Challenge = append([]byte{}, data[authHeaderSize:authHeaderSize+hl]...)
+	m.DHValue = append([]byte{}, data[authHeaderSize+hl:authHeaderSize+hl+dhvlen]...)
+	return nil
+}
+
+// AuthReply (DH-HMAC-CHAP_Reply) carries the host response and optionally a challenge for the controller
+type AuthReply struct {
+	TID       uint16
+	CValid    bool
+	SeqNum    uint32
+	Response  []byte
+	Challenge []byte
+	DHValue   []byte
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthReply) String() string {
+	return fmt.Sprintf("[AuthRpl] TID:%d CValid:%t Seq:%d", m.TID, m.CValid, m.SeqNum)
+}
+
+// Marshal encodes the message, the challenge is always hl bytes long (zero when not valid)
+func (m *AuthReply) Marshal() []byte {
+	hl := len(m.Response)
+	data := make([]byte, authHeaderSize+2*hl+len(m.DHValue))
+	data[0] = AuthTypeDHChap
+	data[1] = AuthIDReply
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	data[6] = uint8(hl)
+	if m.CValid {
+		data[8] = 1
+	}
+	binary.LittleEndian.PutUint16(data[10:], uint16(len(m.DHValue)))
+	binary.LittleEndian.PutUint32(data[12:], m.SeqNum)
+	copy(data[authHeaderSize:], m.Response)
+	if m.CValid {
+		copy(data[authHeaderSize+hl:], m.Challenge)
+	}
+	copy(data[authHeaderSize+2*hl:], m.DHValue)
+	return data
+}
+
+// Unmarshal decodes the message
+func (m *AuthReply) Unmarshal(data []byte) error {
+	if len(data) < authHeaderSize || data[0] != AuthTypeDHChap || data[1] != AuthIDReply {
+		return ErrAuthMessage
+	}
+
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	hl := int(data[6])
+	m.CValid = data[8]&0x1 != 0
+	dhvlen := int(binary.LittleEndian.Uint16(data[10:]))
+	m.SeqNum = binary.LittleEndian.Uint32(data[12:])
+
+	if len(data) < authHeaderSize+2*hl+dhvlen {
+		return ErrAuthMessage
+	}
+	m.Response = append([]byte{}, data[authHeaderSize:authHeaderSize+hl]...)
+	m.Challenge = append([]byte{}, data[authHeaderSize+hl:authHeaderSize+2*hl]...)
+	m.DHValue = append([]byte{}, data[authHeaderSize+2*hl:authHeaderSize+2*hl+dhvlen]...)
+	return nil
+}
+
+// AuthSuccess1 (DH-HMAC-CHAP_Success1) tells the host it authenticated and carries the controller response
+type AuthSuccess1 struct {
+	TID      uint16
+	HL       uint8
+	RValid   bool
+	Response []byte
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthSuccess1) String() string {
+	return fmt.Sprintf("[AuthSc1] TID:%d RValid:%t", m.TID, m.RValid)
+}
+
+// Marshal encodes the message
+func (m *AuthSuccess1) Marshal() []byte {
+	data := make([]byte, authHeaderSize+len(m.Response))
+	data[0] = AuthTypeDHChap
+	data[1] = AuthIDSuccess1
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	data[6] = m.HL
+	if m.RValid {
+		data[8] = 1
+	}
+	copy(data[authHeaderSize:], m.Response)
+	return data
+}
+
+// Unmarshal decodes the message
+func (m *AuthSuccess1) Unmarshal(data []byte) error {
+	if len(data) < authHeaderSize || data[0] != AuthTypeDHChap || data[1] != AuthIDSuccess1 {
+		return ErrAuthMessage
+	}
+
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	m.HL = data[6]
+	m.RValid = data[8]&0x1 != 0
+	m.Response = nil
+	if m.RValid {
+		if len(data) < authHeaderSize+int(m.HL) {
+			return ErrAuthMessage
+		}
+		m.Response = append([]byte{}, data[authHeaderSize:authHeaderSize+int(m.HL)]...)
+	}
+	return nil
+}
+
+// AuthSuccess2 (DH-HMAC-CHAP_Success2) tells the controller the host accepted its response
+type AuthSuccess2 struct {
+	TID uint16
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthSuccess2) String() string {
+	return fmt.Sprintf("[AuthSc2] TID:%d", m.TID)
+}
+
+// Marshal encodes the message
+func (m *AuthSuccess2) Marshal() []byte {
+	data := make([]byte, authHeaderSize)
+	data[0] = AuthTypeDHChap
+	data[1] = AuthIDSuccess2
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	return data
+}
+
+// Unmarshal decodes the message
+func (m *AuthSuccess2) Unmarshal(data []byte) error {
+	if len(data) < authHeaderSize || data[0] != AuthTypeDHChap || data[1] != AuthIDSuccess2 {
+		return ErrAuthMessage
+	}
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	return nil
+}
+
+// AuthFailure (AUTH_Failure1/AUTH_Failure2) aborts an authentication transaction
+type AuthFailure struct {
+	ID          uint8 // AuthIDFailure1 (controller) or AuthIDFailure2 (host)
+	TID         uint16
+	Explanation uint8
+}
+
+// String returns a pretty string representation of the message
+func (m *AuthFailure) String() string {
+	return fmt.Sprintf("[AuthFal] ID:0x%x TID:%d Explanation:%d", m.ID, m.TID, m.Explanation)
+}
+
+// Marshal encodes the message
+func (m *AuthFailure) Marshal() []byte {
+	data := make([]byte, authFailureSize)
+	data[0] = AuthTypeCommon
+	data[1] = m.ID
+	binary.LittleEndian.PutUint16(data[4:], m.TID)
+	data[6] = AuthFailureReason
+	data[7] = m.Explanation
+	return data
+}
+
+// Unmarshal decodes the message
+func (m *AuthFailure) Unmarshal(data []byte) error {
+	if len(data) < authFailureSize || data[0] != AuthTypeCommon || (data[1] != AuthIDFailure1 && data[1] != AuthIDFailure2) {
+		return ErrAuthMessage
+	}
+	m.ID = data[1]
+	m.TID = binary.LittleEndian.Uint16(data[4:])
+	m.Explanation = data[7]
+	return nil
+}
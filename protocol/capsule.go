@@ -5,10 +5,14 @@ import (
 	"fmt"
 )
 
+// CapsuleCommand is the 64 byte submission queue entry
+//
+//	NSID and FCType share the same bytes, fabric commands carry FCType where other commands carry NSID
 type CapsuleCommand struct {
 	OpCode uint8    `offset:"0"`
 	PRP    uint8    `offset:"1"`
 	CID    uint16   `offset:"2"`
+	NSID   uint32   `offset:"4"`
 	FCType uint8    `offset:"4"`
 	DPTR   [16]byte `offset:"24" length:"16"` // FIXME what is the offset of DPTR ?
 	D10    uint32   `offset:"40"`
@@ -23,6 +27,7 @@ func (c *CapsuleCommand) Unmarshal(data []byte) {
 	c.OpCode = data[0]
 	c.PRP = data[1]
 	c.CID = binary.LittleEndian.Uint16(data[2:])
+	c.NSID = binary.LittleEndian.Uint32(data[4:])
 	c.FCType = data[4]
 	copy(c.DPTR[0:16], data[24:])
 	c.D10 = binary.LittleEndian.Uint32(data[40:])
@@ -37,7 +42,11 @@ func (c *CapsuleCommand) Marshal(data []byte) {
 	data[0] = c.OpCode
 	data[1] = c.PRP
 	binary.LittleEndian.PutUint16(data[2:], c.CID)
-	data[4] = c.FCType
+	if c.OpCode == CapsuleCmdFabric {
+		binary.LittleEndian.PutUint32(data[4:], uint32(c.FCType))
+	} else {
+		binary.LittleEndian.PutUint32(data[4:], c.NSID)
+	}
 	copy(data[24:16+24], c.DPTR[0:16])
 	binary.LittleEndian.PutUint32(data[40:], c.D10)
 	binary.LittleEndian.PutUint32(data[44:], c.D11)
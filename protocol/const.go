@@ -16,10 +16,35 @@ const (
 	C2HTermReq  = 0x3
 	CapsuleCmd  = 0x4
 	CapsuleResp = 0x5
+	H2CData     = 0x6
 	C2HData     = 0x7
 	R2T         = 0x9
 )
 
+// PDU header flags (CH.Flags)
+const (
+	PDUFlagHDGSTF  = 0x1 << 0 // header digest present
+	PDUFlagDDGSTF  = 0x1 << 1 // data digest present
+	PDUFlagLastPDU = 0x1 << 2 // last data PDU of a transfer
+	PDUFlagSuccess = 0x1 << 3 // C2HData only: the command succeeded, no response capsule follows
+)
+
+// Digest types negotiated in ICReq/ICResp (DGST field)
+const (
+	DigestHeader = 0x1 << 0
+	DigestData   = 0x1 << 1
+)
+
+// Fatal Error Status values for C2HTermReq/H2CTermReq
+const (
+	FESInvalidHeaderField        = 0x01
+	FESPDUSequenceError          = 0x02
+	FESHeaderDigestError         = 0x03
+	FESDataTransferOutOfRange    = 0x04
+	FESDataTransferLimitExceeded = 0x05
+	FESUnsupportedParameter      = 0x06
+)
+
 var headerTypeToString = map[uint8]string{
 	ICReq:       "ICReq",
 	ICResp:      "ICResp",
@@ -27,6 +52,7 @@ var headerTypeToString = map[uint8]string{
 	C2HTermReq:  "C2HTermReq",
 	CapsuleCmd:  "CapsuleCmd",
 	CapsuleResp: "CapsuleResp",
+	H2CData:     "H2CData",
 	C2HData:     "C2HData",
 	R2T:         "R2T",
 }
@@ -71,7 +97,9 @@ const (
 	CapsuleCmdNVMEMIReceive            = 0x1E
 	CapsuleCmdDoorbellBufferConfig     = 0x7C
 	CapsuleCmdFabric                   = 0x7F
+	CapsuleCmdFormatNVM                = 0x80
 	CapsuleCmdSecurityRecv             = 0x82
+	CapsuleCmdSanitize                 = 0x84
 	CapsuleCmdInvalid                  = 0xFF // test command should be treated as invalid by the target
 )
 
@@ -99,17 +127,20 @@ var AdminCmdToString = map[uint8]string{
 	CapsuleCmdNVMEMIReceive:            "CapsuleCmdNVMEMIReceive",
 	CapsuleCmdDoorbellBufferConfig:     "CapsuleCmdDoorbellBufferConfig",
 	CapsuleCmdFabric:                   "CapsuleCmdFabric",
+	CapsuleCmdFormatNVM:                "CapsuleCmdFormatNVM",
+	CapsuleCmdSanitize:                 "CapsuleCmdSanitize",
 	CapsuleCmdInvalid:                  "CapsuleCmdInvalid-Test",
 }
 
 const (
 	// 5.21.1 Feature Specific Information
 	//  Figure 271: Set Features – Feature Identifiers
-	FeatureLbaRangeType     = 0x03
-	FeatureNumberOfQueues   = 0x07
-	FeatureAsyncEventConfig = 0x0b
-	FeatureTimestamp        = 0x0e
-	FeatureKeepAliveTimer   = 0x0f
+	FeatureLbaRangeType       = 0x03
+	FeatureVolatileWriteCache = 0x06
+	FeatureNumberOfQueues     = 0x07
+	FeatureAsyncEventConfig   = 0x0b
+	FeatureTimestamp          = 0x0e
+	FeatureKeepAliveTimer     = 0x0f
 )
 
 // NVME IO Capsule Commands
@@ -179,8 +210,13 @@ const (
 	RegisterControllerReset         = 0x20
 )
 
+// Read/Write/Write Zeroes command bits in CDW12, CDW13 bits 7:0 hold the Dataset Management hints
 const (
 	CommandBitDeallocateSet = 1 << 25
+	CommandBitFUA           = 1 << 30 // Force Unit Access
+	CommandBitLimitedRetry  = 1 << 31
+
+	CommandDSMMask = 0xFF
 )
 
 // Identify CNS Pages
@@ -190,17 +226,35 @@ const (
 	CNSIdentifyActiveNamespaces        = 0x02
 	CNSIdentifyNamespaceDescriptorList = 0x03
 	CNSIdentifyControlerDataStructures = 0x06
+
+	// Namespace Management lists, namespaces may be allocated without being attached to the controller
+	CNSIdentifyAllocatedNamespaces          = 0x10
+	CNSIdentifyAllocatedNamespace           = 0x11
+	CNSIdentifyNamespaceAttachedControllers = 0x12
+	CNSIdentifyControllerList               = 0x13
+)
+
+// NSIDBroadcast addresses every namespace attached to the controller
+const NSIDBroadcast = 0xFFFFFFFF
+
+// Namespace Identifier Types of the Namespace Identification Descriptor list
+const (
+	NIDTEUI64 = 0x1
+	NIDTNGUID = 0x2
+	NIDTUUID  = 0x3
 )
 
 const (
 	LPErrorInformation          = 0x01
 	LPHealthInformation         = 0x02
 	LPFirmwareSlotInformation   = 0x03
+	LPChangedNamespaceList      = 0x04
 	LPCommandsSupported         = 0x05
 	LPDeviceSelfTest            = 0x06
 	LPAsymmetricNamespaceAccess = 0x0c
 
-	LPDiscovery = 0x70
+	LPDiscovery      = 0x70
+	LPSanitizeStatus = 0x81
 )
 
 const (
@@ -210,3 +264,23 @@ const (
 	PropertyControllerStatus        = 0x1c
 	PropertySubsystemReset          = 0x20
 )
+
+// Controller Capabilities (CAP), Controller Configuration (CC) and Controller Status (CSTS) fields
+const (
+	CAPSubsystemResetSupported = uint64(1) << 36
+
+	CCEnable         = 1 << 0
+	CCShutdownMask   = 0x3 << 14
+	CCShutdownNormal = 0x1 << 14
+	CCShutdownAbrupt = 0x2 << 14
+
+	CSTSReady              = 1 << 0
+	CSTSFatal              = 1 << 1
+	CSTSShutdownMask       = 0x3 << 2
+	CSTSShutdownProcessing = 0x1 << 2
+	CSTSShutdownComplete   = 0x2 << 2
+	CSTSSubsystemReset     = 1 << 4
+
+	// NSSRReset is the value ("NVMe") written to NSSR to start a subsystem reset
+	NSSRReset = 0x4E564D65
+)
@@ -57,7 +57,26 @@ const (
 	SCReservationConflict              NVMEStatusCode = 0x83
 	SCFormatInProgress                 NVMEStatusCode = 0x84
 
-	SCCmdFeatureNotChangeable NVMEStatusCode = 0x10e
+	SCAsyncEventRequestLimitExceeded NVMEStatusCode = 0x105
+	SCInvalidLogPage                 NVMEStatusCode = 0x109
+	SCInvalidFormat                  NVMEStatusCode = 0x10a
+	SCCmdFeatureNotChangeable        NVMEStatusCode = 0x10e
+
+	// Namespace Management and Namespace Attachment Command Specific Status Values
+	SCNamespaceInsufficientCapacity NVMEStatusCode = 0x115
+	SCNamespaceIDUnavailable        NVMEStatusCode = 0x116
+	SCNamespaceAlreadyAttached      NVMEStatusCode = 0x118
+	SCNamespaceIsPrivate            NVMEStatusCode = 0x119
+	SCNamespaceNotAttached          NVMEStatusCode = 0x11a
+	SCControllerListInvalid         NVMEStatusCode = 0x11c
+
+	// Fabrics Connect Command Specific Status Values
+	SCConnectIncompatibleFormat   NVMEStatusCode = 0x180
+	SCConnectControllerBusy       NVMEStatusCode = 0x181
+	SCConnectInvalidParameters    NVMEStatusCode = 0x182
+	SCConnectRestartDiscovery     NVMEStatusCode = 0x183
+	SCConnectInvalidHost          NVMEStatusCode = 0x184
+	SCConnectAuthenticationNeeded NVMEStatusCode = 0x191
 
 	SCMediaWriteFault                  NVMEStatusCode = 0x280
 	SCMediaUncorrectableReadError      NVMEStatusCode = 0x281
@@ -129,7 +148,25 @@ var genericStatusToString = map[NVMEStatusCode]string{
 	SCFormatInProgress:                 "format in progress",
 
 	// Command Specific Status Definition (Figure 128,129)
-	SCCmdFeatureNotChangeable: "feature not changeable",
+	SCAsyncEventRequestLimitExceeded: "asynchronous event request limit exceeded",
+	SCInvalidLogPage:                 "invalid log page",
+	SCInvalidFormat:                  "invalid format",
+	SCCmdFeatureNotChangeable:        "feature not changeable",
+
+	SCNamespaceInsufficientCapacity: "namespace insufficient capacity",
+	SCNamespaceIDUnavailable:        "namespace identifier unavailable",
+	SCNamespaceAlreadyAttached:      "namespace already attached",
+	SCNamespaceIsPrivate:            "namespace is private",
+	SCNamespaceNotAttached:          "namespace not attached",
+	SCControllerListInvalid:         "controller list invalid",
+
+	// Fabrics Command Specific Status Definition
+	SCConnectIncompatibleFormat:   "connect incompatible format",
+	SCConnectControllerBusy:       "connect controller busy",
+	SCConnectInvalidParameters:    "connect invalid parameters",
+	SCConnectRestartDiscovery:     "connect restart discovery",
+	SCConnectInvalidHost:          "connect invalid host",
+	SCConnectAuthenticationNeeded: "authentication required",
 
 	// Media Specific Status Definition (Figure 130,131)
 	SCMediaWriteFault:                  "write fault",
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Dataset Management (CDW10 bits 7:0 hold the 0 based number of ranges, CDW11 the attributes)
+const (
+	DSMAttributeIDR        = 1 << 0 // Integral Dataset for Read
+	DSMAttributeIDW        = 1 << 1 // Integral Dataset for Write
+	DSMAttributeDeallocate = 1 << 2
+
+	DSMRangeSize = 16
+	DSMMaxRanges = 256
+)
+
+// DSMRange is one range descriptor of the Dataset Management data
+type DSMRange struct {
+	Attributes  uint32 // context attributes
+	Length      uint32 // in logical blocks
+	StartingLBA uint64
+}
+
+func (d *DSMRange) String() string {
+	return fmt.Sprintf("[DSM   ] Lba:%d Len:%d Attr:0x%x", d.StartingLBA, d.Length, d.Attributes)
+}
+
+// Marshal encodes the range into its 16 byte descriptor
+func (d *DSMRange) Marshal(data []byte) {
+	binary.LittleEndian.PutUint32(data[0:], d.Attributes)
+	binary.LittleEndian.PutUint32(data[4:], d.Length)
+	binary.LittleEndian.PutUint64(data[8:], d.StartingLBA)
+}
+
+// Unmarshal decodes the range from its 16 byte descriptor
+func (d *DSMRange) Unmarshal(data []byte) {
+	d.Attributes = binary.LittleEndian.Uint32(data[0:])
+	d.Length = binary.LittleEndian.Uint32(data[4:])
+	d.StartingLBA = binary.LittleEndian.Uint64(data[8:])
+}
+
+// MarshalDSMRanges returns the Dataset Management data for ranges
+func MarshalDSMRanges(ranges []DSMRange) []byte {
+	data := make([]byte, len(ranges)*DSMRangeSize)
+	for i := range ranges {
+		ranges[i].Marshal(data[i*DSMRangeSize:])
+	}
+	return data
+}
+
+// UnmarshalDSMRanges decodes the range descriptors in data
+func UnmarshalDSMRanges(data []byte) []DSMRange {
+	ranges := make([]DSMRange, len(data)/DSMRangeSize)
+	for i := range ranges {
+		ranges[i].Unmarshal(data[i*DSMRangeSize:])
+	}
+	return ranges
+}
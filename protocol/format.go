@@ -0,0 +1,33 @@
+package protocol
+
+// Format NVM fields of CDW10
+const (
+	FormatLBAFMask  = 0xF      // LBA format, bits 3:0
+	FormatMSET      = 1 << 4   // metadata settings
+	FormatPIMask    = 0x7 << 5 // protection information
+	FormatPIL       = 1 << 8   // protection information location
+	FormatSESShift  = 9        // secure erase settings, bits 11:9
+	FormatSESMask   = 0x7
+	FormatLBAFUMask = 0x3 << 12 // upper bits of the LBA format, bits 13:12
+)
+
+// Secure Erase Settings (SES) of Format NVM
+const (
+	SecureEraseNone     = 0x0
+	SecureEraseUserData = 0x1
+	SecureEraseCrypto   = 0x2
+)
+
+// Format NVM Attributes (FNA) of Identify Controller
+const (
+	FNAFormatAllNamespaces = 1 << 0 // a format applies to every namespace
+	FNAEraseAllNamespaces  = 1 << 1 // a secure erase applies to every namespace
+	FNACryptoErase         = 1 << 2 // cryptographic erase is supported
+)
+
+// FPISupported is set in Identify Namespace FPI when the format progress is reported, bits 6:0 are the
+// percentage of the format still to do
+const (
+	FPISupported     = 0x80
+	FPIRemainingMask = 0x7F
+)
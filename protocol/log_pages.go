@@ -35,6 +35,7 @@ type IdentifyController struct {
 	TNVMCAP0            uint64   `offset:"280"` // in BYTES!!! ( 128 bits of size )
 	TNVMCAP1            uint64   `offset:"288"`
 	KAS                 uint16   `offset:"320"`
+	SANICAP             uint32   `offset:"328"`
 	ANATT               uint8    `offset:"342"`
 	ANACAP              uint8    `offset:"343"`
 	ANAGRPMAX           uint32   `offset:"344"`
@@ -120,13 +121,38 @@ type IdentifyActiveNamespaceListData struct {
 	CNS [1024]uint32 `offset:"0" length:"1024"`
 }
 
-type IdentifyNamespaceDescriptor struct {
-	NIDT uint8 `offset:"0"`
-	NIDL uint8 `offset:"1"`
-	// FIXME: technically this is broken
-	//  this SHOULD be 04 - NIDL+3 ( IE offset 4, length NIDL )
-	//  but we're going to use 16 always since we're storing uuids
-	NID [16]byte `offset:"4" length:"16"`
+// NamespaceDescriptor is an entry of the Namespace Identification Descriptor list (CNS 03h),
+// the length of NID (NIDL) depends on the type
+type NamespaceDescriptor struct {
+	NIDT uint8
+	NID  []byte
+}
+
+// Marshal writes the descriptor into data and returns its length
+func (d *NamespaceDescriptor) Marshal(data []byte) int {
+	data[0] = d.NIDT
+	data[1] = uint8(len(d.NID))
+	data[2] = 0
+	data[3] = 0
+	copy(data[4:], d.NID)
+	return 4 + len(d.NID)
+}
+
+// UnmarshalNamespaceDescriptors decodes a descriptor list, the list ends at the first zero NIDL
+func UnmarshalNamespaceDescriptors(data []byte) []NamespaceDescriptor {
+	var descs []NamespaceDescriptor
+	for len(data) >= 4 && data[1] != 0 {
+		length := 4 + int(data[1])
+		if length > len(data) {
+			break
+		}
+		descs = append(descs, NamespaceDescriptor{
+			NIDT: data[0],
+			NID:  append([]byte(nil), data[4:length]...),
+		})
+		data = data[length:]
+	}
+	return descs
 }
 
 type GetLogPageCommand struct {
@@ -145,6 +171,9 @@ type GetLogPageCommand struct {
 	D15 uint32 `offset:"60"`
 }
 
+// LogPageRAE is the Retain Asynchronous Event bit of LogSp (CDW10 bit 15)
+const LogPageRAE = 0x80
+
 func (p *GetLogPageCommand) GetReturnBufferLength() uint32 {
 	// The counter is zero based where 0 -> 1
 	return 4 * ((uint32(p.NumDWordsUpper) | uint32(p.NumDWordsLower)) + 1)
@@ -159,18 +188,21 @@ type AsymmetricNamespaceAccessLog struct {
 	ChangeCount     uint64 `offset:"0"`
 	DescriptorCount uint16 `offset:"8"`
 	// FIXME this is a marshalled list of ANAGroupDescriptors which are of variable size
-	//  but we're cheating since we only have one
+	//  but we're cheating since we only have one, its NSIDs follow at ANAGroupNSIDOffset
 	ANAGroupDesc ANAGroupDescriptor `offset:"16" length:""`
 }
 
 type ANAGroupDescriptor struct {
-	ANAGroupID  uint32    `offset:"0"`
-	NSIDCount   uint32    `offset:"4"`
-	ChangeCount uint64    `offset:"8"`
-	ANAS        uint8     `offset:"16"`
-	NID         [1]uint32 `offset:"32" length:"1"`
+	ANAGroupID  uint32 `offset:"0"`
+	NSIDCount   uint32 `offset:"4"`
+	ChangeCount uint64 `offset:"8"`
+	ANAS        uint8  `offset:"16"`
 }
 
+// ANAGroupNSIDOffset is where the NSID list of the first ANA group descriptor starts in the ANA log,
+// each NSID is 4 bytes
+const ANAGroupNSIDOffset = 16 + 32
+
 type DiscoveryLogPageEntry struct {
 	TransportType         uint8  `offset:"0"`
 	AddressFamily         uint8  `offset:"1"`
@@ -185,6 +217,21 @@ type DiscoveryLogPageEntry struct {
 	TSAS                  string `offset:"768" length:"256"`
 }
 
+// Discovery log entry transport requirements (TREQ)
+const (
+	TREQSecureChannelNotSpecified = 0x0
+	TREQSecureChannelRequired     = 0x1
+	TREQSecureChannelNotRequired  = 0x2
+	TREQDisableSQFlowControl      = 0x4
+)
+
+// NVMe/TCP transport specific address subtype security types (TSAS.SECTYPE)
+const (
+	TSASSecurityNone  = 0x0
+	TSASSecurityTLS12 = 0x1
+	TSASSecurityTLS13 = 0x2
+)
+
 type DiscoveryLogPage struct {
 	GenerationCounter   uint64                  `offset:"0"`
 	NumberOfRecords     uint64                  `offset:"8"`
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Namespace Management and Namespace Attachment select the operation in CDW10 bits 3:0
+const (
+	NamespaceManagementCreate = 0x0
+	NamespaceManagementDelete = 0x1
+
+	NamespaceAttachmentAttach = 0x0
+	NamespaceAttachmentDetach = 0x1
+
+	NamespaceSelectMask = 0xF
+)
+
+// FLBASFormatMask selects the LBA format of a namespace in Identify Namespace FLBAS
+const FLBASFormatMask = 0xF
+
+// LBAFormat encodes an LBA Format entry (Identify Namespace LBAF) for a data size that is a power of two,
+// the data size is stored as its log2 (LBADS) in bits 23:16
+func LBAFormat(dataSize uint32) uint32 {
+	return uint32(bits.TrailingZeros32(dataSize)) << 16
+}
+
+// LBAFormatDataSize returns the data size in bytes of an LBA Format entry, 0 for an unused entry
+func LBAFormatDataSize(lbaf uint32) uint32 {
+	lbads := lbaf >> 16 & 0xFF
+	if lbads == 0 {
+		return 0
+	}
+	return 1 << lbads
+}
+
+// OACSNamespaceManagement is set in Identify Controller OACS when Namespace Management and Namespace
+// Attachment are supported
+const OACSNamespaceManagement = 1 << 3
+
+// ControllerListSize is the size of a Controller List, a count followed by up to MaxControllerListIDs IDs
+const (
+	ControllerListSize   = 4096
+	MaxControllerListIDs = 2047
+)
+
+// MarshalControllerList encodes the controller IDs into a Controller List, IDs past MaxControllerListIDs
+// are dropped
+func MarshalControllerList(ids []uint16) []byte {
+	if len(ids) > MaxControllerListIDs {
+		ids = ids[:MaxControllerListIDs]
+	}
+
+	data := make([]byte, ControllerListSize)
+	binary.LittleEndian.PutUint16(data[0:], uint16(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint16(data[2+2*i:], id)
+	}
+	return data
+}
+
+// UnmarshalControllerList decodes the controller IDs of a Controller List
+func UnmarshalControllerList(data []byte) []uint16 {
+	if len(data) < 2 {
+		return nil
+	}
+
+	count := int(binary.LittleEndian.Uint16(data[0:]))
+	if count > MaxControllerListIDs {
+		count = MaxControllerListIDs
+	}
+	if max := (len(data) - 2) / 2; count > max {
+		count = max
+	}
+
+	ids := make([]uint16, count)
+	for i := range ids {
+		ids[i] = binary.LittleEndian.Uint16(data[2+2*i:])
+	}
+	return ids
+}
@@ -0,0 +1,56 @@
+package protocol
+
+// Sanitize fields of CDW10, CDW11 holds the overwrite pattern
+const (
+	SanitizeActionMask  = 0x7    // sanitize action (SANACT), bits 2:0
+	SanitizeAUSE        = 1 << 3 // allow unrestricted sanitize exit
+	SanitizeOWPASSShift = 4      // overwrite pass count, bits 7:4, 0 is 16 passes
+	SanitizeOWPASSMask  = 0xF
+	SanitizeOIPBP       = 1 << 8 // overwrite invert pattern between passes
+	SanitizeNDAS        = 1 << 9 // no deallocate after sanitize
+)
+
+// Sanitize Actions (SANACT)
+const (
+	SanitizeExitFailureMode = 0x1
+	SanitizeBlockErase      = 0x2
+	SanitizeOverwrite       = 0x3
+	SanitizeCryptoErase     = 0x4
+)
+
+// Sanitize Capabilities (SANICAP) of Identify Controller
+const (
+	SANICAPCryptoErase = 1 << 0
+	SANICAPBlockErase  = 1 << 1
+	SANICAPOverwrite   = 1 << 2
+)
+
+// Sanitize Status (SSTAT) of the Sanitize Status log, bits 7:3 count the completed overwrite passes
+const (
+	SanitizeStatusNever      = 0x0
+	SanitizeStatusCompleted  = 0x1
+	SanitizeStatusInProgress = 0x2
+	SanitizeStatusFailed     = 0x3
+	SanitizeStatusMask       = 0x7
+
+	SanitizeStatusPassesShift = 3
+	SanitizeStatusPassesMask  = 0x1F
+)
+
+// SanitizeNoEstimate is the estimated time of a sanitize we can not tell
+const SanitizeNoEstimate = 0xFFFFFFFF
+
+// SanitizeStatusLogSize is the size of the Sanitize Status log (Log Identifier 81h)
+const SanitizeStatusLogSize = 512
+
+// SanitizeStatusLog implements 5.14.1.16 Sanitize Status (Log Identifier 81h)
+//
+//	SPROG is the fraction of the sanitize done as a numerator of 65536, 0xFFFF when no sanitize runs
+type SanitizeStatusLog struct {
+	SPROG         uint16 `offset:"0"`
+	SSTAT         uint16 `offset:"2"`
+	SCDW10        uint32 `offset:"4"`
+	ETOverwrite   uint32 `offset:"8"`
+	ETBlockErase  uint32 `offset:"12"`
+	ETCryptoErase uint32 `offset:"16"`
+}
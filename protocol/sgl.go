@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SGL descriptor types and sub types used by NVMe/TCP (the SGL identifier is type<<4 | subtype)
+const (
+	SGLTypeDataBlock          = 0x0
+	SGLTypeTransportDataBlock = 0x5
+
+	SGLSubTypeAddress = 0x0
+	// SGLSubTypeOffset is a Data Block whose address is the offset into the in capsule data
+	SGLSubTypeOffset    = 0x1
+	SGLSubTypeTransport = 0xA
+)
+
+// SGL Support (SGLS) bits reported in Identify Controller
+const (
+	SGLSupported     = 0x1
+	SGLSupportOffset = 1 << 20 // address of a data block may be an offset into in capsule data
+)
+
+// SGLDescriptor is the SGL1 data pointer (DPTR) of a command capsule
+type SGLDescriptor struct {
+	Address uint64
+	Length  uint32
+	Type    uint8
+	SubType uint8
+}
+
+// InCapsuleSGL describes length bytes of in capsule data starting at offset
+func InCapsuleSGL(offset uint64, length uint32) SGLDescriptor {
+	return SGLDescriptor{
+		Address: offset,
+		Length:  length,
+		Type:    SGLTypeDataBlock,
+		SubType: SGLSubTypeOffset,
+	}
+}
+
+// TransportSGL describes length bytes moved by the transport (C2HData or R2T/H2CData)
+func TransportSGL(length uint32) SGLDescriptor {
+	return SGLDescriptor{
+		Length:  length,
+		Type:    SGLTypeTransportDataBlock,
+		SubType: SGLSubTypeTransport,
+	}
+}
+
+// InCapsule returns true if the data follows the command in the capsule
+func (d *SGLDescriptor) InCapsule() bool {
+	return d.Type == SGLTypeDataBlock && d.SubType == SGLSubTypeOffset
+}
+
+// Transport returns true if the data is transferred in separate data PDUs
+func (d *SGLDescriptor) Transport() bool {
+	return d.Type == SGLTypeTransportDataBlock && d.SubType == SGLSubTypeTransport
+}
+
+func (d *SGLDescriptor) String() string {
+	return fmt.Sprintf("[SGL   ] Type:0x%x/0x%x Addr:%d Len:%d", d.Type, d.SubType, d.Address, d.Length)
+}
+
+// Marshal encodes the descriptor into the 16 byte DPTR
+func (d *SGLDescriptor) Marshal(data []byte) {
+	binary.LittleEndian.PutUint64(data[0:], d.Address)
+	binary.LittleEndian.PutUint32(data[8:], d.Length)
+	data[12] = 0
+	data[13] = 0
+	data[14] = 0
+	data[15] = d.Type<<4 | d.SubType&0xF
+}
+
+// Unmarshal decodes the descriptor from the 16 byte DPTR
+func (d *SGLDescriptor) Unmarshal(data []byte) {
+	d.Address = binary.LittleEndian.Uint64(data[0:])
+	d.Length = binary.LittleEndian.Uint32(data[8:])
+	d.Type = data[15] >> 4
+	d.SubType = data[15] & 0xF
+}
+
+// SGL returns the data descriptor of the command
+func (c *CapsuleCommand) SGL() SGLDescriptor {
+	d := SGLDescriptor{}
+	d.Unmarshal(c.DPTR[:])
+	return d
+}
+
+// SetSGL sets the data descriptor of the command
+func (c *CapsuleCommand) SetSGL(d SGLDescriptor) {
+	d.Marshal(c.DPTR[:])
+}
@@ -32,6 +32,36 @@ func (c *C2HDataTransfer) Unmarshal(data []byte) {
 	c.DATAL = binary.LittleEndian.Uint32(data[8:])
 }
 
+// H2CDataTransfer (H2CData) represents the header sent by a host alongside a data transfer to the controller.
+// This is sent by the host in response to an R2T for WRITE operations whose data did not fit in the capsule
+type H2CDataTransfer struct {
+	CCCID uint16 `offset:"0"`
+	TTAG  uint16 `offset:"2"`
+	DATAO uint32 `offset:"4"`
+	DATAL uint32 `offset:"8"`
+}
+
+// String returns a pretty string representation of the H2CData PDU
+func (c *H2CDataTransfer) String() string {
+	return fmt.Sprintf("[H2C   ] CID:%d  Ofs:%d Len:%d Tag:%d", c.CCCID, c.DATAO, c.DATAL, c.TTAG)
+}
+
+// Marshal marshals the data structure onto a stream buffer
+func (c *H2CDataTransfer) Marshal(data []byte) {
+	binary.LittleEndian.PutUint16(data[0:], c.CCCID)
+	binary.LittleEndian.PutUint16(data[2:], c.TTAG)
+	binary.LittleEndian.PutUint32(data[4:], c.DATAO)
+	binary.LittleEndian.PutUint32(data[8:], c.DATAL)
+}
+
+// Unmarshal decodes the structure from a stream buffer
+func (c *H2CDataTransfer) Unmarshal(data []byte) {
+	c.CCCID = binary.LittleEndian.Uint16(data[0:])
+	c.TTAG = binary.LittleEndian.Uint16(data[2:])
+	c.DATAO = binary.LittleEndian.Uint32(data[4:])
+	c.DATAL = binary.LittleEndian.Uint32(data[8:])
+}
+
 // R2TRequest (R2T) represents a request to transmit message from the controller to host.
 // This is sent when the controller needs additional data PDU from the host for a Capsule command
 type R2TRequest struct {
@@ -66,7 +96,7 @@ func (c *R2TRequest) Unmarshal(data []byte) {
 // This request may be accompanied by a data buffer containing the offending PDU/Capsule
 type C2HTermRequest struct {
 	FatalErrorStatus      uint16
-	FatalErrorInformation uint16
+	FatalErrorInformation uint32
 }
 
 // String returns a pretty string representation of the C2HTerm
@@ -77,20 +107,20 @@ func (c *C2HTermRequest) String() string {
 // Marshal marshals the data structure onto a stream buffer
 func (c *C2HTermRequest) Marshal(data []byte) {
 	binary.LittleEndian.PutUint16(data[0:], c.FatalErrorStatus)
-	binary.LittleEndian.PutUint16(data[2:], c.FatalErrorInformation)
+	binary.LittleEndian.PutUint32(data[2:], c.FatalErrorInformation)
 }
 
 // Unmarshal decodes the structure from a stream buffer
 func (c *C2HTermRequest) Unmarshal(data []byte) {
 	c.FatalErrorStatus = binary.LittleEndian.Uint16(data[0:])
-	c.FatalErrorInformation = binary.LittleEndian.Uint16(data[2:])
+	c.FatalErrorInformation = binary.LittleEndian.Uint32(data[2:])
 }
 
 // H2CTermRequest (H2CTermReq) represents a Host to Controller termination request.
 // This request may be accompanied by a data buffer containing the offending PDU/Capsule
 type H2CTermRequest struct {
 	FatalErrorStatus      uint16
-	FatalErrorInformation uint16
+	FatalErrorInformation uint32
 }
 
 // String returns a pretty string representation of the H2CTerm
@@ -101,11 +131,11 @@ func (c *H2CTermRequest) String() string {
 // Marshal marshals the data structure onto a stream buffer
 func (c *H2CTermRequest) Marshal(data []byte) {
 	binary.LittleEndian.PutUint16(data[0:], c.FatalErrorStatus)
-	binary.LittleEndian.PutUint16(data[2:], c.FatalErrorInformation)
+	binary.LittleEndian.PutUint32(data[2:], c.FatalErrorInformation)
 }
 
 // Unmarshal decodes the structure from a stream buffer
 func (c *H2CTermRequest) Unmarshal(data []byte) {
 	c.FatalErrorStatus = binary.LittleEndian.Uint16(data[0:])
-	c.FatalErrorInformation = binary.LittleEndian.Uint16(data[2:])
+	c.FatalErrorInformation = binary.LittleEndian.Uint32(data[2:])
 }
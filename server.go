@@ -1,10 +1,13 @@
 package nvme
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/thirdmartini/go-nvme/internal/sys"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
@@ -13,6 +16,16 @@ import (
 
 var serialAccess sync.Mutex
 
+// ErrSecureChannelUnavailable is returned when a subsystem requires a secure channel from a server that
+// does not run TLS
+var ErrSecureChannelUnavailable = errors.New("secure channel required but the server does not run TLS")
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxC2HDataLength is the largest C2HData PDU we send unless SetMaxC2HDataLength changed it,
+// larger reads are split into several PDUs
+const DefaultMaxC2HDataLength = 128 * 1024
+
 type SessionInfo struct {
 	Source string
 	Ctrl   *Controller
@@ -23,12 +36,20 @@ type Server struct {
 	SubSystems  map[string]Subsystem
 	SessionInfo map[string]SessionInfo
 	Lock        sync.Mutex
+
+	// controllers holds the controller ID registry of each subsystem
+	controllers map[string]*ControllerRegistry
 	listen      net.Listener
 
+	// tlsConfig is set when the server only accepts TLS connections
+	tlsConfig *tls.Config
+
 	wg   sync.WaitGroup
 	quit chan bool
 
-	debugLevel uint64
+	debugLevel       uint64
+	maxC2HDataLength uint32
+	c2hSuccess       bool
 }
 
 func (s *Server) RegisterSession(name string, ctrl *Controller) {
@@ -59,10 +80,19 @@ func (s *Server) GetSessions() []SessionInfo {
 	return sil
 }
 
-func (s *Server) AddSubSystem(subsys Subsystem) {
+// AddSubSystem makes subsys available to hosts, it fails if subsys requires a secure channel the server
+// cannot offer
+func (s *Server) AddSubSystem(subsys Subsystem) error {
+	if ts, ok := subsys.(*TargetSubsystem); ok && ts.SecureChannelRequired && !s.IsSecure() {
+		return fmt.Errorf("%s: %w", subsys.GetNQN(), ErrSecureChannelUnavailable)
+	}
+
 	s.Lock.Lock()
-	defer s.Lock.Unlock()
 	s.SubSystems[subsys.GetNQN()] = subsys
+	s.Lock.Unlock()
+
+	s.NotifyDiscoveryChange()
+	return nil
 }
 
 func (s *Server) GetSubSystem(nqn string) Subsystem {
@@ -87,7 +117,27 @@ func (s *Server) ListSubSystems() []Subsystem {
 	return ls
 }
 
+// Controllers returns the controller registry of the subsystem
+func (s *Server) Controllers(nqn string) *ControllerRegistry {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	registry, ok := s.controllers[nqn]
+	if !ok {
+		registry = NewControllerRegistry()
+		s.controllers[nqn] = registry
+	}
+	return registry
+}
+
 func (s *Server) RemoveSubSystem(nqn string) error {
+	err := s.removeSubSystem(nqn)
+	if err == nil {
+		s.NotifyDiscoveryChange()
+	}
+	return err
+}
+
+func (s *Server) removeSubSystem(nqn string) error {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 	subsys, ok := s.SubSystems[nqn]
@@ -95,6 +145,7 @@ func (s *Server) RemoveSubSystem(nqn string) error {
 		return fmt.Errorf("nqn:%s does not exists", nqn)
 	}
 	delete(s.SubSystems, subsys.GetNQN())
+	delete(s.controllers, subsys.GetNQN())
 
 	for id := range s.SessionInfo {
 		session := s.SessionInfo[id]
@@ -107,11 +158,30 @@ func (s *Server) RemoveSubSystem(nqn string) error {
 	return nil
 }
 
+// NotifyAsyncEvent reports the event to every controller of the subsystem
+func (s *Server) NotifyAsyncEvent(nqn string, ev protocol.AsyncEvent) {
+	for _, state := range s.Controllers(nqn).List() {
+		state.NotifyAsyncEvent(ev)
+	}
+}
+
+// NotifyNamespaceChanged tells the hosts of the subsystem a namespace was added, removed or resized
+func (s *Server) NotifyNamespaceChanged(nqn string, nsid uint32) {
+	for _, state := range s.Controllers(nqn).List() {
+		state.NotifyNamespaceChanged(nsid)
+	}
+}
+
+// NotifyDiscoveryChange tells hosts connected to the discovery subsystem to read the discovery log again
+func (s *Server) NotifyDiscoveryChange() {
+	s.NotifyAsyncEvent(NVMEDiscoverySubsystemName, protocol.DiscoveryChangeEvent)
+}
+
 func (s *Server) startController(conn *sys.Conn) {
 	sessionId := conn.RemoteAddr().String()
 
 	ctrl := Controller{
-		REGCtrlCaps: uint64(1)<<37 | uint64(15)<<24 | (uint64(protocol.NVMECtrlAttrMaxQueueSize) - 1),
+		REGCtrlCaps: uint64(1)<<37 | protocol.CAPSubsystemResetSupported | uint64(15)<<24 | (uint64(protocol.NVMECtrlAttrMaxQueueSize) - 1),
 		//		REGCtrlStatus: 0x1,              // Controller is ready
 		REGCtrlStatus: 0x0,
 		Version:       1<<16 | 3<<8 | 0, // 1.3.0
@@ -120,19 +190,21 @@ func (s *Server) startController(conn *sys.Conn) {
 		QueueID:       0,
 		QueueSize:     protocol.NVMECtrlAttrMaxQueueSize, // default queue size
 		Queue:         make([]NVMERequest, protocol.NVMECtrlAttrMaxQueueSize, protocol.NVMECtrlAttrMaxQueueSize),
-		SQCUR:         0,
-		SQHD:          0,
 		Server:        s,
 
 		SessionID: sessionId,
 
 		FlowControlDisabled: false,
+		SecureChannel:       s.tlsConfig != nil,
+		MaxC2HDataLength:    s.maxC2HDataLength,
+		C2HSuccess:          s.c2hSuccess,
 		waiting:             make(chan *NVMERequest, protocol.NVMECtrlAttrMaxQueueSize),
 		completions:         make(chan *NVMERequest, protocol.NVMECtrlAttrMaxQueueSize),
 	}
 
 	for i, _ := range ctrl.Queue {
 		req := &ctrl.Queue[i]
+		req.tag = uint16(i)
 		ctrl.waiting <- req
 	}
 
@@ -146,8 +218,22 @@ func (s *Server) startController(conn *sys.Conn) {
 	}
 	ctrl.Log.Begin(tracer.TraceController, "Session Started")
 
+	if tc, ok := conn.Conn.(*tls.Conn); ok {
+		// finish the handshake before registering the session so a failed handshake never shows up
+		tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := tc.Handshake()
+		if err != nil {
+			ctrl.Log.Trace(tracer.TraceController, "TLS handshake failed: %s", err.Error())
+			conn.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		ctrl.TLSServerName = tc.ConnectionState().ServerName
+	}
+
 	s.RegisterSession(sessionId, &ctrl)
 	defer func() {
+		ctrl.detachState()
 		s.UnRegisterSession(sessionId)
 		ctrl.Log.Trace(tracer.TraceController, "Session Terminated")
 		conn.Close()
@@ -174,6 +260,9 @@ func (s *Server) Serve() error {
 				log.Println("accept error", err)
 			}
 		} else {
+			if s.tlsConfig != nil {
+				conn = tls.Server(conn, s.tlsConfig)
+			}
 			sconn := sys.NewConn(conn)
 			fmt.Printf("Server Starded Queue\n")
 			s.wg.Add(1)
@@ -198,18 +287,67 @@ func (s *Server) SetDebugLevel(level uint64) {
 	s.debugLevel = level
 }
 
+// SetC2HSuccess lets connections accepted after the call complete successful reads with the
+// SUCCESS flag on the last C2HData PDU instead of a response capsule
+//
+//	This only applies to queues where the host disabled SQ flow control
+func (s *Server) SetC2HSuccess(enable bool) {
+	s.c2hSuccess = enable
+}
+
+// SetMaxC2HDataLength sets the largest C2HData PDU sent on connections accepted after the call
+func (s *Server) SetMaxC2HDataLength(size uint32) {
+	if size == 0 {
+		size = DefaultMaxC2HDataLength
+	}
+	s.maxC2HDataLength = size
+}
+
+// ListenAddr returns the address the server accepts connections on, the port is filled in when
+// the server was created with port 0
+func (s *Server) ListenAddr() string {
+	return s.listen.Addr().String()
+}
+
+// IsSecure returns true if the server only accepts TLS connections
+func (s *Server) IsSecure() bool {
+	return s.tlsConfig != nil
+}
+
+// New creates a server accepting plain TCP connections on addr
 func New(addr string) (*Server, error) {
+	return newServer(addr, nil)
+}
+
+// NewTLS creates a server that requires TLS 1.3 on all connections to addr
+//
+//	config can carry X.509 certificates or come from psk.ServerConfig
+func NewTLS(addr string, config *tls.Config) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("tls config required")
+	}
+
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	return newServer(addr, config)
+}
+
+func newServer(addr string, config *tls.Config) (*Server, error) {
 	listen, err := net.Listen("tcp4", addr)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Server{
+		tlsConfig:   config,
 		SubSystems:  make(map[string]Subsystem),
 		SessionInfo: make(map[string]SessionInfo),
+		controllers: make(map[string]*ControllerRegistry),
 		Address:     addr,
 		listen:      listen,
 		quit:        make(chan bool),
+
+		maxC2HDataLength: DefaultMaxC2HDataLength,
 	}
 	s.wg.Add(1)
 	// We always have a discovery subsystem
@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"errors"
+	"hash/crc32"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+const (
+	digestSize = 4
+)
+
+var (
+	ErrHeaderDigest = errors.New("pdu header digest mismatch")
+	ErrDataDigest   = errors.New("pdu data digest mismatch")
+	ErrDigestFlags  = errors.New("pdu digest flags do not match negotiated digests")
+	ErrHeaderLength = errors.New("pdu header length out of range")
+	ErrPDULength    = errors.New("pdu data offset/length out of range")
+)
+
+// NVMe/TCP digests are CRC32C
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func digest(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// hasDigests returns true if the PDU type carries digests when they are enabled
+//
+//	Connection setup and termination PDUs never carry digests
+func hasDigests(t uint8) bool {
+	switch t {
+	case protocol.ICReq, protocol.ICResp, protocol.H2CTermReq, protocol.C2HTermReq:
+		return false
+	}
+	return true
+}
+
+// hasData returns true if PDUs of type t can carry data the data digest covers
+func hasData(t uint8) bool {
+	switch t {
+	case protocol.CapsuleCmd, protocol.H2CData, protocol.C2HData:
+		return true
+	}
+	return false
+}
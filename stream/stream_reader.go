@@ -1,18 +1,35 @@
 package stream
 
 import (
+	"bufio"
+	"encoding/binary"
 	"io"
 
 	"github.com/thirdmartini/go-nvme/internal/utilities"
 	"github.com/thirdmartini/go-nvme/protocol"
 )
 
+// readBufferSize is how much we read ahead from the connection, small PDUs (capsules, H2CData headers)
+// are then parsed without a syscall each. Payloads larger than the buffer bypass it.
+const readBufferSize = 64 * 1024
+
 // Reader implements the on wire decoding of NVME protocol
 type Reader struct {
 	reader io.Reader
 	CH     protocol.CommonHeader
 	header [protocol.MaxHeaderSize]byte
+	digest [digestSize]byte
 	data   []byte
+
+	// digests negotiated during ICReq/ICResp
+	headerDigest bool
+	dataDigest   bool
+}
+
+// EnableDigests enables verification of header and/or data digests on all following PDUs
+func (r *Reader) EnableDigests(header, data bool) {
+	r.headerDigest = header
+	r.dataDigest = data
 }
 
 func (r *Reader) Dequeue() (*protocol.CommonHeader, error) {
@@ -26,38 +43,142 @@ func (r *Reader) Dequeue() (*protocol.CommonHeader, error) {
 }
 
 func (r *Reader) Receive(h protocol.PDU) error {
+	err := r.validate()
+	if err != nil {
+		return err
+	}
+
 	//  Read the remainder of the header
-	err := utilities.MustRead(r.reader, r.header[8:r.CH.HeaderLength])
+	err = utilities.MustRead(r.reader, r.header[8:r.CH.HeaderLength])
 	if err != nil {
 		return err
 	}
 
-	h.Unmarshal(r.header[8:r.CH.HeaderLength])
+	hasHeaderDigest := r.CH.Flags&protocol.PDUFlagHDGSTF != 0
+	hasDataDigest := r.CH.Flags&protocol.PDUFlagDDGSTF != 0
+	// once negotiated every PDU with data carries the digest, PDUs without data never do
+	if hasHeaderDigest != (r.headerDigest && hasDigests(r.CH.Type)) ||
+		hasDataDigest != (r.dataDigest && hasData(r.CH.Type) && r.CH.DataOffset != 0) {
+		return ErrDigestFlags
+	}
 
-	// FIXME: stop allocating things
 	// Slurp the padding that may be between the header and the payload
-	//   [HEADER][PAD][PAYLOAD]
+	//   [HEADER][HDGST][PAD][PAYLOAD][DDGST]
 	slurp := int64(r.CH.DataOffset) - int64(r.CH.HeaderLength)
+	if hasHeaderDigest {
+		slurp -= digestSize
+		err = utilities.MustRead(r.reader, r.digest[:])
+		if err != nil {
+			return err
+		}
+	}
+
 	if slurp > 0 {
-		null := make([]byte, slurp, slurp)
-		err = utilities.MustRead(r.reader, null)
+		_, err = io.CopyN(io.Discard, r.reader, slurp)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.Unmarshal(r.header[8:r.CH.HeaderLength])
+
+	if hasHeaderDigest && binary.LittleEndian.Uint32(r.digest[:]) != digest(r.header[0:r.CH.HeaderLength]) {
+		return ErrHeaderDigest
+	}
+	return nil
+}
+
+// pduHeaderLength is the HLEN of each PDU type, Receive unmarshals exactly this many bytes
+var pduHeaderLength = map[uint8]uint8{
+	protocol.ICReq:       128,
+	protocol.ICResp:      128,
+	protocol.H2CTermReq:  24,
+	protocol.C2HTermReq:  24,
+	protocol.CapsuleCmd:  72,
+	protocol.CapsuleResp: 24,
+	protocol.H2CData:     24,
+	protocol.C2HData:     24,
+	protocol.R2T:         24,
+}
+
+// maxTermReqData is the most error data a termination request may carry after its header
+const maxTermReqData = 128
+
+// validate checks the common header describes a PDU we can parse, a malformed header is a fatal
+// transport error as we can no longer find the start of the next PDU
+func (r *Reader) validate() error {
+	hlen, ok := pduHeaderLength[r.CH.Type]
+	if !ok || r.CH.HeaderLength != hlen {
+		return ErrHeaderLength
+	}
+
+	header := uint32(hlen)
+	if r.CH.Flags&protocol.PDUFlagHDGSTF != 0 {
+		header += digestSize
+	}
+
+	if r.CH.DataOffset == 0 {
+		switch r.CH.Type {
+		case protocol.H2CTermReq, protocol.C2HTermReq:
+			// the error data follows the header, nothing after it is read anyway
+			if r.CH.DataLength < header || r.CH.DataLength > header+maxTermReqData {
+				return ErrPDULength
+			}
+		default:
+			if r.CH.DataLength != header {
+				return ErrPDULength
+			}
+		}
+		return nil
+	}
+
+	trailer := uint32(0)
+	if r.CH.Flags&protocol.PDUFlagDDGSTF != 0 {
+		trailer = digestSize
+	}
+	if uint32(r.CH.DataOffset) < header || r.CH.DataLength < uint32(r.CH.DataOffset)+trailer {
+		return ErrPDULength
 	}
 	return nil
 }
 
 func (r *Reader) Length() uint32 {
 	if r.CH.DataOffset != 0 {
+		if r.CH.Flags&protocol.PDUFlagDDGSTF != 0 {
+			return r.CH.DataLength - uint32(r.CH.DataOffset) - digestSize
+		}
 		return r.CH.DataLength - uint32(r.CH.DataOffset)
 	}
 	return 0
 }
 
+// ReceiveData reads the PDU payload into data
+//
+//	data must be exactly Length() bytes as the data digest (if any) follows it. On a digest
+//	mismatch ErrDataDigest is returned, the stream itself remains usable
 func (r *Reader) ReceiveData(data []byte) error {
-	return utilities.MustRead(r.reader, data)
+	err := utilities.MustRead(r.reader, data)
+	if err != nil {
+		return err
+	}
+
+	if r.CH.Flags&protocol.PDUFlagDDGSTF == 0 {
+		return nil
+	}
+
+	err = utilities.MustRead(r.reader, r.digest[:])
+	if err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(r.digest[:]) != digest(data) {
+		return ErrDataDigest
+	}
+	return nil
 }
 
 func NewReader(r io.Reader) *Reader {
 	return &Reader{
-		reader: r,
+		reader: bufio.NewReaderSize(r, readBufferSize),
 	}
 }
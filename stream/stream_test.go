@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thirdmartini/go-nvme/protocol"
+)
+
+func marshalTestPDU(t *testing.T, header, data bool) ([]byte, []byte) {
+	var buf bytes.Buffer
+
+	payload := make([]byte, 1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	w := NewWriter(&buf)
+	w.EnableDigests(header, data)
+	h2c := protocol.H2CDataTransfer{
+		CCCID: 7,
+		TTAG:  3,
+		DATAO: 0,
+		DATAL: uint32(len(payload)),
+	}
+	err := w.MarshalWithData2(protocol.H2CData, protocol.PDUFlagLastPDU, &h2c, 16, payload)
+	require.Nil(t, err)
+	require.Nil(t, w.Flush())
+	return buf.Bytes(), payload
+}
+
+func TestDigests(t *testing.T) {
+	wire, payload := marshalTestPDU(t, true, true)
+	require.Equal(t, 24+4+len(payload)+4, len(wire))
+
+	r := NewReader(bytes.NewReader(wire))
+	r.EnableDigests(true, true)
+
+	hdr, err := r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, uint8(protocol.PDUFlagHDGSTF|protocol.PDUFlagDDGSTF|protocol.PDUFlagLastPDU), hdr.Flags)
+
+	h2c := protocol.H2CDataTransfer{}
+	require.Nil(t, r.Receive(&h2c))
+	require.Equal(t, uint16(7), h2c.CCCID)
+	require.Equal(t, uint32(len(payload)), r.Length())
+
+	data := make([]byte, r.Length())
+	require.Nil(t, r.ReceiveData(data))
+	require.Equal(t, payload, data)
+}
+
+func TestDigestMismatch(t *testing.T) {
+	// corrupt the header
+	wire, _ := marshalTestPDU(t, true, true)
+	wire[12] ^= 0x1
+
+	r := NewReader(bytes.NewReader(wire))
+	r.EnableDigests(true, true)
+	_, err := r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrHeaderDigest, r.Receive(&protocol.H2CDataTransfer{}))
+
+	// corrupt the data
+	wire, _ = marshalTestPDU(t, true, true)
+	wire[40] ^= 0x1
+
+	r = NewReader(bytes.NewReader(wire))
+	r.EnableDigests(true, true)
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Nil(t, r.Receive(&protocol.H2CDataTransfer{}))
+	require.Equal(t, ErrDataDigest, r.ReceiveData(make([]byte, r.Length())))
+
+	// digests that were not negotiated
+	wire, _ = marshalTestPDU(t, true, false)
+	r = NewReader(bytes.NewReader(wire))
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrDigestFlags, r.Receive(&protocol.H2CDataTransfer{}))
+
+	// data without the negotiated data digest
+	wire, _ = marshalTestPDU(t, true, false)
+	r = NewReader(bytes.NewReader(wire))
+	r.EnableDigests(true, true)
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrDigestFlags, r.Receive(&protocol.H2CDataTransfer{}))
+
+	// a data digest on a pdu without data
+	wire = make([]byte, 24)
+	(&protocol.CommonHeader{
+		Type:         protocol.R2T,
+		Flags:        protocol.PDUFlagDDGSTF,
+		HeaderLength: 24,
+		DataLength:   24,
+	}).Marshal(wire[0:8])
+	r = NewReader(bytes.NewReader(wire))
+	r.EnableDigests(false, true)
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrDigestFlags, r.Receive(&protocol.R2TRequest{}))
+}
+
+func TestMalformedHeader(t *testing.T) {
+	// header length past the largest header we know
+	wire, _ := marshalTestPDU(t, false, false)
+	wire[2] = 0xFF
+
+	r := NewReader(bytes.NewReader(wire))
+	_, err := r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrHeaderLength, r.Receive(&protocol.H2CDataTransfer{}))
+
+	// a capsule with a header too short for the command
+	r = NewReader(bytes.NewReader([]byte{protocol.CapsuleCmd, 0, 8, 0, 8, 0, 0, 0}))
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrHeaderLength, r.Receive(&protocol.CapsuleCommand{}))
+
+	// a pdu length that does not match a pdu without data
+	wire, _ = marshalTestPDU(t, false, false)
+	wire[3] = 0
+	binary.LittleEndian.PutUint32(wire[4:], 40)
+
+	r = NewReader(bytes.NewReader(wire))
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrPDULength, r.Receive(&protocol.H2CDataTransfer{}))
+
+	// data offset past the end of the pdu
+	wire, _ = marshalTestPDU(t, false, false)
+	binary.LittleEndian.PutUint32(wire[4:], 16)
+
+	r = NewReader(bytes.NewReader(wire))
+	_, err = r.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, ErrPDULength, r.Receive(&protocol.H2CDataTransfer{}))
+}
+
+// vectorBuffer records every Writev call
+type vectorBuffer struct {
+	bytes.Buffer
+	writes int
+}
+
+func (v *vectorBuffer) Writev(bufs [][]byte) error {
+	v.writes++
+	for _, b := range bufs {
+		v.Write(b)
+	}
+	return nil
+}
+
+func TestQueueSync(t *testing.T) {
+	var buf vectorBuffer
+	w := NewWriter(&buf)
+	w.EnableDigests(true, true)
+
+	// queued PDUs go out together, in order
+	payload := []byte("0123456789abcdef")
+	for i := uint16(0); i < 4; i++ {
+		h2c := protocol.H2CDataTransfer{CCCID: i, DATAL: uint32(len(payload))}
+		require.Nil(t, w.MarshalWithData2(protocol.H2CData, protocol.PDUFlagLastPDU, &h2c, 16, payload))
+		w.Queue()
+	}
+	require.Equal(t, 0, buf.Len())
+	require.Nil(t, w.Sync())
+	require.Equal(t, 1, buf.writes)
+
+	r := NewReader(&buf.Buffer)
+	r.EnableDigests(true, true)
+	for i := uint16(0); i < 4; i++ {
+		_, err := r.Dequeue()
+		require.Nil(t, err)
+		h2c := protocol.H2CDataTransfer{}
+		require.Nil(t, r.Receive(&h2c))
+		require.Equal(t, i, h2c.CCCID)
+
+		data := make([]byte, r.Length())
+		require.Nil(t, r.ReceiveData(data))
+		require.Equal(t, payload, data)
+	}
+
+	// nothing queued, nothing written
+	require.Nil(t, w.Sync())
+	require.Equal(t, 1, buf.writes)
+}
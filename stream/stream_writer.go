@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"encoding/binary"
 	"io"
 	"log"
 
@@ -8,44 +9,115 @@ import (
 	"github.com/thirdmartini/go-nvme/protocol"
 )
 
+// vectorWriter is implemented by connections that can write several buffers with one call (sys.Conn)
+type vectorWriter interface {
+	Writev(bufs [][]byte) error
+}
+
 type Writer struct {
 	writer io.Writer
 	CH     protocol.CommonHeader
-	header [protocol.MaxHeaderSize]byte
+	header [protocol.MaxHeaderSize + digestSize]byte
+	digest [digestSize]byte
 	data   []byte
+
+	// digests negotiated during ICReq/ICResp
+	headerDigest bool
+	dataDigest   bool
+
+	// PDUs queued by Queue until Sync, headers and digests are copied to arena as header is reused
+	pending [][]byte
+	arena   []byte
 }
 
+// EnableDigests enables generation of header and/or data digests on all following PDUs
+func (s *Writer) EnableDigests(header, data bool) {
+	s.headerDigest = header
+	s.dataDigest = data
+}
+
+// Flush writes any queued PDUs followed by the current one
 func (s *Writer) Flush() error {
-	s.CH.Marshal(s.header[0:8])
-
-	/*
-		// buffered code net.Buffers code should allow us to use read.v ... but alas it performs memory allocations which make it actually
-		// slower
-		if len(s.data) != 0 {
-			v := make(net.Buffers, 0, 3)
-			v = append(v, s.header[0:s.CH.HeaderLength])
-			v = append(v, s.data)
-			v.WriteTo(s.writer)
-		} else {
-			err := utilities.MustWrite(s.writer, s.header[0:s.CH.HeaderLength])
-			if err != nil {
-				return err
-			}
-		}*/
+	s.Queue()
+	return s.Sync()
+}
 
-	err := utilities.MustWrite(s.writer, s.header[0:s.CH.HeaderLength])
-	if err != nil {
-		return err
+// Queue adds the current PDU to the PDUs written by the next Sync (or Flush)
+//
+//	The data of the PDU is not copied, it must stay untouched until then
+func (s *Writer) Queue() {
+	// digests are added to a copy of the header so the PDU can be queued again unchanged
+	ch := s.CH
+	hlen := ch.HeaderLength
+	ddgst := false
+	if hasDigests(ch.Type) {
+		if s.headerDigest {
+			ch.Flags |= protocol.PDUFlagHDGSTF
+			ch.DataLength += digestSize
+			hlen += digestSize
+		}
+		if s.dataDigest && len(s.data) != 0 {
+			ch.Flags |= protocol.PDUFlagDDGSTF
+			ch.DataLength += digestSize
+			ddgst = true
+		}
+	}
+	if len(s.data) != 0 {
+		ch.DataOffset = hlen
 	}
 
+	ch.Marshal(s.header[0:8])
+	if ch.Flags&protocol.PDUFlagHDGSTF != 0 {
+		binary.LittleEndian.PutUint32(s.header[ch.HeaderLength:], digest(s.header[0:ch.HeaderLength]))
+	}
+
+	s.pending = append(s.pending, s.copy(s.header[0:hlen]))
 	if len(s.data) != 0 {
-		return utilities.MustWrite(s.writer, s.data)
+		s.pending = append(s.pending, s.data)
 	}
-	return nil
+
+	if ddgst {
+		binary.LittleEndian.PutUint32(s.digest[:], digest(s.data))
+		s.pending = append(s.pending, s.copy(s.digest[:]))
+	}
+}
+
+// copy stores b in the arena, slices handed out earlier stay valid if the arena has to grow
+func (s *Writer) copy(b []byte) []byte {
+	start := len(s.arena)
+	s.arena = append(s.arena, b...)
+	return s.arena[start:len(s.arena):len(s.arena)]
+}
+
+// Sync writes all queued PDUs, with a single writev when the connection supports it
+func (s *Writer) Sync() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	var err error
+	if vw, ok := s.writer.(vectorWriter); ok {
+		err = vw.Writev(s.pending)
+	} else {
+		for _, b := range s.pending {
+			err = utilities.MustWrite(s.writer, b)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	for i := range s.pending {
+		s.pending[i] = nil
+	}
+	s.pending = s.pending[:0]
+	s.arena = s.arena[:0]
+	return err
 }
 
 func (s *Writer) Send(t uint8, hdr protocol.PDU, hlen uint8) error {
 	s.CH.Type = t
+	s.CH.Flags = 0
 	s.CH.DataOffset = 0
 	s.data = nil
 
@@ -1,15 +1,20 @@
 package nvme
 
 import (
+	"errors"
+
 	"github.com/thirdmartini/go-nvme/targets"
 )
 
+// ErrInvalidNamespace is returned by Identify for a namespace ID the subsystem does not accept
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
 // Subsystem defines the interface to an NVME Subsystem
 type Subsystem interface {
-	Identify(ctrlID uint16, cns uint8) ([]byte, error)
+	Identify(ctrlID uint16, cns uint8, nsid uint32) ([]byte, error)
 	GetLogPage(pageId int, offset uint64, length int) ([]byte, error)
-	HandleIO(r *targets.IORequest) targets.TargetError
-	QueueIO(r *targets.IORequest) targets.TargetError
+	HandleIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError
+	QueueIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError
 	GetNQN() string
 	GetRuntimeDetails() []targets.KV
 }
@@ -0,0 +1,72 @@
+package nvme
+
+import (
+	"sort"
+
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
+)
+
+// HostSecret holds the DH-HMAC-CHAP secrets for a host
+//
+//	Controller is optional, when set the controller can authenticate itself to the host (bidirectional)
+type HostSecret struct {
+	Host       *dhchap.Secret
+	Controller *dhchap.Secret
+}
+
+// SetHostSecret sets the secret hostNQN authenticates with
+//
+//	Secrets are only checked once authentication is required, see SetAuthenticationRequired
+func (s *TargetSubsystem) SetHostSecret(hostNQN string, secret HostSecret) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.hostSecrets == nil {
+		s.hostSecrets = make(map[string]HostSecret)
+	}
+	s.hostSecrets[hostNQN] = secret
+}
+
+// RemoveHostSecret removes the secret for hostNQN
+func (s *TargetSubsystem) RemoveHostSecret(hostNQN string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.hostSecrets, hostNQN)
+}
+
+// GetHostSecret returns the secret configured for hostNQN
+func (s *TargetSubsystem) GetHostSecret(hostNQN string) (HostSecret, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secret, ok := s.hostSecrets[hostNQN]
+	return secret, ok
+}
+
+// ListAuthenticatedHosts returns the hosts that have a secret configured
+func (s *TargetSubsystem) ListAuthenticatedHosts() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hosts := make([]string, 0, len(s.hostSecrets))
+	for host := range s.hostSecrets {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// SetAuthenticationRequired sets whether hosts must authenticate before using the subsystem
+//
+//	Hosts without a secret cannot connect while authentication is required, it only applies to new connections
+func (s *TargetSubsystem) SetAuthenticationRequired(required bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.authRequired = required
+}
+
+// AuthenticationRequired returns true if hosts must authenticate before using the subsystem
+func (s *TargetSubsystem) AuthenticationRequired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.authRequired
+}
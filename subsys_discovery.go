@@ -12,6 +12,9 @@ import (
 
 const (
 	NVMEDiscoverySubsystemName = "nqn.2014-08.org.nvmexpress.discovery"
+
+	// discoveryAsyncEvents are the asynchronous events the discovery subsystem reports (OAES)
+	discoveryAsyncEvents = protocol.AECDiscoveryChange
 )
 
 // DiscoverySubsystem implements an NVME over Fabrics Discovery Service
@@ -28,7 +31,7 @@ func (s *DiscoverySubsystem) GetNQN() string {
 }
 
 // Identify implements Subsystem.Identify
-func (s *DiscoverySubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error) {
+func (s *DiscoverySubsystem) Identify(ctrlID uint16, cns uint8, nsid uint32) ([]byte, error) {
 	sm := serialize.New(make([]byte, 4096, 4096))
 
 	switch cns {
@@ -38,10 +41,12 @@ func (s *DiscoverySubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error)
 			PCIDevice:         0,
 			ControllerId:      ctrlID,
 			Version:           protocol.NVMESpecificationVersion,
-			OAES:              0x80000000,
+			OAES:              discoveryAsyncEvents,
+			AERL:              AsyncEventRequestLimit - 1,
 			LogPageAttributes: 0x4,
 			MaxCMDS:           protocol.NVMECtrlMaxCmds,
-			SGLSupport:        1 | 1<<20,
+			KAS:               KeepAliveGranularity,
+			SGLSupport:        protocol.SGLSupported | protocol.SGLSupportOffset,
 			SubNQN:            NVMEDiscoverySubsystemName,
 		}
 		sm.Serialize(&id)
@@ -57,19 +62,27 @@ func (s *DiscoverySubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error)
 //
 //	as we also have to deal with offsets
 func (s *DiscoverySubsystem) GetLogPage(pageId int, offset uint64, length int) ([]byte, error) {
+	// without a host we only list subsystems that are open to every host
+	return s.GetLogPageForHost("", [16]byte{}, pageId, offset, length)
+}
+
+// GetLogPageForHost returns the log page as seen by a host, the discovery log only lists the
+// subsystems the host is allowed to connect to
+func (s *DiscoverySubsystem) GetLogPageForHost(hostNQN string, hostID [16]byte, pageId int, offset uint64, length int) ([]byte, error) {
 	ss := serialize.New(make([]byte, length, length))
 
 	switch pageId {
 	case protocol.LPDiscovery: // GetList of Discovery Targets we serve
 		// Todo, something we could do here that may be less convoluted is to just jkeep the marshalled log page in memory
 
-		subsys := make([]Subsystem, 0, len(s.Server.SubSystems))
+		all := s.Server.ListSubSystems()
+		subsys := make([]Subsystem, 0, len(all))
 
-		for k := range s.Server.SubSystems {
-			if k == NVMEDiscoverySubsystemName {
+		for _, v := range all {
+			if v.GetNQN() == NVMEDiscoverySubsystemName || !isHostAllowed(v, hostNQN, hostID) {
 				continue
 			}
-			subsys = append(subsys, s.Server.SubSystems[k])
+			subsys = append(subsys, v)
 		}
 
 		sort.Slice(subsys, func(i, j int) bool {
@@ -89,18 +102,7 @@ func (s *DiscoverySubsystem) GetLogPage(pageId int, offset uint64, length int) (
 			ipAndPort := strings.Split(s.Server.Address, ":")
 
 			for _, v := range subsys {
-				dlpe := protocol.DiscoveryLogPageEntry{
-					TransportType:         0x03, // TCP
-					AddressFamily:         0x01, // AF_INET
-					SubsystemType:         0x02, // NVMe Device
-					TransportRequirements: 0x04,
-					PortId:                0x1,
-					ControllerId:          0xffff,       // Dynamic Controller Model
-					AdminMaxQueueSize:     0x2000,       //
-					TransportServiceId:    ipAndPort[1], // port
-					SubNQN:                v.GetNQN(),
-					TransportAddress:      ipAndPort[0],
-				}
+				dlpe := s.logPageEntry(v, ipAndPort)
 				dlp.DiscoveryLofEntries = append(dlp.DiscoveryLofEntries, dlpe)
 			}
 			s.Server.Lock.Unlock()
@@ -115,18 +117,7 @@ func (s *DiscoverySubsystem) GetLogPage(pageId int, offset uint64, length int) (
 			for idx := idxOffset; idx < len(subsys); idx++ {
 				v := subsys[idx]
 
-				dlpe := protocol.DiscoveryLogPageEntry{
-					TransportType:         0x03, // TCP
-					AddressFamily:         0x01, // AF_INET
-					SubsystemType:         0x02, // NVMe Device
-					TransportRequirements: 0x04,
-					PortId:                0x1,
-					ControllerId:          0xffff,       // Dynamic Controller Model
-					AdminMaxQueueSize:     0x2000,       //
-					TransportServiceId:    ipAndPort[1], // port
-					SubNQN:                v.GetNQN(),
-					TransportAddress:      ipAndPort[0],
-				}
+				dlpe := s.logPageEntry(v, ipAndPort)
 				dlp.DiscoveryLofEntries = append(dlp.DiscoveryLofEntries, dlpe)
 			}
 			s.Server.Lock.Unlock()
@@ -139,11 +130,37 @@ func (s *DiscoverySubsystem) GetLogPage(pageId int, offset uint64, length int) (
 	return ss.Get(), nil
 }
 
-func (s *DiscoverySubsystem) HandleIO(r *targets.IORequest) targets.TargetError {
+// logPageEntry builds the discovery log entry for subsys, the server lock must be held
+func (s *DiscoverySubsystem) logPageEntry(subsys Subsystem, ipAndPort []string) protocol.DiscoveryLogPageEntry {
+	// the listener decides, a TLS server takes nothing but TLS and subsystems that require a secure
+	// channel are only added to TLS servers
+	treq := uint8(protocol.TREQDisableSQFlowControl | protocol.TREQSecureChannelNotRequired)
+	tsas := string([]byte{protocol.TSASSecurityNone})
+	if s.Server.IsSecure() {
+		treq = protocol.TREQDisableSQFlowControl | protocol.TREQSecureChannelRequired
+		tsas = string([]byte{protocol.TSASSecurityTLS13})
+	}
+
+	return protocol.DiscoveryLogPageEntry{
+		TransportType:         0x03, // TCP
+		AddressFamily:         0x01, // AF_INET
+		SubsystemType:         0x02, // NVMe Device
+		TransportRequirements: treq,
+		PortId:                0x1,
+		ControllerId:          0xffff,       // Dynamic Controller Model
+		AdminMaxQueueSize:     0x2000,       //
+		TransportServiceId:    ipAndPort[1], // port
+		SubNQN:                subsys.GetNQN(),
+		TransportAddress:      ipAndPort[0],
+		TSAS:                  tsas,
+	}
+}
+
+func (s *DiscoverySubsystem) HandleIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
 	return targets.TargetErrorUnsupported
 }
 
-func (s *DiscoverySubsystem) QueueIO(r *targets.IORequest) targets.TargetError {
+func (s *DiscoverySubsystem) QueueIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
 	return targets.TargetErrorUnsupported
 }
 
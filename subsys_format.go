@@ -0,0 +1,137 @@
+package nvme
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// formatZeroChunk is the size of the Write Zeroes requests that erase targets without targets.EraseTarget
+const formatZeroChunk = 1024 * 1024
+
+// ErrFormatInProgress is returned for a namespace that is already being formatted
+var ErrFormatInProgress = errors.New("format in progress")
+
+// beginFormat marks the namespace as being formatted, I/O to it fails until endFormat
+func (ns *Namespace) beginFormat() error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if ns.formatting {
+		return ErrFormatInProgress
+	}
+	ns.formatting = true
+	ns.remaining = 100
+	return nil
+}
+
+func (ns *Namespace) endFormat() {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.formatting = false
+	ns.remaining = 0
+}
+
+// setFormatRemaining records the percentage of the format still to do
+func (ns *Namespace) setFormatRemaining(remaining uint8) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.remaining = remaining
+}
+
+// beginFormat marks the namespaces as being formatted, unless one of them already is or a sanitize runs
+func (s *TargetSubsystem) beginFormat(namespaces []*Namespace) error {
+	// holding the sanitize lock keeps a sanitize from starting while we mark the namespaces
+	s.sanitize.lock.Lock()
+	defer s.sanitize.lock.Unlock()
+	if s.sanitize.running {
+		return ErrSanitizeInProgress
+	}
+
+	for i, ns := range namespaces {
+		if err := ns.beginFormat(); err != nil {
+			for _, started := range namespaces[:i] {
+				started.endFormat()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatProgress returns true while the namespace is being formatted and the percentage still to do
+func (ns *Namespace) FormatProgress() (bool, uint8) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	return ns.formatting, ns.remaining
+}
+
+// FormatNamespace formats the namespace to the LBA data size blockSize, ses (protocol.SecureErase*)
+// selects whether its data is erased first
+//
+//	It returns once the format is done, until then I/O to the namespace fails with Format In Progress
+//	and Identify Namespace reports the progress (FPI). I/O the namespace took before completes first
+func (s *TargetSubsystem) FormatNamespace(nsid uint32, blockSize uint32, ses uint8) error {
+	ns := s.Namespace(nsid)
+	if ns == nil {
+		return ErrInvalidNamespace
+	}
+	if _, ok := lbaFormat(blockSize); !ok {
+		return ErrInvalidFormat
+	}
+	if err := s.beginFormat([]*Namespace{ns}); err != nil {
+		return err
+	}
+	err := ns.format(blockSize, ses)
+	s.namespacesChanged()
+	return err
+}
+
+// format does the work of a format started with beginFormat
+//
+//	We keep no keys to throw away, a cryptographic erase erases the user data just like a user data
+//	erase does, afterwards every read returns zeros
+func (ns *Namespace) format(blockSize uint32, ses uint8) error {
+	defer ns.endFormat()
+
+	// beginFormat keeps new I/O out, nothing may still use the data or the old block size
+	ns.drain()
+
+	if ses != protocol.SecureEraseNone {
+		progress := func(done, size uint64) {
+			ns.setFormatRemaining(uint8(100 - done*100/size))
+		}
+		if err := eraseTarget(ns.Target, progress); err != nil {
+			return fmt.Errorf("namespace %d erase failed: %w", ns.ID, err)
+		}
+	}
+
+	ns.lock.Lock()
+	ns.BlockSize = blockSize
+	ns.lock.Unlock()
+	return nil
+}
+
+// eraseTarget zeroes all data of the target, progress is told how many of its bytes are done as it goes
+func eraseTarget(t targets.Target, progress func(done, size uint64)) error {
+	if eraser, ok := targets.GetEraser(t); ok {
+		return eraser.Erase()
+	}
+
+	size := t.GetSize()
+	r := &targets.IORequest{}
+	for offset := uint64(0); offset < size; offset += formatZeroChunk {
+		length := uint64(formatZeroChunk)
+		if size-offset < length {
+			length = size - offset
+		}
+
+		r.Init(targets.IORequestCmdWriteZero, offset/targets.DefaultBlockSize, uint32(length), nil)
+		if status := queueAndWait(t, r); status != targets.TargetErrorNone {
+			return fmt.Errorf("write zeroes at %d failed: 0x%x", offset, status)
+		}
+		progress(offset+length, size)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package nvme
+
+import (
+	"sort"
+)
+
+// AllowedHost is an entry in a subsystem's host allow list
+//
+//	A zero HostID accepts the host with any host identifier
+type AllowedHost struct {
+	HostNQN string
+	HostID  [16]byte
+}
+
+// AllowHost adds a host to the subsystem allow list
+//
+//	While the list is empty any host may connect, once a host is added only listed hosts can
+func (s *TargetSubsystem) AllowHost(hostNQN string, hostID [16]byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.allowedHosts == nil {
+		s.allowedHosts = make(map[string]AllowedHost)
+	}
+	s.allowedHosts[hostNQN] = AllowedHost{
+		HostNQN: hostNQN,
+		HostID:  hostID,
+	}
+}
+
+// DisallowHost removes a host from the allow list, existing connections are not affected
+func (s *TargetSubsystem) DisallowHost(hostNQN string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.allowedHosts, hostNQN)
+}
+
+// ListAllowedHosts returns the allow list sorted by host NQN
+func (s *TargetSubsystem) ListAllowedHosts() []AllowedHost {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hosts := make([]AllowedHost, 0, len(s.allowedHosts))
+	for _, host := range s.allowedHosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].HostNQN < hosts[j].HostNQN
+	})
+	return hosts
+}
+
+// IsHostAllowed returns true if the host may connect to the subsystem
+func (s *TargetSubsystem) IsHostAllowed(hostNQN string, hostID [16]byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.allowedHosts) == 0 {
+		return true
+	}
+
+	host, ok := s.allowedHosts[hostNQN]
+	if !ok {
+		return false
+	}
+	return host.HostID == [16]byte{} || host.HostID == hostID
+}
+
+// isHostAllowed checks the allow list of subsystems that have one
+func isHostAllowed(subsys Subsystem, hostNQN string, hostID [16]byte) bool {
+	ts, ok := subsys.(*TargetSubsystem)
+	if !ok {
+		return true
+	}
+	return ts.IsHostAllowed(hostNQN, hostID)
+}
@@ -13,7 +13,7 @@ type InitSubsystem struct {
 	RootController *Controller
 }
 
-func (s *InitSubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error) {
+func (s *InitSubsystem) Identify(ctrlID uint16, cns uint8, nsid uint32) ([]byte, error) {
 	return nil, fmt.Errorf("identify command not supported on root subsystem")
 }
 
@@ -21,11 +21,11 @@ func (s *InitSubsystem) GetLogPage(pageId int, offset uint64, length int) ([]byt
 	return nil, fmt.Errorf("log page command not supported on root subsystem")
 }
 
-func (s *InitSubsystem) HandleIO(r *targets.IORequest) targets.TargetError {
+func (s *InitSubsystem) HandleIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
 	return targets.TargetErrorUnsupported
 }
 
-func (s *InitSubsystem) QueueIO(r *targets.IORequest) targets.TargetError {
+func (s *InitSubsystem) QueueIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
 	return targets.TargetErrorUnsupported
 }
 
@@ -0,0 +1,597 @@
+package nvme
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// MaxNamespaces is the largest namespace ID a target subsystem supports (Identify Controller NN)
+const MaxNamespaces = 1024
+
+// maxNamespaceSize is the largest namespace in bytes CreateNamespace provisions, targets address their
+// data with int64 offsets
+const maxNamespaceSize = math.MaxInt64
+
+// LBAFormats are the LBA data sizes of the formats every namespace advertises, the index is the format
+// number hosts select with FLBAS
+var LBAFormats = []uint32{512, 4096}
+
+// lbaFormat returns the format number of blockSize
+func lbaFormat(blockSize uint32) (uint8, bool) {
+	for i, size := range LBAFormats {
+		if size == blockSize {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// Namespace Management and Attachment errors, see controller_ns.go for the status they map to
+var (
+	ErrNamespaceManagementDisabled = errors.New("namespace management is not enabled")
+	ErrNamespaceIDUnavailable      = errors.New("no namespace id available")
+	ErrNamespaceAlreadyAttached    = errors.New("namespace already attached")
+	ErrNamespaceNotAttached        = errors.New("namespace not attached")
+	ErrInvalidFormat               = errors.New("lba format not supported")
+	ErrInsufficientCapacity        = errors.New("namespace size exceeds the capacity")
+)
+
+// NamespaceBackend is the target type and its default options used for namespaces made with
+// Namespace Management, e.g. type "file" with a "dir" option creates sparse images in that directory
+type NamespaceBackend struct {
+	Type    string
+	Options targets.Options
+}
+
+// namespaceOUI is the IEEE OUI used to build an EUI64 for namespaces that are not given one
+var namespaceOUI = [3]byte{0x38, 0x25, 0x00}
+
+// Namespace is a volume of a target subsystem backed by its own target
+//
+//	NGUID and EUI64 are derived from the UUID when left zero, BlockSize is one of LBAFormats and
+//	defaults to 512 bytes. Format NVM changes BlockSize, use LBASize to read it
+type Namespace struct {
+	ID        uint32
+	Target    targets.Target
+	UUID      [16]byte
+	NGUID     [16]byte
+	EUI64     [8]byte
+	BlockSize uint32
+
+	// hosts the namespace is attached to by host NQN, nil attaches it to every host. Attachments are
+	// kept by host so they outlive the controllers they were made through
+	hosts map[string]bool
+
+	// options are set for namespaces made by CreateNamespace, their storage is released on delete
+	options targets.Options
+
+	// lock guards BlockSize once the namespace is in a subsystem and the state of a Format NVM,
+	// remaining is the percentage of the format still to do, see subsys_format.go
+	lock       sync.Mutex
+	formatting bool
+	remaining  uint8
+
+	// active counts the requests QueueIO handed to the target, removed is set once the namespace left
+	// its subsystem and drained is closed when the last active request completes, see drain
+	active  int
+	removed bool
+	drained chan struct{}
+}
+
+// attachedTo returns true if the namespace is active for the controller, must be called with nsLock held
+func (s *TargetSubsystem) attachedTo(ns *Namespace, ctrlID uint16) bool {
+	if ns.hosts == nil {
+		return true
+	}
+	host, ok := s.controllerHosts[ctrlID]
+	return ok && ns.hosts[host]
+}
+
+// LBASize returns the LBA data size of the namespace in bytes
+func (ns *Namespace) LBASize() uint32 {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if ns.BlockSize == 0 {
+		return targets.DefaultBlockSize
+	}
+	return ns.BlockSize
+}
+
+// LBAFormat returns the format number of the namespace (FLBAS)
+func (ns *Namespace) LBAFormat() uint8 {
+	format, _ := lbaFormat(ns.LBASize())
+	return format
+}
+
+// Blocks returns the size of the namespace in logical blocks
+func (ns *Namespace) Blocks() uint64 {
+	return ns.Target.GetSize() / uint64(ns.LBASize())
+}
+
+func (ns *Namespace) setDefaultIdentifiers() {
+	if ns.UUID == [16]byte{} {
+		return
+	}
+	if ns.NGUID == [16]byte{} {
+		ns.NGUID = ns.UUID
+	}
+	if ns.EUI64 == [8]byte{} {
+		copy(ns.EUI64[0:3], namespaceOUI[:])
+		copy(ns.EUI64[3:], ns.UUID[0:5])
+	}
+}
+
+// validNamespaceID returns true for IDs a namespace can have, whether it exists or not
+func validNamespaceID(nsid uint32) bool {
+	return nsid != 0 && nsid <= MaxNamespaces
+}
+
+// namespaceMap returns the namespaces of the subsystem, must be called with nsLock held
+//
+//	A subsystem set up with only Target gets it as namespace 1
+func (s *TargetSubsystem) namespaceMap() map[uint32]*Namespace {
+	s.nsOnce.Do(func() {
+		s.namespaces = make(map[uint32]*Namespace)
+		if s.Target != nil {
+			ns := &Namespace{
+				ID:        1,
+				Target:    s.Target,
+				UUID:      s.UUID,
+				BlockSize: s.BlockSize,
+			}
+			ns.setDefaultIdentifiers()
+			s.namespaces[ns.ID] = ns
+		}
+	})
+	return s.namespaces
+}
+
+// AddNamespace adds a namespace to the subsystem, it is attached to every controller
+func (s *TargetSubsystem) AddNamespace(ns *Namespace) error {
+	if !validNamespaceID(ns.ID) {
+		return fmt.Errorf("namespace id %d out of range 1-%d", ns.ID, MaxNamespaces)
+	}
+	if ns.Target == nil {
+		return fmt.Errorf("namespace %d has no target", ns.ID)
+	}
+	if _, ok := lbaFormat(ns.LBASize()); !ok {
+		return fmt.Errorf("namespace %d block size %d not supported", ns.ID, ns.BlockSize)
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	if err := s.applyWriteCache(ns.Target); err != nil {
+		return fmt.Errorf("namespace %d: %w", ns.ID, err)
+	}
+
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+
+	namespaces := s.namespaceMap()
+	if _, ok := namespaces[ns.ID]; ok {
+		return fmt.Errorf("namespace %d already exists", ns.ID)
+	}
+	ns.setDefaultIdentifiers()
+	namespaces[ns.ID] = ns
+	return nil
+}
+
+// RemoveNamespace takes a namespace out of the subsystem and returns it once the I/O queued to it
+// finished, the target is not closed
+func (s *TargetSubsystem) RemoveNamespace(nsid uint32) *Namespace {
+	s.nsLock.Lock()
+	namespaces := s.namespaceMap()
+	ns := namespaces[nsid]
+	if ns != nil {
+		// I/O that looked the namespace up before it was removed fails with Invalid Namespace
+		ns.lock.Lock()
+		ns.removed = true
+		ns.lock.Unlock()
+		delete(namespaces, nsid)
+	}
+	s.nsLock.Unlock()
+
+	if ns != nil {
+		ns.drain()
+	}
+	return ns
+}
+
+// beginIO admits a request to the target of the namespace, endIO has to follow once it completed
+func (ns *Namespace) beginIO() targets.TargetError {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	switch {
+	case ns.removed:
+		return targets.TargetErrorInvalidNamespace
+	case ns.formatting:
+		return targets.TargetErrorFormatInProgress
+	}
+	ns.active++
+	return targets.TargetErrorNone
+}
+
+func (ns *Namespace) endIO() {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.active--
+	if ns.active == 0 && ns.drained != nil {
+		close(ns.drained)
+		ns.drained = nil
+	}
+}
+
+// drain waits for the requests admitted by beginIO to complete, whatever keeps new ones out has
+// to be set before
+func (ns *Namespace) drain() {
+	ns.lock.Lock()
+	if ns.active == 0 {
+		ns.lock.Unlock()
+		return
+	}
+	if ns.drained == nil {
+		ns.drained = make(chan struct{})
+	}
+	drained := ns.drained
+	ns.lock.Unlock()
+	<-drained
+}
+
+// Namespace returns the allocated namespace with nsid or nil if there is none
+func (s *TargetSubsystem) Namespace(nsid uint32) *Namespace {
+	s.nsLock.RLock()
+	defer s.nsLock.RUnlock()
+	return s.namespaceMap()[nsid]
+}
+
+// AttachedNamespace returns the namespace with nsid if it is attached to the controller
+func (s *TargetSubsystem) AttachedNamespace(ctrlID uint16, nsid uint32) *Namespace {
+	s.nsLock.RLock()
+	defer s.nsLock.RUnlock()
+
+	ns := s.namespaceMap()[nsid]
+	if ns == nil || !s.attachedTo(ns, ctrlID) {
+		return nil
+	}
+	return ns
+}
+
+// Namespaces returns the allocated namespaces of the subsystem ordered by ID
+func (s *TargetSubsystem) Namespaces() []*Namespace {
+	return s.listNamespaces(func(ns *Namespace) bool {
+		return true
+	})
+}
+
+// AttachedNamespaces returns the namespaces attached to the controller ordered by ID
+func (s *TargetSubsystem) AttachedNamespaces(ctrlID uint16) []*Namespace {
+	return s.listNamespaces(func(ns *Namespace) bool {
+		return s.attachedTo(ns, ctrlID)
+	})
+}
+
+func (s *TargetSubsystem) listNamespaces(match func(ns *Namespace) bool) []*Namespace {
+	s.nsLock.RLock()
+	defer s.nsLock.RUnlock()
+
+	namespaces := s.namespaceMap()
+	list := make([]*Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if match(ns) {
+			list = append(list, ns)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Capacity returns the combined size in bytes of all namespaces
+func (s *TargetSubsystem) Capacity() uint64 {
+	size := uint64(0)
+	for _, ns := range s.Namespaces() {
+		size += ns.Target.GetSize()
+	}
+	return size
+}
+
+// NamespaceManagement returns true if hosts can create and delete namespaces
+func (s *TargetSubsystem) NamespaceManagement() bool {
+	return s.NamespaceBackend.Type != ""
+}
+
+// CreateNamespace provisions a namespace of blocks logical blocks of blockSize bytes on the
+// NamespaceBackend with the lowest free ID
+//
+//	The namespace is not attached to any host
+func (s *TargetSubsystem) CreateNamespace(blocks uint64, blockSize uint32) (*Namespace, error) {
+	if !s.NamespaceManagement() {
+		return nil, ErrNamespaceManagementDisabled
+	}
+	if _, ok := lbaFormat(blockSize); !ok {
+		return nil, ErrInvalidFormat
+	}
+	// the size in bytes has to fit, blocks*blockSize must not wrap
+	if blocks > maxNamespaceSize/uint64(blockSize) {
+		return nil, ErrInsufficientCapacity
+	}
+
+	ns, err := s.createNamespace(blocks, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	s.namespacesChanged()
+	return ns, nil
+}
+
+func (s *TargetSubsystem) createNamespace(blocks uint64, blockSize uint32) (*Namespace, error) {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+
+	namespaces := s.namespaceMap()
+	nsid := uint32(1)
+	for ; nsid <= MaxNamespaces; nsid++ {
+		if _, ok := namespaces[nsid]; !ok {
+			break
+		}
+	}
+	if nsid > MaxNamespaces {
+		return nil, ErrNamespaceIDUnavailable
+	}
+
+	id := uuid.New()
+	options := s.NamespaceBackend.Options
+	if options == nil {
+		options = targets.Options{}
+	}
+	target, options, err := targets.Provision(s.NamespaceBackend.Type, id.String(), blocks*uint64(blockSize), options)
+	if err != nil {
+		return nil, err
+	}
+	if err = target.Start(); err != nil {
+		target.Close()
+		targets.Release(s.NamespaceBackend.Type, options)
+		return nil, err
+	}
+	if err = s.applyWriteCache(target); err != nil {
+		target.Close()
+		targets.Release(s.NamespaceBackend.Type, options)
+		return nil, err
+	}
+
+	ns := &Namespace{
+		ID:        nsid,
+		Target:    target,
+		BlockSize: blockSize,
+		hosts:     make(map[string]bool),
+		options:   options,
+	}
+	copy(ns.UUID[:], id[:])
+	ns.setDefaultIdentifiers()
+	namespaces[nsid] = ns
+	return ns, nil
+}
+
+// NamespaceState is what it takes to restore a namespace made by CreateNamespace after a restart
+type NamespaceState struct {
+	ID        uint32
+	UUID      [16]byte
+	BlockSize uint32
+	// Options open the target on the NamespaceBackend
+	Options targets.Options
+	// Hosts are the NQNs of the hosts the namespace is attached to
+	Hosts []string
+}
+
+// CreatedNamespaces returns the state of the namespaces made by CreateNamespace ordered by ID
+func (s *TargetSubsystem) CreatedNamespaces() []NamespaceState {
+	s.nsLock.RLock()
+	defer s.nsLock.RUnlock()
+
+	var list []NamespaceState
+	for _, ns := range s.namespaceMap() {
+		if ns.options == nil {
+			continue
+		}
+
+		state := NamespaceState{
+			ID:        ns.ID,
+			UUID:      ns.UUID,
+			BlockSize: ns.LBASize(),
+			Options:   ns.options.Copy(),
+			Hosts:     make([]string, 0, len(ns.hosts)),
+		}
+		for host := range ns.hosts {
+			state.Hosts = append(state.Hosts, host)
+		}
+		sort.Strings(state.Hosts)
+		list = append(list, state)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// RestoreNamespace opens a namespace saved from CreatedNamespaces on the NamespaceBackend and adds it
+// to the subsystem with its attachments, deleting it releases its storage like one made by CreateNamespace
+func (s *TargetSubsystem) RestoreNamespace(state NamespaceState) error {
+	if !s.NamespaceManagement() {
+		return ErrNamespaceManagementDisabled
+	}
+
+	target, err := targets.New(s.NamespaceBackend.Type, state.Options)
+	if err != nil {
+		return fmt.Errorf("namespace %d: %w", state.ID, err)
+	}
+	if err = target.Start(); err != nil {
+		target.Close()
+		return fmt.Errorf("namespace %d: %w", state.ID, err)
+	}
+
+	ns := &Namespace{
+		ID:        state.ID,
+		Target:    target,
+		UUID:      state.UUID,
+		BlockSize: state.BlockSize,
+		hosts:     make(map[string]bool),
+		options:   state.Options.Copy(),
+	}
+	for _, host := range state.Hosts {
+		ns.hosts[host] = true
+	}
+	if err = s.AddNamespace(ns); err != nil {
+		target.Close()
+		return err
+	}
+	return nil
+}
+
+// namespacesChanged tells NamespacesChanged that namespaces were created, deleted, attached, detached
+// or formatted
+func (s *TargetSubsystem) namespacesChanged() {
+	if s.NamespacesChanged != nil {
+		s.NamespacesChanged()
+	}
+}
+
+// DeleteNamespace removes the namespace and closes its target, the storage of namespaces made by
+// CreateNamespace is released
+func (s *TargetSubsystem) DeleteNamespace(nsid uint32) error {
+	ns := s.RemoveNamespace(nsid)
+	if ns == nil {
+		return ErrInvalidNamespace
+	}
+	// the namespace is gone even if closing or releasing its target fails
+	s.namespacesChanged()
+
+	err := ns.Target.Close()
+	if ns.options == nil {
+		return err
+	}
+
+	release := targets.Release(s.NamespaceBackend.Type, ns.options)
+	if err == nil {
+		err = release
+	}
+	return err
+}
+
+// AttachNamespace attaches the namespace to the hosts of the controllers, none of which may have it
+// attached. It stays attached to those hosts when their controllers go away
+func (s *TargetSubsystem) AttachNamespace(nsid uint32, ctrlIDs []uint16) error {
+	if err := s.attachNamespace(nsid, ctrlIDs); err != nil {
+		return err
+	}
+	s.namespacesChanged()
+	return nil
+}
+
+func (s *TargetSubsystem) attachNamespace(nsid uint32, ctrlIDs []uint16) error {
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+
+	ns := s.namespaceMap()[nsid]
+	if ns == nil {
+		return ErrInvalidNamespace
+	}
+	for _, id := range ctrlIDs {
+		if s.attachedTo(ns, id) {
+			return ErrNamespaceAlreadyAttached
+		}
+	}
+	for _, id := range ctrlIDs {
+		if host, ok := s.controllerHosts[id]; ok {
+			ns.hosts[host] = true
+		}
+	}
+	return nil
+}
+
+// DetachNamespace detaches the namespace from the hosts of the controllers, all of which must have it
+// attached
+//
+//	A namespace attached to every host stays attached to the other hosts of live, the controllers of
+//	the subsystem at this time
+func (s *TargetSubsystem) DetachNamespace(nsid uint32, ctrlIDs []uint16, live []uint16) error {
+	if err := s.detachNamespace(nsid, ctrlIDs, live); err != nil {
+		return err
+	}
+	s.namespacesChanged()
+	return nil
+}
+
+func (s *TargetSubsystem) detachNamespace(nsid uint32, ctrlIDs []uint16, live []uint16) error {
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+
+	ns := s.namespaceMap()[nsid]
+	if ns == nil {
+		return ErrInvalidNamespace
+	}
+	for _, id := range ctrlIDs {
+		if !s.attachedTo(ns, id) {
+			return ErrNamespaceNotAttached
+		}
+	}
+
+	if ns.hosts == nil {
+		ns.hosts = make(map[string]bool)
+		for _, id := range live {
+			if host, ok := s.controllerHosts[id]; ok {
+				ns.hosts[host] = true
+			}
+		}
+	}
+	for _, id := range ctrlIDs {
+		delete(ns.hosts, s.controllerHosts[id])
+	}
+	return nil
+}
+
+// AttachedControllers returns the controllers of live the namespace is attached to
+func (s *TargetSubsystem) AttachedControllers(nsid uint32, live []uint16) []uint16 {
+	s.nsLock.RLock()
+	defer s.nsLock.RUnlock()
+
+	ns := s.namespaceMap()[nsid]
+	if ns == nil {
+		return nil
+	}
+
+	var ids []uint16
+	for _, id := range live {
+		if s.attachedTo(ns, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// registerController records the host of a new controller, namespaces are attached by host
+func (s *TargetSubsystem) registerController(ctrlID uint16, hostNQN string) {
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+
+	if s.controllerHosts == nil {
+		s.controllerHosts = make(map[uint16]string)
+	}
+	s.controllerHosts[ctrlID] = hostNQN
+}
+
+// releaseController forgets a controller that went away, the attachments of its host are kept for
+// the controllers the host connects next
+func (s *TargetSubsystem) releaseController(ctrlID uint16) {
+	s.nsLock.Lock()
+	defer s.nsLock.Unlock()
+	delete(s.controllerHosts, ctrlID)
+}
@@ -0,0 +1,231 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/targets"
+)
+
+// sanitizeOverwriteChunk is the size of the writes that overwrite a target with the sanitize pattern
+const sanitizeOverwriteChunk = 1024 * 1024
+
+// Sanitize errors, see controller_sanitize.go for the status they map to
+var (
+	ErrSanitizeInProgress = errors.New("sanitize in progress")
+	ErrSanitizeFailed     = errors.New("sanitize failed")
+	ErrInvalidSanitize    = errors.New("invalid sanitize action")
+)
+
+// sanitizeState is what the Sanitize Status log reports about the last sanitize of a subsystem
+type sanitizeState struct {
+	lock     sync.Mutex
+	running  bool
+	status   uint16 // SSTAT
+	progress uint16 // SPROG
+	cdw10    uint32
+
+	// failed is set after a sanitize failed, restricted when the host did not allow an unrestricted
+	// exit (AUSE) and only a successful sanitize ends the failure
+	failed     bool
+	restricted bool
+}
+
+// Sanitize starts a sanitize of every namespace of the subsystem, cdw10 is that of the Sanitize command
+// (protocol.Sanitize*) and pattern the overwrite pattern
+//
+//	The sanitize runs in the background and done is called once it finished. Until then I/O fails with
+//	Sanitize In Progress and the Sanitize Status log reports the progress, I/O the namespaces took before
+//	completes ahead of the erase. Exit Failure Mode returns right away
+func (s *TargetSubsystem) Sanitize(cdw10, pattern uint32, done func()) error {
+	s.sanitize.lock.Lock()
+	defer s.sanitize.lock.Unlock()
+	if s.sanitize.running {
+		return ErrSanitizeInProgress
+	}
+
+	switch cdw10 & protocol.SanitizeActionMask {
+	case protocol.SanitizeExitFailureMode:
+		if s.sanitize.failed && s.sanitize.restricted {
+			return ErrSanitizeFailed
+		}
+		s.sanitize.failed = false
+		return nil
+
+	case protocol.SanitizeBlockErase, protocol.SanitizeOverwrite, protocol.SanitizeCryptoErase:
+
+	default:
+		return ErrInvalidSanitize
+	}
+
+	namespaces := s.Namespaces()
+	for _, ns := range namespaces {
+		if formatting, _ := ns.FormatProgress(); formatting {
+			return ErrFormatInProgress
+		}
+	}
+
+	s.sanitize.running = true
+	s.sanitize.status = protocol.SanitizeStatusInProgress
+	s.sanitize.progress = 0
+	s.sanitize.cdw10 = cdw10
+
+	go func() {
+		// running keeps new I/O out, what QueueIO admitted before has to finish
+		for _, ns := range namespaces {
+			ns.drain()
+		}
+		err := s.runSanitize(namespaces, cdw10, pattern)
+
+		s.sanitize.lock.Lock()
+		s.sanitize.running = false
+		s.sanitize.progress = 0xFFFF
+		if err != nil {
+			fmt.Printf("Sanitize Error: %s\n", err.Error())
+			s.sanitize.status = protocol.SanitizeStatusFailed
+			s.sanitize.failed = true
+			s.sanitize.restricted = cdw10&protocol.SanitizeAUSE == 0
+		} else {
+			s.sanitize.status = protocol.SanitizeStatusCompleted
+			if cdw10&protocol.SanitizeActionMask == protocol.SanitizeOverwrite {
+				s.sanitize.status |= uint16(sanitizePasses(cdw10)&protocol.SanitizeStatusPassesMask) << protocol.SanitizeStatusPassesShift
+			}
+			s.sanitize.failed = false
+		}
+		s.sanitize.lock.Unlock()
+
+		if done != nil {
+			done()
+		}
+	}()
+	return nil
+}
+
+// sanitizePasses returns the number of overwrite passes, a count of 0 asks for 16
+func sanitizePasses(cdw10 uint32) uint64 {
+	passes := uint64(cdw10 >> protocol.SanitizeOWPASSShift & protocol.SanitizeOWPASSMask)
+	if passes == 0 {
+		passes = 16
+	}
+	return passes
+}
+
+// runSanitize erases or overwrites the namespaces one after the other
+//
+//	Like Format NVM a crypto erase is a block erase for us, we keep no keys to throw away
+func (s *TargetSubsystem) runSanitize(namespaces []*Namespace, cdw10, pattern uint32) error {
+	overwrite := cdw10&protocol.SanitizeActionMask == protocol.SanitizeOverwrite
+	passes := uint64(1)
+	if overwrite {
+		passes = sanitizePasses(cdw10)
+	}
+
+	total := uint64(0)
+	for _, ns := range namespaces {
+		total += ns.Target.GetSize() * passes
+	}
+
+	finished := uint64(0)
+	progress := func(done, size uint64) {
+		s.setSanitizeProgress(finished+done, total)
+	}
+	for _, ns := range namespaces {
+		for pass := uint64(0); pass < passes; pass++ {
+			var err error
+			if overwrite {
+				p := pattern
+				if cdw10&protocol.SanitizeOIPBP != 0 && pass%2 == 1 {
+					p = ^p
+				}
+				err = overwriteTarget(ns.Target, p, progress)
+			} else {
+				err = eraseTarget(ns.Target, progress)
+			}
+			if err != nil {
+				return fmt.Errorf("namespace %d: %w", ns.ID, err)
+			}
+
+			finished += ns.Target.GetSize()
+			s.setSanitizeProgress(finished, total)
+		}
+
+		if status := flushTarget(ns.Target); status != targets.TargetErrorNone {
+			return fmt.Errorf("namespace %d flush failed: 0x%x", ns.ID, status)
+		}
+	}
+	return nil
+}
+
+// overwriteTarget writes the 32 bit pattern over all of the target
+func overwriteTarget(t targets.Target, pattern uint32, progress func(done, size uint64)) error {
+	size := t.GetSize()
+	buf := make([]byte, sanitizeOverwriteChunk)
+	for i := 0; i < len(buf); i += 4 {
+		binary.LittleEndian.PutUint32(buf[i:], pattern)
+	}
+
+	r := &targets.IORequest{}
+	for offset := uint64(0); offset < size; offset += sanitizeOverwriteChunk {
+		length := uint64(sanitizeOverwriteChunk)
+		if size-offset < length {
+			length = size - offset
+		}
+
+		r.Init(targets.IORequestCmdWrite, offset/targets.DefaultBlockSize, uint32(length), nil)
+		r.AddBuffer(buf[:length])
+		if status := queueAndWait(t, r); status != targets.TargetErrorNone {
+			return fmt.Errorf("overwrite at %d failed: 0x%x", offset, status)
+		}
+		progress(offset+length, size)
+	}
+	return nil
+}
+
+// setSanitizeProgress records done bytes of total as SPROG, a fraction of 65536
+func (s *TargetSubsystem) setSanitizeProgress(done, total uint64) {
+	progress := uint64(0xFFFF)
+	if total != 0 && done*0x10000/total < progress {
+		progress = done * 0x10000 / total
+	}
+
+	s.sanitize.lock.Lock()
+	defer s.sanitize.lock.Unlock()
+	if s.sanitize.running {
+		s.sanitize.progress = uint16(progress)
+	}
+}
+
+// sanitizeIOStatus returns the error for I/O while a sanitize runs or after it failed
+func (s *TargetSubsystem) sanitizeIOStatus() targets.TargetError {
+	s.sanitize.lock.Lock()
+	defer s.sanitize.lock.Unlock()
+	switch {
+	case s.sanitize.running:
+		return targets.TargetErrorSanitizeInProgress
+	case s.sanitize.failed:
+		return targets.TargetErrorSanitizeFailed
+	}
+	return targets.TargetErrorNone
+}
+
+// SanitizeStatus returns the Sanitize Status log of the subsystem
+func (s *TargetSubsystem) SanitizeStatus() protocol.SanitizeStatusLog {
+	s.sanitize.lock.Lock()
+	defer s.sanitize.lock.Unlock()
+
+	lp := protocol.SanitizeStatusLog{
+		SPROG:         0xFFFF,
+		SSTAT:         s.sanitize.status,
+		SCDW10:        s.sanitize.cdw10,
+		ETOverwrite:   protocol.SanitizeNoEstimate,
+		ETBlockErase:  protocol.SanitizeNoEstimate,
+		ETCryptoErase: protocol.SanitizeNoEstimate,
+	}
+	if s.sanitize.running {
+		lp.SPROG = s.sanitize.progress
+	}
+	return lp
+}
@@ -1,7 +1,9 @@
 package nvme
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
 
 	"github.com/thirdmartini/go-nvme/internal/serialize"
 	"github.com/thirdmartini/go-nvme/protocol"
@@ -14,7 +16,17 @@ const (
 	MaximumPDUDataSize = (64 + MaximumDataSize) / 16 // 64Bytes for Header + 262144 for data
 	// and the value must be in 16byte units
 
-	NumberOfNamespaces = 1
+	// DefaultMaxTransferSize is the largest single command transfer (MDTS) unless the subsystem sets one,
+	// MaxTransferSizeLimit is the largest we allow to be configured
+	DefaultMaxTransferSize = 65536
+	MaxTransferSizeLimit   = 2 * 1024 * 1024
+
+	// MDTS is reported as a power of two in units of the minimum memory page size (CAP.MPSMIN)
+	mdtsUnit = 4096
+
+	// targetAsyncEvents are the asynchronous events a target subsystem reports (OAES), there are no
+	// SMART readings and the one ANA group never changes state
+	targetAsyncEvents = protocol.AECNamespaceAttribute
 )
 
 type TargetSubsystem struct {
@@ -23,75 +35,248 @@ type TargetSubsystem struct {
 	ModelName       string
 	SerialNumber    string
 	FirmwareVersion string
-	Target          targets.Target
+	// Target and UUID describe namespace 1 of a subsystem with a single namespace, subsystems with
+	// more namespaces leave Target nil and use AddNamespace, see subsys_namespace.go
+	Target targets.Target
+	// BlockSize is the LBA data size of namespace 1 when Target is used, 0 selects 512 bytes
+	BlockSize uint32
+
+	// MaxTransferSize is the largest data transfer of a single command in bytes, it is rounded down to a
+	// power of two between 4K and MaxTransferSizeLimit. 0 selects DefaultMaxTransferSize
+	MaxTransferSize uint32
+
+	// SecureChannelRequired rejects hosts that connect without TLS
+	SecureChannelRequired bool
+
+	// NamespaceBackend enables Namespace Management, hosts create their namespaces on it
+	NamespaceBackend NamespaceBackend
+	// NamespacesChanged is called after hosts created, deleted, attached, detached or formatted
+	// namespaces, CreatedNamespaces returns what to save to restore them with RestoreNamespace
+	NamespacesChanged func()
+
+	// hostSecrets holds the DH-HMAC-CHAP secrets hosts authenticate with once authRequired is set, see
+	// subsys_auth.go
+	// allowedHosts limits which hosts can connect, see subsys_hosts.go
+	lock         sync.Mutex
+	authRequired bool
+	hostSecrets  map[string]HostSecret
+	allowedHosts map[string]AllowedHost
+
+	// writeThrough is set when the volatile write cache is disabled, cacheLock also keeps namespaces
+	// from being added while the setting is applied to the others
+	cacheLock    sync.Mutex
+	writeThrough bool
+
+	// namespaces holds the namespaces by ID and controllerHosts the host NQN of each live controller
+	// for the namespace attachments, see subsys_namespace.go
+	nsLock          sync.RWMutex
+	nsOnce          sync.Once
+	namespaces      map[uint32]*Namespace
+	controllerHosts map[uint16]string
+
+	// sanitize is the state of the last Sanitize command, see subsys_sanitize.go
+	sanitize sanitizeState
 }
 
 func (s *TargetSubsystem) GetNQN() string {
 	return s.NQN
 }
 
-func (s *TargetSubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error) {
+// TransferSize returns the largest data transfer of a single command in bytes
+func (s *TargetSubsystem) TransferSize() uint32 {
+	return mdtsUnit << s.mdts()
+}
+
+func (s *TargetSubsystem) mdts() uint8 {
+	size := s.MaxTransferSize
+	if size == 0 {
+		size = DefaultMaxTransferSize
+	}
+	if size > MaxTransferSizeLimit {
+		size = MaxTransferSizeLimit
+	}
+
+	n := uint8(0)
+	for mdtsUnit<<(n+1) <= size {
+		n++
+	}
+	return n
+}
+
+// VolatileWriteCache returns whether any namespace has a volatile write cache and if it is enabled
+func (s *TargetSubsystem) VolatileWriteCache() (present bool, enabled bool) {
+	for _, ns := range s.Namespaces() {
+		if _, ok := targets.GetWriteCache(ns.Target); ok {
+			present = true
+			break
+		}
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	return present, !s.writeThrough
+}
+
+// SetVolatileWriteCache enables or disables the write cache of every namespace that has one, the setting
+// belongs to the subsystem and is seen by all controllers
+//
+//	Namespaces added later get the same setting
+func (s *TargetSubsystem) SetVolatileWriteCache(enable bool) error {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	s.writeThrough = !enable
+	for _, ns := range s.Namespaces() {
+		if err := s.applyWriteCache(ns.Target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWriteCache gives target the volatile write cache setting of the subsystem, s.cacheLock must be held
+func (s *TargetSubsystem) applyWriteCache(target targets.Target) error {
+	wc, ok := targets.GetWriteCache(target)
+	if !ok {
+		return nil
+	}
+	return wc.SetWriteCache(!s.writeThrough)
+}
+
+func identifyNamespace(ns *Namespace) *protocol.IdentifyNamespaceData {
+	id := &protocol.IdentifyNamespaceData{
+		NSFEAT:   0x0, // was 0x2
+		NMIC:     0x1,
+		RESCAP:   0xff, //0x12,
+		FPI:      protocol.FPISupported,
+		ANAGRPID: 0x1, // was  0x1
+	}
+	id.NLBAF = uint8(len(LBAFormats) - 1) // 0based (ie +1)
+	for i, size := range LBAFormats {
+		id.LBAF[i] = protocol.LBAFormat(size)
+	}
+
+	if ns != nil {
+		size := ns.Target.GetSize()
+		lbaCount := ns.Blocks()
+		id.FLBAS = ns.LBAFormat()
+		if _, remaining := ns.FormatProgress(); remaining != 0 {
+			id.FPI |= remaining & protocol.FPIRemainingMask
+		}
+		id.NSZE = lbaCount
+		id.NCAP = lbaCount
+		id.NUSE = lbaCount
+		id.NVMCAP = [2]uint64{size, 0}
+		id.NGUID = ns.NGUID
+		// the EUI64 is stored big endian, serializing the field little endian has to give back the same bytes
+		id.EUI64 = binary.LittleEndian.Uint64(ns.EUI64[:])
+	}
+	return id
+}
+
+// namespaceDescriptors returns the Namespace Identification Descriptor list of ns, zero identifiers are left out
+func namespaceDescriptors(ns *Namespace, data []byte) []byte {
+	offset := 0
+	add := func(nidt uint8, nid []byte) {
+		for _, b := range nid {
+			if b != 0 {
+				desc := protocol.NamespaceDescriptor{NIDT: nidt, NID: nid}
+				offset += desc.Marshal(data[offset:])
+				return
+			}
+		}
+	}
+	add(protocol.NIDTEUI64, ns.EUI64[:])
+	add(protocol.NIDTNGUID, ns.NGUID[:])
+	add(protocol.NIDTUUID, ns.UUID[:])
+	return data
+}
+
+// namespaceList returns the IDs of the namespaces greater than nsid, namespaces has to be sorted
+func namespaceList(namespaces []*Namespace, nsid uint32) *protocol.IdentifyActiveNamespaceListData {
+	id := &protocol.IdentifyActiveNamespaceListData{}
+	idx := 0
+	for _, ns := range namespaces {
+		if ns.ID <= nsid {
+			continue
+		}
+		if idx == len(id.CNS) {
+			break
+		}
+		id.CNS[idx] = ns.ID
+		idx++
+	}
+	return id
+}
+
+func (s *TargetSubsystem) Identify(ctrlID uint16, cns uint8, nsid uint32) ([]byte, error) {
 	sm := serialize.New(make([]byte, 4096, 4096))
 
 	switch cns {
 	case protocol.CNSIdentifyNamespace:
-		lbaCount := s.Target.GetSize() / 512
-
-		id := protocol.IdentifyNamespaceData{
-			NSZE:     lbaCount,
-			NCAP:     lbaCount,
-			NUSE:     lbaCount,
-			NSFEAT:   0x0, // was 0x2
-			NLBAF:    0x0, // 0based (ie +1)
-			NMIC:     0x1,
-			RESCAP:   0xff, //0x12,
-			FPI:      0x80, // was 0c0
-			ANAGRPID: 0x1,  // was  0x1
-			NVMCAP:   [2]uint64{s.Target.GetSize(), 0},
-		}
-		id.LBAF[0] = uint32(9 << 16) // 512 bytes
-		sm.Serialize(&id)
+		if nsid == protocol.NSIDBroadcast {
+			sm.Serialize(identifyNamespace(nil))
+			break
+		}
+		if !validNamespaceID(nsid) {
+			return nil, ErrInvalidNamespace
+		}
+
+		// an inactive namespace ID returns a zero filled structure
+		if ns := s.AttachedNamespace(ctrlID, nsid); ns != nil {
+			sm.Serialize(identifyNamespace(ns))
+		}
 
 	case protocol.CNSIdentifyController: //0x01
+		vwc := uint8(0)
+		if present, _ := s.VolatileWriteCache(); present {
+			vwc = 0x1
+		}
+		oacs := uint16(0x17)
+		if s.NamespaceManagement() {
+			oacs |= protocol.OACSNamespaceManagement
+		}
+
 		// Identify Controller header structure for the controller processing the command
 		id := protocol.IdentifyController{
 			PCIVendor:           0x144d,
 			PCIDevice:           0x144d,
 			RAB:                 0x6, //2^6
 			OUI:                 [3]byte{0x38, 0x25, 0x00},
-			CMIC:                0xb, // More than 1 port, more than 1 controller, and Asymmetric Namespace Access (ANA)
-			MDTS:                4,   // this is 2^n * size of CAP.MPSMIN ( 4096*2^4) == 64K will be the biggest transfer from the  host to us
+			CMIC:                0xb,      // More than 1 port, more than 1 controller, and Asymmetric Namespace Access (ANA)
+			MDTS:                s.mdts(), // this is 2^n * size of CAP.MPSMIN, the biggest transfer between the host and us
 			ControllerId:        ctrlID,
 			Version:             protocol.NVMESpecificationVersion,
-			OAES:                0x0, // 0x0900,
+			OAES:                targetAsyncEvents,
 			CTRATT:              0x0,
 			CNTRLTYPE:           0x1,  // CNTRLTYPE is required for NVME 1.4 or newer
-			OACS:                0x17, // 0x1 << 7, // support virtualization
+			OACS:                oacs, // 0x1 << 7, // support virtualization
 			ACL:                 0x7,  // 0x3,
-			AERL:                0x3,
+			AERL:                AsyncEventRequestLimit - 1,
 			FRWM:                0x16, //0x3,
 			LogPageAttributes:   0x3,  // 0x07,
 			ErrorLogPageEntries: 0x3f, //0x7f,
-			KAS:                 30,   // 10 seconds ( 100x100ms)
+			KAS:                 KeepAliveGranularity,
 			ANATT:               0xa,
 			ANACAP:              0x1f,
 			ANAGRPMAX:           0x80,
 			NANAGRPID:           0x80,
-			TNVMCAP0:            s.Target.GetSize(),
+			TNVMCAP0:            s.Capacity(),
 			SQES:                0x66,
 			CQES:                0x44,
 			MaxCMDS:             protocol.NVMECtrlMaxCmds,
-			NumberNamespaces:    NumberOfNamespaces,
+			NumberNamespaces:    MaxNamespaces,
 			ONCS:                0xc,
 			//			FUSES:               0x1,
-			FNA:   0x5, //0x0,
-			AWUN:  0xffff,
-			AWUPF: 0x800,
+			FNA:     protocol.FNACryptoErase, // each namespace is formatted on its own
+			SANICAP: protocol.SANICAPCryptoErase | protocol.SANICAPBlockErase | protocol.SANICAPOverwrite,
+			AWUN:    0xffff,
+			AWUPF:   0x800,
 			//			ACWU:                63, // 32K (64 x 512by block)
-			VWC:        0x1,
+			VWC:        vwc,
 			NWPC:       0x1,
-			SGLSupport: 0x1,
-			MNAN:       NumberOfNamespaces,
+			SGLSupport: protocol.SGLSupported | protocol.SGLSupportOffset,
+			MNAN:       MaxNamespaces,
 			SubNQN:     s.NQN,
 			IOCCSZ:     MaximumPDUDataSize,
 			IORCSZ:     0x01, // 16 bytes
@@ -111,18 +296,32 @@ func (s *TargetSubsystem) Identify(ctrlID uint16, cns uint8) ([]byte, error) {
 		sm.Serialize(&id)
 
 	case protocol.CNSIdentifyActiveNamespaces:
-		// Return a list of namespaces currently enabled
-		//   right now we only support 1 namespace
-		id := protocol.IdentifyActiveNamespaceListData{}
-		id.CNS[0] = 0x1 // just our 1 namespace
-		sm.Serialize(&id)
+		// Return the active namespaces with an ID greater than nsid in increasing order
+		if nsid >= protocol.NSIDBroadcast-1 {
+			return nil, ErrInvalidNamespace
+		}
+		sm.Serialize(namespaceList(s.AttachedNamespaces(ctrlID), nsid))
 
 	case protocol.CNSIdentifyNamespaceDescriptorList:
-		id := protocol.IdentifyNamespaceDescriptor{}
-		id.NIDT = 0x3 // UUID
-		id.NIDL = 16  // 16 bytes
-		copy(id.NID[:], s.UUID[:])
-		sm.Serialize(&id)
+		ns := s.AttachedNamespace(ctrlID, nsid)
+		if ns == nil {
+			return nil, ErrInvalidNamespace
+		}
+		return namespaceDescriptors(ns, make([]byte, 4096)), nil
+
+	case protocol.CNSIdentifyAllocatedNamespaces:
+		if nsid >= protocol.NSIDBroadcast-1 {
+			return nil, ErrInvalidNamespace
+		}
+		sm.Serialize(namespaceList(s.Namespaces(), nsid))
+
+	case protocol.CNSIdentifyAllocatedNamespace:
+		if !validNamespaceID(nsid) {
+			return nil, ErrInvalidNamespace
+		}
+		if ns := s.Namespace(nsid); ns != nil {
+			sm.Serialize(identifyNamespace(ns))
+		}
 
 	case protocol.CNSIdentifyControlerDataStructures:
 		return nil, fmt.Errorf("identify with unsupported cns:0x%x for subsystem:target", cns)
@@ -153,27 +352,59 @@ func (s *TargetSubsystem) GetLogPage(pageId int, offset uint64, length int) ([]b
 		lp.ACS[protocol.CapsuleCmdGetFeatures] = 0x01
 		lp.ACS[protocol.CapsuleCmdAsyncEventRequest] = 0x01
 		lp.ACS[protocol.CapsuleCmdKeepAlive] = 0x01
+		// both change the data (LBCC), one Format NVM per namespace and one Sanitize per subsystem (CSE)
+		lp.ACS[protocol.CapsuleCmdFormatNVM] = 0x07 | 0x1<<16
+		lp.ACS[protocol.CapsuleCmdSanitize] = 0x03 | 0x2<<16
 		lp.IOCS[protocol.CapsuleCmdFlush] = 0x01
 		lp.IOCS[protocol.CapsuleCmdWrite] = 0x01
 		lp.IOCS[protocol.CapsuleCmdRead] = 0x01
 		lp.IOCS[protocol.CapsuleCmdWriteZeros] = 0x01
 		lp.IOCS[protocol.CapsuleCmdDatasetMgmt] = 0x01
+		if s.NamespaceManagement() {
+			// the commands change which namespaces exist (NIC)
+			lp.ACS[protocol.CapsuleCmdNamespaceManagement] = 0x09
+			lp.ACS[protocol.CapsuleCmdNamespaceAttachment] = 0x09
+		}
 
 		ss.Serialize(&lp)
 
 	case protocol.LPDeviceSelfTest:
 
+	case protocol.LPSanitizeStatus: // Sanitize Status (Log Identifier 81h)
+		page := make([]byte, protocol.SanitizeStatusLogSize)
+		lp := s.SanitizeStatus()
+		serialize.New(page).Serialize(&lp)
+
+		data := make([]byte, length)
+		if offset < uint64(len(page)) {
+			copy(data, page[offset:])
+		}
+		return data, nil
+
 	case protocol.LPAsymmetricNamespaceAccess: // Asymmetric Namespace Access (Log Identifier 0Ch)
+		// all namespaces are in the one ANA group, the group descriptor grows by an NSID per namespace
+		namespaces := s.Namespaces()
+		page := make([]byte, protocol.ANAGroupNSIDOffset+4*len(namespaces))
+
 		lp := protocol.AsymmetricNamespaceAccessLog{
 			DescriptorCount: 1,
 		}
-
 		lp.ANAGroupDesc.ANAGroupID = 1
-		lp.ANAGroupDesc.NSIDCount = 1
+		lp.ANAGroupDesc.NSIDCount = uint32(len(namespaces))
 		lp.ANAGroupDesc.ChangeCount = 0
 		lp.ANAGroupDesc.ANAS = 0x01 // State = ANA Optimized state
-		lp.ANAGroupDesc.NID[0] = 0x1
-		ss.Serialize(&lp)
+		serialize.New(page).Serialize(&lp)
+
+		nids := page[protocol.ANAGroupNSIDOffset:]
+		for idx, ns := range namespaces {
+			binary.LittleEndian.PutUint32(nids[4*idx:], ns.ID)
+		}
+
+		data := make([]byte, length)
+		if offset < uint64(len(page)) {
+			copy(data, page[offset:])
+		}
+		return data, nil
 
 	default:
 		return nil, fmt.Errorf("log page 0x%x not supported by target subsystem", pageId)
@@ -181,14 +412,103 @@ func (s *TargetSubsystem) GetLogPage(pageId int, offset uint64, length int) ([]b
 	return ss.Get(), nil
 }
 
-func (s *TargetSubsystem) HandleIO(r *targets.IORequest) targets.TargetError {
-	return s.Target.Queue(r)
+func (s *TargetSubsystem) HandleIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
+	return s.QueueIO(ctrlID, nsid, r)
 }
 
 func (s *TargetSubsystem) GetRuntimeDetails() []targets.KV {
-	return s.Target.GetRuntimeDetails()
+	namespaces := s.Namespaces()
+	if len(namespaces) == 1 {
+		return namespaces[0].Target.GetRuntimeDetails()
+	}
+
+	var details []targets.KV
+	for _, ns := range namespaces {
+		for _, kv := range ns.Target.GetRuntimeDetails() {
+			details = append(details, targets.KV{
+				Key:   fmt.Sprintf("ns%d.%s", ns.ID, kv.Key),
+				Value: kv.Value,
+			})
+		}
+	}
+	return details
 }
 
-func (s *TargetSubsystem) QueueIO(r *targets.IORequest) targets.TargetError {
-	return s.Target.Queue(r)
+// Flush writes back anything the namespaces cached and waits for it
+func (s *TargetSubsystem) Flush() targets.TargetError {
+	return flushNamespaces(s.Namespaces())
+}
+
+func flushNamespaces(namespaces []*Namespace) targets.TargetError {
+	status := targets.TargetErrorNone
+	for _, ns := range namespaces {
+		// namespaces removed or being formatted since the list was made are left out, their data is going away
+		if ns.beginIO() != targets.TargetErrorNone {
+			continue
+		}
+		err := flushTarget(ns.Target)
+		ns.endIO()
+		if status == targets.TargetErrorNone {
+			status = err
+		}
+	}
+	return status
+}
+
+func flushTarget(t targets.Target) targets.TargetError {
+	r := &targets.IORequest{}
+	return queueAndWait(t, r.Init(targets.IORequestCmdFlush, 0, 0, nil))
+}
+
+// queueAndWait sends the request to the target and waits for it to complete
+func queueAndWait(t targets.Target, r *targets.IORequest) targets.TargetError {
+	done := make(chan targets.TargetError, 1)
+	r.CompleteRequest = func(status targets.TargetError) {
+		done <- status
+	}
+
+	status := t.Queue(r)
+	if status != targets.TargetErrorNone {
+		return status
+	}
+	return <-done
+}
+
+// QueueIO queues the request to the target of namespace nsid, which has to be attached to the controller
+//
+//	A flush to the broadcast NSID flushes every namespace attached to the controller
+func (s *TargetSubsystem) QueueIO(ctrlID uint16, nsid uint32, r *targets.IORequest) targets.TargetError {
+	if nsid == protocol.NSIDBroadcast && r.Command == targets.IORequestCmdFlush {
+		namespaces := s.AttachedNamespaces(ctrlID)
+		go func() {
+			r.Complete(flushNamespaces(namespaces))
+		}()
+		return targets.TargetErrorNone
+	}
+
+	ns := s.AttachedNamespace(ctrlID, nsid)
+	if ns == nil {
+		return targets.TargetErrorInvalidNamespace
+	}
+	if status := ns.beginIO(); status != targets.TargetErrorNone {
+		return status
+	}
+	// checked once the request is active so a sanitize that starts now waits for it
+	if status := s.sanitizeIOStatus(); status != targets.TargetErrorNone {
+		ns.endIO()
+		return status
+	}
+
+	complete := r.CompleteRequest
+	r.CompleteRequest = func(status targets.TargetError) {
+		r.CompleteRequest = complete
+		ns.endIO()
+		complete(status)
+	}
+	status := ns.Target.Queue(r)
+	if status != targets.TargetErrorNone {
+		r.CompleteRequest = complete
+		ns.endIO()
+	}
+	return status
 }
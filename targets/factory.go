@@ -6,12 +6,26 @@ import (
 
 type InitFunc func(options Options) (Target, error)
 
+// ProvisionFunc creates the storage for a new target called name of size bytes, options holds the
+// defaults of the backend. It returns the options that open the target
+type ProvisionFunc func(name string, size uint64, options Options) (Options, error)
+
+// ReleaseFunc destroys the storage of a target made by a ProvisionFunc
+type ReleaseFunc func(options Options) error
+
+type provisioner struct {
+	create  ProvisionFunc
+	release ReleaseFunc
+}
+
 type Factory struct {
-	targets map[string]InitFunc
+	targets      map[string]InitFunc
+	provisioners map[string]provisioner
 }
 
 var defaultFactory = Factory{
-	targets: make(map[string]InitFunc),
+	targets:      make(map[string]InitFunc),
+	provisioners: make(map[string]provisioner),
 }
 
 func (f *Factory) RegisterProvider(id string, createFunc InitFunc) error {
@@ -19,6 +33,15 @@ func (f *Factory) RegisterProvider(id string, createFunc InitFunc) error {
 	return nil
 }
 
+// RegisterProvisioner lets targets of type id be created at runtime with Provision
+func (f *Factory) RegisterProvisioner(id string, create ProvisionFunc, release ReleaseFunc) error {
+	f.provisioners[id] = provisioner{
+		create:  create,
+		release: release,
+	}
+	return nil
+}
+
 func (f *Factory) New(id string, options Options) (Target, error) {
 	createFunc, ok := f.targets[id]
 	if !ok {
@@ -28,11 +51,54 @@ func (f *Factory) New(id string, options Options) (Target, error) {
 	return createFunc(options)
 }
 
+// Provision creates the storage for a new target of type id and opens it
+//
+//	The returned options open the target again and are needed to Release it
+func (f *Factory) Provision(id string, name string, size uint64, options Options) (Target, Options, error) {
+	p, ok := f.provisioners[id]
+	if !ok {
+		return nil, nil, errors.New("target type can not be provisioned")
+	}
+
+	opts, err := p.create(name, size, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := f.New(id, opts)
+	if err != nil {
+		p.release(opts)
+		return nil, nil, err
+	}
+	return t, opts, nil
+}
+
+// Release destroys the storage of a target created with Provision, the target has to be closed
+func (f *Factory) Release(id string, options Options) error {
+	p, ok := f.provisioners[id]
+	if !ok {
+		return errors.New("target type can not be provisioned")
+	}
+	return p.release(options)
+}
+
 func RegisterProvider(id string, createFunc InitFunc) error {
 	defaultFactory.targets[id] = createFunc
 	return nil
 }
 
+func RegisterProvisioner(id string, create ProvisionFunc, release ReleaseFunc) error {
+	return defaultFactory.RegisterProvisioner(id, create, release)
+}
+
 func New(id string, options Options) (Target, error) {
 	return defaultFactory.New(id, options)
 }
+
+func Provision(id string, name string, size uint64, options Options) (Target, Options, error) {
+	return defaultFactory.Provision(id, name, size, options)
+}
+
+func Release(id string, options Options) error {
+	return defaultFactory.Release(id, options)
+}
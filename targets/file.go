@@ -4,16 +4,27 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/thirdmartini/go-nvme/internal/sys"
 )
 
+// fileZeroChunk is the largest buffer of zeros we write at once
+const fileZeroChunk = 1024 * 1024
+
 func init() {
 	defaultFactory.RegisterProvider("file", FILECreateTarget)
+	defaultFactory.RegisterProvisioner("file", FILEProvisionTarget, FILEReleaseTarget)
 }
 
 // FileTarget implements target that write to file image
 type FileTarget struct {
 	File      *os.File
 	imageName string
+
+	// writeThrough is set when the host disabled the volatile write cache, see SetWriteCache
+	writeThrough uint32
 }
 
 func (t *FileTarget) GetSize() uint64 {
@@ -28,48 +39,63 @@ func (t *FileTarget) GetSize() uint64 {
 func (t *FileTarget) Queue(r *IORequest) TargetError {
 	switch r.Command {
 	case IORequestCmdRead:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
 			cnt, err := t.File.ReadAt(r.SGL[i].Data, offset)
 			if err != nil {
 				fmt.Printf("Read Error: %s\n", err.Error())
-				return r.Complete(TargetErrorUnsupported)
+				return r.Complete(TargetErrorRead)
 			}
 			if cnt != len(r.SGL[i].Data) {
-				panic(false)
+				return r.Complete(TargetErrorRead)
 			}
 			offset += int64(len(r.SGL[i].Data))
 		}
 		return r.Complete(TargetErrorNone)
 
 	case IORequestCmdWrite:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
 			cnt, err := t.File.WriteAt(r.SGL[i].Data, offset)
 			if err != nil {
 				fmt.Printf("Write Error: %s\n", err.Error())
-				return r.Complete(TargetErrorUnsupported)
+				return r.Complete(TargetErrorWrite)
 			}
 			if cnt != len(r.SGL[i].Data) {
-				panic(false)
+				return r.Complete(TargetErrorWrite)
 			}
 			offset += int64(len(r.SGL[i].Data))
 		}
 
-		return r.Complete(TargetErrorNone)
+		return r.Complete(t.syncFUA(r))
 
-	case IORequestCmdTrim, IORequestCmdWriteZero:
-		offset := int64(r.Lba * 512)
-		buf := make([]byte, r.Length, r.Length)
-		cnt, err := t.File.WriteAt(buf, offset)
-		if err != nil || cnt != len(buf) {
-			return r.Complete(TargetErrorInternal)
+	case IORequestCmdTrim:
+		// give the blocks back to the file system so sparse images shrink, zero them if we can't
+		offset := r.Offset()
+		if sys.PunchHole(t.File, offset, int64(r.Length)) != nil {
+			if err := t.writeZeros(offset, int64(r.Length)); err != nil {
+				fmt.Printf("Trim Error: %s\n", err.Error())
+				return r.Complete(TargetErrorWrite)
+			}
 		}
-		return r.Complete(TargetErrorNone)
+		return r.Complete(t.syncFUA(r))
+
+	case IORequestCmdWriteZero:
+		offset := r.Offset()
+		if err := t.writeZeros(offset, int64(r.Length)); err != nil {
+			fmt.Printf("Write Zeroes Error: %s\n", err.Error())
+			return r.Complete(TargetErrorWrite)
+		}
+		return r.Complete(t.syncFUA(r))
 
 	case IORequestCmdFlush:
+		err := t.File.Sync()
+		if err != nil {
+			fmt.Printf("Flush Error: %s\n", err.Error())
+			return r.Complete(TargetErrorWrite)
+		}
 		return r.Complete(TargetErrorNone)
 
 	default:
@@ -77,6 +103,72 @@ func (t *FileTarget) Queue(r *IORequest) TargetError {
 	}
 }
 
+// writeZeros zeroes length bytes at offset a chunk at a time
+func (t *FileTarget) writeZeros(offset, length int64) error {
+	chunk := int64(fileZeroChunk)
+	if length < chunk {
+		chunk = length
+	}
+	buf := make([]byte, chunk)
+
+	for length > 0 {
+		if length < chunk {
+			buf = buf[:length]
+		}
+		cnt, err := t.File.WriteAt(buf, offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(cnt)
+		length -= int64(cnt)
+	}
+	return nil
+}
+
+// syncFUA writes back the data of a FUA write before it completes, other writes stay in the page cache
+// until the host flushes unless the write cache is disabled
+func (t *FileTarget) syncFUA(r *IORequest) TargetError {
+	if !r.FUA() && t.WriteCache() {
+		return TargetErrorNone
+	}
+
+	err := sys.Fdatasync(t.File)
+	if err != nil {
+		fmt.Printf("Sync Error: %s\n", err.Error())
+		return TargetErrorWrite
+	}
+	return TargetErrorNone
+}
+
+// SetWriteCache switches between write-back (the page cache) and write-through
+func (t *FileTarget) SetWriteCache(enable bool) error {
+	if enable {
+		atomic.StoreUint32(&t.writeThrough, 0)
+		return nil
+	}
+
+	atomic.StoreUint32(&t.writeThrough, 1)
+	return t.File.Sync()
+}
+
+// WriteCache returns true when running write-back
+func (t *FileTarget) WriteCache() bool {
+	return atomic.LoadUint32(&t.writeThrough) == 0
+}
+
+// Erase truncates the image and extends it back to its size, the file system hands out zeros for the
+// blocks it freed
+func (t *FileTarget) Erase() error {
+	size := int64(t.GetSize())
+	if err := t.File.Truncate(0); err != nil {
+		return err
+	}
+	if err := t.File.Truncate(size); err != nil {
+		return err
+	}
+	return t.File.Sync()
+}
+
 func (t *FileTarget) Start() error {
 	return nil
 }
@@ -100,7 +192,8 @@ func FILECreateTarget(options Options) (Target, error) {
 		return nil, errors.New("no image option provided")
 	}
 
-	f, err := os.OpenFile(img, os.O_RDWR|os.O_SYNC, 0755)
+	// writes are cached, FUA writes and flushes sync the image (every write when the cache is disabled)
+	f, err := os.OpenFile(img, os.O_RDWR, 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -112,3 +205,36 @@ func FILECreateTarget(options Options) (Target, error) {
 
 	return NewWorkQueue(options, t), nil
 }
+
+// FILEProvisionTarget creates a sparse image called name.raw in the directory given by the dir option
+func FILEProvisionTarget(name string, size uint64, options Options) (Options, error) {
+	dir, ok := options["dir"]
+	if !ok {
+		return nil, errors.New("no dir option provided")
+	}
+
+	img := filepath.Join(dir, name+".raw")
+	f, err := os.OpenFile(img, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = f.Truncate(int64(size)); err != nil {
+		os.Remove(img)
+		return nil, err
+	}
+
+	opts := options.Copy()
+	opts["image"] = img
+	return opts, nil
+}
+
+// FILEReleaseTarget removes an image made by FILEProvisionTarget
+func FILEReleaseTarget(options Options) error {
+	img, ok := options["image"]
+	if !ok {
+		return errors.New("no image option provided")
+	}
+	return os.Remove(img)
+}
@@ -2,6 +2,7 @@ package targets
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -31,3 +32,123 @@ func TestFileTarget(t *testing.T) {
 
 	TestTarget(t, target)
 }
+
+func TestFileTargetFUA(t *testing.T) {
+	f, err := os.CreateTemp("", "targets-file-")
+	require.Nil(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	require.Nil(t, f.Truncate(1024*1024))
+
+	options := make(Options)
+	options["image"] = f.Name()
+
+	target, err := New("file", options)
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// a FUA write is synced before it completes, the data is in the image
+	r := &IORequest{}
+	r.Init(IORequestCmdWrite, 8, uint32(len(data)), nil)
+	r.Flags = IORequestFlagFUA
+	r.AddBuffer(data)
+	require.Equal(t, TargetErrorNone, TestRequest(target, r))
+
+	verify := make([]byte, len(data))
+	_, err = f.ReadAt(verify, 8*512)
+	require.Nil(t, err)
+	require.Equal(t, data, verify)
+}
+
+func TestFileTargetTrim(t *testing.T) {
+	f, err := os.CreateTemp("", "targets-file-")
+	require.Nil(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = 0xA5
+	}
+	_, err = f.Write(data)
+	require.Nil(t, err)
+
+	options := make(Options)
+	options["image"] = f.Name()
+
+	target, err := New("file", options)
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+
+	// trimmed blocks read back as zeros and the image keeps its size
+	r := &IORequest{}
+	r.Init(IORequestCmdTrim, 8, 64*1024, nil)
+	require.Equal(t, TargetErrorNone, TestRequest(target, r))
+	require.Equal(t, uint64(len(data)), target.GetSize())
+
+	verify := make([]byte, len(data))
+	_, err = f.ReadAt(verify, 0)
+	require.Nil(t, err)
+	copy(data[8*512:], make([]byte, 64*1024))
+	require.Equal(t, data, verify)
+}
+
+func TestFileTargetProvision(t *testing.T) {
+	dir := t.TempDir()
+
+	_, _, err := Provision("file", "vol0", 1024*1024, Options{})
+	require.NotNil(t, err)
+
+	target, options, err := Provision("file", "vol0", 1024*1024, Options{"dir": dir})
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+	require.Equal(t, uint64(1024*1024), target.GetSize())
+	require.Equal(t, filepath.Join(dir, "vol0.raw"), options["image"])
+
+	// the name is taken
+	_, _, err = Provision("file", "vol0", 1024*1024, Options{"dir": dir})
+	require.NotNil(t, err)
+
+	TestTarget(t, target)
+	require.Nil(t, target.Close())
+	require.Nil(t, Release("file", options))
+	_, err = os.Stat(options["image"])
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFileTargetErase(t *testing.T) {
+	dir := t.TempDir()
+	target, _, err := Provision("file", "vol0", 1024*1024, Options{"dir": dir})
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+	defer target.Close()
+
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = 0x5A
+	}
+	r := &IORequest{}
+	r.Init(IORequestCmdWrite, 16, uint32(len(data)), nil)
+	r.AddBuffer(data)
+	require.Equal(t, TargetErrorNone, TestRequest(target, r))
+
+	eraser, ok := GetEraser(target)
+	require.True(t, ok)
+	require.Nil(t, eraser.Erase())
+	require.Equal(t, uint64(1024*1024), target.GetSize())
+
+	verify := make([]byte, len(data))
+	r.Init(IORequestCmdRead, 16, uint32(len(verify)), nil)
+	r.AddBuffer(verify)
+	require.Equal(t, TargetErrorNone, TestRequest(target, r))
+	require.Equal(t, make([]byte, len(data)), verify)
+}
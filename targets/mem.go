@@ -3,12 +3,19 @@ package targets
 import (
 	"errors"
 	"strconv"
+	"sync/atomic"
 )
 
 func init() {
 	defaultFactory.RegisterProvider("mem", MEMCreateTarget)
+	defaultFactory.RegisterProvisioner("mem", MEMProvisionTarget, func(options Options) error {
+		return nil
+	})
 }
 
+// memZeroChunk is how much a Write Zeroes clears before it checks for an abort
+const memZeroChunk = 64 * 1024
+
 // MemTarget implements target that write to file image
 type MemTarget struct {
 	Buffer []byte
@@ -21,20 +28,35 @@ func (t *MemTarget) GetSize() uint64 {
 func (t *MemTarget) Queue(r *IORequest) TargetError {
 	// fmt.Printf("-->> Handle: 0x%0x Len:%d\n", r.Command, len(r.SGL[0].Data))
 
+	// an abort stops the request between buffers
+	aborted := uint32(0)
+	r.OnCancel(func() {
+		atomic.StoreUint32(&aborted, 1)
+	})
+	isAborted := func() bool {
+		return atomic.LoadUint32(&aborted) != 0
+	}
+
 	switch r.Command {
 	case IORequestCmdRead:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
+			if isAborted() {
+				return r.Complete(TargetErrorAborted)
+			}
 			copy(r.SGL[i].Data, t.Buffer[offset:offset+int64(r.Length)])
 			offset += int64(len(r.SGL[i].Data))
 		}
 		return r.Complete(TargetErrorNone)
 
 	case IORequestCmdWrite:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
+			if isAborted() {
+				return r.Complete(TargetErrorAborted)
+			}
 			copy(t.Buffer[offset:offset+int64(r.Length)], r.SGL[i].Data)
 			offset += int64(len(r.SGL[i].Data))
 		}
@@ -44,8 +66,11 @@ func (t *MemTarget) Queue(r *IORequest) TargetError {
 		return r.Complete(TargetErrorNone)
 
 	case IORequestCmdWriteZero, IORequestCmdTrim:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 		for i := int64(0); i < int64(r.Length); i++ {
+			if i%memZeroChunk == 0 && isAborted() {
+				return r.Complete(TargetErrorAborted)
+			}
 			t.Buffer[offset+i] = 0
 		}
 		return r.Complete(TargetErrorNone)
@@ -55,6 +80,12 @@ func (t *MemTarget) Queue(r *IORequest) TargetError {
 	}
 }
 
+// Erase drops the memory of the target, reads return zeros from a fresh buffer of the same size
+func (t *MemTarget) Erase() error {
+	t.Buffer = make([]byte, len(t.Buffer))
+	return nil
+}
+
 func (t *MemTarget) Start() error {
 	return nil
 }
@@ -82,3 +113,8 @@ func MEMCreateTarget(options Options) (Target, error) {
 		Buffer: make([]byte, sz, sz),
 	}, nil
 }
+
+// MEMProvisionTarget sizes a memory target, the memory goes away with the target
+func MEMProvisionTarget(name string, size uint64, options Options) (Options, error) {
+	return options.Copy().With("size", size), nil
+}
@@ -17,3 +17,15 @@ func TestMemTarget(t *testing.T) {
 
 	TestTarget(t, target)
 }
+
+func TestMemTargetErase(t *testing.T) {
+	target := &MemTarget{Buffer: make([]byte, 64*1024)}
+	for i := range target.Buffer {
+		target.Buffer[i] = 0xFF
+	}
+
+	eraser, ok := GetEraser(target)
+	require.True(t, ok)
+	require.Nil(t, eraser.Erase())
+	require.Equal(t, make([]byte, 64*1024), target.Buffer)
+}
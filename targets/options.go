@@ -32,6 +32,15 @@ func (o Options) Int(key string, def int) int {
 	return def
 }
 
+// Copy returns a copy of the options that can be changed without affecting o
+func (o Options) Copy() Options {
+	c := make(Options, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
 func (o Options) With(key string, data interface{}) Options {
 	//fmt.Printf("Kind: %v | %v\n", value.Kind(), typ.Name())
 	switch v := data.(type) {
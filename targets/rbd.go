@@ -15,6 +15,9 @@ func init() {
 	defaultFactory.RegisterProvider("rbd", RBDCreateTarget)
 }
 
+// rbdZeroChunk is the largest buffer of zeros we write at once
+const rbdZeroChunk = 1024 * 1024
+
 type RBDTarget struct {
 	ioctx *rados.IOContext
 	image *rbd.Image
@@ -31,56 +34,106 @@ func (t *RBDTarget) GetSize() uint64 {
 func (t *RBDTarget) Queue(r *IORequest) TargetError {
 	switch r.Command {
 	case IORequestCmdRead:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
 			cnt, err := t.image.ReadAt(r.SGL[i].Data, offset)
 			if err != nil {
 				fmt.Printf("Read Error: %s\n", err.Error())
-				return r.Complete(TargetErrorUnsupported)
+				return r.Complete(TargetErrorRead)
 			}
 			if cnt != len(r.SGL[i].Data) {
-				panic(false)
+				return r.Complete(TargetErrorRead)
 			}
 			offset += int64(len(r.SGL[i].Data))
 		}
 		return r.Complete(TargetErrorNone)
 
 	case IORequestCmdWrite:
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 
 		for i := range r.Buffers() {
 			cnt, err := t.image.WriteAt(r.SGL[i].Data, offset)
 			if err != nil {
 				fmt.Printf("Write Error: %s\n", err.Error())
-				return r.Complete(TargetErrorUnsupported)
+				return r.Complete(TargetErrorWrite)
 			}
 			if cnt != len(r.SGL[i].Data) {
-				panic(false)
+				return r.Complete(TargetErrorWrite)
 			}
 			offset += int64(len(r.SGL[i].Data))
 		}
+
+		// librbd may cache writes, FUA has to get the data to the cluster
+		if r.FUA() {
+			if err := t.image.Flush(); err != nil {
+				fmt.Printf("Flush Error: %s\n", err.Error())
+				return r.Complete(TargetErrorWrite)
+			}
+		}
 		return r.Complete(TargetErrorNone)
 
 	case IORequestCmdFlush:
-		// FIXME: need to do a proper flush
+		if err := t.image.Flush(); err != nil {
+			fmt.Printf("Flush Error: %s\n", err.Error())
+			return r.Complete(TargetErrorWrite)
+		}
 		return r.Complete(TargetErrorNone)
 
-	case IORequestCmdTrim, IORequestCmdWriteZero:
+	case IORequestCmdTrim:
+		offset := uint64(r.Offset())
+		_, err := t.image.Discard(offset, uint64(r.Length))
+		if err != nil {
+			fmt.Printf("Discard Error: %s\n", err.Error())
+			return r.Complete(TargetErrorWrite)
+		}
 		return r.Complete(TargetErrorNone)
-		/*
-			offset := int64(r.Lba * 512)
-			cnt, err := t.image.Trim(offset, r.Length)
-			if err != nil {
-				return r.Complete(TargetErrorNone)
+
+	case IORequestCmdWriteZero:
+		// a discard does not zero partial objects on every cluster, the zeros are written instead
+		offset := r.Offset()
+		if err := t.writeZeros(offset, int64(r.Length)); err != nil {
+			fmt.Printf("Write Zeroes Error: %s\n", err.Error())
+			return r.Complete(TargetErrorWrite)
+		}
+		if r.FUA() {
+			if err := t.image.Flush(); err != nil {
+				fmt.Printf("Flush Error: %s\n", err.Error())
+				return r.Complete(TargetErrorWrite)
 			}
-			return r.Complete(TargetErrorNone)*/
+		}
+		return r.Complete(TargetErrorNone)
 
 	default:
 		return r.Complete(TargetErrorUnsupported)
 	}
 }
 
+// writeZeros zeroes length bytes at offset a chunk at a time
+func (t *RBDTarget) writeZeros(offset, length int64) error {
+	chunk := int64(rbdZeroChunk)
+	if length < chunk {
+		chunk = length
+	}
+	buf := make([]byte, chunk)
+
+	for length > 0 {
+		if length < chunk {
+			buf = buf[:length]
+		}
+		cnt, err := t.image.WriteAt(buf, offset)
+		if err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return errors.New("short write")
+		}
+		offset += int64(cnt)
+		length -= int64(cnt)
+	}
+	return nil
+}
+
 func (t *RBDTarget) Start() error {
 	return nil
 }
@@ -3,6 +3,7 @@ package targets
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type TargetError uint16
@@ -13,11 +14,23 @@ const (
 	TargetErrorAborted       TargetError = 0x3
 	TargetErrorLbaOutOfRange TargetError = 0x4
 
-	TargetErrorWrite    TargetError = 0x5
-	TargetErrorRead     TargetError = 0x6
+	TargetErrorWrite TargetError = 0x5
+	TargetErrorRead  TargetError = 0x6
+	// TargetErrorInvalidNamespace is returned by subsystems for requests to a namespace they do not have
+	TargetErrorInvalidNamespace TargetError = 0x7
+	// TargetErrorFormatInProgress is returned by subsystems for requests to a namespace being formatted
+	TargetErrorFormatInProgress TargetError = 0x8
+	// TargetErrorSanitizeInProgress and TargetErrorSanitizeFailed are returned by subsystems while a
+	// sanitize runs or after it failed
+	TargetErrorSanitizeInProgress TargetError = 0x9
+	TargetErrorSanitizeFailed     TargetError = 0xa
+
 	TargetErrorInternal TargetError = 0xffff
 )
 
+// DefaultBlockSize is the LBA data size of requests that do not set one
+const DefaultBlockSize = 512
+
 type TargetCommand uint8
 
 const (
@@ -30,6 +43,41 @@ const (
 	IORequestSnapshot TargetCommand = 0x20
 )
 
+// IORequestFlags are per command flags the host set on Read/Write/Write Zeroes
+type IORequestFlags uint8
+
+const (
+	// IORequestFlagFUA (Force Unit Access) requires written data to be on non-volatile media before the
+	// request completes, for reads the data has to come from non-volatile media
+	IORequestFlagFUA IORequestFlags = 1 << 0
+	// IORequestFlagLimitedRetry asks the target to give up early rather than retry hard
+	IORequestFlagLimitedRetry IORequestFlags = 1 << 1
+)
+
+// IOHints is the Dataset Management field of Read/Write (CDW13 bits 7:0), targets may use it to
+// place or cache the data
+type IOHints uint8
+
+// AccessFrequency returns the expected access frequency (0 is no information)
+func (h IOHints) AccessFrequency() uint8 {
+	return uint8(h) & 0xF
+}
+
+// AccessLatency returns the expected access latency (0 is no information, 1 idle, 2 normal, 3 low)
+func (h IOHints) AccessLatency() uint8 {
+	return uint8(h) >> 4 & 0x3
+}
+
+// Sequential is set when the data is part of a sequential access
+func (h IOHints) Sequential() bool {
+	return h&(1<<6) != 0
+}
+
+// Incompressible is set when the data is not compressible
+func (h IOHints) Incompressible() bool {
+	return h&(1<<7) != 0
+}
+
 // SGE defines a Scatter Gather Element
 type SGE struct {
 	Data []byte
@@ -50,19 +98,52 @@ type IORequest struct {
 	Length          uint32
 	SGL             [16]SGE
 	SGLC            int
+	Flags           IORequestFlags
+	Hints           IOHints
 	ExecuteRequest  Executer
 	CompleteRequest Completer
+
+	// BlockSize is the LBA data size of the namespace, Lba counts blocks of it while Length is in bytes.
+	// 0 is DefaultBlockSize
+	BlockSize uint32
+
+	// cancellation state, see Cancel
+	lock      sync.Mutex
+	waiting   bool
+	cancelled bool
+	canceler  func()
 }
 
 func (r *IORequest) Init(c TargetCommand, lba uint64, length uint32, completion Completer) *IORequest {
 	r.Command = c
 	r.Lba = lba
 	r.Length = length
+	r.BlockSize = DefaultBlockSize
 	r.CompleteRequest = completion
 	r.SGLC = 0
+	r.Flags = 0
+	r.Hints = 0
 	return r
 }
 
+// LBASize returns the LBA data size of the request in bytes
+func (r *IORequest) LBASize() uint32 {
+	if r.BlockSize == 0 {
+		return DefaultBlockSize
+	}
+	return r.BlockSize
+}
+
+// Offset returns the byte offset of Lba
+func (r *IORequest) Offset() int64 {
+	return int64(r.Lba) * int64(r.LBASize())
+}
+
+// FUA returns true if the request has to reach non-volatile media before it completes
+func (r *IORequest) FUA() bool {
+	return r.Flags&IORequestFlagFUA != 0
+}
+
 func (r *IORequest) Assert() error {
 	bufferLen := 0
 	for i := 0; i < r.SGLC; i++ {
@@ -91,10 +172,81 @@ func (r *IORequest) Buffers() []SGE {
 	return r.SGL[0:r.SGLC]
 }
 
+// Wait marks the request as waiting to run, until Resume takes it out Cancel can abort it
+func (r *IORequest) Wait() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waiting = true
+}
+
+// Resume is called by whoever held the request once it is about to run, false if it was cancelled
+// while waiting and has to be completed with TargetErrorAborted instead
+func (r *IORequest) Resume() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waiting = false
+	return !r.cancelled
+}
+
+// Cancel aborts a request that is still waiting or that the target can interrupt, returns false if
+// it can't be aborted (anymore)
+//
+//	A cancelled request is completed with TargetErrorAborted by whoever holds it when it calls Resume,
+//	a running request is interrupted through the hook the target installed with OnCancel. Requests
+//	whose target did not install one are left to complete.
+func (r *IORequest) Cancel() bool {
+	r.lock.Lock()
+	if r.waiting {
+		r.cancelled = true
+		r.lock.Unlock()
+		return true
+	}
+
+	hook := r.canceler
+	r.canceler = nil
+	if hook == nil {
+		r.lock.Unlock()
+		return false
+	}
+	r.cancelled = true
+	r.lock.Unlock()
+
+	hook()
+	return true
+}
+
+// Cancelled returns true once the request was cancelled
+func (r *IORequest) Cancelled() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cancelled
+}
+
+// OnCancel installs the hook Cancel calls while a target works on the request, nil removes it
+//
+//	The hook only tells the target to stop, the target still completes the request, with
+//	TargetErrorAborted once the hook ran. Complete removes the hook, it may still be running when the
+//	request completes so it must only touch state of the target.
+func (r *IORequest) OnCancel(hook func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.canceler = hook
+}
+
+// Reset clears the cancellation state before the request is reused
+func (r *IORequest) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waiting = false
+	r.cancelled = false
+	r.canceler = nil
+}
+
 func (r *IORequest) Start() {
 }
 
 func (r *IORequest) Complete(status TargetError) TargetError {
+	r.OnCancel(nil)
 	r.CompleteRequest(status)
 	return TargetErrorNone
 }
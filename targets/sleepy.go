@@ -18,7 +18,17 @@ func (t *SleepyTarget) GetSize() uint64 {
 }
 
 func (t *SleepyTarget) Queue(r *IORequest) TargetError {
-	time.Sleep(t.SleepTime)
+	// an abort cuts the sleep short
+	cancel := make(chan struct{})
+	r.OnCancel(func() {
+		close(cancel)
+	})
+
+	select {
+	case <-time.After(t.SleepTime):
+	case <-cancel:
+		return r.Complete(TargetErrorAborted)
+	}
 	switch r.Command {
 	case IORequestCmdRead:
 		return r.Complete(TargetErrorNone)
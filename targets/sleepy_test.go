@@ -2,7 +2,9 @@ package targets
 
 import (
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,3 +13,21 @@ func TestSleepyTarget(t *testing.T) {
 	require.Nil(t, err)
 	TestTarget(t, target)
 }
+
+func TestSleepyTargetCancel(t *testing.T) {
+	target := &SleepyTarget{
+		Size:      1024 * 1024,
+		SleepTime: time.Hour,
+	}
+
+	done := make(chan TargetError, 1)
+	r := &IORequest{}
+	r.Init(IORequestCmdRead, 0, 0, func(status TargetError) {
+		done <- status
+	})
+	go target.Queue(r)
+
+	// the abort cuts the sleep short once the target installed its hook
+	require.Eventually(t, r.Cancel, time.Second, time.Millisecond)
+	assert.Equal(t, TargetErrorAborted, <-done)
+}
@@ -18,3 +18,38 @@ type Target interface {
 	// GetRuntimeDetails returns internal configuration information about the target
 	GetRuntimeDetails() []KV
 }
+
+// WriteCacheTarget is implemented by targets with a volatile write cache the host can turn off
+//
+//	With the cache disabled (write-through) every write is on non-volatile media before it completes
+type WriteCacheTarget interface {
+	// SetWriteCache enables or disables the cache, disabling writes back whatever is cached
+	SetWriteCache(enable bool) error
+	// WriteCache returns true if the cache is enabled
+	WriteCache() bool
+}
+
+// GetWriteCache returns the write cache of t if it has one, looking through a WorkQueue
+func GetWriteCache(t Target) (WriteCacheTarget, bool) {
+	if wq, ok := t.(*WorkQueue); ok {
+		t = wq.Handler
+	}
+	wc, ok := t.(WriteCacheTarget)
+	return wc, ok
+}
+
+// EraseTarget is implemented by targets that can throw away all of their data faster than writing zeros
+//
+//	After Erase every read returns zeros, the size of the target does not change
+type EraseTarget interface {
+	Erase() error
+}
+
+// GetEraser returns the eraser of t if it has one, looking through a WorkQueue
+func GetEraser(t Target) (EraseTarget, bool) {
+	if wq, ok := t.(*WorkQueue); ok {
+		t = wq.Handler
+	}
+	e, ok := t.(EraseTarget)
+	return e, ok
+}
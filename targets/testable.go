@@ -40,9 +40,9 @@ func (t *TestableTarget) GetSize() uint64 {
 }
 
 func (t *TestableTarget) Queue(r *IORequest) TargetError {
-	maxLba := t.GetSize() / 512
+	maxLba := t.GetSize() / uint64(r.LBASize())
 
-	reqLen := uint64(r.Length / 512)
+	reqLen := uint64(r.Length / r.LBASize())
 	if r.Lba+reqLen >= maxLba {
 		return r.Complete(TargetErrorLbaOutOfRange)
 	}
@@ -65,7 +65,7 @@ func (t *TestableTarget) Queue(r *IORequest) TargetError {
 			return r.Complete(TargetErrorRead)
 		}
 
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 		for i := range r.Buffers() {
 			copy(r.SGL[i].Data, t.Buffer[offset:offset+int64(r.Length)])
 			offset += int64(len(r.SGL[i].Data))
@@ -78,7 +78,7 @@ func (t *TestableTarget) Queue(r *IORequest) TargetError {
 			return r.Complete(TargetErrorWrite)
 		}
 
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 		for i := range r.Buffers() {
 			copy(t.Buffer[offset:offset+int64(r.Length)], r.SGL[i].Data)
 			offset += int64(len(r.SGL[i].Data))
@@ -87,7 +87,7 @@ func (t *TestableTarget) Queue(r *IORequest) TargetError {
 
 	case IORequestCmdWriteZero:
 		atomic.AddUint64(&t.ZeroCount, 1)
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 		for i := int64(0); i < int64(r.Length); i++ {
 			t.Buffer[offset+i] = 0
 		}
@@ -95,7 +95,7 @@ func (t *TestableTarget) Queue(r *IORequest) TargetError {
 
 	case IORequestCmdTrim:
 		atomic.AddUint64(&t.TrimCount, 1)
-		offset := int64(r.Lba * 512)
+		offset := r.Offset()
 		for i := int64(0); i < int64(r.Length); i++ {
 			t.Buffer[offset+i] = 0
 		}
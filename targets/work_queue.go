@@ -2,15 +2,31 @@ package targets
 
 import (
 	"fmt"
+	"sync"
 )
 
 type Handler interface {
 	Handle(r *IORequest)
 }
 
+// writeBarrier tracks the writes submitted between two flushes
+//
+//	A flush seals the current barrier and runs once its writes completed and prev, the barrier sealed
+//	by the flush before it, is done. Barriers that are done unlink themselves from next.
+type writeBarrier struct {
+	writes int
+	flush  *IORequest
+	prev   *writeBarrier
+	next   *writeBarrier
+}
+
 type WorkQueue struct {
 	queue   chan *IORequest
 	Handler Target
+
+	// barrier collects the writes submitted since the last flush, the barriers are guarded by lock
+	lock    sync.Mutex
+	barrier *writeBarrier
 }
 
 func (w *WorkQueue) Close() error {
@@ -29,7 +45,22 @@ func (w *WorkQueue) Work() {
 		if r == nil {
 			return
 		}
-		w.Handler.Queue(r)
+
+		w.run(r)
+	}
+}
+
+// run hands the request to the target unless it was aborted while it was waiting
+func (w *WorkQueue) run(r *IORequest) {
+	// aborted while it was waiting, the target never sees it
+	if !r.Resume() {
+		r.Complete(TargetErrorAborted)
+		return
+	}
+
+	status := w.Handler.Queue(r)
+	if status != TargetErrorNone {
+		r.Complete(status)
 	}
 }
 
@@ -41,10 +72,74 @@ func (w *WorkQueue) Start() error {
 }
 
 func (w *WorkQueue) Queue(r *IORequest) TargetError {
+	r.Wait()
+
+	w.lock.Lock()
+	switch r.Command {
+	case IORequestCmdWrite, IORequestCmdWriteZero, IORequestCmdTrim:
+		w.trackWrite(r)
+
+	case IORequestCmdFlush:
+		// the workers run in parallel, a flush must not overtake the writes submitted before it. It
+		// waits without a worker and the last of those writes to complete runs it
+		if len(w.sealWrites(r)) == 0 {
+			w.lock.Unlock()
+			return TargetErrorNone
+		}
+	}
+	w.lock.Unlock()
+
 	w.queue <- r
 	return TargetErrorNone
 }
 
+// trackWrite adds the write to the current barrier, it leaves the barrier when it completes
+func (w *WorkQueue) trackWrite(r *IORequest) {
+	b := w.barrier
+	b.writes++
+
+	complete := r.CompleteRequest
+	r.CompleteRequest = func(status TargetError) {
+		r.CompleteRequest = complete
+
+		w.lock.Lock()
+		b.writes--
+		ready := w.releaseFlushes(b)
+		w.lock.Unlock()
+
+		// the flushes complete after the writes they waited for
+		complete(status)
+		for _, flush := range ready {
+			w.run(flush)
+		}
+	}
+}
+
+// sealWrites closes the current barrier for the flush r and starts a new one, returns r if it
+// does not have to wait for any write
+func (w *WorkQueue) sealWrites(r *IORequest) []*IORequest {
+	sealed := w.barrier
+	sealed.flush = r
+	w.barrier = &writeBarrier{prev: sealed}
+	sealed.next = w.barrier
+	return w.releaseFlushes(sealed)
+}
+
+// releaseFlushes returns the flushes that no longer wait for writes starting at barrier b, a flush
+// also waits for the barriers before its own. w.lock must be held
+func (w *WorkQueue) releaseFlushes(b *writeBarrier) []*IORequest {
+	var ready []*IORequest
+	for b != nil && b.flush != nil && b.writes == 0 && b.prev == nil {
+		ready = append(ready, b.flush)
+		b.flush = nil
+		if b.next != nil {
+			b.next.prev = nil
+		}
+		b = b.next
+	}
+	return ready
+}
+
 // GetSize in bytes
 func (w *WorkQueue) GetSize() uint64 {
 	return w.Handler.GetSize()
@@ -58,5 +153,6 @@ func NewWorkQueue(options map[string]string, h Target) *WorkQueue {
 	return &WorkQueue{
 		Handler: h,
 		queue:   make(chan *IORequest, 8),
+		barrier: &writeBarrier{},
 	}
 }
@@ -1,7 +1,9 @@
 package targets
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -36,3 +38,217 @@ func TestNewWorkQueue(t *testing.T) {
 	err = wqTarget.Close()
 	assert.Nil(t, err)
 }
+
+func TestWorkQueueCancel(t *testing.T) {
+	// more requests than workers, the ones the workers did not pick up are still queued
+	ioCount := 12
+	backend := &gatedTarget{
+		gate:    make(chan struct{}),
+		started: make(chan *IORequest, ioCount),
+	}
+	wqTarget := NewWorkQueue(nil, backend)
+	require.Nil(t, wqTarget.Start())
+
+	statuses := make(chan TargetError, ioCount)
+	requests := make([]*IORequest, ioCount)
+	for i := range requests {
+		requests[i] = &IORequest{}
+		requests[i].Init(IORequestCmdWrite, uint64(i), 0, func(status TargetError) {
+			statuses <- status
+		})
+		require.Equal(t, TargetErrorNone, wqTarget.Queue(requests[i]))
+	}
+	for i := 0; i < cap(wqTarget.queue); i++ {
+		<-backend.started
+	}
+
+	// the running requests are interrupted by the target, the queued ones never reach it
+	for _, r := range requests {
+		assert.True(t, r.Cancel())
+	}
+	for range requests {
+		assert.Equal(t, TargetErrorAborted, <-statuses)
+	}
+	assert.Equal(t, 0, len(backend.started))
+
+	// completed requests can't be cancelled
+	assert.False(t, requests[0].Cancel())
+
+	close(backend.gate)
+	require.Nil(t, wqTarget.Close())
+}
+
+// orderedTarget is a slow backend, a write sleeps Lba*10ms, it records the order requests finish in
+type orderedTarget struct {
+	lock     sync.Mutex
+	finished []*IORequest
+}
+
+func (t *orderedTarget) Queue(r *IORequest) TargetError {
+	if r.Command == IORequestCmdWrite {
+		time.Sleep(time.Duration(r.Lba) * 10 * time.Millisecond)
+	}
+
+	t.lock.Lock()
+	t.finished = append(t.finished, r)
+	t.lock.Unlock()
+	return r.Complete(TargetErrorNone)
+}
+
+func (t *orderedTarget) Start() error {
+	return nil
+}
+
+func (t *orderedTarget) GetSize() uint64 {
+	return 1024 * 1024
+}
+
+func (t *orderedTarget) Close() error {
+	return nil
+}
+
+func (t *orderedTarget) GetRuntimeDetails() []KV {
+	return nil
+}
+
+func TestWorkQueueFlushOrder(t *testing.T) {
+	backend := &orderedTarget{}
+	wqTarget := NewWorkQueue(nil, backend)
+	require.Nil(t, wqTarget.Start())
+
+	lock := sync.Mutex{}
+	completed := make([]*IORequest, 0)
+	wg := sync.WaitGroup{}
+	submit := func(cmd TargetCommand, lba uint64) *IORequest {
+		r := &IORequest{}
+		r.Init(cmd, lba, 0, func(status TargetError) {
+			assert.Equal(t, TargetErrorNone, status)
+			lock.Lock()
+			completed = append(completed, r)
+			lock.Unlock()
+			wg.Done()
+		})
+		wg.Add(1)
+		require.Equal(t, TargetErrorNone, wqTarget.Queue(r))
+		return r
+	}
+
+	// the first write is the slowest, the flush has to wait for all of them
+	writes := make([]*IORequest, 0)
+	for lba := uint64(6); lba > 0; lba-- {
+		writes = append(writes, submit(IORequestCmdWrite, lba))
+	}
+	flush := submit(IORequestCmdFlush, 0)
+
+	// writes after the flush are not held up by it
+	later := submit(IORequestCmdWrite, 0)
+	wg.Wait()
+
+	indexOf := func(list []*IORequest, r *IORequest) int {
+		for i := range list {
+			if list[i] == r {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// the backend flushed after the writes, and the flush completed after them
+	for _, w := range writes {
+		assert.Less(t, indexOf(backend.finished, w), indexOf(backend.finished, flush))
+		assert.Less(t, indexOf(completed, w), indexOf(completed, flush))
+	}
+	assert.Less(t, indexOf(completed, later), indexOf(completed, flush))
+
+	require.Nil(t, wqTarget.Close())
+}
+
+// gatedTarget holds writes until the gate is closed or they are cancelled, everything else completes
+// right away. If started is set it receives the writes once they are held
+type gatedTarget struct {
+	gate    chan struct{}
+	started chan *IORequest
+}
+
+func (t *gatedTarget) Queue(r *IORequest) TargetError {
+	if r.Command == IORequestCmdWrite {
+		cancel := make(chan struct{})
+		r.OnCancel(func() {
+			close(cancel)
+		})
+		if t.started != nil {
+			t.started <- r
+		}
+
+		select {
+		case <-t.gate:
+		case <-cancel:
+			return r.Complete(TargetErrorAborted)
+		}
+	}
+	return r.Complete(TargetErrorNone)
+}
+
+func (t *gatedTarget) Start() error {
+	return nil
+}
+
+func (t *gatedTarget) GetSize() uint64 {
+	return 1024 * 1024
+}
+
+func (t *gatedTarget) Close() error {
+	return nil
+}
+
+func (t *gatedTarget) GetRuntimeDetails() []KV {
+	return nil
+}
+
+func TestWorkQueueFlushWithoutWorker(t *testing.T) {
+	backend := &gatedTarget{gate: make(chan struct{})}
+	wqTarget := NewWorkQueue(nil, backend)
+	require.Nil(t, wqTarget.Start())
+
+	submit := func(cmd TargetCommand) chan TargetError {
+		done := make(chan TargetError, 1)
+		r := &IORequest{}
+		r.Init(cmd, 0, 0, func(status TargetError) {
+			done <- status
+		})
+		require.Equal(t, TargetErrorNone, wqTarget.Queue(r))
+		return done
+	}
+
+	// the writes hold all but one worker, the flush waiting for them must leave that one free
+	writes := make([]chan TargetError, 0)
+	for i := 0; i < cap(wqTarget.queue)-1; i++ {
+		writes = append(writes, submit(IORequestCmdWrite))
+	}
+	flush := submit(IORequestCmdFlush)
+
+	select {
+	case status := <-submit(IORequestCmdRead):
+		assert.Equal(t, TargetErrorNone, status)
+	case <-time.After(time.Second):
+		t.Fatal("read waited for the flush")
+	}
+	select {
+	case <-flush:
+		t.Fatal("flush overtook the writes")
+	default:
+	}
+
+	close(backend.gate)
+	for _, done := range writes {
+		assert.Equal(t, TargetErrorNone, <-done)
+	}
+	select {
+	case status := <-flush:
+		assert.Equal(t, TargetErrorNone, status)
+	case <-time.After(time.Second):
+		t.Fatal("flush did not run after the writes")
+	}
+
+	require.Nil(t, wqTarget.Close())
+}
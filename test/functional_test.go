@@ -1,8 +1,22 @@
 package test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,20 +25,70 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/thirdmartini/go-nvme"
 	"github.com/thirdmartini/go-nvme/client"
+	"github.com/thirdmartini/go-nvme/pkg/dhchap"
+	"github.com/thirdmartini/go-nvme/pkg/psk"
 	"github.com/thirdmartini/go-nvme/pkg/tracer"
 	"github.com/thirdmartini/go-nvme/protocol"
+	"github.com/thirdmartini/go-nvme/stream"
 	"github.com/thirdmartini/go-nvme/targets"
 )
 
 const (
-	testNQN           = "nqn.2020-20.com.thirdmartini.nvme:null"
-	testServerAddress = "localhost:4444"
+	testNQN     = "nqn.2020-20.com.thirdmartini.nvme:null"
+	testHostNQN = "nqn.2020-20.com.thirdmartini.nvme:initiator0"
 )
 
-func TestTargetFunctions(t *testing.T) {
-	s, err := nvme.New(testServerAddress)
+// testListenAddress lets the kernel pick a free port for every test server
+const testListenAddress = "127.0.0.1:0"
+
+// testServer is a server that serves on a port of its own for one test
+type testServer struct {
+	*nvme.Server
+	addr string
+	wg   sync.WaitGroup
+	err  error
+}
+
+// newTestServer creates a plain TCP server, the test adds its subsystems and calls start
+func newTestServer(t *testing.T) *testServer {
+	s, err := nvme.New(testListenAddress)
+	require.Nil(t, err)
+	return &testServer{Server: s, addr: s.ListenAddr()}
+}
+
+// newTestTLSServer creates a server that only accepts TLS connections
+func newTestTLSServer(t *testing.T, config *tls.Config) *testServer {
+	s, err := nvme.NewTLS(testListenAddress, config)
+	require.Nil(t, err)
+	return &testServer{Server: s, addr: s.ListenAddr()}
+}
+
+// start serves connections until stop
+func (s *testServer) start() {
+	s.wg.Add(1)
+	go func() {
+		s.err = s.Serve()
+		s.wg.Done()
+	}()
+}
+
+// stop closes the server and waits for every session to end, clients have to be closed first
+func (s *testServer) stop(t *testing.T) {
+	assert.Nil(t, s.Close())
+	s.wg.Wait()
+	assert.Nil(t, s.err)
+}
+
+// connect returns a client logged in to the subsystem nqn
+func (s *testServer) connect(t *testing.T, nqn string) *client.Client {
+	c, err := client.New(s.addr, nqn)
 	require.Nil(t, err)
-	require.NotNil(t, s)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	return c
+}
+
+func TestTargetFunctions(t *testing.T) {
+	s := newTestServer(t)
 
 	options := make(targets.Options).With("size", 1024*1024*1024)
 
@@ -46,14 +110,9 @@ func TestTargetFunctions(t *testing.T) {
 	s.AddSubSystem(subsys)
 	s.SetDebugLevel(tracer.TraceAll)
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		err = s.Serve()
-		wg.Done()
-	}()
+	s.start()
 
-	c, err := client.New(testServerAddress, testNQN)
+	c, err := client.New(s.addr, testNQN)
 	require.Nil(t, err)
 	require.NotNil(t, c)
 
@@ -130,6 +189,19 @@ func TestTargetFunctions(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, zero, verify)
 
+	// Writes larger than the in capsule data size are transferred through R2T/H2CData
+	large := make([]byte, 65536)
+	largeVerify := make([]byte, 65536)
+	for i := range large {
+		large[i] = byte(i / 512)
+	}
+
+	err = ioq.Write(2048, large)
+	require.Nil(t, err)
+	err = ioq.Read(2048, largeVerify)
+	require.Nil(t, err)
+	assert.Equal(t, large, largeVerify)
+
 	// TODO: do some io here for testing
 	err = c.CloseQueue(1)
 	assert.Nil(t, err)
@@ -137,25 +209,20 @@ func TestTargetFunctions(t *testing.T) {
 	err = c.Close()
 	assert.Nil(t, err)
 
-	err = s.Close()
-	assert.Nil(t, err)
-	wg.Wait()
+	s.stop(t)
 }
 
 func TestSafeShutdown(t *testing.T) {
-	s, err := nvme.New(testServerAddress)
-	require.Nil(t, err)
-	require.NotNil(t, s)
+	s := newTestServer(t)
 
 	options := make(targets.Options).With("size", 1024*1024*1024).With("sleep", 10)
 
 	testable := targets.NewTestableTarget(options)
-	require.Nil(t, err)
 	require.NotNil(t, testable)
 
 	target := targets.NewWorkQueue(nil, testable)
 
-	err = target.Start()
+	err := target.Start()
 	require.Nil(t, err)
 
 	subsys := &nvme.TargetSubsystem{
@@ -169,14 +236,9 @@ func TestSafeShutdown(t *testing.T) {
 	s.AddSubSystem(subsys)
 	s.SetDebugLevel(tracer.TraceAll)
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		err = s.Serve()
-		wg.Done()
-	}()
+	s.start()
 
-	c, err := client.New(testServerAddress, testNQN)
+	c, err := client.New(s.addr, testNQN)
 	require.Nil(t, err)
 	require.NotNil(t, c)
 
@@ -235,3 +297,2174 @@ func TestSafeShutdown(t *testing.T) {
 	fmt.Printf("ZC: %d\n", testable.ZeroCount)
 
 }
+
+func TestDigests(t *testing.T) {
+	s := newTestServer(t)
+
+	options := make(targets.Options).With("size", 1024*1024*1024)
+
+	target, err := targets.New("testable", options)
+	require.Nil(t, err)
+	require.NotNil(t, target)
+
+	err = target.Start()
+	require.Nil(t, err)
+
+	subsys := &nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	}
+	uuid, err := uuid2.NewUUID()
+	require.Nil(t, err)
+	copy(subsys.UUID[:], uuid[:])
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	require.NotNil(t, c)
+	c.WithDigests(true, true)
+
+	status := c.Login()
+	require.Equal(t, protocol.SCSuccess, status)
+
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+	require.NotNil(t, ioq)
+
+	// in capsule data
+	data := make([]byte, 4096)
+	verify := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = ioq.Write(16, data)
+	require.Nil(t, err)
+	err = ioq.Read(16, verify)
+	require.Nil(t, err)
+	assert.Equal(t, data, verify)
+
+	// R2T data
+	large := make([]byte, 65536)
+	largeVerify := make([]byte, 65536)
+	for i := range large {
+		large[i] = byte(i / 512)
+	}
+	err = ioq.Write(2048, large)
+	require.Nil(t, err)
+	err = ioq.Read(2048, largeVerify)
+	require.Nil(t, err)
+	assert.Equal(t, large, largeVerify)
+
+	err = c.CloseQueue(1)
+	assert.Nil(t, err)
+
+	err = c.Close()
+	assert.Nil(t, err)
+
+	s.stop(t)
+}
+
+// newTestCertificate generates a self signed certificate for localhost
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, pool
+}
+
+func newTestSubsystem(t *testing.T, secure bool) *nvme.TargetSubsystem {
+	options := make(targets.Options).With("size", 1024*1024*1024)
+
+	target, err := targets.New("testable", options)
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+
+	subsys := &nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+
+		SecureChannelRequired: secure,
+	}
+	uuid, err := uuid2.NewUUID()
+	require.Nil(t, err)
+	copy(subsys.UUID[:], uuid[:])
+	return subsys
+}
+
+func testReadWrite(t *testing.T, c *client.Client) {
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+	require.NotNil(t, ioq)
+
+	data := make([]byte, 65536)
+	verify := make([]byte, 65536)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	err := ioq.Write(2048, data)
+	require.Nil(t, err)
+	err = ioq.Read(2048, verify)
+	require.Nil(t, err)
+	assert.Equal(t, data, verify)
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+
+	keys := psk.NewKeyring()
+	keys.Add(testHostNQN, testNQN, key)
+
+	config := psk.ServerConfig(keys)
+	config.Certificates = []tls.Certificate{cert}
+
+	s := newTestTLSServer(t, config)
+	require.Nil(t, s.AddSubSystem(newTestSubsystem(t, true)))
+	require.Nil(t, s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    "nqn.2020-20.com.thirdmartini.nvme:plain",
+		Target: &targets.MemTarget{Buffer: make([]byte, 1024*1024)},
+	}))
+
+	s.start()
+
+	// the discovery log advertises TLS 1.3 and the secure channel requirement, the listener only takes
+	// TLS so that includes subsystems that would not require it
+	lp, err := s.GetSubSystem(nvme.NVMEDiscoverySubsystemName).GetLogPage(protocol.LPDiscovery, 0, 4096)
+	require.Nil(t, err)
+	for _, entry := range []int{1024, 2048} {
+		assert.Equal(t, uint8(protocol.TREQDisableSQFlowControl|protocol.TREQSecureChannelRequired), lp[entry+3])
+		assert.Equal(t, uint8(protocol.TSASSecurityTLS13), lp[entry+768])
+	}
+
+	// plain connections never get past the handshake
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	require.Equal(t, protocol.SCConnectionFailure, c.Login())
+
+	// X.509 mode
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithTLS(&tls.Config{RootCAs: pool, ServerName: "localhost"})
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+
+	// PSK mode
+	clientConfig, err := psk.ClientConfig(testHostNQN, testNQN, key)
+	require.Nil(t, err)
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithTLS(clientConfig)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+
+	// PSK identity does not match the host we connect as
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN("nqn.2020-20.com.thirdmartini.nvme:initiator1").WithTLS(clientConfig)
+	require.Equal(t, protocol.SCConnectInvalidHost, c.Login().Code())
+
+	// wrong key
+	clientConfig, err = psk.ClientConfig(testHostNQN, testNQN, make([]byte, 32))
+	require.Nil(t, err)
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithTLS(clientConfig)
+	require.Equal(t, protocol.SCConnectionFailure, c.Login())
+
+	s.stop(t)
+}
+
+func TestSecureChannelRequired(t *testing.T) {
+	s := newTestServer(t)
+
+	// a plain TCP server can't offer the secure channel
+	err := s.AddSubSystem(newTestSubsystem(t, true))
+	assert.ErrorIs(t, err, nvme.ErrSecureChannelUnavailable)
+	assert.Nil(t, s.GetSubSystem(testNQN))
+
+	require.Nil(t, s.AddSubSystem(newTestSubsystem(t, false)))
+
+	s.start()
+
+	lp, err := s.GetSubSystem(nvme.NVMEDiscoverySubsystemName).GetLogPage(protocol.LPDiscovery, 0, 4096)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(protocol.TREQDisableSQFlowControl|protocol.TREQSecureChannelNotRequired), lp[1024+3])
+	assert.Equal(t, uint8(protocol.TSASSecurityNone), lp[1024+768])
+
+	s.stop(t)
+}
+
+func TestAuthentication(t *testing.T) {
+	hostSecret, err := dhchap.NewSecret()
+	require.Nil(t, err)
+	ctrlSecret, err := dhchap.NewSecret()
+	require.Nil(t, err)
+	wrongSecret, err := dhchap.NewSecret()
+	require.Nil(t, err)
+
+	s := newTestServer(t)
+
+	subsys := newTestSubsystem(t, false)
+	subsys.SetHostSecret(testHostNQN, nvme.HostSecret{Host: hostSecret, Controller: ctrlSecret})
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	// a secret alone does not require authentication
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN)
+	require.Equal(t, protocol.SCSuccess, c.Login().Code())
+	c.Close()
+
+	subsys.SetAuthenticationRequired(true)
+
+	// no secret
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN)
+	require.Equal(t, protocol.SCConnectAuthenticationNeeded, c.Login().Code())
+
+	// wrong secret
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithAuthentication(wrongSecret, nil)
+	require.Equal(t, protocol.SCConnectAuthenticationNeeded, c.Login().Code())
+
+	// host without a secret configured
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN("nqn.2020-20.com.thirdmartini.nvme:initiator1").WithAuthentication(hostSecret, nil)
+	require.Equal(t, protocol.SCConnectAuthenticationNeeded, c.Login().Code())
+
+	// controller does not know the controller secret we expect
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithAuthentication(hostSecret, wrongSecret)
+	require.Equal(t, protocol.SCConnectAuthenticationNeeded, c.Login().Code())
+
+	// unidirectional, the I/O queue authenticates as well
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithAuthentication(hostSecret, nil)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+
+	// bidirectional
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithAuthentication(hostSecret, ctrlSecret)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+
+	s.stop(t)
+}
+
+func TestAllowedHosts(t *testing.T) {
+	const openNQN = "nqn.2020-20.com.thirdmartini.nvme:open"
+	const otherHostNQN = "nqn.2020-20.com.thirdmartini.nvme:initiator1"
+	hostID := [16]byte{0x1, 0x2, 0x3}
+
+	s := newTestServer(t)
+
+	restricted := newTestSubsystem(t, false)
+	restricted.AllowHost(testHostNQN, hostID)
+	s.AddSubSystem(restricted)
+
+	open := newTestSubsystem(t, false)
+	open.NQN = openNQN
+	s.AddSubSystem(open)
+
+	s.start()
+
+	// the discovery log only shows what the host can connect to
+	discovery := s.GetSubSystem(nvme.NVMEDiscoverySubsystemName).(*nvme.DiscoverySubsystem)
+	lp, err := discovery.GetLogPageForHost(testHostNQN, hostID, protocol.LPDiscovery, 0, 4096)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(2), lp[8])
+
+	lp, err = discovery.GetLogPageForHost(otherHostNQN, hostID, protocol.LPDiscovery, 0, 4096)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(1), lp[8])
+	assert.Equal(t, openNQN, string(lp[1024+256:1024+256+len(openNQN)]))
+
+	// host not in the list
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(otherHostNQN).WithHostID(hostID)
+	require.Equal(t, protocol.SCConnectInvalidHost, c.Login().Code())
+
+	// listed host with the wrong host identifier
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN)
+	require.Equal(t, protocol.SCConnectInvalidHost, c.Login().Code())
+
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN).WithHostID(hostID)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+
+	// subsystems without a list accept anyone
+	c, err = client.New(s.addr, openNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(otherHostNQN)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	assert.Nil(t, c.Close())
+
+	s.stop(t)
+}
+
+func TestControllerIDs(t *testing.T) {
+	const otherHostNQN = "nqn.2020-20.com.thirdmartini.nvme:initiator1"
+
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	c1, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c1.WithHostNQN(testHostNQN)
+	require.Equal(t, protocol.SCSuccess, c1.Login())
+
+	c2, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c2.WithHostNQN(otherHostNQN)
+	require.Equal(t, protocol.SCSuccess, c2.Login())
+
+	// every admin queue gets its own controller
+	assert.NotEqual(t, c1.ControllerID(), c2.ControllerID())
+	testReadWrite(t, c1)
+	testReadWrite(t, c2)
+
+	registry := s.Controllers(testNQN)
+	controllers := registry.List()
+	require.Equal(t, 2, len(controllers))
+	state := registry.Lookup(c1.ControllerID())
+	require.NotNil(t, state)
+	assert.Equal(t, testHostNQN, state.HostNQN)
+	assert.Equal(t, 2, len(state.Queues()))
+
+	// features set on the admin queue are seen by the whole controller
+	ncqr, nsqr, err := c1.AdminQueue().SetNumberOfQueues(3, 3)
+	require.Nil(t, err)
+	assert.Equal(t, uint16(3), ncqr)
+	assert.Equal(t, uint16(3), nsqr)
+	ncqr, nsqr = state.NumberOfQueues()
+	assert.Equal(t, uint16(3), ncqr)
+	assert.Equal(t, uint16(3), nsqr)
+
+	// I/O queues beyond what was allocated are refused
+	_, status := c1.OpenIOQueue(5)
+	assert.Equal(t, protocol.SCConnectInvalidParameters, status.Code())
+
+	// losing the admin queue ends the controller, its I/O queues can no longer connect
+	c1.AdminQueue().Close()
+	require.Eventually(t, func() bool {
+		return registry.Lookup(c1.ControllerID()) == nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, status = c1.OpenIOQueue(2)
+	assert.Equal(t, protocol.SCConnectInvalidParameters, status.Code())
+
+	assert.Nil(t, c2.Close())
+	require.Eventually(t, func() bool {
+		return len(registry.List()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	s.stop(t)
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithKeepAliveTimeout(250 * time.Millisecond)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+
+	// the timeout is rounded up to the keep alive granularity
+	registry := s.Controllers(testNQN)
+	state := registry.Lookup(c.ControllerID())
+	require.NotNil(t, state)
+	assert.Equal(t, uint32(300), state.KeepAliveTimeout())
+
+	// a host sending keep alives stays connected
+	for i := 0; i < 8; i++ {
+		time.Sleep(100 * time.Millisecond)
+		require.Nil(t, c.AdminQueue().KeepAlive())
+	}
+	assert.NotNil(t, registry.Lookup(c.ControllerID()))
+
+	// once it stops the controller and its I/O queue are torn down
+	require.Eventually(t, func() bool {
+		return registry.Lookup(c.ControllerID()) == nil && len(s.GetSessions()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	c.Close()
+
+	s.stop(t)
+}
+
+func asyncEventRequest(q *client.AdminQueue) chan protocol.AsyncEvent {
+	events := make(chan protocol.AsyncEvent, 1)
+	go func() {
+		ev, err := q.AsyncEventRequest()
+		if err == nil {
+			events <- ev
+		}
+		close(events)
+	}()
+	return events
+}
+
+func TestAsyncEvents(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	// only the events the target reports can be enabled
+	id, err := admin.IdentifyController()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(protocol.AECNamespaceAttribute), id.OAES)
+	require.Nil(t, admin.SetAsyncEventConfig(protocol.AECNamespaceAttribute|protocol.AECANAChange|protocol.CriticalWarningTemperature))
+	aec, err := admin.AsyncEventConfig()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(protocol.AECNamespaceAttribute), aec)
+
+	// events that happen before an AER is outstanding are held
+	s.NotifyNamespaceChanged(testNQN, 1)
+	select {
+	case ev := <-asyncEventRequest(admin):
+		assert.Equal(t, protocol.NamespaceChangedEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("namespace change not reported")
+	}
+
+	// further changes are masked until the log page is read
+	events := asyncEventRequest(admin)
+	s.NotifyNamespaceChanged(testNQN, 2)
+	s.NotifyAsyncEvent(testNQN, protocol.ANAChangeEvent) // not enabled
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %s", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	log := make([]byte, 4096)
+	require.Nil(t, admin.GetLogPage(protocol.LPChangedNamespaceList, false, log))
+	assert.Equal(t, []byte{1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}, log[:12])
+
+	s.NotifyNamespaceChanged(testNQN, 3)
+	select {
+	case ev := <-events:
+		assert.Equal(t, protocol.NamespaceChangedEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("namespace change not reported after reading the log")
+	}
+	require.Nil(t, admin.GetLogPage(protocol.LPChangedNamespaceList, false, log))
+	assert.Equal(t, []byte{3, 0, 0, 0, 0, 0, 0, 0}, log[:8])
+
+	// reads are cut at the end of the page and offsets past it are rejected
+	long := make([]byte, 8192)
+	require.Nil(t, admin.GetLogPage(protocol.LPChangedNamespaceList, true, long))
+	req := client.NewCapsuleRequest(&protocol.CapsuleCommand{
+		OpCode: protocol.CapsuleCmdGetLogPage,
+		D10:    uint32(protocol.LPChangedNamespaceList) | protocol.LogPageRAE<<8 | 1023<<16,
+		D12:    4096,
+	}, log, nil)
+	admin.QueueCapsule(req)
+	req.Wait()
+	assert.Equal(t, protocol.SCInvalidFieldInCommand, req.GetStatus().Code())
+
+	// no more than AERL+1 requests can be outstanding
+	for i := 0; i < nvme.AsyncEventRequestLimit; i++ {
+		asyncEventRequest(admin)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err = admin.AsyncEventRequest()
+	require.NotNil(t, err)
+
+	// hosts connected to the discovery subsystem hear about new subsystems
+	d := s.connect(t, nvme.NVMEDiscoverySubsystemName)
+	require.Nil(t, d.AdminQueue().SetAsyncEventConfig(protocol.AECDiscoveryChange))
+
+	events = asyncEventRequest(d.AdminQueue())
+	other := newTestSubsystem(t, false)
+	other.NQN = "nqn.2020-20.com.thirdmartini.nvme:other"
+	s.AddSubSystem(other)
+	select {
+	case ev := <-events:
+		assert.Equal(t, protocol.DiscoveryChangeEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("discovery change not reported")
+	}
+
+	// outstanding AERs do not keep the controllers around
+	assert.Nil(t, c.Close())
+	assert.Nil(t, d.Close())
+	require.Eventually(t, func() bool {
+		return len(s.GetSessions()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	s.stop(t)
+}
+
+// gatedTarget holds every request until the test releases it, started receives the requests it holds
+//
+//	Once interruptible is set the requests can be aborted while they are held
+type gatedTarget struct {
+	started       chan *targets.IORequest
+	release       chan struct{}
+	interruptible uint32
+}
+
+func (g *gatedTarget) Start() error {
+	return nil
+}
+
+func (g *gatedTarget) Queue(r *targets.IORequest) targets.TargetError {
+	cancel := make(chan struct{})
+	if atomic.LoadUint32(&g.interruptible) != 0 {
+		r.OnCancel(func() {
+			close(cancel)
+		})
+	}
+	g.started <- r
+
+	select {
+	case <-g.release:
+		return r.Complete(targets.TargetErrorNone)
+	case <-cancel:
+		return r.Complete(targets.TargetErrorAborted)
+	}
+}
+
+func (g *gatedTarget) GetSize() uint64 {
+	return 1024 * 1024
+}
+
+func (g *gatedTarget) Close() error {
+	return nil
+}
+
+func (g *gatedTarget) GetRuntimeDetails() []targets.KV {
+	return nil
+}
+
+func TestAbort(t *testing.T) {
+	s := newTestServer(t)
+
+	// the work queue runs 8 requests at a time
+	reads := 8
+	gated := &gatedTarget{
+		started: make(chan *targets.IORequest, reads),
+		release: make(chan struct{}),
+	}
+	target := targets.NewWorkQueue(nil, gated)
+	require.Nil(t, target.Start())
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	})
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	startReads := func() chan error {
+		result := make(chan error, reads)
+		for i := 0; i < reads; i++ {
+			go func() {
+				result <- ioq.Read(0, make([]byte, 4096))
+			}()
+		}
+		for i := 0; i < reads; i++ {
+			<-gated.started
+		}
+		return result
+	}
+
+	// running reads the target can't interrupt are left to complete
+	result := startReads()
+	for _, id := range ioq.Outstanding() {
+		aborted, err := admin.Abort(1, id)
+		require.Nil(t, err)
+		assert.False(t, aborted)
+	}
+	for i := 0; i < reads; i++ {
+		gated.release <- struct{}{}
+	}
+	for i := 0; i < reads; i++ {
+		assert.Nil(t, <-result)
+	}
+
+	// the target interrupts running reads once it installed its cancel hook
+	atomic.StoreUint32(&gated.interruptible, 1)
+	result = startReads()
+	cids := ioq.Outstanding()
+	require.Equal(t, reads, len(cids))
+	for _, id := range cids {
+		aborted, err := admin.Abort(1, id)
+		require.Nil(t, err)
+		assert.True(t, aborted)
+	}
+	for i := 0; i < reads; i++ {
+		assert.EqualError(t, <-result, protocol.SCAbortedRequest.String())
+	}
+	cid := cids[0]
+
+	// unknown commands and queues are not aborted
+	aborted, err := admin.Abort(1, cid+100)
+	require.Nil(t, err)
+	assert.False(t, aborted)
+	aborted, err = admin.Abort(7, cid)
+	require.Nil(t, err)
+	assert.False(t, aborted)
+
+	// held AERs can be aborted as well
+	events := asyncEventRequest(admin)
+	require.Eventually(t, func() bool {
+		return len(admin.Outstanding()) == 1
+	}, time.Second, 10*time.Millisecond)
+	aborted, err = admin.Abort(0, admin.Outstanding()[0])
+	require.Nil(t, err)
+	assert.True(t, aborted)
+	_, ok := <-events
+	assert.False(t, ok)
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestControllerReset(t *testing.T) {
+	s := newTestServer(t)
+
+	target := targets.NewTestableTarget(nil)
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	})
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	status := func() uint64 {
+		v, err := admin.GetProperty(protocol.PropertyControllerStatus, 0)
+		require.Nil(t, err)
+		return v
+	}
+	setConfig := func(cc uint64) {
+		_, err := admin.SetProperty(protocol.PropertyControllerConfiguration, cc, 0)
+		require.Nil(t, err)
+	}
+
+	cap, err := admin.GetProperty(protocol.PropertyControllerCapabilities, 1)
+	require.Nil(t, err)
+	assert.NotZero(t, cap&protocol.CAPSubsystemResetSupported)
+
+	setConfig(protocol.CCEnable)
+	assert.Equal(t, uint64(protocol.CSTSReady), status())
+	testReadWrite(t, c)
+
+	// disabling the controller resets it and drops the I/O queues
+	state := s.Controllers(testNQN).Lookup(c.ControllerID())
+	require.NotNil(t, state)
+	require.Equal(t, 2, len(state.Queues()))
+	setConfig(0)
+	assert.Equal(t, uint64(0), status())
+	assert.Equal(t, 1, len(state.Queues()))
+
+	// once enabled again the host connects its I/O queues again
+	setConfig(protocol.CCEnable)
+	assert.Equal(t, uint64(protocol.CSTSReady), status())
+	c.CloseQueue(1)
+	testReadWrite(t, c)
+
+	// a normal shutdown flushes the target before reporting completion
+	flushes := atomic.LoadUint64(&target.FlushCount)
+	setConfig(protocol.CCEnable | protocol.CCShutdownNormal)
+	require.Eventually(t, func() bool {
+		return status()&protocol.CSTSShutdownMask == protocol.CSTSShutdownComplete
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, flushes+1, atomic.LoadUint64(&target.FlushCount))
+
+	// the host has to reset the controller before using it again
+	setConfig(0)
+	assert.Equal(t, uint64(0), status())
+	setConfig(protocol.CCEnable)
+	c.CloseQueue(1)
+	testReadWrite(t, c)
+
+	// a subsystem reset resets the controller and is reported through NSSRO until cleared
+	_, err = admin.SetProperty(protocol.PropertySubsystemReset, protocol.NSSRReset, 0)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(protocol.CSTSSubsystemReset), status())
+	assert.Equal(t, 1, len(state.Queues()))
+
+	_, err = admin.SetProperty(protocol.PropertyControllerStatus, protocol.CSTSSubsystemReset, 0)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), status())
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestControllerResetInFlight(t *testing.T) {
+	s := newTestServer(t)
+
+	gated := &gatedTarget{
+		started: make(chan *targets.IORequest, 1),
+		release: make(chan struct{}),
+	}
+	target := targets.NewWorkQueue(nil, gated)
+	require.Nil(t, target.Start())
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	})
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+	state := s.Controllers(testNQN).Lookup(c.ControllerID())
+	require.NotNil(t, state)
+
+	setConfig := func(cc uint64) {
+		_, err := admin.SetProperty(protocol.PropertyControllerConfiguration, cc, 0)
+		require.Nil(t, err)
+	}
+	startRead := func() chan error {
+		ioq, status := c.OpenIOQueue(1)
+		require.False(t, status.IsError())
+		result := make(chan error, 1)
+		go func() {
+			result <- ioq.Read(0, make([]byte, 4096))
+		}()
+		<-gated.started
+		return result
+	}
+	setConfig(protocol.CCEnable)
+
+	// the reset waits for a read the target can't interrupt, the host still gets its completion
+	result := startRead()
+	reset := make(chan struct{})
+	go func() {
+		setConfig(0)
+		close(reset)
+	}()
+	require.Eventually(t, func() bool {
+		return len(state.Queues()) == 1
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-reset:
+		t.Fatal("reset completed before the running read")
+	default:
+	}
+	gated.release <- struct{}{}
+	assert.Nil(t, <-result)
+	<-reset
+	v, err := admin.GetProperty(protocol.PropertyControllerStatus, 0)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), v)
+
+	// a read the target can interrupt is aborted by the reset
+	atomic.StoreUint32(&gated.interruptible, 1)
+	setConfig(protocol.CCEnable)
+	c.CloseQueue(1)
+	result = startRead()
+	setConfig(0)
+	assert.EqualError(t, <-result, protocol.SCAbortedRequest.String())
+	assert.Equal(t, 1, len(state.Queues()))
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+// dialRaw opens a connection that speaks NVMe/TCP PDUs directly, the connection is initialized
+func dialRaw(t *testing.T, addr string) (net.Conn, *stream.Writer, *stream.Reader) {
+	return dialRawWith(t, addr, protocol.ICRequest{})
+}
+
+// dialRawWith is dialRaw initializing the connection with ic
+func dialRawWith(t *testing.T, addr string, ic protocol.ICRequest) (net.Conn, *stream.Writer, *stream.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	out := stream.NewWriter(conn)
+	in := stream.NewReader(conn)
+
+	require.Nil(t, out.Send(protocol.ICReq, &ic, 120))
+	require.Nil(t, out.Flush())
+	hdr, err := in.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, uint8(protocol.ICResp), hdr.Type)
+	require.Nil(t, in.Receive(&protocol.ICResponse{}))
+	return conn, out, in
+}
+
+// expectTermination waits for the C2HTermReq that ends the connection
+func expectTermination(t *testing.T, in *stream.Reader, status uint16, info uint32) {
+	hdr, err := in.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, uint8(protocol.C2HTermReq), hdr.Type)
+	term := protocol.C2HTermRequest{}
+	require.Nil(t, in.Receive(&term))
+	assert.Equal(t, status, term.FatalErrorStatus)
+	assert.Equal(t, info, term.FatalErrorInformation)
+	_, err = in.Dequeue()
+	assert.NotNil(t, err)
+}
+
+func TestSessionErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	// unknown properties fail the command, not the session
+	_, err := admin.GetProperty(0x7F0, 0)
+	assert.EqualError(t, err, protocol.SCInvalidFieldInCommand.String())
+	_, err = admin.SetProperty(0x7F0, 1, 0)
+	assert.EqualError(t, err, protocol.SCInvalidFieldInCommand.String())
+
+	// a PDU type we don't know terminates only the connection it arrived on
+	conn, _, in := dialRaw(t, s.addr)
+	_, err = conn.Write([]byte{0x7F, 0, 8, 0, 8, 0, 0, 0})
+	require.Nil(t, err)
+	expectTermination(t, in, protocol.FESInvalidHeaderField, 0)
+	conn.Close()
+
+	// so does a capsule whose header is too short to hold a command
+	conn, _, in = dialRaw(t, s.addr)
+	_, err = conn.Write([]byte{protocol.CapsuleCmd, 0, 8, 0, 8, 0, 0, 0})
+	require.Nil(t, err)
+	expectTermination(t, in, protocol.FESInvalidHeaderField, 2)
+	conn.Close()
+
+	// the other session is still usable
+	require.Nil(t, admin.KeepAlive())
+	testReadWrite(t, c)
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+// connectRaw connects a raw connection as I/O queue qid of the controller
+func connectRaw(t *testing.T, out *stream.Writer, in *stream.Reader, cntlid uint16, qid uint16) {
+	fc := protocol.ConnectCommand{
+		OpCode:    protocol.CapsuleCmdFabric,
+		FCType:    protocol.FabricCmdConnect,
+		CATTR:     nvme.SQFlowControlDisabled,
+		QueueID:   qid,
+		QueueSize: client.DefaultQueueSize - 1,
+	}
+	require.Nil(t, fc.SetConnectData(&protocol.ConnectData{
+		CNTLID:  cntlid,
+		SubNQN:  testNQN,
+		HostNQN: testHostNQN,
+	}))
+	require.Nil(t, out.MarshalWithData2(protocol.CapsuleCmd, 0, &fc, 64, fc.Data()))
+	require.Nil(t, out.Flush())
+
+	hdr, err := in.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, uint8(protocol.CapsuleResp), hdr.Type)
+	rsp := protocol.CapsuleResponse{}
+	require.Nil(t, in.Receive(&rsp))
+	require.Equal(t, uint16(protocol.SCSuccess), rsp.Status)
+}
+
+func TestH2CDataRange(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+	s.start()
+
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithHostNQN(testHostNQN)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+
+	// a write that needs R2T, the host answers with data the controller did not ask for
+	write := func(h2c protocol.H2CDataTransfer) {
+		conn, out, in := dialRaw(t, s.addr)
+		defer conn.Close()
+		connectRaw(t, out, in, c.ControllerID(), 1)
+
+		cmd := &protocol.CapsuleCommand{
+			OpCode: protocol.CapsuleCmdWrite,
+			CID:    1,
+			NSID:   1,
+			D12:    8192/512 - 1,
+		}
+		cmd.SetSGL(protocol.TransportSGL(8192))
+		require.Nil(t, out.MarshalWithData2(protocol.CapsuleCmd, 0, cmd, 64, nil))
+		require.Nil(t, out.Flush())
+
+		hdr, err := in.Dequeue()
+		require.Nil(t, err)
+		require.Equal(t, uint8(protocol.R2T), hdr.Type)
+		r2t := protocol.R2TRequest{}
+		require.Nil(t, in.Receive(&r2t))
+
+		h2c.CCCID = r2t.CCCID
+		h2c.TTAG = r2t.TTAG
+		require.Nil(t, out.MarshalWithData2(protocol.H2CData, protocol.PDUFlagLastPDU, &h2c, 16, make([]byte, h2c.DATAL)))
+		require.Nil(t, out.Flush())
+		expectTermination(t, in, protocol.FESDataTransferOutOfRange, 0)
+	}
+
+	// an offset that wraps past the end of the transfer
+	write(protocol.H2CDataTransfer{DATAO: 0xFFFFFF00, DATAL: 512})
+	// an offset other than the one the R2T asked for
+	write(protocol.H2CDataTransfer{DATAO: 512, DATAL: 512})
+
+	// the controller keeps working for everyone else
+	testReadWrite(t, c)
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestMaxR2T(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: &targets.MemTarget{Buffer: make([]byte, 1024*1024)},
+	})
+	s.start()
+
+	c := s.connect(t, testNQN)
+
+	// the largest MAXR2T the host can ask for, every R2T of the transfer may be outstanding at once
+	conn, out, in := dialRawWith(t, s.addr, protocol.ICRequest{PDUMaxR2T: 0xFFFFFFFF})
+	defer conn.Close()
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	connectRaw(t, out, in, c.ControllerID(), 1)
+
+	length := uint32(2 * protocol.MaxH2CPDUSize)
+	cmd := &protocol.CapsuleCommand{
+		OpCode: protocol.CapsuleCmdWrite,
+		CID:    1,
+		NSID:   1,
+		D12:    length/512 - 1,
+	}
+	cmd.SetSGL(protocol.TransportSGL(length))
+	require.Nil(t, out.MarshalWithData2(protocol.CapsuleCmd, 0, cmd, 64, nil))
+	require.Nil(t, out.Flush())
+
+	r2ts := make([]protocol.R2TRequest, 2)
+	for i := range r2ts {
+		hdr, err := in.Dequeue()
+		require.Nil(t, err)
+		require.Equal(t, uint8(protocol.R2T), hdr.Type)
+		require.Nil(t, in.Receive(&r2ts[i]))
+		assert.Equal(t, uint32(i*protocol.MaxH2CPDUSize), r2ts[i].DATAO)
+		assert.Equal(t, uint32(protocol.MaxH2CPDUSize), r2ts[i].DATAL)
+	}
+	for _, r2t := range r2ts {
+		h2c := protocol.H2CDataTransfer{CCCID: r2t.CCCID, TTAG: r2t.TTAG, DATAO: r2t.DATAO, DATAL: r2t.DATAL}
+		require.Nil(t, out.MarshalWithData2(protocol.H2CData, protocol.PDUFlagLastPDU, &h2c, 16, make([]byte, h2c.DATAL)))
+		require.Nil(t, out.Flush())
+	}
+
+	hdr, err := in.Dequeue()
+	require.Nil(t, err)
+	require.Equal(t, uint8(protocol.CapsuleResp), hdr.Type)
+	rsp := protocol.CapsuleResponse{}
+	require.Nil(t, in.Receive(&rsp))
+	assert.Equal(t, uint16(protocol.SCSuccess), rsp.Status)
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestIOQueueFabricCommands(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: &targets.MemTarget{Buffer: make([]byte, 1024*1024)},
+	})
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+	_, err := admin.SetProperty(protocol.PropertyControllerConfiguration, protocol.CCEnable, 0)
+	require.Nil(t, err)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	// properties and connect belong to the admin queue, a reset through an I/O queue must not happen
+	for _, cmd := range []*protocol.CapsuleCommand{
+		{OpCode: protocol.CapsuleCmdFabric, FCType: protocol.FabricCmdPropertyGet, D11: protocol.PropertyControllerStatus},
+		{OpCode: protocol.CapsuleCmdFabric, FCType: protocol.FabricCmdPropertySet, D11: protocol.PropertyControllerConfiguration},
+		{OpCode: protocol.CapsuleCmdFabric, FCType: protocol.FabricCmdPropertySet, D11: protocol.PropertySubsystemReset, D12: protocol.NSSRReset},
+		{OpCode: protocol.CapsuleCmdFabric, FCType: protocol.FabricCmdConnect},
+	} {
+		req := client.NewCapsuleRequest(cmd, nil, nil)
+		ioq.QueueCapsule(req)
+		req.Wait()
+		assert.Equal(t, protocol.SCInvalidCommandOpcode, req.GetStatus().Code(), protocol.FCTypeToString(cmd.FCType))
+	}
+
+	require.Nil(t, ioq.Write(0, make([]byte, 4096)))
+	csts, err := admin.GetProperty(protocol.PropertyControllerStatus, 0)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(protocol.CSTSReady), csts)
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestSGLDescriptors(t *testing.T) {
+	s := newTestServer(t)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	submit := func(opcode uint8, sgl protocol.SGLDescriptor, send, recv []byte) protocol.NVMEStatusCode {
+		cmd := &protocol.CapsuleCommand{
+			OpCode: opcode,
+			NSID:   1,
+			D12:    4096/512 - 1,
+		}
+		cmd.SetSGL(sgl)
+		req := client.NewCapsuleRequest(cmd, recv, send)
+		req.KeepSGL = true
+		ioq.QueueCapsule(req)
+		req.Wait()
+		return req.GetStatus().Code()
+	}
+
+	// in capsule data may start at an offset
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	payload := append(make([]byte, 512), data...)
+	assert.Equal(t, protocol.SCSuccess, submit(protocol.CapsuleCmdWrite, protocol.InCapsuleSGL(512, 4096), payload, nil))
+
+	read := make([]byte, 4096)
+	require.Nil(t, ioq.Read(0, read))
+	assert.Equal(t, data, read)
+
+	// the descriptor has to match the command and the data that came with it
+	assert.Equal(t, protocol.SCInvalidSGLData, submit(protocol.CapsuleCmdWrite, protocol.InCapsuleSGL(0, 2048), data, nil))
+	assert.Equal(t, protocol.SCInvalidSGLOffset, submit(protocol.CapsuleCmdWrite, protocol.InCapsuleSGL(8192, 4096), data, nil))
+	assert.Equal(t, protocol.SCInvalidSGLData, submit(protocol.CapsuleCmdWrite, protocol.TransportSGL(4096), data, nil))
+	assert.Equal(t, protocol.SCInvalidSGLType, submit(protocol.CapsuleCmdRead, protocol.InCapsuleSGL(0, 4096), nil, read))
+	assert.Equal(t, protocol.SCInvalidSGLData, submit(protocol.CapsuleCmdRead, protocol.TransportSGL(512), nil, read))
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestLargeTransfers(t *testing.T) {
+	s := newTestServer(t)
+	s.SetMaxC2HDataLength(16 * 1024)
+
+	subsys := newTestSubsystem(t, false)
+	subsys.MaxTransferSize = 1024 * 1024
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+
+	id, err := c.AdminQueue().IdentifyController()
+	require.Nil(t, err)
+	assert.Equal(t, uint8(8), id.MDTS) // 4K * 2^8
+
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	// reads come back in many C2HData PDUs
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7 / 512)
+	}
+	require.Nil(t, ioq.Write(0, data))
+	verify := make([]byte, len(data))
+	require.Nil(t, ioq.Read(0, verify))
+	assert.Equal(t, data, verify)
+
+	// anything past MDTS is rejected
+	err = ioq.Read(0, make([]byte, 2*1024*1024))
+	assert.EqualError(t, err, protocol.SCInvalidFieldInCommand.String())
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+// pduCounter counts the PDUs of each type the client receives
+type pduCounter struct {
+	tracer.NullTracer
+	counts [256]uint64
+}
+
+func (p *pduCounter) TraceProtocol(level uint64, a interface{}) {
+	if hdr, ok := a.(*protocol.CommonHeader); ok {
+		atomic.AddUint64(&p.counts[hdr.Type], 1)
+	}
+}
+
+func (p *pduCounter) count(pdu uint8) uint64 {
+	return atomic.LoadUint64(&p.counts[pdu])
+}
+
+func TestC2HSuccess(t *testing.T) {
+	s := newTestServer(t)
+	s.SetC2HSuccess(true)
+	s.AddSubSystem(newTestSubsystem(t, false))
+
+	s.start()
+
+	pdus := &pduCounter{}
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithTracer(pdus)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	testReadWrite(t, c)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	// a successful read is completed by its last C2HData PDU
+	responses := pdus.count(protocol.CapsuleResp)
+	require.Nil(t, ioq.Read(0, make([]byte, 4096)))
+	assert.Equal(t, responses, pdus.count(protocol.CapsuleResp))
+
+	// failures still get a response capsule
+	err = ioq.Read(1024*1024*1024/512, make([]byte, 4096))
+	assert.EqualError(t, err, protocol.SCLBAOutOfRange.String())
+	assert.Equal(t, responses+1, pdus.count(protocol.CapsuleResp))
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+// heldTarget completes requests right away unless hold is set, then it keeps them until release
+type heldTarget struct {
+	lock     sync.Mutex
+	hold     bool
+	closed   bool
+	requests []*targets.IORequest
+}
+
+func (h *heldTarget) Start() error {
+	return nil
+}
+
+func (h *heldTarget) Queue(r *targets.IORequest) targets.TargetError {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.hold {
+		return r.Complete(targets.TargetErrorNone)
+	}
+	h.requests = append(h.requests, r)
+	return targets.TargetErrorNone
+}
+
+func (h *heldTarget) GetSize() uint64 {
+	return 1024 * 1024 * 1024
+}
+
+func (h *heldTarget) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	return nil
+}
+
+func (h *heldTarget) isClosed() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.closed
+}
+
+func (h *heldTarget) GetRuntimeDetails() []targets.KV {
+	return nil
+}
+
+func (h *heldTarget) setHold(hold bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.hold = hold
+}
+
+func (h *heldTarget) held() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.requests)
+}
+
+func (h *heldTarget) release() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, r := range h.requests {
+		r.Complete(targets.TargetErrorNone)
+	}
+	h.requests = nil
+}
+
+func TestSQFlowControl(t *testing.T) {
+	s := newTestServer(t)
+	target := &heldTarget{}
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	})
+
+	s.start()
+
+	// queues must fit CAP.MQES and admin queues need at least 32 entries
+	for _, size := range []uint16{16, 65} {
+		c, err := client.New(s.addr, testNQN)
+		require.Nil(t, err)
+		c.WithQueueSize(size)
+		assert.Equal(t, protocol.SCConnectInvalidParameters, c.Login().Code())
+		c.Close()
+	}
+
+	pdus := &pduCounter{}
+	c, err := client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithTracer(pdus).WithSQFlowControl(true)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	// Connect took the first slot, the head wraps at the queue size
+	for i := 0; i < 2*client.DefaultQueueSize; i++ {
+		req := client.NewCapsuleRequest(&protocol.CapsuleCommand{OpCode: protocol.CapsuleCmdRead, NSID: 1}, make([]byte, 512), nil)
+		ioq.QueueCapsule(req)
+		req.Wait()
+		require.Equal(t, protocol.SCSuccess, req.GetStatus())
+		assert.Equal(t, uint16((i+2)%client.DefaultQueueSize), req.Response.SQHD)
+	}
+
+	// fill the queue, one more command is an overrun and ends the connection
+	target.setHold(true)
+	results := make(chan error, client.DefaultQueueSize)
+	for i := 0; i < client.DefaultQueueSize; i++ {
+		go func() {
+			results <- ioq.Read(0, make([]byte, 512))
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return target.held() == client.DefaultQueueSize
+	}, time.Second, 10*time.Millisecond)
+
+	req := client.NewCapsuleRequest(&protocol.CapsuleCommand{OpCode: protocol.CapsuleCmdRead, NSID: 1}, make([]byte, 512), nil)
+	ioq.QueueCapsule(req)
+	req.Wait()
+	assert.True(t, req.GetStatus().IsError())
+	for i := 0; i < client.DefaultQueueSize; i++ {
+		assert.NotNil(t, <-results)
+	}
+	assert.Equal(t, uint64(1), pdus.count(protocol.C2HTermReq))
+
+	target.release()
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestVolatileWriteCache(t *testing.T) {
+	f, err := os.CreateTemp("", "functional-vwc-")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	require.Nil(t, f.Truncate(16*1024*1024))
+	require.Nil(t, f.Close())
+
+	target, err := targets.New("file", make(targets.Options).With("image", f.Name()))
+	require.Nil(t, err)
+	require.Nil(t, target.Start())
+
+	subsys := &nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	}
+	s := newTestServer(t)
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	id, err := admin.IdentifyController()
+	require.Nil(t, err)
+	assert.Equal(t, uint8(1), id.VWC)
+
+	enabled, err := admin.VolatileWriteCache()
+	require.Nil(t, err)
+	assert.True(t, enabled)
+
+	// write-through keeps working, flush still succeeds
+	require.Nil(t, admin.SetVolatileWriteCache(false))
+	testReadWrite(t, c)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+	require.Nil(t, ioq.Flush(0, nil))
+	assert.Nil(t, c.Close())
+
+	// namespaces added later run write-through as well
+	f2, err := os.CreateTemp("", "functional-vwc-")
+	require.Nil(t, err)
+	defer os.Remove(f2.Name())
+	require.Nil(t, f2.Truncate(16*1024*1024))
+	require.Nil(t, f2.Close())
+
+	target2, err := targets.New("file", make(targets.Options).With("image", f2.Name()))
+	require.Nil(t, err)
+	require.Nil(t, target2.Start())
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 2, Target: target2}))
+	wc, ok := targets.GetWriteCache(target2)
+	require.True(t, ok)
+	assert.False(t, wc.WriteCache())
+
+	// the setting belongs to the subsystem, a new controller sees it
+	c = s.connect(t, testNQN)
+	enabled, err = c.AdminQueue().VolatileWriteCache()
+	require.Nil(t, err)
+	assert.False(t, enabled)
+	require.Nil(t, c.AdminQueue().SetVolatileWriteCache(true))
+	assert.True(t, wc.WriteCache())
+	assert.Nil(t, c.Close())
+
+	s.stop(t)
+}
+
+func TestDatasetManagement(t *testing.T) {
+	target := targets.NewTestableTarget(make(targets.Options).With("sleep", 0))
+	require.Nil(t, target.Start())
+
+	s := newTestServer(t)
+	s.AddSubSystem(&nvme.TargetSubsystem{
+		NQN:    testNQN,
+		Target: target,
+	})
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	data := make([]byte, 128*512)
+	for i := range data {
+		data[i] = 0xA5
+	}
+	require.Nil(t, ioq.Write(0, data))
+
+	// empty ranges are skipped, only the listed blocks are trimmed
+	err := ioq.Deallocate([]protocol.DSMRange{
+		{StartingLBA: 0, Length: 8},
+		{StartingLBA: 100, Length: 16},
+		{StartingLBA: 200, Length: 0},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&target.TrimCount))
+
+	verify := make([]byte, len(data))
+	require.Nil(t, ioq.Read(0, verify))
+	for lba := 0; lba < 128; lba++ {
+		expected := byte(0xA5)
+		if lba < 8 || (lba >= 100 && lba < 116) {
+			expected = 0
+		}
+		assert.Equal(t, expected, verify[lba*512], "lba %d", lba)
+	}
+
+	// nothing is trimmed when a range is out of bounds
+	err = ioq.Deallocate([]protocol.DSMRange{
+		{StartingLBA: 0, Length: 8},
+		{StartingLBA: 1024 * 1024 * 1024 / 512, Length: 8},
+	})
+	assert.EqualError(t, err, protocol.SCLBAOutOfRange.String())
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&target.TrimCount))
+
+	// a range whose end wraps past 2^64 is out of bounds as well
+	err = ioq.Deallocate([]protocol.DSMRange{
+		{StartingLBA: math.MaxUint64 - 3, Length: 8},
+	})
+	assert.EqualError(t, err, protocol.SCLBAOutOfRange.String())
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&target.TrimCount))
+	assert.Nil(t, c.Close())
+
+	// a full range list does not fit in the capsule and is sent on R2T
+	c, err = client.New(s.addr, testNQN)
+	require.Nil(t, err)
+	c.WithInCapsuleDataSize(1024)
+	require.Equal(t, protocol.SCSuccess, c.Login())
+	ioq, status = c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	ranges := make([]protocol.DSMRange, protocol.DSMMaxRanges)
+	for i := range ranges {
+		ranges[i] = protocol.DSMRange{StartingLBA: uint64(i * 16), Length: 1}
+	}
+	require.Nil(t, ioq.Deallocate(ranges))
+	assert.Equal(t, uint64(2+protocol.DSMMaxRanges), atomic.LoadUint64(&target.TrimCount))
+	assert.Nil(t, c.Close())
+
+	s.stop(t)
+}
+
+func TestNamespaces(t *testing.T) {
+	s := newTestServer(t)
+
+	subsys := &nvme.TargetSubsystem{
+		NQN: testNQN,
+	}
+	for _, nsid := range []uint32{3, 1} {
+		target := targets.NewTestableTarget(make(targets.Options).With("sleep", 0))
+		require.Nil(t, target.Start())
+
+		ns := &nvme.Namespace{
+			ID:     nsid,
+			Target: target,
+		}
+		ns.UUID[0] = byte(nsid)
+		ns.UUID[15] = 0xAA
+		require.Nil(t, subsys.AddNamespace(ns))
+	}
+	assert.NotNil(t, subsys.AddNamespace(&nvme.Namespace{ID: 1, Target: targets.NewNullTarget(nil)}))
+	assert.NotNil(t, subsys.AddNamespace(&nvme.Namespace{ID: nvme.MaxNamespaces + 1, Target: targets.NewNullTarget(nil)}))
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	id, err := admin.IdentifyController()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(nvme.MaxNamespaces), id.NumberNamespaces)
+
+	list, err := admin.ActiveNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1, 3}, list)
+	list, err = admin.ActiveNamespaces(1)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{3}, list)
+
+	nsData, err := admin.IdentifyNamespace(3)
+	require.Nil(t, err)
+	assert.NotZero(t, nsData.NSZE)
+	assert.Equal(t, byte(3), nsData.NGUID[0])
+
+	// an unused namespace ID is inactive, one past the maximum is invalid
+	nsData, err = admin.IdentifyNamespace(2)
+	require.Nil(t, err)
+	assert.Zero(t, nsData.NSZE)
+	_, err = admin.IdentifyNamespace(nvme.MaxNamespaces + 1)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+
+	descs, err := admin.NamespaceDescriptors(3)
+	require.Nil(t, err)
+	require.Len(t, descs, 3)
+	assert.Equal(t, uint8(protocol.NIDTEUI64), descs[0].NIDT)
+	assert.Equal(t, []byte{0x38, 0x25, 0x00, 3, 0, 0, 0, 0}, descs[0].NID)
+	assert.Equal(t, uint8(protocol.NIDTNGUID), descs[1].NIDT)
+	assert.Equal(t, uint8(protocol.NIDTUUID), descs[2].NIDT)
+	assert.Len(t, descs[2].NID, 16)
+	assert.Equal(t, byte(0xAA), descs[2].NID[15])
+	_, err = admin.NamespaceDescriptors(2)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	// each namespace has its own data
+	one := bytes.Repeat([]byte{0x11}, 4096)
+	three := bytes.Repeat([]byte{0x33}, 4096)
+	require.Nil(t, ioq.WithNamespace(1).Write(0, one))
+	require.Nil(t, ioq.WithNamespace(3).Write(0, three))
+
+	verify := make([]byte, 4096)
+	require.Nil(t, ioq.WithNamespace(1).Read(0, verify))
+	assert.Equal(t, one, verify)
+	require.Nil(t, ioq.WithNamespace(3).Read(0, verify))
+	assert.Equal(t, three, verify)
+
+	// namespaces can not be created without a backend
+	_, err = admin.CreateNamespace(8, 0)
+	assert.EqualError(t, err, protocol.SCInvalidCommandOpcode.String())
+
+	err = ioq.WithNamespace(2).Read(0, verify)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+	err = ioq.WithNamespace(2).Write(0, one)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+	assert.Nil(t, ioq.WithNamespace(protocol.NSIDBroadcast).Flush(0, nil))
+
+	page := make([]byte, 4096)
+	require.Nil(t, admin.GetLogPage(protocol.LPAsymmetricNamespaceAccess, false, page))
+	assert.Equal(t, uint32(2), binary.LittleEndian.Uint32(page[16+4:]))
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(page[protocol.ANAGroupNSIDOffset:]))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(page[protocol.ANAGroupNSIDOffset+4:]))
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestNamespaceManagement(t *testing.T) {
+	dir := t.TempDir()
+	target := targets.NewTestableTarget(make(targets.Options).With("sleep", 0))
+	require.Nil(t, target.Start())
+
+	s := newTestServer(t)
+	backend := nvme.NamespaceBackend{
+		Type:    "file",
+		Options: targets.Options{"dir": dir},
+	}
+	changes := int32(0)
+	subsys := &nvme.TargetSubsystem{
+		NQN:              testNQN,
+		Target:           target,
+		NamespaceBackend: backend,
+		NamespacesChanged: func() {
+			atomic.AddInt32(&changes, 1)
+		},
+	}
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	connect := func(hostNQN string) (*client.Client, *client.AdminQueue, *client.IOQueue) {
+		c, err := client.New(s.addr, testNQN)
+		require.Nil(t, err)
+		c.WithHostNQN(hostNQN)
+		require.Equal(t, protocol.SCSuccess, c.Login())
+		ioq, status := c.OpenIOQueue(1)
+		require.False(t, status.IsError())
+		admin := c.AdminQueue()
+		require.Nil(t, admin.SetAsyncEventConfig(protocol.AECNamespaceAttribute))
+		return c, admin, ioq
+	}
+	c1, admin1, ioq1 := connect(testHostNQN)
+	c2, admin2, ioq2 := connect("nqn.2020-20.com.thirdmartini.nvme:initiator1")
+	ctrl1, ctrl2 := c1.ControllerID(), c2.ControllerID()
+
+	id, err := admin1.IdentifyController()
+	require.Nil(t, err)
+	assert.NotZero(t, id.OACS&protocol.OACSNamespaceManagement)
+
+	// a new namespace is allocated but not attached to any controller
+	nsid, err := admin1.CreateNamespace(2048, 0)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(2), nsid)
+	files, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&changes))
+
+	list, err := admin1.AllocatedNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2}, list)
+	list, err = admin1.ActiveNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1}, list)
+	err = ioq1.WithNamespace(2).Write(0, make([]byte, 512))
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+
+	// the other controller hears about the attach, the one that made it does not
+	events1 := asyncEventRequest(admin1)
+	require.Nil(t, admin1.AttachNamespace(2, []uint16{ctrl1, ctrl2}))
+	select {
+	case ev := <-asyncEventRequest(admin2):
+		assert.Equal(t, protocol.NamespaceChangedEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("namespace attach not reported")
+	}
+	select {
+	case ev := <-events1:
+		t.Fatalf("unexpected event %s", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+	log := make([]byte, 4096)
+	require.Nil(t, admin2.GetLogPage(protocol.LPChangedNamespaceList, false, log))
+	assert.Equal(t, []byte{2, 0, 0, 0, 0, 0, 0, 0}, log[:8])
+
+	err = admin1.AttachNamespace(2, []uint16{ctrl2})
+	assert.EqualError(t, err, protocol.SCNamespaceAlreadyAttached.String())
+	err = admin1.AttachNamespace(2, []uint16{0x999})
+	assert.EqualError(t, err, protocol.SCControllerListInvalid.String())
+	ids, err := admin1.AttachedControllers(2)
+	require.Nil(t, err)
+	assert.Equal(t, []uint16{ctrl1, ctrl2}, ids)
+
+	data := bytes.Repeat([]byte{0x5A}, 4096)
+	require.Nil(t, ioq1.WithNamespace(2).Write(8, data))
+	verify := make([]byte, 4096)
+	require.Nil(t, ioq2.WithNamespace(2).Read(8, verify))
+	assert.Equal(t, data, verify)
+
+	// detaching takes the namespace away from that controller only
+	require.Nil(t, admin1.DetachNamespace(2, []uint16{ctrl2}))
+	err = ioq2.WithNamespace(2).Read(8, verify)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+	err = admin1.DetachNamespace(2, []uint16{ctrl2})
+	assert.EqualError(t, err, protocol.SCNamespaceNotAttached.String())
+
+	// a namespace shared by every controller can be detached from one of them
+	require.Nil(t, admin1.DetachNamespace(1, []uint16{ctrl2}))
+	list, err = admin2.ActiveNamespaces(0)
+	require.Nil(t, err)
+	assert.Empty(t, list)
+	list, err = admin1.ActiveNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2}, list)
+	ids, err = admin1.AttachedControllers(1)
+	require.Nil(t, err)
+	assert.Equal(t, []uint16{ctrl1}, ids)
+
+	// attachments belong to the host, its next controller has the same namespaces
+	assert.Nil(t, c1.Close())
+	c1, admin1, ioq1 = connect(testHostNQN)
+	assert.NotEqual(t, ctrl1, c1.ControllerID())
+	ctrl1 = c1.ControllerID()
+	list, err = admin1.ActiveNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2}, list)
+	require.Nil(t, ioq1.WithNamespace(2).Read(8, verify))
+	assert.Equal(t, data, verify)
+
+	// what CreatedNamespaces saves brings the namespace back on the same backend
+	states := subsys.CreatedNamespaces()
+	require.Len(t, states, 1)
+	assert.Equal(t, uint32(2), states[0].ID)
+	assert.Equal(t, []string{testHostNQN}, states[0].Hosts)
+	restored := &nvme.TargetSubsystem{
+		NQN:              testNQN + ".restored",
+		NamespaceBackend: backend,
+	}
+	require.Nil(t, restored.RestoreNamespace(states[0]))
+	ns := restored.Namespace(2)
+	require.NotNil(t, ns)
+	assert.Equal(t, subsys.Namespace(2).UUID, ns.UUID)
+	assert.Equal(t, uint64(2048), ns.Blocks())
+	assert.Nil(t, restored.RemoveNamespace(2).Target.Close())
+
+	// deleting releases the image
+	require.Nil(t, admin1.DeleteNamespace(2))
+	files, err = os.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+	err = admin1.DeleteNamespace(2)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+	list, err = admin1.AllocatedNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1}, list)
+
+	// namespaces are created in any of the advertised formats
+	nsid, err = admin1.CreateNamespace(256, 1)
+	require.Nil(t, err)
+	require.Nil(t, admin1.AttachNamespace(nsid, []uint16{ctrl1}))
+	size, err := admin1.LBASize(nsid)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(4096), size)
+	require.Nil(t, admin1.DeleteNamespace(nsid))
+	_, err = admin1.CreateNamespace(256, 5)
+	assert.EqualError(t, err, protocol.SCInvalidFormat.String())
+
+	// a size that does not fit in 64 bits of bytes is more than any backend has
+	_, err = admin1.CreateNamespace(1<<55, 0)
+	assert.EqualError(t, err, protocol.SCNamespaceInsufficientCapacity.String())
+
+	// the hosts hear about a deleted namespace even when releasing its storage fails
+	nsid, err = admin1.CreateNamespace(256, 0)
+	require.Nil(t, err)
+	events2 := asyncEventRequest(admin2)
+	require.Nil(t, admin1.AttachNamespace(nsid, []uint16{ctrl2}))
+	select {
+	case ev := <-events2:
+		assert.Equal(t, protocol.NamespaceChangedEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("namespace attach not reported")
+	}
+	require.Nil(t, admin2.GetLogPage(protocol.LPChangedNamespaceList, false, log))
+
+	files, err = os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	require.Nil(t, os.Remove(filepath.Join(dir, files[0].Name())))
+	changed := atomic.LoadInt32(&changes)
+	events2 = asyncEventRequest(admin2)
+	err = admin1.DeleteNamespace(nsid)
+	assert.EqualError(t, err, protocol.SCInternalError.String())
+	select {
+	case ev := <-events2:
+		assert.Equal(t, protocol.NamespaceChangedEvent, ev)
+	case <-time.After(time.Second):
+		t.Fatal("namespace delete not reported")
+	}
+	assert.Equal(t, changed+1, atomic.LoadInt32(&changes))
+	list, err = admin1.AllocatedNamespaces(0)
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1}, list)
+
+	assert.Nil(t, c2.Close())
+	assert.Nil(t, c1.Close())
+	s.stop(t)
+}
+
+func TestDeleteNamespaceInFlight(t *testing.T) {
+	s := newTestServer(t)
+
+	target := &heldTarget{}
+	subsys := &nvme.TargetSubsystem{
+		NQN: testNQN,
+	}
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 1, Target: target}))
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	target.setHold(true)
+	written := make(chan error, 1)
+	go func() {
+		written <- ioq.Write(0, make([]byte, 4096))
+	}()
+	require.Eventually(t, func() bool {
+		return target.held() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the delete waits for the write before it closes the target, new I/O is turned away meanwhile
+	deleted := make(chan error, 1)
+	go func() {
+		deleted <- subsys.DeleteNamespace(1)
+	}()
+	require.Eventually(t, func() bool {
+		return subsys.Namespace(1) == nil
+	}, time.Second, 10*time.Millisecond)
+	err := ioq.Read(0, make([]byte, 512))
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+	select {
+	case err := <-deleted:
+		t.Fatalf("delete returned before the write completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, target.isClosed())
+
+	target.release()
+	assert.Nil(t, <-written)
+	assert.Nil(t, <-deleted)
+	assert.True(t, target.isClosed())
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestLBAFormats(t *testing.T) {
+	s := newTestServer(t)
+
+	small := &targets.MemTarget{Buffer: make([]byte, 1024*1024)}
+	large := &targets.MemTarget{Buffer: make([]byte, 1024*1024)}
+	subsys := &nvme.TargetSubsystem{
+		NQN: testNQN,
+	}
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 1, Target: small}))
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 2, Target: large, BlockSize: 4096}))
+	assert.NotNil(t, subsys.AddNamespace(&nvme.Namespace{ID: 3, Target: large, BlockSize: 1024}))
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+
+	// every namespace advertises all formats and selects its own
+	nsData, err := admin.IdentifyNamespace(2)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(len(nvme.LBAFormats)-1), nsData.NLBAF)
+	assert.Equal(t, uint32(512), protocol.LBAFormatDataSize(nsData.LBAF[0]))
+	assert.Equal(t, uint32(4096), protocol.LBAFormatDataSize(nsData.LBAF[1]))
+	assert.Equal(t, uint8(1), nsData.FLBAS)
+	assert.Equal(t, uint64(256), nsData.NSZE)
+
+	size, err := admin.LBASize(1)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(512), size)
+	size, err = admin.LBASize(2)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(4096), size)
+
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+	ioq.WithNamespace(2).WithBlockSize(size)
+
+	// LBAs count 4K blocks, the blocks around the write are untouched
+	data := bytes.Repeat([]byte{0x4B}, 8192)
+	zeros := make([]byte, 4096)
+	verify := make([]byte, 8192)
+	require.Nil(t, ioq.Write(3, data))
+	require.Nil(t, ioq.Read(3, verify))
+	assert.Equal(t, data, verify)
+	for _, lba := range []uint64{2, 5} {
+		require.Nil(t, ioq.Read(lba, verify[:4096]))
+		assert.Equal(t, zeros, verify[:4096])
+	}
+
+	// the last 4K block ends with the target
+	require.Nil(t, ioq.Write(255, data[:4096]))
+	require.Nil(t, ioq.Read(255, verify[:4096]))
+	assert.Equal(t, data[:4096], verify[:4096])
+
+	require.Nil(t, ioq.WriteZero(4, 1))
+	require.Nil(t, ioq.Read(3, verify))
+	assert.Equal(t, data[:4096], verify[:4096])
+	assert.Equal(t, zeros, verify[4096:])
+
+	require.Nil(t, ioq.Deallocate([]protocol.DSMRange{{StartingLBA: 3, Length: 1}}))
+	require.Nil(t, ioq.Read(3, verify[:4096]))
+	assert.Equal(t, zeros, verify[:4096])
+	err = ioq.Deallocate([]protocol.DSMRange{{StartingLBA: 255, Length: 2}})
+	assert.EqualError(t, err, protocol.SCLBAOutOfRange.String())
+
+	// the 512 byte namespace is unaffected
+	ioq.WithNamespace(1).WithBlockSize(512)
+	require.Nil(t, ioq.Write(3, data[:512]))
+	require.Nil(t, ioq.Read(3, verify[:1024]))
+	assert.Equal(t, data[:512], verify[:512])
+	assert.Equal(t, zeros[:512], verify[512:1024])
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+// zeroingTarget hides the Erase of the target it wraps, a format has to write zeros to erase it
+type zeroingTarget struct {
+	targets.Target
+}
+
+func TestFormatNVM(t *testing.T) {
+	s := newTestServer(t)
+
+	mem := &targets.MemTarget{Buffer: make([]byte, 1024*1024)}
+	zeroing := &zeroingTarget{Target: &targets.MemTarget{Buffer: make([]byte, 3*1024*1024)}}
+	held := &heldTarget{}
+	subsys := &nvme.TargetSubsystem{
+		NQN: testNQN,
+	}
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 1, Target: mem}))
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 2, Target: zeroing}))
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 3, Target: held}))
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	id, err := admin.IdentifyController()
+	require.Nil(t, err)
+	assert.NotZero(t, id.FNA&protocol.FNACryptoErase)
+
+	data := bytes.Repeat([]byte{0xF0}, 4096)
+	verify := make([]byte, 4096)
+	zeros := make([]byte, 4096)
+
+	// a user data erase to 4K, the memory target drops its buffer
+	require.Nil(t, ioq.WithNamespace(1).Write(16, data))
+	require.Nil(t, admin.FormatNVM(1, 1, protocol.SecureEraseUserData))
+	size, err := admin.LBASize(1)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(4096), size)
+	require.Nil(t, ioq.WithBlockSize(4096).Read(2, verify))
+	assert.Equal(t, zeros, verify)
+
+	// without an erase only the format changes
+	require.Nil(t, ioq.Write(2, data))
+	require.Nil(t, admin.FormatNVM(1, 0, protocol.SecureEraseNone))
+	require.Nil(t, ioq.WithBlockSize(512).Read(16, verify))
+	assert.Equal(t, data, verify)
+
+	// a crypto erase of a target without Erase writes zeros
+	require.Nil(t, ioq.WithNamespace(2).Write(4000, data))
+	require.Nil(t, admin.FormatNVM(2, 0, protocol.SecureEraseCrypto))
+	require.Nil(t, ioq.Read(4000, verify))
+	assert.Equal(t, zeros, verify)
+
+	// so does a user data erase, the data anywhere on the namespace reads back as zeros
+	lastLBA := uint64(3*1024*1024-4096) / 512
+	for _, lba := range []uint64{0, 2048, lastLBA} {
+		require.Nil(t, ioq.Write(lba, data))
+	}
+	require.Nil(t, admin.FormatNVM(2, 0, protocol.SecureEraseUserData))
+	for _, lba := range []uint64{0, 2048, lastLBA} {
+		require.Nil(t, ioq.Read(lba, verify))
+		assert.Equal(t, zeros, verify)
+	}
+
+	err = admin.FormatNVM(1, 5, protocol.SecureEraseNone)
+	assert.EqualError(t, err, protocol.SCInvalidFormat.String())
+	err = admin.FormatNVM(1, 0, 3)
+	assert.EqualError(t, err, protocol.SCInvalidFieldInCommand.String())
+	err = admin.FormatNVM(9, 0, protocol.SecureEraseNone)
+	assert.EqualError(t, err, protocol.SCInvalidNamespace.String())
+
+	// I/O the namespace took before the format completes before the erase starts
+	held.setHold(true)
+	written := make(chan error, 1)
+	go func() {
+		written <- ioq.WithNamespace(3).Write(0, data)
+	}()
+	require.Eventually(t, func() bool { return held.held() == 1 }, time.Second, 10*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		done <- admin.FormatNVM(3, 0, protocol.SecureEraseUserData)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, held.held())
+	held.setHold(false)
+	held.release()
+	assert.Nil(t, <-written)
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("format did not complete")
+	}
+
+	// while the format runs the namespace reports its progress and takes no I/O
+	held.setHold(true)
+	go func() {
+		done <- admin.FormatNVM(3, 1, protocol.SecureEraseUserData)
+	}()
+	require.Eventually(t, func() bool { return held.held() == 1 }, time.Second, 10*time.Millisecond)
+
+	nsData, err := admin.IdentifyNamespace(3)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(protocol.FPISupported|100), nsData.FPI)
+	err = ioq.WithNamespace(3).Read(0, verify[:512])
+	assert.EqualError(t, err, protocol.SCFormatInProgress.String())
+	err = admin.FormatNVM(protocol.NSIDBroadcast, 0, protocol.SecureEraseNone)
+	assert.EqualError(t, err, protocol.SCFormatInProgress.String())
+
+	held.setHold(false)
+	held.release()
+	select {
+	case err = <-done:
+		require.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("format did not complete")
+	}
+	nsData, err = admin.IdentifyNamespace(3)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(protocol.FPISupported), nsData.FPI)
+	assert.Equal(t, uint8(1), nsData.FLBAS)
+	require.Nil(t, ioq.WithBlockSize(4096).Read(0, verify))
+
+	// the broadcast NSID formats every namespace
+	require.Nil(t, admin.FormatNVM(protocol.NSIDBroadcast, 1, protocol.SecureEraseNone))
+	for _, nsid := range []uint32{1, 2, 3} {
+		size, err = admin.LBASize(nsid)
+		require.Nil(t, err)
+		assert.Equal(t, uint32(4096), size)
+	}
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}
+
+func TestSanitize(t *testing.T) {
+	s := newTestServer(t)
+
+	mem := &targets.MemTarget{Buffer: make([]byte, 1024*1024)}
+	zeroing := &zeroingTarget{Target: &targets.MemTarget{Buffer: make([]byte, 3*1024*1024)}}
+	held := &heldTarget{}
+	subsys := &nvme.TargetSubsystem{
+		NQN: testNQN,
+	}
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 1, Target: mem}))
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 2, Target: zeroing}))
+	require.Nil(t, subsys.AddNamespace(&nvme.Namespace{ID: 3, Target: held}))
+	s.AddSubSystem(subsys)
+
+	s.start()
+
+	c := s.connect(t, testNQN)
+	admin := c.AdminQueue()
+	ioq, status := c.OpenIOQueue(1)
+	require.False(t, status.IsError())
+
+	id, err := admin.IdentifyController()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(protocol.SANICAPCryptoErase|protocol.SANICAPBlockErase|protocol.SANICAPOverwrite), id.SANICAP)
+
+	lp, err := admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusNever), lp.SSTAT)
+	assert.Equal(t, uint16(0xFFFF), lp.SPROG)
+
+	data := bytes.Repeat([]byte{0xF0}, 4096)
+	verify := make([]byte, 4096)
+	zeros := make([]byte, 4096)
+
+	// sanitize waits until it is done, the completion is reported to the host with an event
+	sanitize := func(cdw10, pattern uint32) {
+		events := asyncEventRequest(admin)
+		require.Nil(t, admin.Sanitize(cdw10, pattern))
+		select {
+		case ev := <-events:
+			assert.Equal(t, protocol.SanitizeCompletedEvent, ev)
+		case <-time.After(10 * time.Second):
+			t.Fatal("sanitize did not complete")
+		}
+	}
+
+	// a block erase zeroes every namespace
+	require.Nil(t, ioq.WithNamespace(1).Write(16, data))
+	require.Nil(t, ioq.WithNamespace(2).Write(4000, data))
+	sanitize(protocol.SanitizeBlockErase, 0)
+	require.Nil(t, ioq.WithNamespace(1).Read(16, verify))
+	assert.Equal(t, zeros, verify)
+	require.Nil(t, ioq.WithNamespace(2).Read(4000, verify))
+	assert.Equal(t, zeros, verify)
+
+	lp, err = admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusCompleted), lp.SSTAT)
+	assert.Equal(t, uint32(protocol.SanitizeBlockErase), lp.SCDW10)
+	assert.Equal(t, uint16(0xFFFF), lp.SPROG)
+
+	// two overwrite passes that invert the pattern leave the inverted pattern behind
+	pattern := bytes.Repeat([]byte{0x10, 0x32, 0x54, 0x76}, 1024)
+	cdw10 := uint32(protocol.SanitizeOverwrite | 2<<protocol.SanitizeOWPASSShift | protocol.SanitizeOIPBP)
+	sanitize(cdw10, 0x89ABCDEF)
+	require.Nil(t, ioq.WithNamespace(1).Read(100, verify))
+	assert.Equal(t, pattern, verify)
+	require.Nil(t, ioq.WithNamespace(2).Read(5000, verify))
+	assert.Equal(t, pattern, verify)
+
+	lp, err = admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusCompleted|2<<protocol.SanitizeStatusPassesShift), lp.SSTAT)
+	assert.Equal(t, cdw10, lp.SCDW10)
+
+	// a crypto erase zeroes the data like a block erase
+	sanitize(protocol.SanitizeCryptoErase, 0)
+	require.Nil(t, ioq.WithNamespace(1).Read(100, verify))
+	assert.Equal(t, zeros, verify)
+
+	err = admin.Sanitize(7, 0)
+	assert.EqualError(t, err, protocol.SCInvalidFieldInCommand.String())
+	require.Nil(t, admin.Sanitize(protocol.SanitizeExitFailureMode, 0))
+
+	// I/O the namespaces took before the sanitize completes before anything is erased
+	held.setHold(true)
+	written := make(chan error, 1)
+	go func() {
+		written <- ioq.WithNamespace(3).Write(0, data)
+	}()
+	require.Eventually(t, func() bool { return held.held() == 1 }, time.Second, 10*time.Millisecond)
+	events := asyncEventRequest(admin)
+	require.Nil(t, admin.Sanitize(protocol.SanitizeBlockErase, 0))
+	time.Sleep(100 * time.Millisecond)
+	lp, err = admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusInProgress), lp.SSTAT)
+	assert.Zero(t, lp.SPROG)
+	assert.Equal(t, 1, held.held())
+
+	held.setHold(false)
+	held.release()
+	assert.Nil(t, <-written)
+	select {
+	case ev := <-events:
+		assert.Equal(t, protocol.SanitizeCompletedEvent, ev)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sanitize did not complete")
+	}
+
+	// while the sanitize runs I/O and Format NVM fail and the log reports the progress
+	held.setHold(true)
+	events = asyncEventRequest(admin)
+	require.Nil(t, admin.Sanitize(protocol.SanitizeBlockErase, 0))
+	require.Eventually(t, func() bool { return held.held() == 1 }, time.Second, 10*time.Millisecond)
+
+	lp, err = admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusInProgress), lp.SSTAT)
+	assert.Less(t, lp.SPROG, uint16(0xFFFF))
+	err = ioq.WithNamespace(1).Read(0, verify)
+	assert.EqualError(t, err, protocol.SCSanitizeInProgress.String())
+	err = admin.FormatNVM(1, 0, protocol.SecureEraseNone)
+	assert.EqualError(t, err, protocol.SCSanitizeInProgress.String())
+	err = admin.Sanitize(protocol.SanitizeBlockErase, 0)
+	assert.EqualError(t, err, protocol.SCSanitizeInProgress.String())
+
+	held.setHold(false)
+	held.release()
+	select {
+	case ev := <-events:
+		assert.Equal(t, protocol.SanitizeCompletedEvent, ev)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sanitize did not complete")
+	}
+	lp, err = admin.SanitizeStatus()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(protocol.SanitizeStatusCompleted), lp.SSTAT)
+	require.Nil(t, ioq.WithNamespace(1).Read(0, verify))
+
+	assert.Nil(t, c.Close())
+	s.stop(t)
+}